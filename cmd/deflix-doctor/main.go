@@ -0,0 +1,249 @@
+// deflix-doctor checks whether the debrid services and torrent sites that deflix-stremio uses work from the machine it runs on.
+//
+// It uses the same client packages as the addon, so that a failing check here means the addon fails the same way.
+// Given credentials, it tests them with each debrid service and checks the instant availability of a torrent.
+// It helps diagnosing "Unable to Fetch" errors in Stremio, which can mean that a debrid service or all torrent sites are unreachable from the server,
+// or that the user's credentials are invalid.
+//
+// The result is printed as a table. The exit code is 1 if any check failed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+
+	debrid "github.com/deflix-tv/go-debrid"
+	"github.com/deflix-tv/go-stremio/pkg/cinemeta"
+	"github.com/deflix-tv/imdb2torrent"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/alldebrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/debridlink"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/premiumize"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/realdebrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/torbox"
+	"github.com/doingodswork/deflix-stremio/pkg/metafetcher"
+)
+
+// Info hash of Big Buck Bunny, which is instantly available on most debrid services
+const bigBuckBunnyInfoHash = "dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c"
+
+var (
+	rdToken = flag.String("rdToken", "", "RealDebrid API token. RealDebrid isn't checked if empty.")
+	adKey   = flag.String("adKey", "", "AllDebrid API key. AllDebrid isn't checked if empty.")
+	pmKey   = flag.String("pmKey", "", "Premiumize API key. Premiumize isn't checked if empty.")
+	dlKey   = flag.String("dlKey", "", "Debrid-Link API key. Debrid-Link isn't checked if empty.")
+	tbKey   = flag.String("tbKey", "", "Torbox API key. Torbox isn't checked if empty.")
+	imdbID  = flag.String("imdbID", "tt0111161", "IMDb ID of the movie to search on the torrent sites")
+	sites   = flag.Bool("sites", true, "Check the torrent sites")
+	timeout = flag.Duration("timeout", 10*time.Second, "Timeout for each check")
+	verbose = flag.Bool("verbose", false, "Log the requests of the clients")
+)
+
+// result is a row of the result table.
+type result struct {
+	provider string
+	// "reachability", "auth", "availability" or "search"
+	check    string
+	err      error
+	skipped  bool
+	detail   string
+	duration time.Duration
+}
+
+// check is a single check of a provider. It returns a detail for the result table.
+type check struct {
+	provider string
+	name     string
+	skip     bool
+	run      func(ctx context.Context) (string, error)
+}
+
+func main() {
+	flag.Parse()
+
+	logger := zap.NewNop()
+	if *verbose {
+		var err error
+		if logger, err = zap.NewDevelopment(); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't create logger: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	checks, err := debridChecks(logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't create debrid clients: %v\n", err)
+		os.Exit(2)
+	}
+	if *sites {
+		siteChecks, err := siteChecks(logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't create torrent site clients: %v\n", err)
+			os.Exit(2)
+		}
+		checks = append(checks, siteChecks...)
+	}
+
+	results := runChecks(checks)
+	printResults(results)
+	for _, result := range results {
+		if result.err != nil {
+			os.Exit(1)
+		}
+	}
+}
+
+// debridChecks returns the reachability, auth and availability checks of all debrid services.
+// The auth and availability checks are skipped for debrid services without credentials.
+func debridChecks(logger *zap.Logger) ([]check, error) {
+	rdClient, err := realdebrid.NewClient(realdebrid.DefaultClientOpts, debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	if err != nil {
+		return nil, err
+	}
+	adClient, err := alldebrid.NewClient(alldebrid.DefaultClientOpts, debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	if err != nil {
+		return nil, err
+	}
+	pmClient, err := premiumize.NewClient(premiumize.DefaultClientOpts, debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	if err != nil {
+		return nil, err
+	}
+	dlClient, err := debridlink.NewClient(debridlink.DefaultClientOpts, debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	if err != nil {
+		return nil, err
+	}
+	tbClient, err := torbox.NewClient(torbox.DefaultClientOpts, debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	if err != nil {
+		return nil, err
+	}
+
+	services := []struct {
+		name         string
+		baseURL      string
+		keyOrToken   string
+		test         func(ctx context.Context, keyOrToken string) error
+		availability func(ctx context.Context, keyOrToken string, infoHashes ...string) []string
+	}{
+		{"RealDebrid", realdebrid.DefaultClientOpts.BaseURL, *rdToken, rdClient.TestToken, rdClient.CheckInstantAvailability},
+		{"AllDebrid", alldebrid.DefaultClientOpts.BaseURL, *adKey, adClient.TestAPIkey, adClient.CheckInstantAvailability},
+		{"Premiumize", premiumize.DefaultClientOpts.BaseURL, *pmKey, pmClient.TestAPIkey, pmClient.CheckInstantAvailability},
+		{"Debrid-Link", debridlink.DefaultClientOpts.BaseURL, *dlKey, dlClient.TestAPIkey, dlClient.CheckInstantAvailability},
+		{"Torbox", torbox.DefaultClientOpts.BaseURL, *tbKey, tbClient.TestAPIkey, tbClient.CheckInstantAvailability},
+	}
+	var checks []check
+	for _, service := range services {
+		service := service
+		checks = append(checks,
+			check{service.name, "reachability", false, func(ctx context.Context) (string, error) {
+				return checkReachability(ctx, service.baseURL)
+			}},
+			check{service.name, "auth", service.keyOrToken == "", func(ctx context.Context) (string, error) {
+				return "", service.test(ctx, service.keyOrToken)
+			}},
+			// The debrid clients only log errors of availability checks, so an empty result can also mean that the check failed.
+			check{service.name, "availability", service.keyOrToken == "", func(ctx context.Context) (string, error) {
+				if available := service.availability(ctx, service.keyOrToken, bigBuckBunnyInfoHash); len(available) > 0 {
+					return "Big Buck Bunny is instantly available", nil
+				}
+				return "Big Buck Bunny isn't instantly available, or the check failed (see -verbose)", nil
+			}},
+		)
+	}
+	return checks, nil
+}
+
+// siteChecks returns the search checks of the torrent sites that deflix-stremio uses by default.
+func siteChecks(logger *zap.Logger) ([]check, error) {
+	cinemetaClient := cinemeta.NewClient(cinemeta.DefaultClientOpts, cinemeta.NewInMemoryCache(), logger)
+	metaFetcher, err := metafetcher.NewClient("", cinemetaClient, logger)
+	if err != nil {
+		return nil, err
+	}
+	cache := imdb2torrent.NewInMemoryCache()
+	tpbClient, err := imdb2torrent.NewTPBclient(imdb2torrent.DefaultTPBclientOpts, cache, metaFetcher, logger, false)
+	if err != nil {
+		return nil, err
+	}
+	siteClients := map[string]imdb2torrent.MagnetSearcher{
+		"YTS":   imdb2torrent.NewYTSclient(imdb2torrent.DefaultYTSclientOpts, cache, logger, false),
+		"TPB":   tpbClient,
+		"1337X": imdb2torrent.NewLeetxClient(imdb2torrent.DefaultLeetxClientOpts, cache, metaFetcher, logger, false),
+		"ibit":  imdb2torrent.NewIbitClient(imdb2torrent.DefaultIbitClientOpts, cache, logger, false),
+	}
+	var checks []check
+	for site, siteClient := range siteClients {
+		siteClient := siteClient
+		checks = append(checks, check{site, "search", false, func(ctx context.Context) (string, error) {
+			results, err := siteClient.FindMovie(ctx, *imdbID)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d torrents for %v", len(results), *imdbID), nil
+		}})
+	}
+	return checks, nil
+}
+
+// checkReachability sends a request to the base URL. Any HTTP response counts, because the base URLs of APIs often respond with 404.
+func checkReachability(ctx context.Context, baseURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't send GET request: %v", err)
+	}
+	res.Body.Close()
+	return res.Status, nil
+}
+
+// runChecks runs all checks concurrently and returns the results sorted by provider.
+func runChecks(checks []check) []result {
+	results := make([]result, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		results[i] = result{provider: c.provider, check: c.name, skipped: c.skip}
+		if c.skip {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			defer cancel()
+			start := time.Now()
+			results[i].detail, results[i].err = c.run(ctx)
+			results[i].duration = time.Since(start)
+		}(i, c)
+	}
+	wg.Wait()
+	// Stable, so that the checks of a provider stay in their order
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].provider < results[j].provider
+	})
+	return results
+}
+
+func printResults(results []result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROVIDER\tCHECK\tSTATUS\tLATENCY\tDETAIL")
+	for _, result := range results {
+		status, latency, detail := "OK", result.duration.Round(time.Millisecond).String(), result.detail
+		if result.skipped {
+			status, latency, detail = "SKIPPED", "-", "No credentials"
+		} else if result.err != nil {
+			status, detail = "FAILED", result.err.Error()
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", result.provider, result.check, status, latency, detail)
+	}
+	w.Flush()
+}
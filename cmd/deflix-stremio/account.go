@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// accountInfo contains the info about a debrid service account that's relevant for end-users.
+type accountInfo struct {
+	Username string
+	Premium  bool
+	// Zero value if the debrid service didn't report it
+	PremiumUntil time.Time
+}
+
+// accountClient fetches account info from RealDebrid, AllDebrid, Premiumize, Debrid-Link and Torbox.
+// go-debrid only validates tokens/keys, but doesn't expose the premium status.
+type accountClient struct {
+	baseURLrd    string
+	baseURLad    string
+	baseURLpm    string
+	baseURLdl    string
+	baseURLtb    string
+	extraHeaders map[string]string
+	httpClient   *http.Client
+}
+
+func newAccountClient(baseURLrd, baseURLad, baseURLpm, baseURLdl, baseURLtb string, extraHeaders []string, timeout time.Duration) (*accountClient, error) {
+	extraHeaderMap := make(map[string]string, len(extraHeaders))
+	for _, extraHeader := range extraHeaders {
+		colonIndex := strings.Index(extraHeader, ":")
+		if colonIndex <= 0 || colonIndex == len(extraHeader)-1 {
+			return nil, errors.New("extraHeaders elements must have a format like \"X-Foo: bar\"")
+		}
+		extraHeaderMap[extraHeader[:colonIndex]] = strings.TrimSpace(extraHeader[colonIndex+1:])
+	}
+	return &accountClient{
+		baseURLrd:    baseURLrd,
+		baseURLad:    baseURLad,
+		baseURLpm:    baseURLpm,
+		baseURLdl:    baseURLdl,
+		baseURLtb:    baseURLtb,
+		extraHeaders: extraHeaderMap,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+	}, nil
+}
+
+// getRDinfo fetches the account info of a RealDebrid user.
+func (c *accountClient) getRDinfo(ctx context.Context, token string) (accountInfo, error) {
+	resBody, err := c.get(ctx, c.baseURLrd+"/rest/1.0/user", token)
+	if err != nil {
+		return accountInfo{}, err
+	}
+	var res struct {
+		Username   string `json:"username"`
+		Type       string `json:"type"`
+		Expiration string `json:"expiration"`
+	}
+	if err = json.Unmarshal(resBody, &res); err != nil {
+		return accountInfo{}, fmt.Errorf("Couldn't unmarshal RealDebrid user info: %v", err)
+	}
+	result := accountInfo{
+		Username: res.Username,
+		Premium:  res.Type == "premium",
+	}
+	// Free accounts don't have a (valid) expiration date
+	if expiration, err := time.Parse(time.RFC3339, res.Expiration); err == nil {
+		result.PremiumUntil = expiration
+	}
+	return result, nil
+}
+
+// remoteTraffic is the RealDebrid "remote traffic" of a user, which is used for streams when the user enabled the "rdRemote" option.
+type remoteTraffic struct {
+	// Bytes
+	Left  int64 `json:"left"`
+	Limit int64 `json:"limit"`
+	// Like "daily"
+	Reset string `json:"reset,omitempty"`
+}
+
+// getRDremoteTraffic fetches the remaining remote traffic of a RealDebrid user.
+// RealDebrid reports it as traffic of the "remote" host, alongside the traffic of limited hosters.
+func (c *accountClient) getRDremoteTraffic(ctx context.Context, token string) (remoteTraffic, error) {
+	resBody, err := c.get(ctx, c.baseURLrd+"/rest/1.0/traffic", token)
+	if err != nil {
+		return remoteTraffic{}, err
+	}
+	var res map[string]remoteTraffic
+	if err = json.Unmarshal(resBody, &res); err != nil {
+		return remoteTraffic{}, fmt.Errorf("Couldn't unmarshal RealDebrid traffic info: %v", err)
+	}
+	result, ok := res["remote"]
+	if !ok {
+		return remoteTraffic{}, errors.New("RealDebrid didn't report remote traffic")
+	}
+	return result, nil
+}
+
+// getInfo fetches the account info of a user of the debrid service with the given ID ("rd", "ad", "pm", "dl" or "tb").
+// pmOAUTH2 must be true if the key or token is a Premiumize OAuth2 access token.
+func (c *accountClient) getInfo(ctx context.Context, debridID, keyOrToken string, pmOAUTH2 bool) (accountInfo, error) {
+	switch debridID {
+	case "rd":
+		return c.getRDinfo(ctx, keyOrToken)
+	case "ad":
+		return c.getADinfo(ctx, keyOrToken)
+	case "dl":
+		return c.getDLinfo(ctx, keyOrToken)
+	case "tb":
+		return c.getTBinfo(ctx, keyOrToken)
+	default:
+		return c.getPMinfo(ctx, keyOrToken, pmOAUTH2)
+	}
+}
+
+// getADinfo fetches the account info of an AllDebrid user.
+func (c *accountClient) getADinfo(ctx context.Context, apiKey string) (accountInfo, error) {
+	resBody, err := c.get(ctx, c.baseURLad+"/v4/user?agent=deflix&apikey="+apiKey, "")
+	if err != nil {
+		return accountInfo{}, err
+	}
+	var res struct {
+		Status string `json:"status"`
+		Data   struct {
+			User struct {
+				Username     string `json:"username"`
+				IsPremium    bool   `json:"isPremium"`
+				PremiumUntil int64  `json:"premiumUntil"`
+			} `json:"user"`
+		} `json:"data"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err = json.Unmarshal(resBody, &res); err != nil {
+		return accountInfo{}, fmt.Errorf("Couldn't unmarshal AllDebrid user info: %v", err)
+	}
+	if res.Status != "success" {
+		return accountInfo{}, fmt.Errorf("Got error response from AllDebrid: %v", res.Error.Message)
+	}
+	result := accountInfo{
+		Username: res.Data.User.Username,
+		Premium:  res.Data.User.IsPremium,
+	}
+	if res.Data.User.PremiumUntil > 0 {
+		result.PremiumUntil = time.Unix(res.Data.User.PremiumUntil, 0)
+	}
+	return result, nil
+}
+
+// getPMinfo fetches the account info of a Premiumize user.
+// Premiumize doesn't report a username.
+func (c *accountClient) getPMinfo(ctx context.Context, keyOrToken string, useOAUTH2 bool) (accountInfo, error) {
+	url := c.baseURLpm + "/account/info"
+	if useOAUTH2 {
+		url += "?access_token=" + keyOrToken
+	} else {
+		url += "?apikey=" + keyOrToken
+	}
+	resBody, err := c.get(ctx, url, "")
+	if err != nil {
+		return accountInfo{}, err
+	}
+	var res struct {
+		Status       string `json:"status"`
+		Message      string `json:"message"`
+		PremiumUntil int64  `json:"premium_until"`
+	}
+	if err = json.Unmarshal(resBody, &res); err != nil {
+		return accountInfo{}, fmt.Errorf("Couldn't unmarshal Premiumize account info: %v", err)
+	}
+	if res.Status != "success" {
+		return accountInfo{}, fmt.Errorf("Got error response from Premiumize: %v", res.Message)
+	}
+	result := accountInfo{}
+	if res.PremiumUntil > 0 {
+		result.PremiumUntil = time.Unix(res.PremiumUntil, 0)
+		result.Premium = time.Now().Before(result.PremiumUntil)
+	}
+	return result, nil
+}
+
+// getDLinfo fetches the account info of a Debrid-Link user.
+func (c *accountClient) getDLinfo(ctx context.Context, apiKey string) (accountInfo, error) {
+	resBody, err := c.get(ctx, c.baseURLdl+"/account/infos", apiKey)
+	if err != nil {
+		return accountInfo{}, err
+	}
+	var res struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+		Value   struct {
+			Pseudo string `json:"pseudo"`
+			// 0 is a free account
+			AccountType int `json:"accountType"`
+			// Seconds
+			PremiumLeft int64 `json:"premiumLeft"`
+		} `json:"value"`
+	}
+	if err = json.Unmarshal(resBody, &res); err != nil {
+		return accountInfo{}, fmt.Errorf("Couldn't unmarshal Debrid-Link account info: %v", err)
+	}
+	if !res.Success {
+		return accountInfo{}, fmt.Errorf("Got error response from Debrid-Link: %v", res.Error)
+	}
+	result := accountInfo{
+		Username: res.Value.Pseudo,
+		Premium:  res.Value.AccountType != 0,
+	}
+	if res.Value.PremiumLeft > 0 {
+		result.PremiumUntil = time.Now().Add(time.Duration(res.Value.PremiumLeft) * time.Second)
+	}
+	return result, nil
+}
+
+// getTBinfo fetches the account info of a Torbox user.
+func (c *accountClient) getTBinfo(ctx context.Context, apiKey string) (accountInfo, error) {
+	resBody, err := c.get(ctx, c.baseURLtb+"/user/me", apiKey)
+	if err != nil {
+		return accountInfo{}, err
+	}
+	var res struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+		Data    struct {
+			Email string `json:"email"`
+			// 0 is the free plan
+			Plan             int    `json:"plan"`
+			PremiumExpiresAt string `json:"premium_expires_at"`
+		} `json:"data"`
+	}
+	if err = json.Unmarshal(resBody, &res); err != nil {
+		return accountInfo{}, fmt.Errorf("Couldn't unmarshal Torbox user info: %v", err)
+	}
+	if !res.Success {
+		return accountInfo{}, fmt.Errorf("Got error response from Torbox: %v", res.Error)
+	}
+	result := accountInfo{
+		Username: res.Data.Email,
+		Premium:  res.Data.Plan != 0,
+	}
+	if expiration, err := time.Parse(time.RFC3339, res.Data.PremiumExpiresAt); err == nil {
+		result.PremiumUntil = expiration
+	}
+	return result, nil
+}
+
+// get sends a GET request and returns the response body.
+// The token is sent as bearer token if it's not empty.
+func (c *accountClient) get(ctx context.Context, url, token string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for headerKey, headerVal := range c.extraHeaders {
+		req.Header.Add(headerKey, headerVal)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send GET request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad HTTP response status: %v", res.Status)
+	}
+
+	return io.ReadAll(res.Body)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRDremoteTraffic(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if r.URL.Path != "/rest/1.0/traffic" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"remote": {"left": 5000000000, "bytes": 500, "links": 2, "limit": 5000000500, "type": "bytes", "extra": 0, "reset": "daily"}, "uptobox.com": {"left": 0}}`))
+	}))
+	defer server.Close()
+
+	client, err := newAccountClient(server.URL, "", "", "", "", nil, time.Second)
+	require.NoError(t, err)
+	traffic, err := client.getRDremoteTraffic(context.Background(), "123")
+	require.NoError(t, err)
+	require.Equal(t, "Bearer 123", auth)
+	require.Equal(t, remoteTraffic{Left: 5000000000, Limit: 5000000500, Reset: "daily"}, traffic)
+
+	check := checkRemoteTraffic(traffic, nil)
+	require.True(t, check.OK)
+	require.Equal(t, "You have 5.0 GB of remote traffic left.", check.Details)
+	require.False(t, checkRemoteTraffic(remoteTraffic{}, nil).OK)
+}
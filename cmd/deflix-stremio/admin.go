@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+	gocache "github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+// For movies (like "tt1254207"), TV shows (like "tt0944947") and TV show episodes (like "tt0944947:1:1")
+var adminIMDbIDregex = regexp.MustCompile(`^tt\d{7,8}(:\d+:\d+)?$`)
+
+// createCacheInfoHandler creates a handler that responds with the number of items in each cache.
+// The keys of all caches in Redis are in the same keyspace, so only the total number of keys in Redis is returned for them.
+// The requests must be authorized by the admin auth middleware.
+func createCacheInfoHandler(goCaches map[string]*gocache.Cache, rdb *redis.Client, logger *zap.Logger) fiber.Handler {
+	type cacheInfoResponse struct {
+		// Cache name to number of items
+		Caches    map[string]int `json:"caches"`
+		RedisKeys *int64         `json:"redisKeys,omitempty"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		logger.Debug("cacheInfoHandler called")
+
+		res := cacheInfoResponse{
+			Caches: map[string]int{},
+		}
+		for name, cache := range goCaches {
+			res.Caches[name] = cache.ItemCount()
+		}
+		if rdb != nil {
+			redisKeys, err := rdb.DBSize(c.Context()).Result()
+			if err != nil {
+				logger.Error("Couldn't get number of keys in Redis", zap.Error(err))
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			res.RedisKeys = &redisKeys
+		}
+		return c.JSON(res)
+	}
+}
+
+// createIMDbCachePurgeHandler creates a handler that deletes the cached torrents, redirects and streams for an IMDb ID.
+// For a TV show (like "tt0944947") the items of all its episodes are deleted, for an episode (like "tt0944947:1:1") only the ones of the episode.
+// This allows fixing stale items, like a dead stream URL, without deleting the cache files and restarting.
+// The requests must be authorized by the admin auth middleware.
+func createIMDbCachePurgeHandler(torrentCache *resultStore, redirectCache, streamCache *goCache, logger *zap.Logger) fiber.Handler {
+	type purgeResponse struct {
+		// Number of deleted items per cache
+		Torrent  int `json:"torrent"`
+		Redirect int `json:"redirect"`
+		Stream   int `json:"stream"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		logger.Debug("imdbCachePurgeHandler called")
+
+		imdbID := c.Params("id")
+		if !adminIMDbIDregex.MatchString(imdbID) {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		zapFieldIMDbID := zap.String("imdbID", imdbID)
+
+		// The keys of all caches start with the IMDb ID, followed by "-" for movies and episodes and ":" for the episodes of a TV show.
+		// The separator is required to not match longer IMDb IDs.
+		prefixes := []string{imdbID + "-"}
+		if !strings.Contains(imdbID, ":") {
+			prefixes = append(prefixes, imdbID+":")
+		}
+		matches := func(id string) bool {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(id, prefix) {
+					return true
+				}
+			}
+			return false
+		}
+
+		res := purgeResponse{}
+		for _, prefix := range prefixes {
+			deleted, err := torrentCache.DeletePrefix(prefix)
+			if err != nil {
+				logger.Error("Couldn't delete torrent cache items", zap.Error(err), zapFieldIMDbID)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			res.Torrent += deleted
+		}
+		var err error
+		// Redirect IDs start with the IMDb ID
+		if res.Redirect, err = redirectCache.deleteFunc(c.Context(), imdbID+"*", matches); err != nil {
+			logger.Error("Couldn't delete redirect cache items", zap.Error(err), zapFieldIMDbID)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		// Stream cache keys are the Base64URL encoded user hash, followed by "-" and the redirect ID
+		userHashLen := base64.RawURLEncoding.EncodedLen(sha256.Size)
+		if res.Stream, err = streamCache.deleteFunc(c.Context(), "*"+imdbID+"*", func(key string) bool {
+			return len(key) > userHashLen+1 && matches(key[userHashLen+1:])
+		}); err != nil {
+			logger.Error("Couldn't delete stream cache items", zap.Error(err), zapFieldIMDbID)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		logger.Info("Purged cache items for IMDb ID", zapFieldIMDbID, zap.Int("torrent", res.Torrent), zap.Int("redirect", res.Redirect), zap.Int("stream", res.Stream))
+		return c.JSON(res)
+	}
+}
+
+// createUserCachePurgeHandler creates a handler that deletes the cached streams and the cached validity of the debrid API key or token of a user.
+// The user is identified by the user data, exactly like it's in the user's stream URLs.
+// The validity of OAuth2 access tokens isn't deleted, because the access token is only known after decrypting and possibly refreshing it.
+// aesKey is only required for encrypted user data.
+// The requests must be authorized by the admin auth middleware.
+func createUserCachePurgeHandler(streamCache *goCache, tokenCaches map[string]*creationCache, aesKey []byte, logger *zap.Logger) fiber.Handler {
+	type purgeResponse struct {
+		// Number of deleted items per cache
+		Stream int `json:"stream"`
+		Token  int `json:"token"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		logger.Debug("userCachePurgeHandler called")
+
+		udString := c.Params("userData")
+		userData, err := decodeUserData(udString, aesKey, logger)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+
+		res := purgeResponse{}
+		// Same as in the redirect handler
+		userHash := sha256.Sum256([]byte(udString))
+		userHashEncoded := base64.RawURLEncoding.EncodeToString(userHash[:])
+		if res.Stream, err = streamCache.deleteFunc(c.Context(), userHashEncoded+"-*", func(key string) bool {
+			return strings.HasPrefix(key, userHashEncoded+"-")
+		}); err != nil {
+			logger.Error("Couldn't delete stream cache items", zap.Error(err))
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		for debridID, keyOrToken := range map[string]string{"rd": userData.RDtoken, "ad": userData.ADkey, "pm": userData.PMkey, "dl": userData.DLkey, "tb": userData.TBkey} {
+			if keyOrToken != "" {
+				tokenCaches[debridID].Delete(keyOrToken)
+				res.Token++
+			}
+		}
+
+		logger.Info("Purged cache items for user", zap.String("userHash", userHashEncoded), zap.Int("stream", res.Stream), zap.Int("token", res.Token))
+		return c.JSON(res)
+	}
+}
+
+// createAvailabilityCachePurgeHandler creates a handler that deletes the cached instant availability of a torrent for all debrid services.
+// The instant availability isn't user-specific, so this affects all users.
+// The requests must be authorized by the admin auth middleware.
+func createAvailabilityCachePurgeHandler(availabilityCaches map[string]*creationCache, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger.Debug("availabilityCachePurgeHandler called")
+
+		infoHash := c.Params("infoHash")
+		if len(infoHash) != 40 {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		for _, availabilityCache := range availabilityCaches {
+			// The debrid clients use the info hash as it's in the torrent results, which can be in either case
+			availabilityCache.Delete(strings.ToLower(infoHash))
+			availabilityCache.Delete(strings.ToUpper(infoHash))
+		}
+
+		logger.Info("Purged instant availability", zap.String("infoHash", infoHash))
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
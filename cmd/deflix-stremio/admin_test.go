@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/gofiber/fiber/v2"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestIMDbCachePurgeHandler(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	torrentCache := &resultStore{
+		store:     &badgerStore{db: db},
+		keyPrefix: "torrent_",
+	}
+	redirectCache := &goCache{cache: gocache.New(time.Hour, time.Hour)}
+	streamCache := &goCache{cache: gocache.New(time.Hour, time.Hour)}
+	userHash := sha256.Sum256([]byte("foo"))
+	userHashEncoded := base64.RawURLEncoding.EncodeToString(userHash[:])
+
+	// The second of each isn't deleted, because it's another IMDb ID that starts with the same digits
+	for _, id := range []string{"tt0944947:1:1", "tt09449470:1:1", "tt0944947:1:2"} {
+		require.NoError(t, torrentCache.Set(id+"-YTS", []imdb2torrent.Result{{Title: "foo"}}))
+		redirectCache.Set(id+"-rd-720p", []imdb2torrent.Result{{Title: "foo"}}, 0)
+		streamCache.Set(userHashEncoded+"-"+id+"-rd-720p", cacheItem{Value: "https://example.com/foo.mkv"}, 0)
+	}
+
+	app := fiber.New()
+	app.Delete("/admin/cache/imdb/:id", createIMDbCachePurgeHandler(torrentCache, redirectCache, streamCache, zap.NewNop()))
+
+	type purgeResponse struct {
+		Torrent  int `json:"torrent"`
+		Redirect int `json:"redirect"`
+		Stream   int `json:"stream"`
+	}
+	purge := func(id string) purgeResponse {
+		res, err := app.Test(httptest.NewRequest("DELETE", "/admin/cache/imdb/"+id, nil))
+		require.NoError(t, err)
+		require.Equal(t, fiber.StatusOK, res.StatusCode)
+		var purgeRes purgeResponse
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&purgeRes))
+		return purgeRes
+	}
+
+	// Single episode
+	require.Equal(t, purgeResponse{Torrent: 1, Redirect: 1, Stream: 1}, purge("tt0944947:1:1"))
+	// All remaining episodes of the TV show
+	require.Equal(t, purgeResponse{Torrent: 1, Redirect: 1, Stream: 1}, purge("tt0944947"))
+	_, _, found, err := torrentCache.Get("tt09449470:1:1-YTS")
+	require.NoError(t, err)
+	require.True(t, found)
+	_, found = redirectCache.Get("tt09449470:1:1-rd-720p")
+	require.True(t, found)
+	_, found = streamCache.Get(userHashEncoded + "-tt09449470:1:1-rd-720p")
+	require.True(t, found)
+
+	res, err := app.Test(httptest.NewRequest("DELETE", "/admin/cache/imdb/foo", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusBadRequest, res.StatusCode)
+}
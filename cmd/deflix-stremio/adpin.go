@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// errPINexpired is returned by adPINclient.check when the user didn't enter the PIN in time.
+var errPINexpired = errors.New("PIN expired")
+
+// adPIN is a PIN that the user must enter on the AllDebrid website to authorize Deflix.
+type adPIN struct {
+	PIN string `json:"pin"`
+	// Secret for checking whether the user entered the PIN
+	Check string `json:"check"`
+	// URL of the AllDebrid website where the user enters the PIN, with the PIN already filled in
+	UserURL string `json:"userURL"`
+	// Seconds
+	ExpiresIn int `json:"expiresIn"`
+}
+
+// adPINclient handles AllDebrid's PIN-based authorization, which AllDebrid offers instead of OAuth2.
+// After the user enters the PIN on the AllDebrid website, AllDebrid hands out the user's API key.
+// See https://docs.alldebrid.com/#pin-auth.
+type adPINclient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+func newADpinClient(baseURL string, timeout time.Duration) *adPINclient {
+	return &adPINclient{
+		baseURL: baseURL,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// get requests a new PIN.
+func (c *adPINclient) get(ctx context.Context) (adPIN, error) {
+	var res struct {
+		Status string `json:"status"`
+		Data   struct {
+			PIN       string `json:"pin"`
+			Check     string `json:"check"`
+			UserURL   string `json:"user_url"`
+			ExpiresIn int    `json:"expires_in"`
+		} `json:"data"`
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := c.request(ctx, "/v4/pin/get?agent=deflix", &res); err != nil {
+		return adPIN{}, err
+	}
+	if res.Status != "success" {
+		return adPIN{}, fmt.Errorf("Got error response from AllDebrid: %v (%v)", res.Error.Message, res.Error.Code)
+	}
+	return adPIN{
+		PIN:       res.Data.PIN,
+		Check:     res.Data.Check,
+		UserURL:   res.Data.UserURL,
+		ExpiresIn: res.Data.ExpiresIn,
+	}, nil
+}
+
+// check returns the user's API key if the user entered the PIN, or an empty string if not yet.
+// If the PIN expired, errPINexpired is returned.
+func (c *adPINclient) check(ctx context.Context, pin, check string) (string, error) {
+	var res struct {
+		Status string `json:"status"`
+		Data   struct {
+			APIkey    string `json:"apikey"`
+			Activated bool   `json:"activated"`
+		} `json:"data"`
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	path := "/v4/pin/check?agent=deflix&pin=" + url.QueryEscape(pin) + "&check=" + url.QueryEscape(check)
+	if err := c.request(ctx, path, &res); err != nil {
+		return "", err
+	}
+	if res.Status != "success" {
+		if res.Error.Code == "PIN_EXPIRED" || res.Error.Code == "PIN_INVALID" {
+			return "", errPINexpired
+		}
+		return "", fmt.Errorf("Got error response from AllDebrid: %v (%v)", res.Error.Message, res.Error.Code)
+	}
+	if !res.Data.Activated {
+		return "", nil
+	}
+	return res.Data.APIkey, nil
+}
+
+func (c *adPINclient) request(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Couldn't send GET request: %v", err)
+	}
+	defer res.Body.Close()
+	// AllDebrid responds with 200 for most errors, with the error in the JSON body
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("bad HTTP response status: %v", res.Status)
+	}
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("Couldn't read response body: %v", err)
+	}
+	if err = json.Unmarshal(resBody, v); err != nil {
+		return fmt.Errorf("Couldn't unmarshal AllDebrid response: %v", err)
+	}
+	return nil
+}
+
+// createADpinInitHandler returns a handler for AllDebrid PIN requests from the deflix-stremio frontend.
+// It responds with the PIN that the user must enter on the AllDebrid website, and the frontend then polls the check endpoint.
+func createADpinInitHandler(pinClient *adPINclient, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pin, err := pinClient.get(c.Context())
+		if err != nil {
+			logger.Warn("Couldn't get AllDebrid PIN", zap.Error(err))
+			return c.SendStatus(fiber.StatusBadGateway)
+		}
+		return c.JSON(pin)
+	}
+}
+
+// createADpinCheckHandler returns a handler for polling requests from the deflix-stremio frontend after it requested an AllDebrid PIN.
+// The "pin" and "check" query parameters must be the ones from the init handler.
+// While the user hasn't entered the PIN yet, it responds with 202 Accepted. When the PIN expired, it responds with 410 Gone.
+// After the user entered the PIN, it responds with the encoded user data, like `{"userData": "eyJhZE9BVVRIMiI6Ii4uLiJ9"}`,
+// in which the API key is encrypted like the RealDebrid and Premiumize OAuth2 data.
+// aesKey should be 32 bytes so that AES-256 is used.
+func createADpinCheckHandler(pinClient *adPINclient, aesKey []byte, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pin, check := c.Query("pin"), c.Query("check")
+		if pin == "" || check == "" {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+
+		apiKey, err := pinClient.check(c.Context(), pin, check)
+		if errors.Is(err, errPINexpired) {
+			return c.SendStatus(fiber.StatusGone)
+		} else if err != nil {
+			logger.Warn("Couldn't check AllDebrid PIN", zap.Error(err))
+			return c.SendStatus(fiber.StatusBadGateway)
+		} else if apiKey == "" {
+			return c.SendStatus(fiber.StatusAccepted)
+		}
+
+		// Encrypt the API key so that the Stremio client doesn't reveal it, same as with OAuth2 tokens
+		encrypted, err := encryptUserData(aesKey, []byte(apiKey))
+		if err != nil {
+			logger.Error("Couldn't encrypt the API key", zap.Error(err))
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		userDataEncoded, err := userData{ADoauth2: encrypted}.encode(logger)
+		if err != nil {
+			logger.Error("Couldn't encode user data with AllDebrid PIN data", zap.Error(err))
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(fiber.Map{"userData": userDataEncoded})
+	}
+}
+
+// decryptADapiKey decrypts the API key from the AllDebrid PIN flow.
+// In case of an error the returned int is the HTTP status code that's appropriate for responding to the client.
+func decryptADapiKey(aesKey []byte, adOAUTH2 string, logger *zap.Logger) (string, int, error) {
+	apiKey, status, err := decryptUserData(aesKey, adOAUTH2, logger)
+	if err != nil {
+		return "", status, err
+	}
+	return string(apiKey), fiber.StatusOK, nil
+}
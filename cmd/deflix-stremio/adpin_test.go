@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestADpinHandlers(t *testing.T) {
+	adServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "deflix", r.URL.Query().Get("agent"))
+		switch r.URL.Path {
+		case "/v4/pin/get":
+			w.Write([]byte(`{"status": "success", "data": {"pin": "ABCD", "check": "secret", "expires_in": 600, "user_url": "https://alldebrid.com/pin/?pin=ABCD"}}`))
+		case "/v4/pin/check":
+			switch r.URL.Query().Get("check") {
+			case "secret":
+				w.Write([]byte(`{"status": "success", "data": {"apikey": "abc123", "activated": true}}`))
+			case "pending":
+				w.Write([]byte(`{"status": "success", "data": {"apikey": "", "activated": false}}`))
+			default:
+				w.Write([]byte(`{"status": "error", "error": {"code": "PIN_EXPIRED", "message": "The PIN expired"}}`))
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer adServer.Close()
+	hash := sha256.Sum256([]byte("foo"))
+	aesKey := hash[:]
+
+	pinClient := newADpinClient(adServer.URL, time.Second)
+	app := fiber.New()
+	app.Get("/oauth2/init/ad", createADpinInitHandler(pinClient, zap.NewNop()))
+	app.Get("/oauth2/check/ad", createADpinCheckHandler(pinClient, aesKey, zap.NewNop()))
+
+	res, err := app.Test(httptest.NewRequest("GET", "/oauth2/init/ad", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, res.StatusCode)
+	var pin adPIN
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&pin))
+	require.Equal(t, adPIN{PIN: "ABCD", Check: "secret", UserURL: "https://alldebrid.com/pin/?pin=ABCD", ExpiresIn: 600}, pin)
+
+	res, err = app.Test(httptest.NewRequest("GET", "/oauth2/check/ad?pin=ABCD&check=pending", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusAccepted, res.StatusCode)
+	res, err = app.Test(httptest.NewRequest("GET", "/oauth2/check/ad?pin=ABCD&check=expired", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusGone, res.StatusCode)
+	res, err = app.Test(httptest.NewRequest("GET", "/oauth2/check/ad?pin=ABCD", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusBadRequest, res.StatusCode)
+
+	res, err = app.Test(httptest.NewRequest("GET", "/oauth2/check/ad?pin=ABCD&check=secret", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, res.StatusCode)
+	var body struct {
+		UserData string `json:"userData"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	ud, err := decodeUserData(body.UserData, nil, zap.NewNop())
+	require.NoError(t, err)
+	require.Empty(t, ud.ADkey)
+	require.NotContains(t, ud.ADoauth2, "abc123")
+	require.Equal(t, "ad", ud.debridID())
+	apiKey, _, err := decryptADapiKey(aesKey, ud.ADoauth2, zap.NewNop())
+	require.NoError(t, err)
+	require.Equal(t, "abc123", apiKey)
+
+	// Wrong key
+	otherHash := sha256.Sum256([]byte("bar"))
+	_, status, err := decryptADapiKey(otherHash[:], ud.ADoauth2, zap.NewNop())
+	require.Error(t, err)
+	require.Equal(t, fiber.StatusForbidden, status)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Sortable time format of the analytics keys, so that the entries of a time window can be iterated over
+const analyticsKeyTimeFormat = "20060102T150405.000000000"
+
+// Number of stream IDs in the list of the most failed ones
+const analyticsTopFailures = 20
+
+// analyticsEntry is a user's click on a stream that was converted via a debrid service, or that failed.
+// Like the audit log it doesn't contain the user data or IP address, only a hash of the user data.
+type analyticsEntry struct {
+	Time time.Time `json:"time"`
+	// Hash of the user data, same as in the stream cache keys and the logs
+	User string `json:"user"`
+	// Like "tt1254207" for movies or "tt0944947:1:1" for TV show episodes
+	StreamID string `json:"streamID"`
+	// "movie" or "series"
+	Type string `json:"type"`
+	// Like "1080p.10bit", or "best" for the stream that tries all qualities
+	Quality string `json:"quality"`
+	// Debrid service ID ("rd", "ad", "pm", "dl" or "tb")
+	Provider string `json:"provider"`
+	Success  bool   `json:"success"`
+	// Time from the request until the response
+	LatencyMillis int64 `json:"latencyMillis"`
+}
+
+// analyticsStore records the stream conversions of users, so that operators see which movies and TV shows fail to convert, backed by BadgerDB.
+// The entries expire automatically.
+type analyticsStore struct {
+	db        *badger.DB
+	keyPrefix string
+	ttl       time.Duration
+}
+
+// record stores the entry.
+// It's safe to call on a nil analyticsStore, in which case nothing is recorded.
+func (s *analyticsStore) record(entry analyticsEntry) error {
+	if s == nil {
+		return nil
+	}
+	val, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// The user and stream ID make the key unique even for concurrent entries
+	key := s.keyPrefix + entry.Time.UTC().Format(analyticsKeyTimeFormat) + "_" + entry.User + "_" + entry.StreamID
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(key), val).WithTTL(s.ttl))
+	})
+}
+
+// analyticsCount contains the aggregates of a group of analytics entries.
+type analyticsCount struct {
+	Requests  int `json:"requests"`
+	Successes int `json:"successes"`
+	// Average of all requests, including failed ones
+	AvgLatencyMillis int64 `json:"avgLatencyMillis"`
+	latencySum       int64
+}
+
+func (c *analyticsCount) add(entry analyticsEntry) {
+	c.Requests++
+	if entry.Success {
+		c.Successes++
+	}
+	c.latencySum += entry.LatencyMillis
+	c.AvgLatencyMillis = c.latencySum / int64(c.Requests)
+}
+
+// analyticsFailure is the number of failed conversions of a movie or TV show episode.
+type analyticsFailure struct {
+	StreamID string `json:"streamID"`
+	Type     string `json:"type"`
+	Failures int    `json:"failures"`
+	Requests int    `json:"requests"`
+}
+
+// analyticsStats are the aggregates of the analytics entries of a time window.
+type analyticsStats struct {
+	Total      analyticsCount            `json:"total"`
+	Users      int                       `json:"users"`
+	ByProvider map[string]analyticsCount `json:"byProvider"`
+	ByQuality  map[string]analyticsCount `json:"byQuality"`
+	ByType     map[string]analyticsCount `json:"byType"`
+	// The movies and TV show episodes with the most failed conversions, the most failed first
+	TopFailures []analyticsFailure `json:"topFailures"`
+}
+
+// stats aggregates the entries since the given time.
+func (s *analyticsStore) stats(since time.Time) (analyticsStats, error) {
+	result := analyticsStats{
+		ByProvider:  map[string]analyticsCount{},
+		ByQuality:   map[string]analyticsCount{},
+		ByType:      map[string]analyticsCount{},
+		TopFailures: []analyticsFailure{},
+	}
+	users := map[string]struct{}{}
+	failures := map[string]*analyticsFailure{}
+	add := func(counts map[string]analyticsCount, key string, entry analyticsEntry) {
+		count := counts[key]
+		count.add(entry)
+		counts[key] = count
+	}
+
+	prefix := []byte(s.keyPrefix)
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek([]byte(s.keyPrefix + since.UTC().Format(analyticsKeyTimeFormat))); it.ValidForPrefix(prefix); it.Next() {
+			var entry analyticsEntry
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &entry)
+			})
+			if err != nil {
+				return err
+			}
+			result.Total.add(entry)
+			users[entry.User] = struct{}{}
+			add(result.ByProvider, entry.Provider, entry)
+			add(result.ByQuality, entry.Quality, entry)
+			add(result.ByType, entry.Type, entry)
+			failure, ok := failures[entry.StreamID]
+			if !ok {
+				failure = &analyticsFailure{StreamID: entry.StreamID, Type: entry.Type}
+				failures[entry.StreamID] = failure
+			}
+			failure.Requests++
+			if !entry.Success {
+				failure.Failures++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return analyticsStats{}, err
+	}
+	result.Users = len(users)
+
+	for _, failure := range failures {
+		if failure.Failures > 0 {
+			result.TopFailures = append(result.TopFailures, *failure)
+		}
+	}
+	sort.Slice(result.TopFailures, func(i, j int) bool {
+		if result.TopFailures[i].Failures != result.TopFailures[j].Failures {
+			return result.TopFailures[i].Failures > result.TopFailures[j].Failures
+		}
+		return result.TopFailures[i].StreamID < result.TopFailures[j].StreamID
+	})
+	if len(result.TopFailures) > analyticsTopFailures {
+		result.TopFailures = result.TopFailures[:analyticsTopFailures]
+	}
+	return result, nil
+}
+
+// qualityFromRedirectID returns the quality of a redirect ID, like "1080p.10bit" from "tt1254207-rd-1080p.10bit", or "best" for the stream that tries all qualities.
+// For files from the user's RealDebrid torrents it's "mytorrents".
+func qualityFromRedirectID(redirectID string) string {
+	if qualityRedirectID, _, ok := parsePinnedRedirectID(redirectID); ok {
+		redirectID = qualityRedirectID
+	} else if _, _, ok := parseRDtorrentRedirectID(redirectID); ok {
+		return strings.TrimSuffix(rdTorrentRedirectIDprefix, ".")
+	}
+	if dashIndex := strings.LastIndex(redirectID, "-"); dashIndex >= 0 {
+		return redirectID[dashIndex+1:]
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyticsStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	store := &analyticsStore{
+		db:        db,
+		keyPrefix: "analytics_",
+		ttl:       time.Hour,
+	}
+
+	now := time.Now()
+	entries := []analyticsEntry{
+		// Outside of the window
+		{Time: now.Add(-2 * time.Hour), User: "a", StreamID: "tt1", Type: "movie", Quality: "1080p", Provider: "rd", Success: false, LatencyMillis: 100},
+		{Time: now.Add(-time.Minute), User: "a", StreamID: "tt1", Type: "movie", Quality: "1080p", Provider: "rd", Success: true, LatencyMillis: 200},
+		{Time: now.Add(-time.Minute), User: "b", StreamID: "tt1", Type: "movie", Quality: "720p", Provider: "ad", Success: false, LatencyMillis: 400},
+		{Time: now, User: "b", StreamID: "tt2:1:1", Type: "series", Quality: "best", Provider: "rd", Success: false, LatencyMillis: 600},
+		{Time: now.Add(time.Second), User: "b", StreamID: "tt2:1:1", Type: "series", Quality: "best", Provider: "rd", Success: false, LatencyMillis: 800},
+	}
+	for _, entry := range entries {
+		require.NoError(t, store.record(entry))
+	}
+
+	stats, err := store.stats(now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, analyticsCount{Requests: 4, Successes: 1, AvgLatencyMillis: 500, latencySum: 2000}, stats.Total)
+	require.Equal(t, 2, stats.Users)
+	require.Equal(t, 3, stats.ByProvider["rd"].Requests)
+	require.Equal(t, 1, stats.ByProvider["rd"].Successes)
+	require.Equal(t, 1, stats.ByQuality["720p"].Requests)
+	require.Equal(t, 2, stats.ByType["series"].Requests)
+	require.Equal(t, []analyticsFailure{
+		{StreamID: "tt2:1:1", Type: "series", Failures: 2, Requests: 2},
+		{StreamID: "tt1", Type: "movie", Failures: 1, Requests: 2},
+	}, stats.TopFailures)
+
+	// Disabled analytics
+	var disabled *analyticsStore
+	require.NoError(t, disabled.record(entries[0]))
+}
+
+func TestQualityFromRedirectID(t *testing.T) {
+	tests := map[string]string{
+		"tt1254207-rd-1080p.10bit":                                    "1080p.10bit",
+		"tt0944947:1:1-ad-a1b2c3d4-720p":                              "720p",
+		"tt1254207-rd-best":                                           "best",
+		"tt1254207-rd-1080p-dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c": "1080p",
+	}
+	for redirectID, expected := range tests {
+		require.Equal(t, expected, qualityFromRedirectID(redirectID), redirectID)
+	}
+}
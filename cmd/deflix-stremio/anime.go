@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the Kitsu IDs that anime catalog addons use, like "kitsu:11469" for movies or "kitsu:11469:5" for TV show episodes
+const kitsuIDprefix = "kitsu:"
+
+var kitsuIDregex = regexp.MustCompile(`^kitsu:(\d+)(?::(\d+))?$`)
+
+// parseKitsuID returns the Kitsu ID and, for TV shows, the episode from a stream ID like "kitsu:11469:5".
+// For movies the episode is 0.
+func parseKitsuID(id string, isTVShow bool) (string, int, error) {
+	match := kitsuIDregex.FindStringSubmatch(id)
+	if match == nil {
+		return "", 0, errors.New("invalid Kitsu ID")
+	}
+	if !isTVShow {
+		if match[2] != "" {
+			return "", 0, errors.New("Kitsu ID for movie contains episode")
+		}
+		return match[1], 0, nil
+	}
+	if match[2] == "" {
+		return "", 0, errors.New("Kitsu ID for TV show doesn't contain episode")
+	}
+	episode, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", 0, err
+	}
+	return match[1], episode, nil
+}
+
+// isTVShowID returns true if the stream ID is for a TV show episode, like "tt0944947:1:1" or "kitsu:11469:5", and false if it's for a movie.
+func isTVShowID(id string) bool {
+	return strings.Contains(strings.TrimPrefix(id, kitsuIDprefix), ":")
+}
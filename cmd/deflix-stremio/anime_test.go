@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKitsuID(t *testing.T) {
+	kitsuID, episode, err := parseKitsuID("kitsu:11469", false)
+	require.NoError(t, err)
+	require.Equal(t, "11469", kitsuID)
+	require.Equal(t, 0, episode)
+
+	kitsuID, episode, err = parseKitsuID("kitsu:11469:5", true)
+	require.NoError(t, err)
+	require.Equal(t, "11469", kitsuID)
+	require.Equal(t, 5, episode)
+
+	_, _, err = parseKitsuID("kitsu:11469", true)
+	require.Error(t, err)
+	_, _, err = parseKitsuID("kitsu:11469:5", false)
+	require.Error(t, err)
+	_, _, err = parseKitsuID("kitsu:foo", false)
+	require.Error(t, err)
+}
+
+func TestIsTVShowID(t *testing.T) {
+	require.False(t, isTVShowID("tt1254207"))
+	require.True(t, isTVShowID("tt0944947:1:1"))
+	require.False(t, isTVShowID("kitsu:11469"))
+	require.True(t, isTVShowID("kitsu:11469:5"))
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	// Date format of the audit log file names. There's one file per day (UTC), so that expired entries can be removed by deleting whole files.
+	auditFileDateFormat = "2006-01-02"
+	auditFilePrefix     = "audit-"
+	auditFileExt        = ".jsonl"
+	// Number of entries that are buffered for the external sink. Further entries are dropped while the sink is too slow.
+	auditSinkBufferSize = 1000
+	auditSinkTimeout    = 5 * time.Second
+)
+
+// auditErrors returns the counter for audit entries that couldn't be written to the given sink ("file" or "url").
+func auditErrors(sink string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`audit_log_errors_total{sink=%q}`, sink))
+}
+
+// auditEntry is a single conversion of a torrent into a stream via a debrid service.
+// It doesn't contain the user data or IP address, only a hash of the user data.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Hash of the user data, same as in the stream cache keys and the logs
+	User string `json:"user"`
+	// IMDb ID, for TV shows including season and episode, like "tt0944947:1:1"
+	IMDbID   string `json:"imdbID"`
+	InfoHash string `json:"infoHash"`
+	// Debrid service ID ("rd", "ad", "pm", "dl" or "tb")
+	Provider string `json:"provider"`
+	// "redirect" for a user's click on a stream, "prefetch" or "queue"
+	Source string `json:"source"`
+	// Whether the debrid service returned a stream URL
+	Success bool `json:"success"`
+}
+
+// auditLog records conversions of torrents into streams, so that operators of public instances can answer DMCA notices about what was and wasn't served.
+// Entries are appended to one file per day and/or sent to an external HTTP endpoint.
+type auditLog struct {
+	// Empty if no files are written
+	dir string
+	// 0 means files are kept forever
+	retention time.Duration
+	file      *os.File
+	fileDay   string
+	fileLock  sync.Mutex
+	// Empty if no external sink is used
+	sinkURL    string
+	sinkQueue  chan []byte
+	httpClient *http.Client
+	logger     *zap.Logger
+}
+
+// newAuditLog creates a new auditLog that writes to files in the given directory and/or POSTs the entries as JSON to the given URL.
+// dir and sinkURL can't both be empty.
+func newAuditLog(ctx context.Context, dir string, retention time.Duration, sinkURL string, logger *zap.Logger) (*auditLog, error) {
+	a := &auditLog{
+		dir:       dir,
+		retention: retention,
+		sinkURL:   sinkURL,
+		httpClient: &http.Client{
+			Timeout: auditSinkTimeout,
+		},
+		logger: logger,
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("Couldn't create audit log directory: %w", err)
+		}
+		a.removeExpiredFiles()
+	}
+	if sinkURL != "" {
+		a.sinkQueue = make(chan []byte, auditSinkBufferSize)
+		go a.runSink(ctx)
+	}
+	return a, nil
+}
+
+// record adds an entry for the conversion of the torrent with the given info hash for the stream with the given redirect ID.
+// It's safe to call on a nil auditLog, in which case nothing is recorded.
+func (a *auditLog) record(userHash, redirectID, infoHash, debridID, source string, success bool) {
+	if a == nil {
+		return
+	}
+	entry := auditEntry{
+		Time:     time.Now().UTC(),
+		User:     userHash,
+		IMDbID:   streamIDfromRedirectID(redirectID),
+		InfoHash: strings.ToLower(infoHash),
+		Provider: debridID,
+		Source:   source,
+		Success:  success,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		a.logger.Error("Couldn't encode audit entry", zap.Error(err))
+		return
+	}
+	if a.dir != "" {
+		if err = a.writeToFile(entry.Time, line); err != nil {
+			a.logger.Error("Couldn't write audit entry to file", zap.Error(err))
+			auditErrors("file").Inc()
+		}
+	}
+	if a.sinkURL != "" {
+		select {
+		case a.sinkQueue <- line:
+		default:
+			a.logger.Warn("Audit sink queue is full, dropping entry")
+			auditErrors("url").Inc()
+		}
+	}
+}
+
+func (a *auditLog) writeToFile(t time.Time, line []byte) error {
+	a.fileLock.Lock()
+	defer a.fileLock.Unlock()
+
+	day := t.Format(auditFileDateFormat)
+	if day != a.fileDay {
+		if a.file != nil {
+			a.file.Close()
+		}
+		file, err := os.OpenFile(filepath.Join(a.dir, auditFilePrefix+day+auditFileExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			a.file = nil
+			a.fileDay = ""
+			return fmt.Errorf("Couldn't open audit log file: %w", err)
+		}
+		a.file = file
+		a.fileDay = day
+		a.removeExpiredFiles()
+	}
+	_, err := a.file.Write(append(line, '\n'))
+	return err
+}
+
+// removeExpiredFiles removes the files of the days that are older than the retention.
+func (a *auditLog) removeExpiredFiles() {
+	if a.retention <= 0 {
+		return
+	}
+	files, err := auditFiles(a.dir)
+	if err != nil {
+		a.logger.Error("Couldn't list audit log files", zap.Error(err))
+		return
+	}
+	for day, file := range files {
+		// The whole day must be older than the retention
+		if time.Since(day.Add(24*time.Hour)) > a.retention {
+			if err = os.Remove(file); err != nil {
+				a.logger.Error("Couldn't remove expired audit log file", zap.Error(err), zap.String("file", file))
+			}
+		}
+	}
+}
+
+// runSink sends the queued entries to the external sink until the context is canceled.
+func (a *auditLog) runSink(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line := <-a.sinkQueue:
+			if err := a.send(ctx, line); err != nil {
+				a.logger.Error("Couldn't send audit entry to sink", zap.Error(err))
+				auditErrors("url").Inc()
+			}
+		}
+	}
+}
+
+func (a *auditLog) send(ctx context.Context, line []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", a.sinkURL, bytes.NewReader(line))
+	if err != nil {
+		return fmt.Errorf("Couldn't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := a.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Couldn't send request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Bad response status: %v", res.StatusCode)
+	}
+	return nil
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.fileLock.Lock()
+	defer a.fileLock.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// streamIDfromRedirectID returns the IMDb ID (with season and episode for TV shows) from the beginning of a redirect ID,
+// like "tt0944947:1:1" from "tt0944947:1:1-rd-720p".
+func streamIDfromRedirectID(redirectID string) string {
+	if dashIndex := strings.Index(redirectID, "-"); dashIndex >= 0 {
+		return redirectID[:dashIndex]
+	}
+	return redirectID
+}
+
+// debridIDfromRedirectID returns the ID of the debrid service from a redirect ID, like "rd" from "tt0944947:1:1-rd-720p",
+// or an empty string if the redirect ID doesn't contain one.
+func debridIDfromRedirectID(redirectID string) string {
+	parts := strings.SplitN(redirectID, "-", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// auditFiles returns the audit log files in the given directory, by their day.
+func auditFiles(dir string) (map[time.Time]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, auditFilePrefix+"*"+auditFileExt))
+	if err != nil {
+		return nil, err
+	}
+	result := map[time.Time]string{}
+	for _, path := range paths {
+		dayString := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), auditFilePrefix), auditFileExt)
+		day, err := time.Parse(auditFileDateFormat, dayString)
+		if err != nil {
+			// Not an audit log file, but a different one with a similar name
+			continue
+		}
+		result[day] = path
+	}
+	return result, nil
+}
+
+// auditFilter selects audit entries. Empty fields match all entries.
+type auditFilter struct {
+	User     string
+	IMDbID   string
+	InfoHash string
+	From     time.Time
+	To       time.Time
+}
+
+func (f auditFilter) matches(entry auditEntry) bool {
+	return (f.User == "" || entry.User == f.User) &&
+		// A TV show's IMDb ID matches all of its episodes
+		(f.IMDbID == "" || entry.IMDbID == f.IMDbID || strings.HasPrefix(entry.IMDbID, f.IMDbID+":")) &&
+		(f.InfoHash == "" || entry.InfoHash == strings.ToLower(f.InfoHash)) &&
+		(f.From.IsZero() || !entry.Time.Before(f.From)) &&
+		(f.To.IsZero() || !entry.Time.After(f.To))
+}
+
+// lookupAudit returns the entries of the audit log files in the given directory that match the filter, sorted by time.
+// Only the files of the days within the filter's time range are read.
+func lookupAudit(dir string, filter auditFilter) ([]auditEntry, error) {
+	files, err := auditFiles(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't list audit log files: %w", err)
+	}
+	var days []time.Time
+	for day := range files {
+		if (!filter.From.IsZero() && day.Add(24*time.Hour).Before(filter.From)) || (!filter.To.IsZero() && day.After(filter.To)) {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].Before(days[j])
+	})
+
+	var result []auditEntry
+	for _, day := range days {
+		if err = func() error {
+			file, err := os.Open(files[day])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				var entry auditEntry
+				if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+					return fmt.Errorf("Couldn't decode entry in %v: %w", files[day], err)
+				}
+				if filter.matches(entry) {
+					result = append(result, entry)
+				}
+			}
+			return scanner.Err()
+		}(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// runAuditLookup prints the audit entries that match the given filter as JSON lines, for responding to DMCA notices.
+// It's run with `deflix-stremio audit-lookup [lookup options] [-- regular options]`, so that it uses the same audit log directory as the instance.
+func runAuditLookup(args []string, logger *zap.Logger) {
+	fs := flag.NewFlagSet("audit-lookup", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory with the audit log files. If empty, the auditLogPath option is used.")
+	user := fs.String("user", "", "Hash of the user data, as found in the audit log and the logs. Empty matches all users.")
+	imdbID := fs.String("imdbID", "", `IMDb ID, like "tt1254207", or for a single TV show episode "tt0944947:1:1". A TV show's IMDb ID matches all of its episodes. Empty matches all.`)
+	infoHash := fs.String("infoHash", "", "Info hash of the torrent. Empty matches all.")
+	from := fs.String("from", "", `Start of the time range in RFC 3339 format, like "2021-01-02T00:00:00Z". Empty means no start.`)
+	to := fs.String("to", "", `End of the time range in RFC 3339 format, like "2021-01-02T23:59:59Z". Empty means no end.`)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s audit-lookup [options] [-- regular options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	filter := auditFilter{
+		User:     *user,
+		IMDbID:   *imdbID,
+		InfoHash: *infoHash,
+	}
+	var err error
+	if *from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			logger.Fatal("Couldn't parse start of time range", zap.Error(err))
+		}
+	}
+	if *to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			logger.Fatal("Couldn't parse end of time range", zap.Error(err))
+		}
+	}
+	if *dir == "" {
+		// The regular options after "--" are parsed by parseConfig via the global flag set
+		os.Args = append([]string{os.Args[0]}, fs.Args()...)
+		*dir = parseConfig(logger).AuditLogPath
+		if *dir == "" {
+			logger.Fatal("Neither dir nor auditLogPath is set")
+		}
+	}
+
+	entries, err := lookupAudit(*dir, filter)
+	if err != nil {
+		logger.Fatal("Couldn't look up audit entries", zap.Error(err))
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, entry := range entries {
+		if err = encoder.Encode(entry); err != nil {
+			logger.Fatal("Couldn't write audit entry", zap.Error(err))
+		}
+	}
+	logger.Info("Found audit entries", zap.Int("count", len(entries)))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "deflix-stremio-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// An expired file from a previous run
+	expiredFile := filepath.Join(dir, "audit-2000-01-01.jsonl")
+	require.NoError(t, os.WriteFile(expiredFile, nil, 0o600))
+
+	received := make(chan auditEntry, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entry auditEntry
+		_ = json.NewDecoder(r.Body).Decode(&entry)
+		received <- entry
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	audit, err := newAuditLog(ctx, dir, 24*time.Hour, server.URL, zap.NewNop())
+	require.NoError(t, err)
+	_, err = os.Stat(expiredFile)
+	require.True(t, os.IsNotExist(err))
+
+	audit.record("user1", "tt1254207-rd-720p", "ABC", "rd", "redirect", true)
+	audit.record("user2", "tt0944947:1:1-ad-1080p", "def", "ad", "prefetch", false)
+	audit.record("user1", "tt0944947:1:2-rd-1080p", "abc", "rd", "redirect", true)
+	require.NoError(t, audit.Close())
+
+	// External sink
+	for i := 0; i < 3; i++ {
+		select {
+		case entry := <-received:
+			require.NotEmpty(t, entry.User)
+		case <-time.After(time.Second):
+			t.Fatal("Entry wasn't sent to sink")
+		}
+	}
+
+	// Lookup
+	entries, err := lookupAudit(dir, auditFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, "tt1254207", entries[0].IMDbID)
+	require.Equal(t, "abc", entries[0].InfoHash)
+	require.Equal(t, "rd", entries[0].Provider)
+	require.Equal(t, "redirect", entries[0].Source)
+	require.True(t, entries[0].Success)
+
+	entries, err = lookupAudit(dir, auditFilter{InfoHash: "ABC"})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// A TV show's IMDb ID matches all of its episodes
+	entries, err = lookupAudit(dir, auditFilter{IMDbID: "tt0944947"})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	entries, err = lookupAudit(dir, auditFilter{IMDbID: "tt0944947:1:1"})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "user2", entries[0].User)
+
+	entries, err = lookupAudit(dir, auditFilter{From: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+}
+
+func TestStreamIDfromRedirectID(t *testing.T) {
+	require.Equal(t, "tt1254207", streamIDfromRedirectID("tt1254207-rd-720p"))
+	require.Equal(t, "tt0944947:1:1", streamIDfromRedirectID("tt0944947:1:1-pm.sort-size-x.webFirst-1080p"))
+	require.Equal(t, "tt1254207", streamIDfromRedirectID("tt1254207"))
+}
+
+func TestDebridIDfromRedirectID(t *testing.T) {
+	require.Equal(t, "rd", debridIDfromRedirectID("tt1254207-rd-720p"))
+	require.Equal(t, "pm", debridIDfromRedirectID("tt0944947:1:1-pm-1a2b3c4d-x.webFirst-1080p"))
+	require.Equal(t, "", debridIDfromRedirectID("tt1254207"))
+}
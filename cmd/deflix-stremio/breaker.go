@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// errBreakerOpen is returned by a resilient searcher while its site is skipped.
+var errBreakerOpen = errors.New("Circuit breaker is open")
+
+// Base delay of the exponential backoff between retries of failed searches
+const retryBaseDelay = 250 * time.Millisecond
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker counts the consecutive failures of a torrent site.
+// When the threshold is reached, the breaker opens and requests are rejected for the cooldown.
+// After the cooldown a single trial request is let through (half-open), and its result decides whether the breaker closes or opens again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	lock      sync.Mutex
+}
+
+// allow returns whether a request may be sent.
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record records the result of a request and returns whether the breaker opened because of it.
+func (b *circuitBreaker) record(err error) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.trial = false
+	if err == nil {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures < b.threshold {
+		return false
+	}
+	b.openedAt = time.Now()
+	return true
+}
+
+// release ends a trial request without a result, for example because the request was canceled.
+func (b *circuitBreaker) release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.trial = false
+}
+
+// state returns the state of the breaker, one of breakerClosed, breakerOpen and breakerHalfOpen.
+func (b *circuitBreaker) state() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < b.threshold {
+		return breakerClosed
+	} else if b.trial || time.Since(b.openedAt) >= b.cooldown {
+		return breakerHalfOpen
+	}
+	return breakerOpen
+}
+
+var _ imdb2torrent.MagnetSearcher = (*resilientSearcher)(nil)
+
+// resilientSearcher wraps a magnet searcher, retries failed searches with exponential backoff
+// and skips the site via a circuit breaker when it fails repeatedly.
+// imdb2torrent's client always waits for all sites until its timeout, so without the breaker a flapping site
+// (like 1337x with Cloudflare challenges) would slow down every request.
+type resilientSearcher struct {
+	imdb2torrent.MagnetSearcher
+	site    string
+	retries int
+	// Nil if disabled
+	breaker *circuitBreaker
+	logger  *zap.Logger
+}
+
+func newResilientSearcher(searcher imdb2torrent.MagnetSearcher, site string, retries, breakerThreshold int, breakerCooldown time.Duration, logger *zap.Logger) *resilientSearcher {
+	s := &resilientSearcher{
+		MagnetSearcher: searcher,
+		site:           site,
+		retries:        retries,
+		logger:         logger,
+	}
+	if breakerThreshold > 0 {
+		s.breaker = &circuitBreaker{
+			threshold: breakerThreshold,
+			cooldown:  breakerCooldown,
+		}
+		// 0 = closed, 1 = half-open, 2 = open
+		metrics.GetOrCreateGauge(fmt.Sprintf(`circuit_breaker_state{site=%q}`, site), func() float64 {
+			switch s.breaker.state() {
+			case breakerHalfOpen:
+				return 1
+			case breakerOpen:
+				return 2
+			}
+			return 0
+		})
+	}
+	return s
+}
+
+func (s *resilientSearcher) FindMovie(ctx context.Context, imdbID string) ([]imdb2torrent.Result, error) {
+	return s.find(ctx, func() ([]imdb2torrent.Result, error) {
+		return s.MagnetSearcher.FindMovie(ctx, imdbID)
+	})
+}
+
+func (s *resilientSearcher) FindTVShow(ctx context.Context, imdbID string, season, episode int) ([]imdb2torrent.Result, error) {
+	return s.find(ctx, func() ([]imdb2torrent.Result, error) {
+		return s.MagnetSearcher.FindTVShow(ctx, imdbID, season, episode)
+	})
+}
+
+// breakerState returns the state of the circuit breaker, or an empty string if it's disabled.
+func (s *resilientSearcher) breakerState() string {
+	if s.breaker == nil {
+		return ""
+	}
+	return s.breaker.state()
+}
+
+// siteBreakerState returns the state of the circuit breaker of the given magnet searcher,
+// which can be wrapped by an instrumentedSearcher. It returns an empty string if the searcher has no circuit breaker.
+func siteBreakerState(searcher imdb2torrent.MagnetSearcher) string {
+	if instrumented, ok := searcher.(*instrumentedSearcher); ok {
+		searcher = instrumented.MagnetSearcher
+	}
+	if resilient, ok := searcher.(*resilientSearcher); ok {
+		return resilient.breakerState()
+	}
+	return ""
+}
+
+func (s *resilientSearcher) find(ctx context.Context, search func() ([]imdb2torrent.Result, error)) ([]imdb2torrent.Result, error) {
+	if s.breaker != nil && !s.breaker.allow() {
+		return nil, errBreakerOpen
+	}
+	var results []imdb2torrent.Result
+	var err error
+	for attempt := 0; ; attempt++ {
+		results, err = search()
+		// Canceled requests aren't retried
+		if err == nil || ctx.Err() != nil || attempt == s.retries {
+			break
+		}
+		delay := retryBaseDelay << attempt
+		s.logger.Debug("Retrying failed search", zap.Error(err), zap.String("site", s.site), zap.Duration("delay", delay))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if s.breaker != nil {
+		// A canceled request doesn't say anything about the site
+		if ctx.Err() != nil {
+			s.breaker.release()
+		} else if s.breaker.record(err) {
+			s.logger.Warn("Circuit breaker opened, skipping site", zap.String("site", s.site), zap.Duration("cooldown", s.breaker.cooldown))
+		}
+	}
+	return results, err
+}
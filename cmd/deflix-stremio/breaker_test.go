@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// countingSearcher fails the first failures searches.
+type countingSearcher struct {
+	fakeMagnetSearcher
+	calls    int
+	failures int
+}
+
+func (s *countingSearcher) FindMovie(ctx context.Context, imdbID string) ([]imdb2torrent.Result, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return nil, errors.New("foo")
+	}
+	return s.results, nil
+}
+
+func TestResilientSearcherRetries(t *testing.T) {
+	searcher := &countingSearcher{failures: 1}
+	s := newResilientSearcher(searcher, "foo", 1, 0, 0, zap.NewNop())
+	_, err := s.FindMovie(context.Background(), "tt1254207")
+	require.NoError(t, err)
+	require.Equal(t, 2, searcher.calls)
+
+	// Without retries
+	searcher = &countingSearcher{failures: 1}
+	s = newResilientSearcher(searcher, "foo", 0, 0, 0, zap.NewNop())
+	_, err = s.FindMovie(context.Background(), "tt1254207")
+	require.Error(t, err)
+	require.Equal(t, 1, searcher.calls)
+
+	// Canceled requests aren't retried
+	searcher = &countingSearcher{failures: 1}
+	s = newResilientSearcher(searcher, "foo", 1, 0, 0, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.FindMovie(ctx, "tt1254207")
+	require.Error(t, err)
+	require.Equal(t, 1, searcher.calls)
+}
+
+func TestResilientSearcherBreaker(t *testing.T) {
+	searcher := &countingSearcher{failures: 3}
+	s := newResilientSearcher(searcher, "foo", 0, 2, 50*time.Millisecond, zap.NewNop())
+	ctx := context.Background()
+
+	_, err := s.FindMovie(ctx, "tt1254207")
+	require.Error(t, err)
+	require.Equal(t, breakerClosed, s.breakerState())
+	_, err = s.FindMovie(ctx, "tt1254207")
+	require.Error(t, err)
+	require.Equal(t, breakerOpen, s.breakerState())
+
+	// Skipped during the cooldown
+	_, err = s.FindMovie(ctx, "tt1254207")
+	require.Equal(t, errBreakerOpen, err)
+	require.Equal(t, 2, searcher.calls)
+
+	// A failed trial opens it again
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, breakerHalfOpen, s.breakerState())
+	_, err = s.FindMovie(ctx, "tt1254207")
+	require.Error(t, err)
+	require.NotEqual(t, errBreakerOpen, err)
+	require.Equal(t, breakerOpen, s.breakerState())
+
+	// A successful trial closes it
+	time.Sleep(50 * time.Millisecond)
+	_, err = s.FindMovie(ctx, "tt1254207")
+	require.NoError(t, err)
+	require.Equal(t, breakerClosed, s.breakerState())
+	require.Equal(t, 4, searcher.calls)
+}
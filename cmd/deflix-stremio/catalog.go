@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/deflix-tv/go-stremio"
+)
+
+// Max number of the most requested IMDb IDs that are checked for a language catalog, as multiple of the catalog size.
+// Only some of the most requested ones are in the catalog's language.
+const languageCatalogCandidates = 5
+
+// catalogLanguages maps the ISO 639-1 codes of the languages for which catalogs can be configured to the language names in Cinemeta's metadata.
+var catalogLanguages = map[string]string{
+	"ar": "Arabic",
+	"cs": "Czech",
+	"da": "Danish",
+	"de": "German",
+	"el": "Greek",
+	"en": "English",
+	"es": "Spanish",
+	"fi": "Finnish",
+	"fr": "French",
+	"he": "Hebrew",
+	"hi": "Hindi",
+	"hu": "Hungarian",
+	"it": "Italian",
+	"ja": "Japanese",
+	"ko": "Korean",
+	"nl": "Dutch",
+	"no": "Norwegian",
+	"pl": "Polish",
+	"pt": "Portuguese",
+	"ro": "Romanian",
+	"ru": "Russian",
+	"sv": "Swedish",
+	"tr": "Turkish",
+	"zh": "Mandarin",
+}
+
+// languageCatalogID returns the catalog ID for the language with the ISO 639-1 code, like "deflix-lang-de".
+func languageCatalogID(code string) string {
+	return "deflix-lang-" + code
+}
+
+// languageCatalogItems returns the manifest's catalog items of the languages with the ISO 639-1 codes, for each of the types.
+func languageCatalogItems(codes, types []string) []stremio.CatalogItem {
+	var result []stremio.CatalogItem
+	for _, streamType := range types {
+		for _, code := range codes {
+			result = append(result, stremio.CatalogItem{
+				Type: streamType,
+				ID:   languageCatalogID(code),
+				Name: catalogLanguages[code] + " on Deflix",
+			})
+		}
+	}
+	return result
+}
+
+// hasLanguage returns true if the language is one of the languages in Cinemeta's metadata, which is a list like "English, German".
+func hasLanguage(metaLanguages, language string) bool {
+	for _, metaLanguage := range strings.Split(metaLanguages, ",") {
+		if strings.EqualFold(strings.TrimSpace(metaLanguage), language) {
+			return true
+		}
+	}
+	return false
+}
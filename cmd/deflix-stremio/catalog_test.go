@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasLanguage(t *testing.T) {
+	require.True(t, hasLanguage("English, German", "German"))
+	require.True(t, hasLanguage("german", "German"))
+	require.False(t, hasLanguage("English, Swiss German", "German"))
+	require.False(t, hasLanguage("", "German"))
+}
+
+func TestLanguageCatalogItems(t *testing.T) {
+	items := languageCatalogItems([]string{"de", "fr"}, []string{"movie", "series"})
+	require.Len(t, items, 4)
+	require.Equal(t, "movie", items[0].Type)
+	require.Equal(t, "deflix-lang-de", items[0].ID)
+	require.Equal(t, "German on Deflix", items[0].Name)
+	require.Equal(t, "series", items[3].Type)
+	require.Equal(t, "deflix-lang-fr", items[3].ID)
+}
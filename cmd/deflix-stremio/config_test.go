@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigOptions(t *testing.T) {
+	var c config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o := newConfigOptions(fs)
+	o.String(&c.BindAddr, "bindAddr", "BIND_ADDR", "localhost", "")
+	o.Int(&c.Port, "port", "PORT", 8080, "")
+	o.Bool(&c.ReadOnly, "readOnly", "READ_ONLY", false, "")
+	o.Duration(&c.CacheAgeXD, "cacheAgeXD", "CACHE_AGE_XD", 24*time.Hour, "")
+	o.Strings(&c.TorznabEndpoints, "torznabEndpoint", "TORZNAB_ENDPOINT", "")
+	o.Strings(&c.ExtraHeadersXD, "extraHeadersXD", "EXTRA_HEADERS_RD", "")
+
+	require.NoError(t, fs.Parse([]string{"-port", "1234"}))
+	os.Setenv("TEST_PORT", "2345")
+	defer os.Unsetenv("TEST_PORT")
+	os.Setenv("TEST_READ_ONLY", "true")
+	defer os.Unsetenv("TEST_READ_ONLY")
+	os.Setenv("TEST_EXTRA_HEADERS_RD", "X-Foo: bar\nX-Bar: baz\n")
+	defer os.Unsetenv("TEST_EXTRA_HEADERS_RD")
+	fileValues := map[string]interface{}{
+		"port":            3456,
+		"readOnly":        false,
+		"cacheAgeXD":      "1h",
+		"torznabEndpoint": []interface{}{"http://localhost:9696/1/api", "http://localhost:9696/2/api"},
+	}
+	require.NoError(t, o.apply("TEST_", fileValues))
+
+	// Default
+	require.Equal(t, "localhost", c.BindAddr)
+	// Command line argument before env var and config file
+	require.Equal(t, 1234, c.Port)
+	// Env var before config file
+	require.True(t, c.ReadOnly)
+	require.Equal(t, []string{"X-Foo: bar", "X-Bar: baz"}, c.ExtraHeadersXD)
+	// Config file
+	require.Equal(t, time.Hour, c.CacheAgeXD)
+	require.Equal(t, []string{"http://localhost:9696/1/api", "http://localhost:9696/2/api"}, c.TorznabEndpoints)
+
+	// Unknown options and invalid values
+	for _, fileValues := range []map[string]interface{}{
+		{"foo": "bar"},
+		{"cacheAgeXD": "foo"},
+		{"cacheAgeXD": []interface{}{"1h"}},
+	} {
+		// Options that were applied before count as set via command line argument
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		o := newConfigOptions(fs)
+		o.Duration(&c.CacheAgeXD, "cacheAgeXD", "CACHE_AGE_XD", 24*time.Hour, "")
+		require.NoError(t, fs.Parse(nil))
+		require.Error(t, o.apply("TEST_", fileValues))
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "deflix-stremio-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	exp := map[string]interface{}{
+		"port":            1234,
+		"readOnly":        true,
+		"torznabEndpoint": []interface{}{"http://localhost:9696/1/api"},
+	}
+	files := map[string]string{
+		"config.yaml": "port: 1234\nreadOnly: true\ntorznabEndpoint:\n  - http://localhost:9696/1/api\n",
+		"config.json": `{"port": 1234, "readOnly": true, "torznabEndpoint": ["http://localhost:9696/1/api"]}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		actual, err := loadConfigFile(path)
+		require.NoError(t, err)
+		require.Equal(t, exp, actual)
+	}
+
+	_, err = loadConfigFile(filepath.Join(dir, "foo.yaml"))
+	require.Error(t, err)
+}
+
+func TestSiteEnabled(t *testing.T) {
+	c := config{}
+	require.True(t, c.siteEnabled("1337X"))
+
+	c.EnabledSites = "yts, 1337x,RARBG"
+	require.True(t, c.siteEnabled("YTS"))
+	require.True(t, c.siteEnabled("1337X"))
+	require.True(t, c.siteEnabled("RARBG"))
+	require.False(t, c.siteEnabled("TPB"))
+	require.False(t, c.siteEnabled("Nyaa"))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+)
+
+// configureTemplate is the name of the template for the configure page in the configure directory
+const configureTemplate = "index.html.tmpl"
+
+// configurePage is the data for rendering the configure page template.
+type configurePage struct {
+	// Version of the addon, like in the manifest
+	Version string
+	// The addon URLs that the configure page creates are based on it
+	BaseURL string
+	// Whether RealDebrid and Premiumize are configured via OAuth2 instead of API keys/tokens
+	OAUTH2   bool
+	Features instanceFeatures
+}
+
+// Supports returns true if the instance supports the debrid service with the given ID.
+func (p configurePage) Supports(debridID string) bool {
+	for _, supported := range p.Features.DebridServices {
+		if supported == debridID {
+			return true
+		}
+	}
+	return false
+}
+
+// StreamsPerQualityChoices returns the numbers of streams per quality that users can choose in addition to the default of 1.
+func (p configurePage) StreamsPerQualityChoices() []int {
+	var result []int
+	for n := 2; n <= p.Features.MaxStreamsPerQuality; n++ {
+		result = append(result, n)
+	}
+	return result
+}
+
+// configureFS serves the files for the "/configure" endpoint.
+// The index file is rendered from the template when the file system is created, because the data doesn't change while the instance is running.
+// The template itself is hidden. We don't want people to access `www.example.com/index.html.tmpl` for example.
+type configureFS struct {
+	fs      http.FileSystem
+	index   []byte
+	modTime time.Time
+}
+
+// newConfigureFS creates a file system with the files of the given directory, which must contain the configure page template.
+func newConfigureFS(dir fs.FS, page configurePage) (http.FileSystem, error) {
+	tpl, err := template.ParseFS(dir, configureTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse configure page template: %w", err)
+	}
+	// Render now, so we fail early instead of when the first user visits the page
+	index := &bytes.Buffer{}
+	if err = tpl.Execute(index, page); err != nil {
+		return nil, fmt.Errorf("Couldn't render configure page template: %w", err)
+	}
+	return configureFS{
+		fs:      http.FS(dir),
+		index:   index.Bytes(),
+		modTime: time.Now(),
+	}, nil
+}
+
+// Open implements the http.FileSystem interface.
+func (c configureFS) Open(name string) (http.File, error) {
+	switch name {
+	case "/index.html":
+		return &renderedFile{
+			Reader: bytes.NewReader(c.index),
+			info: renderedFileInfo{
+				name:    "index.html",
+				size:    int64(len(c.index)),
+				modTime: c.modTime,
+			},
+		}, nil
+	case "/" + configureTemplate:
+		return nil, os.ErrNotExist
+	}
+	return c.fs.Open(name)
+}
+
+// renderedFile is an in-memory http.File with the rendered configure page.
+type renderedFile struct {
+	*bytes.Reader
+	info renderedFileInfo
+}
+
+func (f *renderedFile) Close() error {
+	return nil
+}
+
+func (f *renderedFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *renderedFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// renderedFileInfo implements fs.FileInfo for a renderedFile.
+type renderedFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i renderedFileInfo) Name() string       { return i.name }
+func (i renderedFileInfo) Size() int64        { return i.size }
+func (i renderedFileInfo) Mode() fs.FileMode  { return 0o444 }
+func (i renderedFileInfo) ModTime() time.Time { return i.modTime }
+func (i renderedFileInfo) IsDir() bool        { return false }
+func (i renderedFileInfo) Sys() interface{}   { return nil }
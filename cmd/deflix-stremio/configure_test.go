@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/doingodswork/deflix-stremio/web"
+)
+
+func TestConfigureFS(t *testing.T) {
+	configureDir, err := fs.Sub(web.Configure, "configure")
+	require.NoError(t, err)
+
+	for _, useOAUTH2 := range []bool{false, true} {
+		page := configurePage{
+			Version: "1.2.3",
+			BaseURL: "https://example.com",
+			OAUTH2:  useOAUTH2,
+			Features: instanceFeatures{
+				DebridServices:       []string{"rd", "tb"},
+				MaxStreamsPerQuality: 3,
+			},
+		}
+		httpFS, err := newConfigureFS(configureDir, page)
+		require.NoError(t, err)
+
+		f, err := httpFS.Open("/index.html")
+		require.NoError(t, err)
+		index, err := io.ReadAll(f)
+		require.NoError(t, err)
+		stat, err := f.Stat()
+		require.NoError(t, err)
+		require.Equal(t, int64(len(index)), stat.Size())
+		f.Close()
+		require.Contains(t, string(index), "Deflix 1.2.3 - Made by")
+		require.Contains(t, string(index), `var baseURL = "https://example.com";`)
+		require.Contains(t, string(index), `<option value="tb">Torbox</option>`)
+		require.NotContains(t, string(index), `<option value="ad">AllDebrid</option>`)
+		require.Contains(t, string(index), `<option value="3">3</option>`)
+		require.NotContains(t, string(index), `<option value="4">4</option>`)
+		if useOAUTH2 {
+			require.Contains(t, string(index), "/oauth2/init/rd")
+		} else {
+			require.NotContains(t, string(index), "/oauth2/init/rd")
+		}
+
+		// The template is hidden
+		_, err = httpFS.Open("/" + configureTemplate)
+		require.True(t, os.IsNotExist(err))
+
+		f, err = httpFS.Open("/deflix.css")
+		require.NoError(t, err)
+		f.Close()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// contextKey is the type of the keys of values that are passed along with a request, for example from a middleware to a handler.
+// Fiber's Locals and fasthttp's RequestCtx.Value only work with string keys, so the keys are converted to strings when setting and getting values.
+// Still, only values with these keys can be set and read with the helpers below, which prevents typos.
+type contextKey string
+
+const (
+	ctxKeyUserData           contextKey = "deflix_userData"
+	ctxKeyKeyOrToken         contextKey = "deflix_keyOrToken"
+	ctxKeyFallbackKeyOrToken contextKey = "deflix_fallbackKeyOrToken"
+	ctxKeyStreamHints        contextKey = "deflix_streamHints"
+	ctxKeyStreamNames        contextKey = "deflix_streamNames"
+	ctxKeyTelemetry          contextKey = "deflix_telemetry"
+	ctxKeySearchCollector    contextKey = "deflix_searchCollector"
+	ctxKeyDiagnostics        contextKey = "deflix_diagnostics"
+	ctxKeyRecomputation      contextKey = "deflix_recomputation"
+	ctxKeySpan               contextKey = "deflix_span"
+	ctxKeyRequestID          contextKey = "deflix_requestID"
+	ctxKeyRDwaitBudget       contextKey = "deflix_rdWaitBudget"
+	ctxKeyRDtorrentList      contextKey = "deflix_rdTorrentList"
+	ctxKeyRDpolling          contextKey = "deflix_rdPolling"
+	// The debrid clients read these ones
+	ctxKeyDebridOAUTH2   contextKey = "debrid_OAUTH2"
+	ctxKeyDebridOriginIP contextKey = "debrid_originIP"
+)
+
+// setLocal sets a value for the request, which handlers can read via the request context.
+func setLocal(c *fiber.Ctx, key contextKey, value interface{}) {
+	c.Locals(string(key), value)
+}
+
+// withValue returns a copy of the context with the value set.
+func withValue(ctx context.Context, key contextKey, value interface{}) context.Context {
+	return context.WithValue(ctx, string(key), value)
+}
+
+// value returns the value for the key, or nil if it isn't set.
+func value(ctx context.Context, key contextKey) interface{} {
+	return ctx.Value(string(key))
+}
+
+// errMissingContextValue is returned by the accessor functions when a value is missing in the context or has the wrong type,
+// which means that a route was wired without the required middleware.
+func errMissingContextValue(key contextKey) error {
+	return fmt.Errorf("%v is missing in the request context or has the wrong type, is the middleware missing for the route?", key)
+}
+
+// userDataFromContext returns the user data that the auth middleware decoded and validated.
+func userDataFromContext(ctx context.Context) (userData, error) {
+	ud, ok := value(ctx, ctxKeyUserData).(userData)
+	if !ok {
+		return userData{}, errMissingContextValue(ctxKeyUserData)
+	}
+	return ud, nil
+}
+
+// keyOrTokenFromContext returns the user's debrid API key or token that the auth middleware validated.
+// For OAuth2 users it's the access token.
+func keyOrTokenFromContext(ctx context.Context) (string, error) {
+	keyOrToken, ok := value(ctx, ctxKeyKeyOrToken).(string)
+	if !ok || keyOrToken == "" {
+		return "", errMissingContextValue(ctxKeyKeyOrToken)
+	}
+	return keyOrToken, nil
+}
+
+// fallbackKeyOrTokenFromContext returns the user's API key or token for the fallback debrid service that the auth middleware validated,
+// or an empty string if the user didn't configure a fallback or if its validation failed.
+func fallbackKeyOrTokenFromContext(ctx context.Context) string {
+	keyOrToken, _ := value(ctx, ctxKeyFallbackKeyOrToken).(string)
+	return keyOrToken
+}
+
+// debridContext returns a new context with the values that the debrid clients read from the given context.
+// It's used for debrid API calls in the background, after the request context is canceled.
+func debridContext(ctx context.Context) context.Context {
+	result := context.Background()
+	if oauth2 := value(ctx, ctxKeyDebridOAUTH2); oauth2 != nil {
+		result = withValue(result, ctxKeyDebridOAUTH2, oauth2)
+	}
+	// So that the logs of the background work can be correlated with the request
+	if requestID := value(ctx, ctxKeyRequestID); requestID != nil {
+		result = withValue(result, ctxKeyRequestID, requestID)
+	}
+	// So that the background work's metrics are only recorded if the request allowed it
+	if telemetry := value(ctx, ctxKeyTelemetry); telemetry != nil {
+		result = withValue(result, ctxKeyTelemetry, telemetry)
+	}
+	return result
+}
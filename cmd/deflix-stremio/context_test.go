@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserDataFromContext(t *testing.T) {
+	// Missing values, for example because a route was wired without the auth middleware
+	_, err := userDataFromContext(context.Background())
+	require.Error(t, err)
+	_, err = keyOrTokenFromContext(context.Background())
+	require.Error(t, err)
+
+	// Wrong type
+	ctx := withValue(context.Background(), ctxKeyUserData, "foo")
+	_, err = userDataFromContext(ctx)
+	require.Error(t, err)
+
+	exp := userData{ADkey: "foo"}
+	ctx = withValue(context.Background(), ctxKeyUserData, exp)
+	ctx = withValue(ctx, ctxKeyKeyOrToken, "foo")
+	ud, err := userDataFromContext(ctx)
+	require.NoError(t, err)
+	require.Equal(t, exp, ud)
+	keyOrToken, err := keyOrTokenFromContext(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "foo", keyOrToken)
+}
+
+func TestDebridContext(t *testing.T) {
+	ctx := withValue(context.Background(), ctxKeyDebridOAUTH2, struct{}{})
+	ctx = withValue(ctx, ctxKeyKeyOrToken, "foo")
+	ctx = withValue(ctx, ctxKeyRequestID, "bar")
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	debridCtx := debridContext(ctx)
+	require.NoError(t, debridCtx.Err())
+	require.NotNil(t, debridCtx.Value("debrid_OAUTH2"))
+	require.Equal(t, "bar", value(debridCtx, ctxKeyRequestID))
+	require.Nil(t, value(debridCtx, ctxKeyKeyOrToken))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// searchCollector collects the results of all magnet searchers for a single search request.
+// It's passed to the instrumented searchers via the context.
+type searchCollector struct {
+	lock    sync.Mutex
+	closed  bool
+	results map[string][]imdb2torrent.Result
+}
+
+func newSearchCollector() *searchCollector {
+	return &searchCollector{
+		results: map[string][]imdb2torrent.Result{},
+	}
+}
+
+// add adds the results of a magnet searcher.
+// Results that are added after the collector was closed are ignored, because they didn't make it into the response
+// (for example when a slow searcher timed out and continued in the background).
+func (c *searchCollector) add(site string, results []imdb2torrent.Result) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.results[site] = results
+}
+
+// close closes the collector and returns the sites that contributed at least one torrent that no other site found.
+func (c *searchCollector) close() map[string]struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+
+	// Info hash -> number of sites that found it
+	siteCounts := map[string]int{}
+	for _, results := range c.results {
+		infoHashes := map[string]struct{}{}
+		for _, result := range results {
+			infoHashes[result.InfoHash] = struct{}{}
+		}
+		for infoHash := range infoHashes {
+			siteCounts[infoHash]++
+		}
+	}
+	contributors := map[string]struct{}{}
+	for site, results := range c.results {
+		for _, result := range results {
+			if siteCounts[result.InfoHash] == 1 {
+				contributors[site] = struct{}{}
+				break
+			}
+		}
+	}
+	return contributors
+}
+
+// sites returns the sites that found each info hash.
+// It can be called after the collector was closed.
+func (c *searchCollector) sites() map[string][]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	infoHashSites := map[string][]string{}
+	for site, results := range c.results {
+		for _, result := range results {
+			sites := infoHashSites[result.InfoHash]
+			// A site can return the same torrent multiple times
+			if len(sites) == 0 || sites[len(sites)-1] != site {
+				infoHashSites[result.InfoHash] = append(sites, site)
+			}
+		}
+	}
+	return infoHashSites
+}
+
+// coverageBucket contains the coverage counts of one time slot of the rolling window.
+type coverageBucket struct {
+	start    time.Time
+	requests int
+	// Site -> number of requests where the site contributed at least one unique torrent
+	contributions map[string]int
+}
+
+// coverageStat is the coverage of a single magnet searcher.
+type coverageStat struct {
+	Requests      int `json:"requests"`
+	Contributions int `json:"contributions"`
+	// Contributions / requests
+	Coverage float64 `json:"coverage"`
+}
+
+// searcherCoverage tracks per magnet searcher the fraction of search requests where it contributed at least one unique (non-duplicate) torrent, over a rolling window.
+// This helps deciding which torrent sites are worth their latency and maintenance cost.
+type searcherCoverage struct {
+	lock       sync.Mutex
+	sites      []string
+	window     time.Duration
+	bucketSize time.Duration
+	buckets    []coverageBucket
+}
+
+func newSearcherCoverage(sites []string, window, bucketSize time.Duration) *searcherCoverage {
+	return &searcherCoverage{
+		sites:      sites,
+		window:     window,
+		bucketSize: bucketSize,
+	}
+}
+
+// record records a search request with the given contributors (as returned by searchCollector.close()).
+func (sc *searcherCoverage) record(contributors map[string]struct{}) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	now := time.Now()
+	sc.removeExpired(now)
+	bucketStart := now.Truncate(sc.bucketSize)
+	if len(sc.buckets) == 0 || !sc.buckets[len(sc.buckets)-1].start.Equal(bucketStart) {
+		sc.buckets = append(sc.buckets, coverageBucket{
+			start:         bucketStart,
+			contributions: map[string]int{},
+		})
+	}
+	bucket := &sc.buckets[len(sc.buckets)-1]
+	bucket.requests++
+	for site := range contributors {
+		bucket.contributions[site]++
+	}
+}
+
+// stats returns the coverage of all magnet searchers within the rolling window.
+func (sc *searcherCoverage) stats() map[string]coverageStat {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	sc.removeExpired(time.Now())
+	result := make(map[string]coverageStat, len(sc.sites))
+	for _, site := range sc.sites {
+		stat := coverageStat{}
+		for _, bucket := range sc.buckets {
+			stat.Requests += bucket.requests
+			stat.Contributions += bucket.contributions[site]
+		}
+		if stat.Requests > 0 {
+			stat.Coverage = float64(stat.Contributions) / float64(stat.Requests)
+		}
+		result[site] = stat
+	}
+	return result
+}
+
+// removeExpired removes the buckets that are completely outside of the rolling window.
+// The lock must be held by the caller.
+func (sc *searcherCoverage) removeExpired(now time.Time) {
+	i := 0
+	for ; i < len(sc.buckets); i++ {
+		if now.Sub(sc.buckets[i].start) < sc.window+sc.bucketSize {
+			break
+		}
+	}
+	sc.buckets = sc.buckets[i:]
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestSearcherCoverage(t *testing.T) {
+	coverage := newSearcherCoverage([]string{"YTS", "TPB", "RARBG"}, time.Hour, time.Minute)
+
+	collector := newSearchCollector()
+	collector.add("YTS", []imdb2torrent.Result{{InfoHash: "a"}, {InfoHash: "b"}})
+	collector.add("TPB", []imdb2torrent.Result{{InfoHash: "a"}})
+	collector.add("RARBG", nil)
+	contributors := collector.close()
+	require.Equal(t, map[string]struct{}{"YTS": {}}, contributors)
+	coverage.record(contributors)
+
+	collector = newSearchCollector()
+	collector.add("YTS", []imdb2torrent.Result{{InfoHash: "a"}})
+	collector.add("TPB", []imdb2torrent.Result{{InfoHash: "b"}})
+	contributors = collector.close()
+	// Results that arrive after closing are ignored
+	collector.add("RARBG", []imdb2torrent.Result{{InfoHash: "c"}})
+	require.Equal(t, map[string]struct{}{"YTS": {}, "TPB": {}}, contributors)
+	coverage.record(contributors)
+
+	stats := coverage.stats()
+	require.Equal(t, coverageStat{Requests: 2, Contributions: 2, Coverage: 1}, stats["YTS"])
+	require.Equal(t, coverageStat{Requests: 2, Contributions: 1, Coverage: 0.5}, stats["TPB"])
+	require.Equal(t, coverageStat{Requests: 2}, stats["RARBG"])
+
+	// Buckets outside of the window are removed
+	coverage.buckets[0].start = coverage.buckets[0].start.Add(-2 * time.Hour)
+	require.Equal(t, coverageStat{}, coverage.stats()["YTS"])
+}
+
+func TestSearchCollectorSites(t *testing.T) {
+	collector := newSearchCollector()
+	collector.add("YTS", []imdb2torrent.Result{{InfoHash: "a"}, {InfoHash: "b"}})
+	collector.add("TPB", []imdb2torrent.Result{{InfoHash: "a"}, {InfoHash: "a"}})
+	collector.close()
+	sites := collector.sites()
+	require.ElementsMatch(t, []string{"YTS", "TPB"}, sites["a"])
+	require.Equal(t, []string{"YTS"}, sites["b"])
+
+	diagnostics := newQualityDiagnostics([]imdb2torrent.Result{{InfoHash: "a"}, {InfoHash: "b"}, {InfoHash: "c"}}, sites)
+	require.Equal(t, qualityDiagnostics{Torrents: 3, Sites: map[string]int{"YTS": 2, "TPB": 1}}, diagnostics)
+	require.Equal(t, qualityDiagnostics{Torrents: 1}, newQualityDiagnostics([]imdb2torrent.Result{{InfoHash: "a"}}, nil))
+}
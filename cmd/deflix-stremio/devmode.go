@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Dev mode responds with Big Buck Bunny for every movie, in 720p and 1080p
+const (
+	devTitle          = "Big Buck Bunny"
+	devInfoHash1080p  = "DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C"
+	devInfoHash720p   = "C9E15763F722F23E98A29DECDFAE341B98D53056"
+	devFileName       = "big_buck_bunny_1080p.mp4"
+	devFileSize       = 725106140
+	devStreamURL      = "https://download.blender.org/peach/bigbuckbunny_movies/big_buck_bunny_1080p_h264.mov"
+	devPremiumUntil   = 4102444800 // 2100-01-01
+	devPremiumUntilTS = "2100-01-01T00:00:00Z"
+)
+
+// applyDevMode changes the config so that all torrent sites, debrid services and Cinemeta are replaced by the fake upstream server at the URL.
+// Only YTS is enabled, and the sites that need extra servers (Jackett, Zilean etc.) are disabled.
+func (c *config) applyDevMode(upstreamURL string) {
+	c.BaseURLcinemeta = upstreamURL + "/cinemeta"
+	c.BaseURLyts = upstreamURL + "/yts"
+	c.EnabledSites = "YTS"
+	c.BaseURLnyaa = ""
+	c.BaseURLjackett = ""
+	c.BaseURLzilean = ""
+	c.BaseURLbitmagnet = ""
+	c.TorznabEndpoints = nil
+	c.IMDB2metaAddr = ""
+	c.BaseURLrd = upstreamURL + "/rd"
+	c.BaseURLad = upstreamURL + "/ad"
+	c.BaseURLpm = upstreamURL + "/pm"
+	c.BaseURLdl = upstreamURL + "/dl"
+	c.BaseURLtorbox = upstreamURL + "/tb"
+	c.UpdateCheckInterval = 0
+}
+
+// startDevUpstream starts the fake upstream server for dev mode on a free local port and returns its URL.
+// The server is shut down when the context is canceled.
+func startDevUpstream(ctx context.Context, logger *zap.Logger) (string, error) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return "", fmt.Errorf("Couldn't listen on a free port: %v", err)
+	}
+	server := &http.Server{Handler: newDevUpstream()}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("Fake upstream server stopped", zap.Error(err))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return "http://" + listener.Addr().String(), nil
+}
+
+// newDevUpstream creates a handler that responds like Cinemeta, YTS and the debrid services, with Big Buck Bunny for every movie.
+// Any API key or token is accepted, all torrents are instantly available and every conversion leads to the same stream URL.
+// TV shows have no torrents, because YTS only has movies.
+func newDevUpstream() http.Handler {
+	mux := http.NewServeMux()
+	torrentFile := fmt.Sprintf(`{"filename": %q, "filesize": %d}`, devFileName, devFileSize)
+
+	// Cinemeta
+	mux.HandleFunc("/cinemeta/meta/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/cinemeta/meta/"), "/")
+		if len(parts) != 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		id := strings.TrimSuffix(parts[1], ".json")
+		writeDevJSON(w, fmt.Sprintf(`{"meta": {"id": %q, "type": %q, "name": %q, "releaseInfo": "2008"}}`, id, parts[0], devTitle))
+	})
+
+	// YTS
+	mux.HandleFunc("/yts/api/v2/list_movies.json", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, fmt.Sprintf(`{"status": "ok", "data": {"movie_count": 1, "movies": [{"title": %q, "torrents": [
+			{"quality": "1080p", "type": "bluray", "hash": %q},
+			{"quality": "720p", "type": "bluray", "hash": %q}
+		]}]}}`, devTitle, devInfoHash1080p, devInfoHash720p))
+	})
+
+	// RealDebrid
+	mux.HandleFunc("/rd/rest/1.0/user", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, `{"id": 1, "username": "dev", "type": "premium", "expiration": "`+devPremiumUntilTS+`"}`)
+	})
+	mux.HandleFunc("/rd/rest/1.0/torrents/instantAvailability/", func(w http.ResponseWriter, r *http.Request) {
+		var items []string
+		for _, infoHash := range strings.Split(strings.TrimPrefix(r.URL.Path, "/rd/rest/1.0/torrents/instantAvailability/"), "/") {
+			items = append(items, fmt.Sprintf(`%q: {"rd": [{"1": %v}]}`, strings.ToLower(infoHash), torrentFile))
+		}
+		writeDevJSON(w, "{"+strings.Join(items, ", ")+"}")
+	})
+	mux.HandleFunc("/rd/rest/1.0/torrents", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, `[]`)
+	})
+	mux.HandleFunc("/rd/rest/1.0/torrents/addMagnet", func(w http.ResponseWriter, r *http.Request) {
+		// The RealDebrid client replaces the scheme and host by its base URL
+		w.WriteHeader(http.StatusCreated)
+		writeDevJSON(w, `{"id": "DEV", "uri": "https://api.real-debrid.com/rest/1.0/torrents/info/DEV"}`)
+	})
+	mux.HandleFunc("/rd/rest/1.0/torrents/info/DEV", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, fmt.Sprintf(`{"id": "DEV", "status": "downloaded", "files": [{"id": 1, "path": "/%v", "bytes": %d, "selected": 1}], "links": ["https://real-debrid.com/d/DEV"]}`, devFileName, devFileSize))
+	})
+	mux.HandleFunc("/rd/rest/1.0/torrents/selectFiles/DEV", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/rd/rest/1.0/unrestrict/link", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, `{"id": "DEV", "download": "`+devStreamURL+`"}`)
+	})
+
+	// AllDebrid
+	mux.HandleFunc("/ad/v4/user", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, fmt.Sprintf(`{"status": "success", "data": {"user": {"username": "dev", "isPremium": true, "premiumUntil": %d}}}`, devPremiumUntil))
+	})
+	mux.HandleFunc("/ad/v4/magnet/instant", func(w http.ResponseWriter, r *http.Request) {
+		var magnets []string
+		if err := r.ParseForm(); err == nil {
+			for _, infoHash := range r.Form["magnets[]"] {
+				magnets = append(magnets, fmt.Sprintf(`{"hash": %q, "instant": true}`, infoHash))
+			}
+		}
+		writeDevJSON(w, `{"status": "success", "data": {"magnets": [`+strings.Join(magnets, ", ")+`]}}`)
+	})
+	mux.HandleFunc("/ad/v4/magnet/upload", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, `{"status": "success", "data": {"magnets": [{"id": 1, "ready": true}]}}`)
+	})
+	mux.HandleFunc("/ad/v4/magnet/status", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, fmt.Sprintf(`{"status": "success", "data": {"magnets": {"id": 1, "status": "Ready", "links": [{"link": "https://alldebrid.com/f/DEV", "filename": %q, "size": %d}]}}}`, devFileName, devFileSize))
+	})
+	mux.HandleFunc("/ad/v4/link/unlock", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, `{"status": "success", "data": {"link": "`+devStreamURL+`"}}`)
+	})
+
+	// Premiumize
+	mux.HandleFunc("/pm/account/info", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, fmt.Sprintf(`{"status": "success", "customer_id": "dev", "premium_until": %d}`, devPremiumUntil))
+	})
+	mux.HandleFunc("/pm/cache/check", func(w http.ResponseWriter, r *http.Request) {
+		var response []string
+		if err := r.ParseForm(); err == nil {
+			for range r.Form["items[]"] {
+				response = append(response, "true")
+			}
+		}
+		writeDevJSON(w, `{"status": "success", "response": [`+strings.Join(response, ", ")+`]}`)
+	})
+	mux.HandleFunc("/pm/transfer/directdl", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, fmt.Sprintf(`{"status": "success", "content": [{"path": %q, "size": %d, "link": %q}]}`, devFileName, devFileSize, devStreamURL))
+	})
+	mux.HandleFunc("/pm/folder/list", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, `{"status": "success", "content": []}`)
+	})
+
+	// Debrid-Link
+	mux.HandleFunc("/dl/account/infos", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, `{"success": true, "value": {"pseudo": "dev", "accountType": 1, "premiumLeft": 2000000000}}`)
+	})
+	mux.HandleFunc("/dl/seedbox/cached", func(w http.ResponseWriter, r *http.Request) {
+		var items []string
+		for _, infoHash := range strings.Split(r.URL.Query().Get("url"), ",") {
+			items = append(items, fmt.Sprintf(`%q: {"name": %q}`, strings.ToLower(infoHash), devTitle))
+		}
+		writeDevJSON(w, `{"success": true, "value": {`+strings.Join(items, ", ")+`}}`)
+	})
+	mux.HandleFunc("/dl/seedbox/add", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, fmt.Sprintf(`{"success": true, "value": {"files": [{"name": %q, "size": %d, "downloadUrl": %q}]}}`, devFileName, devFileSize, devStreamURL))
+	})
+
+	// Torbox
+	mux.HandleFunc("/tb/user/me", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, `{"success": true, "data": {"email": "dev@example.com", "plan": 2, "premium_expires_at": "`+devPremiumUntilTS+`"}}`)
+	})
+	mux.HandleFunc("/tb/torrents/checkcached", func(w http.ResponseWriter, r *http.Request) {
+		var items []string
+		for _, infoHash := range strings.Split(r.URL.Query().Get("hash"), ",") {
+			items = append(items, fmt.Sprintf(`{"hash": %q}`, strings.ToLower(infoHash)))
+		}
+		writeDevJSON(w, `{"success": true, "data": [`+strings.Join(items, ", ")+`]}`)
+	})
+	mux.HandleFunc("/tb/torrents/createtorrent", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, `{"success": true, "data": {"torrent_id": 1}}`)
+	})
+	mux.HandleFunc("/tb/torrents/mylist", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, fmt.Sprintf(`{"success": true, "data": {"id": 1, "files": [{"id": 0, "name": %q, "size": %d}]}}`, devFileName, devFileSize))
+	})
+	mux.HandleFunc("/tb/torrents/requestdl", func(w http.ResponseWriter, r *http.Request) {
+		writeDevJSON(w, `{"success": true, "data": "`+devStreamURL+`"}`)
+	})
+
+	return mux
+}
+
+func writeDevJSON(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(body))
+}
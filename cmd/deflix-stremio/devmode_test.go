@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	debrid "github.com/deflix-tv/go-debrid"
+	"github.com/deflix-tv/go-stremio/pkg/cinemeta"
+	"github.com/deflix-tv/imdb2torrent"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/alldebrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/debridlink"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/premiumize"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/realdebrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/torbox"
+)
+
+// TestDevUpstream uses the production clients against the fake upstream server, so that it breaks when a client changes in a way the fake doesn't cover.
+func TestDevUpstream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstreamURL, err := startDevUpstream(ctx, zap.NewNop())
+	require.NoError(t, err)
+	c := config{EnabledSites: "YTS,TPB", BaseURLjackett: "http://localhost:9117"}
+	c.applyDevMode(upstreamURL)
+	require.Equal(t, "YTS", c.EnabledSites)
+	require.Empty(t, c.BaseURLjackett)
+	logger := zap.NewNop()
+
+	// Cinemeta and YTS
+	cinemetaOpts := cinemeta.DefaultClientOpts
+	cinemetaOpts.BaseURL = c.BaseURLcinemeta
+	meta, err := cinemeta.NewClient(cinemetaOpts, cinemeta.NewInMemoryCache(), logger).GetMovie(ctx, "tt1254207")
+	require.NoError(t, err)
+	require.Equal(t, devTitle, meta.Name)
+	ytsClient := imdb2torrent.NewYTSclient(imdb2torrent.NewYTSclientOpts(c.BaseURLyts, time.Second, 0), imdb2torrent.NewInMemoryCache(), logger, false)
+	torrents, err := ytsClient.FindMovie(ctx, "tt1254207")
+	require.NoError(t, err)
+	require.Len(t, torrents, 2)
+	magnetURL := torrents[0].MagnetURL
+
+	// Debrid services
+	rdClient, err := realdebrid.NewClient(realdebrid.NewClientOpts(c.BaseURLrd, time.Second, time.Hour, nil, false), debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	require.NoError(t, err)
+	adClient, err := alldebrid.NewClient(alldebrid.NewClientOpts(c.BaseURLad, time.Second, time.Hour, nil), debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	require.NoError(t, err)
+	pmClient, err := premiumize.NewClient(premiumize.NewClientOpts(c.BaseURLpm, time.Second, time.Hour, nil, false), debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	require.NoError(t, err)
+	dlClient, err := debridlink.NewClient(debridlink.NewClientOpts(c.BaseURLdl, time.Second, time.Hour, nil), debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	require.NoError(t, err)
+	tbClient, err := torbox.NewClient(torbox.NewClientOpts(c.BaseURLtorbox, time.Second, time.Hour, nil), debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	require.NoError(t, err)
+	services := map[string]struct {
+		test         func(ctx context.Context, keyOrToken string) error
+		availability func(ctx context.Context, keyOrToken string, infoHashes ...string) []string
+		streamURL    func(ctx context.Context, magnetURL, keyOrToken string) (string, error)
+	}{
+		"rd": {rdClient.TestToken, rdClient.CheckInstantAvailability, func(ctx context.Context, magnetURL, keyOrToken string) (string, error) {
+			return rdClient.GetStreamURL(ctx, magnetURL, keyOrToken, false)
+		}},
+		"ad": {adClient.TestAPIkey, adClient.CheckInstantAvailability, adClient.GetStreamURL},
+		"pm": {pmClient.TestAPIkey, pmClient.CheckInstantAvailability, pmClient.GetStreamURL},
+		"dl": {dlClient.TestAPIkey, dlClient.CheckInstantAvailability, dlClient.GetStreamURL},
+		"tb": {tbClient.TestAPIkey, tbClient.CheckInstantAvailability, tbClient.GetStreamURL},
+	}
+	for debridID, service := range services {
+		require.NoError(t, service.test(ctx, "foo"), debridID)
+		require.Len(t, service.availability(ctx, "foo", torrents[0].InfoHash, torrents[1].InfoHash), 2, debridID)
+		streamURL, err := service.streamURL(ctx, magnetURL, "foo")
+		require.NoError(t, err, debridID)
+		require.Equal(t, devStreamURL, streamURL, debridID)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+// diagnosisCheck is the result of a single check of the self-diagnostics page.
+type diagnosisCheck struct {
+	Name    string
+	OK      bool
+	Details string
+}
+
+var diagnosisTemplate = template.Must(template.New("diagnosis").Parse(`<!DOCTYPE html>
+<html lang="en">
+
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1.0">
+  <title>Deflix - Diagnosis</title>
+  <link rel="icon" href="/configure/favicon.ico">
+  <link rel="stylesheet" href="/configure/mvp.css">
+  <link rel="stylesheet" href="/configure/deflix.css">
+</head>
+
+<body>
+  <main>
+    <section>
+      <header>
+        <h2>Diagnosis</h2>
+        <p>These are the results of checking your addon configuration:</p>
+      </header>
+    </section>
+    <section>
+      <table>
+        {{- range .}}
+        <tr>
+          <td>{{if .OK}}✔️{{else}}❌{{end}}</td>
+          <td><b>{{.Name}}</b></td>
+          <td>{{.Details}}</td>
+        </tr>
+        {{- end}}
+      </table>
+    </section>
+    <section>
+      <p>If all checks are fine but you still get errors in Stremio, please <a href="/configure">reinstall the addon</a>.</p>
+    </section>
+  </main>
+</body>
+
+</html>
+`))
+
+// checkReachability checks if the addon is reachable at its base URL from the server's perspective.
+func checkReachability(ctx context.Context, httpClient *http.Client, baseURL string) diagnosisCheck {
+	result := diagnosisCheck{Name: "Addon reachability"}
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/health", nil)
+	if err != nil {
+		result.Details = fmt.Sprintf("The addon's base URL %v is invalid. This is a server-side problem.", baseURL)
+		return result
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		result.Details = fmt.Sprintf("The server couldn't reach the addon at %v. This is a server-side problem, please try again later.", baseURL)
+		return result
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		result.Details = fmt.Sprintf("The addon at %v responded with %v. This is a server-side problem, please try again later.", baseURL, res.Status)
+		return result
+	}
+	result.OK = true
+	result.Details = fmt.Sprintf("The addon is reachable at %v.", baseURL)
+	return result
+}
+
+// checkPremium checks if the user's debrid service account has premium status.
+func checkPremium(serviceName string, info accountInfo, err error) diagnosisCheck {
+	result := diagnosisCheck{Name: serviceName + " premium status"}
+	if err != nil {
+		result.Details = fmt.Sprintf("Couldn't fetch your account info from %v: %v", serviceName, err)
+		return result
+	}
+	if !info.Premium {
+		result.Details = fmt.Sprintf("Your %v account doesn't have premium status, which is required for streaming.", serviceName)
+		return result
+	}
+	result.OK = true
+	if info.PremiumUntil.IsZero() {
+		result.Details = "Your account has premium status."
+	} else {
+		result.Details = "Your account has premium status until " + info.PremiumUntil.Format("2006-01-02") + "."
+	}
+	return result
+}
+
+// checkRemoteTraffic checks if the RealDebrid user has remote traffic left, which is required when the "rdRemote" option is enabled.
+func checkRemoteTraffic(traffic remoteTraffic, err error) diagnosisCheck {
+	result := diagnosisCheck{Name: "RealDebrid remote traffic"}
+	if err != nil {
+		result.Details = fmt.Sprintf("Couldn't fetch your remote traffic from RealDebrid: %v", err)
+		return result
+	}
+	if traffic.Left <= 0 {
+		result.Details = `You have no remote traffic left, but enabled the "remote traffic" option. Please reinstall the addon without the option or wait until your remote traffic is reset.`
+		return result
+	}
+	result.OK = true
+	result.Details = "You have " + formatSize(traffic.Left) + " of remote traffic left."
+	return result
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
+	"go.uber.org/zap"
+)
+
+// Episode markers in file names, like "S01E05", "s01.e05" or "1x05"
+var (
+	episodeMarkerRegex    = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])s(\d{1,2})[ ._-]?e(\d{1,3})(?:[^0-9]|$)`)
+	episodeMarkerAltRegex = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(\d{1,2})x(\d{2,3})(?:[^0-9]|$)`)
+)
+
+// seasonEpisodeFromStreamID returns the season and episode from a stream ID like "tt0944947:1:5".
+// For movies and for Kitsu IDs, which use absolute episode numbers, both are 0.
+func seasonEpisodeFromStreamID(id string) (int, int) {
+	if strings.HasPrefix(id, kitsuIDprefix) {
+		return 0, 0
+	}
+	parts := strings.Split(id, ":")
+	if len(parts) != 3 {
+		return 0, 0
+	}
+	season, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0
+	}
+	episode, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return 0, 0
+	}
+	return season, episode
+}
+
+// matchesEpisode returns true if the file name or path contains a marker for the season and episode, like "S01E05".
+func matchesEpisode(name string, season, episode int) bool {
+	// The episode is in the file name, but the directory of a season pack contains a marker like "S01E01-E10" as well
+	if slashIndex := strings.LastIndex(name, "/"); slashIndex >= 0 {
+		name = name[slashIndex+1:]
+	}
+	for _, regex := range []*regexp.Regexp{episodeMarkerRegex, episodeMarkerAltRegex} {
+		for _, match := range regex.FindAllStringSubmatch(name, -1) {
+			s, _ := strconv.Atoi(match[1])
+			e, _ := strconv.Atoi(match[2])
+			if s == season && e == episode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// debridFile is a file of a torrent on a debrid service.
+type debridFile struct {
+	Name string
+	Size int64
+}
+
+// selectEpisodeFile returns the index of the largest file that matches the season and episode.
+// If none matches, it's the index of the largest file, like go-debrid selects it, so that torrents with unusual file names still work.
+// It's -1 if there are no files.
+func selectEpisodeFile(files []debridFile, season, episode int) int {
+	result, largest := -1, -1
+	for i, file := range files {
+		if largest < 0 || file.Size > files[largest].Size {
+			largest = i
+		}
+		if matchesEpisode(file.Name, season, episode) && (result < 0 || file.Size > files[result].Size) {
+			result = i
+		}
+	}
+	if result < 0 {
+		return largest
+	}
+	return result
+}
+
+// selectLargestFile returns the index of the largest file, which is the movie, or -1 if there are no files.
+func selectLargestFile(files []debridFile) int {
+	largest := -1
+	for i, file := range files {
+		if largest < 0 || file.Size > files[largest].Size {
+			largest = i
+		}
+	}
+	return largest
+}
+
+// episodeClient converts torrents into stream URLs of a specific TV show episode.
+// go-debrid always selects the largest file of a torrent, which is the wrong episode for season packs.
+// It covers RealDebrid, AllDebrid and Premiumize. Debrid-Link and Torbox still use the largest file.
+type episodeClient struct {
+	rdTorrents      *rdTorrentClient
+	baseURLad       string
+	baseURLpm       string
+	extraHeaders    map[string]string
+	forwardOriginIP bool
+	httpClient      *http.Client
+	logger          *zap.Logger
+}
+
+func newEpisodeClient(rdTorrents *rdTorrentClient, baseURLad, baseURLpm string, forwardOriginIP bool, timeout time.Duration, logger *zap.Logger) *episodeClient {
+	return &episodeClient{
+		rdTorrents:      rdTorrents,
+		baseURLad:       baseURLad,
+		baseURLpm:       baseURLpm,
+		extraHeaders:    rdTorrents.extraHeaders,
+		forwardOriginIP: forwardOriginIP,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		logger: logger,
+	}
+}
+
+// supports returns true if the client can select episode files on the debrid service with the given ID.
+func (c *episodeClient) supports(debridID string) bool {
+	return debridID == "rd" || debridID == "ad" || debridID == "pm"
+}
+
+// streamURLFunc returns the conversion for the resolver of AllDebrid or Premiumize in the debrid registry.
+// It selects the episode's file for TV show episodes, and converts other torrents via the resolver.
+func (c *episodeClient) streamURLFunc(debridID string, resolver debrid.Resolver) debrid.StreamURLFunc {
+	return func(ctx context.Context, magnetURL, keyOrToken string, season, episode int, remote bool) (string, error) {
+		if season > 0 {
+			return c.getStreamURL(ctx, debridID, magnetURL, keyOrToken, season, episode, remote)
+		}
+		return resolver.GetStreamURL(ctx, magnetURL, keyOrToken, 0, 0, remote)
+	}
+}
+
+// getStreamURL converts the torrent into a stream URL of the episode's file via the debrid service with the given ID ("rd", "ad" or "pm").
+func (c *episodeClient) getStreamURL(ctx context.Context, debridID, magnetURL, keyOrToken string, season, episode int, rdRemote bool) (string, error) {
+	switch debridID {
+	case "rd":
+		return c.rdTorrents.getStreamURL(ctx, magnetURL, keyOrToken, season, episode, rdRemote)
+	case "ad":
+		return c.getADstreamURL(ctx, magnetURL, keyOrToken, season, episode)
+	case "pm":
+		return c.getPMstreamURL(ctx, magnetURL, keyOrToken, season, episode)
+	default:
+		return "", fmt.Errorf("Episode file selection isn't supported for debrid service %v", debridID)
+	}
+}
+
+func (c *episodeClient) getADstreamURL(ctx context.Context, magnetURL, apiKey string, season, episode int) (string, error) {
+	data := url.Values{}
+	data.Set("magnets[]", magnetURL)
+	var uploadRes struct {
+		Data struct {
+			Magnets []struct {
+				ID int64 `json:"id"`
+			} `json:"magnets"`
+		} `json:"data"`
+	}
+	if err := c.doAD(ctx, "POST", "/v4/magnet/upload", apiKey, data, &uploadRes); err != nil {
+		return "", fmt.Errorf("Couldn't add magnet to AllDebrid: %v", err)
+	}
+	if len(uploadRes.Data.Magnets) == 0 || uploadRes.Data.Magnets[0].ID == 0 {
+		return "", errors.New("Couldn't determine torrent ID in magnet upload response from AllDebrid")
+	}
+
+	var statusRes struct {
+		Data struct {
+			Magnets struct {
+				Links []struct {
+					Link     string `json:"link"`
+					Filename string `json:"filename"`
+					Size     int64  `json:"size"`
+				} `json:"links"`
+			} `json:"magnets"`
+		} `json:"data"`
+	}
+	statusQuery := url.Values{}
+	statusQuery.Set("id", strconv.FormatInt(uploadRes.Data.Magnets[0].ID, 10))
+	if err := c.doAD(ctx, "GET", "/v4/magnet/status", apiKey, statusQuery, &statusRes); err != nil {
+		return "", fmt.Errorf("Couldn't get magnet status from AllDebrid: %v", err)
+	}
+	links := statusRes.Data.Magnets.Links
+	files := make([]debridFile, len(links))
+	for i, link := range links {
+		files[i] = debridFile{Name: link.Filename, Size: link.Size}
+	}
+	i := selectEpisodeFile(files, season, episode)
+	if i < 0 || links[i].Link == "" {
+		return "", errors.New("Couldn't find proper link in magnet status")
+	}
+
+	var unlockRes struct {
+		Data struct {
+			Link string `json:"link"`
+		} `json:"data"`
+	}
+	unlockQuery := url.Values{}
+	unlockQuery.Set("link", links[i].Link)
+	if err := c.doAD(ctx, "GET", "/v4/link/unlock", apiKey, unlockQuery, &unlockRes); err != nil {
+		return "", fmt.Errorf("Couldn't unlock link: %v", err)
+	}
+	if unlockRes.Data.Link == "" {
+		return "", errors.New("AllDebrid didn't return an unlocked link")
+	}
+	return unlockRes.Data.Link, nil
+}
+
+// doAD sends a request to the AllDebrid API and unmarshals the response into the result.
+// For GET requests the data is sent as query.
+func (c *episodeClient) doAD(ctx context.Context, method, path, apiKey string, data url.Values, result interface{}) error {
+	query := url.Values{}
+	query.Set("agent", "deflix")
+	query.Set("apikey", apiKey)
+	var body io.Reader
+	if method == "GET" {
+		for key, values := range data {
+			query[key] = values
+		}
+	} else {
+		body = strings.NewReader(data.Encode())
+	}
+	resBody, err := c.do(ctx, method, c.baseURLad+path+"?"+query.Encode(), body)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		Status string `json:"status"`
+		Error  struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err = json.Unmarshal(resBody, &res); err != nil {
+		return fmt.Errorf("Couldn't unmarshal response: %v", err)
+	}
+	if res.Status != "success" {
+		return fmt.Errorf("Got error response from AllDebrid: %v", res.Error.Message)
+	}
+	return json.Unmarshal(resBody, result)
+}
+
+func (c *episodeClient) getPMstreamURL(ctx context.Context, magnetURL, keyOrToken string, season, episode int) (string, error) {
+	query := url.Values{}
+	if value(ctx, ctxKeyDebridOAUTH2) != nil {
+		query.Set("access_token", keyOrToken)
+	} else {
+		query.Set("apikey", keyOrToken)
+	}
+	data := url.Values{}
+	data.Set("src", magnetURL)
+	// Like go-debrid, because Premiumize asks for the original IP for directdl requests
+	if ip, ok := value(ctx, ctxKeyDebridOriginIP).(string); c.forwardOriginIP && ok {
+		data.Set("download_ip", ip)
+	}
+	resBody, err := c.do(ctx, "POST", c.baseURLpm+"/transfer/directdl?"+query.Encode(), strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("Couldn't add magnet to Premiumize: %v", err)
+	}
+	var res struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Content []struct {
+			Path string `json:"path"`
+			Size int64  `json:"size"`
+			Link string `json:"link"`
+		} `json:"content"`
+	}
+	if err = json.Unmarshal(resBody, &res); err != nil {
+		return "", fmt.Errorf("Couldn't unmarshal Premiumize response: %v", err)
+	}
+	if res.Status != "success" {
+		return "", fmt.Errorf("Got error response from Premiumize: %v", res.Message)
+	}
+	files := make([]debridFile, len(res.Content))
+	for i, content := range res.Content {
+		files[i] = debridFile{Name: content.Path, Size: content.Size}
+	}
+	i := selectEpisodeFile(files, season, episode)
+	if i < 0 || res.Content[i].Link == "" {
+		return "", errors.New("Couldn't find proper link in Premiumize response")
+	}
+	return res.Content[i].Link, nil
+}
+
+func (c *episodeClient) do(ctx context.Context, method, reqURL string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create %v request: %v", method, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for headerKey, headerVal := range c.extraHeaders {
+		req.Header.Add(headerKey, headerVal)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send %v request: %v", method, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad HTTP response status: %v", res.Status)
+	}
+
+	return io.ReadAll(res.Body)
+}
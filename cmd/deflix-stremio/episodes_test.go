@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSeasonEpisodeFromStreamID(t *testing.T) {
+	season, episode := seasonEpisodeFromStreamID("tt0944947:1:5")
+	require.Equal(t, 1, season)
+	require.Equal(t, 5, episode)
+
+	for _, id := range []string{"tt1254207", "kitsu:11469:5", "tt0944947:foo:5"} {
+		season, episode = seasonEpisodeFromStreamID(id)
+		require.Zero(t, season, id)
+		require.Zero(t, episode, id)
+	}
+}
+
+func TestMatchesEpisode(t *testing.T) {
+	for _, name := range []string{
+		"Game.of.Thrones.S01E05.720p.mkv",
+		"game of thrones s1e5.mp4",
+		"Game.of.Thrones.S01.E05.mkv",
+		"Game of Thrones - 1x05 - The Wolf and the Lion.avi",
+		"Game.of.Thrones.S01E01-E10/Game.of.Thrones.S01E05.mkv",
+	} {
+		require.True(t, matchesEpisode(name, 1, 5), name)
+	}
+	for _, name := range []string{
+		"Game.of.Thrones.S01E15.720p.mkv",
+		"Game.of.Thrones.S11E05.720p.mkv",
+		"Game.of.Thrones.S01E01-E10/Game.of.Thrones.S01E01.mkv",
+		"Game.of.Thrones.1080p.mkv",
+	} {
+		require.False(t, matchesEpisode(name, 1, 5), name)
+	}
+}
+
+func TestSelectEpisodeFile(t *testing.T) {
+	files := []debridFile{
+		{Name: "Show.S01E01.mkv", Size: 3000},
+		{Name: "Show.S01E02.mkv", Size: 2000},
+		{Name: "Sample/Show.S01E02.sample.mkv", Size: 10},
+	}
+	require.Equal(t, 1, selectEpisodeFile(files, 1, 2))
+	// Largest file if none matches
+	require.Equal(t, 0, selectEpisodeFile(files, 1, 3))
+	require.Equal(t, -1, selectEpisodeFile(nil, 1, 3))
+}
+
+func TestEpisodeClientRD(t *testing.T) {
+	selectedFile := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rest/1.0/torrents/addMagnet":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": "ABC", "uri": "https://api.real-debrid.com/rest/1.0/torrents/info/ABC"}`))
+		case "/rest/1.0/torrents/info/ABC":
+			w.Write([]byte(`{"status": "downloaded", "files": [{"id": 1, "path": "/Show.S01E01.mkv", "bytes": 3000}, {"id": 2, "path": "/Show.S01E02.mkv", "bytes": 2000}], "links": ["https://real-debrid.com/d/ABC2"]}`))
+		case "/rest/1.0/torrents/selectFiles/ABC":
+			require.NoError(t, r.ParseForm())
+			selectedFile = r.PostForm.Get("files")
+			w.WriteHeader(http.StatusNoContent)
+		case "/rest/1.0/unrestrict/link":
+			require.NoError(t, r.ParseForm())
+			require.Equal(t, "https://real-debrid.com/d/ABC2", r.PostForm.Get("link"))
+			w.Write([]byte(`{"download": "https://foo.download.real-debrid.com/d/ABC2/Show.S01E02.mkv"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	rdTorrents, err := newRDtorrentClient(server.URL, nil, false, 5*time.Second, time.Second, time.Second, zap.NewNop())
+	require.NoError(t, err)
+	episodes := newEpisodeClient(rdTorrents, server.URL, server.URL, false, time.Second, zap.NewNop())
+	streamURL, err := episodes.getStreamURL(context.Background(), "rd", "magnet:?xt=urn:btih:abc", "foo", 1, 2, false)
+	require.NoError(t, err)
+	require.Equal(t, "2", selectedFile)
+	require.Equal(t, "https://foo.download.real-debrid.com/d/ABC2/Show.S01E02.mkv", streamURL)
+}
+
+func TestEpisodeClientAD(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "foo", r.URL.Query().Get("apikey"))
+		switch r.URL.Path {
+		case "/v4/magnet/upload":
+			w.Write([]byte(`{"status": "success", "data": {"magnets": [{"id": 123}]}}`))
+		case "/v4/magnet/status":
+			require.Equal(t, "123", r.URL.Query().Get("id"))
+			w.Write([]byte(`{"status": "success", "data": {"magnets": {"links": [{"link": "https://uptobox.com/1", "filename": "Show.S01E01.mkv", "size": 3000}, {"link": "https://uptobox.com/2", "filename": "Show.S01E02.mkv", "size": 2000}]}}}`))
+		case "/v4/link/unlock":
+			require.Equal(t, "https://uptobox.com/2", r.URL.Query().Get("link"))
+			w.Write([]byte(`{"status": "success", "data": {"link": "https://foo.debrid.it/dl/2/Show.S01E02.mkv"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	rdTorrents, err := newRDtorrentClient(server.URL, nil, false, 5*time.Second, time.Second, time.Second, zap.NewNop())
+	require.NoError(t, err)
+	episodes := newEpisodeClient(rdTorrents, server.URL, server.URL, false, time.Second, zap.NewNop())
+	streamURL, err := episodes.getStreamURL(context.Background(), "ad", "magnet:?xt=urn:btih:abc", "foo", 1, 2, false)
+	require.NoError(t, err)
+	require.Equal(t, "https://foo.debrid.it/dl/2/Show.S01E02.mkv", streamURL)
+}
+
+func TestEpisodeClientPM(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/transfer/directdl", r.URL.Path)
+		require.Equal(t, "foo", r.URL.Query().Get("apikey"))
+		w.Write([]byte(`{"status": "success", "content": [{"path": "Show.S01/Show.S01E01.mkv", "size": 3000, "link": "https://foo.premiumize.me/1"}, {"path": "Show.S01/Show.S01E02.mkv", "size": 2000, "link": "https://foo.premiumize.me/2"}]}`))
+	}))
+	defer server.Close()
+
+	rdTorrents, err := newRDtorrentClient(server.URL, nil, false, 5*time.Second, time.Second, time.Second, zap.NewNop())
+	require.NoError(t, err)
+	episodes := newEpisodeClient(rdTorrents, server.URL, server.URL, false, time.Second, zap.NewNop())
+	streamURL, err := episodes.getStreamURL(context.Background(), "pm", "magnet:?xt=urn:btih:abc", "foo", 1, 2, false)
+	require.NoError(t, err)
+	require.Equal(t, "https://foo.premiumize.me/2", streamURL)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"html/template"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Machine-readable error codes of the redirect endpoint, which apps can use to show their own error messages
+const (
+	errCodeRedirectExpired  = "redirect_expired"
+	errCodeStillDownloading = "still_downloading"
+)
+
+// Seconds after which a client should request a stream again when the torrent is still downloading
+const stillDownloadingRetryAfter = 60
+
+// redirectError is the body of an error response of the redirect endpoint.
+type redirectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+var redirectErrorTemplate = template.Must(template.New("redirectError").Parse(`<!DOCTYPE html>
+<html lang="en">
+
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1.0">
+  <title>Deflix - Error</title>
+  <link rel="icon" href="/configure/favicon.ico">
+  <link rel="stylesheet" href="/configure/mvp.css">
+  <link rel="stylesheet" href="/configure/deflix.css">
+</head>
+
+<body>
+  <main>
+    <section>
+      <header>
+        <h2>Error</h2>
+        <p>{{.Message}}</p>
+        <p><small>Error code: <code>{{.Code}}</code></small></p>
+      </header>
+    </section>
+  </main>
+</body>
+
+</html>
+`))
+
+// sendRedirectError responds with the given status and error, as HTML page if the client prefers HTML and as JSON otherwise.
+// Players don't show the response body, but it's useful for users who open the link in a browser and for apps that show their own error messages.
+func sendRedirectError(c *fiber.Ctx, status int, code, message string) error {
+	c.Status(status)
+	body := redirectError{
+		Code:    code,
+		Message: message,
+	}
+	if c.Accepts("application/json", "text/html") == "text/html" {
+		c.Type("html")
+		return redirectErrorTemplate.Execute(c, body)
+	}
+	return c.JSON(body)
+}
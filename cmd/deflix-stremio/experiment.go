@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// controlVariant is the variant of users who take part in an experiment, but get the regular torrent order.
+// Comparing its metrics with the ones of the strategy's variant shows whether the strategy is an improvement.
+const controlVariant = "control"
+
+// experimentStrategies are the alternative torrent orderings that can be tested in an experiment.
+// They sort in place. Which file of a torrent is selected is decided by the debrid clients, so only the order of the torrents can be tested.
+var experimentStrategies = map[string]func([]imdb2torrent.Result){
+	// Smaller files are more likely to be cached by the debrid services and start faster
+	"smallestFirst": sortSmallestFirst,
+	// WEB releases are more popular than BluRay releases of the same quality, so they're more likely to be cached by the debrid services
+	"webFirst": func(torrents []imdb2torrent.Result) {
+		sort.SliceStable(torrents, func(i, j int) bool {
+			return strings.Contains(torrents[i].Quality, "(web)") && !strings.Contains(torrents[j].Quality, "(web)")
+		})
+	},
+}
+
+// experimentConversions returns the counter for conversions of torrents into streams in the redirect handler, for the given experiment variant and result ("success" or "failure").
+func experimentConversions(variant, result string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`experiment_conversions_total{variant=%q, result=%q}`, variant, result))
+}
+
+// experimentTimeToStream returns the histogram for the duration from a user's click on a stream until the redirect to the converted stream, for the given experiment variant.
+func experimentTimeToStream(variant string) *metrics.Histogram {
+	return metrics.GetOrCreateHistogram(fmt.Sprintf(`experiment_time_to_stream_seconds{variant=%q}`, variant))
+}
+
+// experiment assigns users to either the control variant or the variant of an alternative torrent ordering strategy.
+// The assignment is based on the user hash, so a user always gets the same variant.
+type experiment struct {
+	strategy string
+	// Percentage of users that get the strategy's variant
+	percent int
+}
+
+// newExperiment creates a new experiment for the given strategy, or returns nil if strategy is empty.
+// The strategy must be one of the keys of experimentStrategies.
+func newExperiment(strategy string, percent int) *experiment {
+	if strategy == "" {
+		return nil
+	}
+	return &experiment{
+		strategy: strategy,
+		percent:  percent,
+	}
+}
+
+// variant returns the variant for the user with the given hash, or an empty string if the user doesn't take part in the experiment.
+// Users with their own sorting and filtering preferences don't take part, because their preferences would distort the results.
+// It's safe to call on a nil experiment.
+func (e *experiment) variant(userHash string, ud userData) string {
+	if e == nil || ud.hasPreferences() {
+		return ""
+	}
+	// The strategy is part of the hashed value, so that each experiment has a different group of users
+	hash := sha256.Sum256([]byte(e.strategy + "-" + userHash))
+	if int(binary.BigEndian.Uint64(hash[:8])%100) < e.percent {
+		return e.strategy
+	}
+	return controlVariant
+}
+
+// experimentID returns an ID for the variant, or an empty string if it's the regular torrent order.
+// It's used in the redirect IDs, because the torrent lists in the redirect cache are shared by all users with the same variant.
+func experimentID(variant string) string {
+	if variant == "" || variant == controlVariant {
+		return ""
+	}
+	return "-x." + variant
+}
+
+// applyExperiment sorts the torrents according to the variant's strategy.
+// The control variant and users who don't take part keep the regular order.
+func applyExperiment(torrents []imdb2torrent.Result, variant string) []imdb2torrent.Result {
+	strategy, ok := experimentStrategies[variant]
+	if !ok {
+		return torrents
+	}
+	// Don't modify the order of the original slice, which might be cached
+	result := make([]imdb2torrent.Result, len(torrents))
+	copy(result, torrents)
+	strategy(result)
+	return result
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestExperimentVariant(t *testing.T) {
+	var nilExperiment *experiment
+	require.Empty(t, nilExperiment.variant("abc", userData{}))
+
+	e := newExperiment("webFirst", 10)
+	// Users with preferences don't take part
+	require.Empty(t, e.variant("abc", userData{PreferSmallest: true}))
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		userHash := strconv.Itoa(i)
+		variant := e.variant(userHash, userData{})
+		// Same user, same variant
+		require.Equal(t, variant, e.variant(userHash, userData{}))
+		counts[variant]++
+	}
+	require.Len(t, counts, 2)
+	require.InDelta(t, 1000, counts["webFirst"], 150)
+	require.Equal(t, 10000, counts["webFirst"]+counts[controlVariant])
+
+	require.Equal(t, controlVariant, newExperiment("webFirst", 0).variant("abc", userData{}))
+	require.Equal(t, "webFirst", newExperiment("webFirst", 100).variant("abc", userData{}))
+}
+
+func TestApplyExperiment(t *testing.T) {
+	torrents := []imdb2torrent.Result{
+		{Quality: "1080p", MagnetURL: "magnet:?xt=urn:btih:1&xl=2000"},
+		{Quality: "1080p (web)", MagnetURL: "magnet:?xt=urn:btih:2"},
+		{Quality: "1080p (web)", MagnetURL: "magnet:?xt=urn:btih:3&xl=1000"},
+	}
+
+	require.Equal(t, torrents, applyExperiment(torrents, ""))
+	require.Equal(t, torrents, applyExperiment(torrents, controlVariant))
+	require.Equal(t, []imdb2torrent.Result{torrents[1], torrents[2], torrents[0]}, applyExperiment(torrents, "webFirst"))
+	require.Equal(t, []imdb2torrent.Result{torrents[2], torrents[0], torrents[1]}, applyExperiment(torrents, "smallestFirst"))
+	// The original order isn't modified
+	require.Equal(t, "magnet:?xt=urn:btih:1&xl=2000", torrents[0].MagnetURL)
+
+	require.Empty(t, experimentID(controlVariant))
+	require.Equal(t, "-x.webFirst", experimentID("webFirst"))
+}
@@ -0,0 +1,46 @@
+package main
+
+// instanceFeatures describes which options this instance supports.
+// It's served via "/api/features", so that the configure page can render only the controls that the instance supports,
+// which decouples frontend releases from the capabilities of the backend instances.
+type instanceFeatures struct {
+	// IDs of the supported debrid services ("rd", "ad", "pm", "dl" and "tb")
+	DebridServices []string `json:"debridServices"`
+	// IDs of the debrid services that are configured via OAuth2 instead of API keys/tokens
+	OAUTH2providers []string `json:"oauth2Providers"`
+	TVshows         bool     `json:"tvShows"`
+	Catalogs        bool     `json:"catalogs"`
+	// Whether users can choose to only get streams that are cached on the debrid service
+	CachedOnlyToggle bool `json:"cachedOnlyToggle"`
+	// Torrent sorting and filtering preferences users can set, like "maxResolution". Empty if preferences aren't supported.
+	QualityFilters []string `json:"qualityFilters"`
+	// Whether users can choose to get P2P streams when no cached stream is available
+	P2Pfallback bool `json:"p2pFallback"`
+	// Whether users can choose to queue a download on the debrid service when no cached stream is available
+	QueueDownloads bool `json:"queueDownloads"`
+	// Whether Premiumize users can choose to get a matching file from their cloud as top stream
+	PMcloud bool `json:"pmCloud"`
+	// Whether RealDebrid users can choose to get a matching file from their torrents instead of searching torrents
+	RDtorrents bool `json:"rdTorrents"`
+	// Max number of streams per quality users can choose. 1 means users can't choose.
+	MaxStreamsPerQuality int `json:"maxStreamsPerQuality"`
+}
+
+func newInstanceFeatures(config config) instanceFeatures {
+	result := instanceFeatures{
+		DebridServices: []string{"rd", "ad", "pm", "dl", "tb"},
+		// An empty slice instead of nil, so it's serialized as empty JSON array
+		OAUTH2providers:      []string{},
+		TVshows:              !config.DisableTVshows,
+		Catalogs:             true,
+		QualityFilters:       []string{"preferSmallest", "excludeCam", "maxResolution", "only10bit", "languages", "excludeFormats"},
+		QueueDownloads:       !config.ReadOnly,
+		PMcloud:              true,
+		RDtorrents:           true,
+		MaxStreamsPerQuality: config.MaxStreamsPerQuality,
+	}
+	if config.UseOAUTH2 {
+		result.OAUTH2providers = []string{"rd", "ad", "pm"}
+	}
+	return result
+}
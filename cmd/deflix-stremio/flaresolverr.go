@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Max duration FlareSolverr may take for solving a challenge
+const flareSolverrTimeout = time.Minute
+
+// flareSolverrTransport is an HTTP transport that routes requests to the given hosts through FlareSolverr when they're blocked by a Cloudflare challenge.
+// The cookies and user agent of a solved challenge are reused for further requests to the same host, so only requests after the clearance expired go through FlareSolverr again.
+// The 1337x and ibit clients of imdb2torrent don't accept an HTTP client or transport, but use the default transport, so this is meant to replace http.DefaultTransport.
+// Requests to other hosts are passed through unchanged.
+type flareSolverrTransport struct {
+	base       http.RoundTripper
+	endpoint   string
+	hosts      map[string]bool
+	httpClient *http.Client
+	// Key: host
+	clearances map[string]flareSolverrClearance
+	// Key: host. For solving only one challenge per host at a time.
+	pending map[string]*flareSolverrSolve
+	lock    sync.Mutex
+	logger  *zap.Logger
+}
+
+type flareSolverrClearance struct {
+	cookies   []*http.Cookie
+	userAgent string
+}
+
+type flareSolverrSolve struct {
+	url      string
+	solution flareSolverrSolution
+	err      error
+	done     chan struct{}
+}
+
+type flareSolverrSolution struct {
+	URL       string `json:"url"`
+	Status    int    `json:"status"`
+	Response  string `json:"response"`
+	UserAgent string `json:"userAgent"`
+	Cookies   []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"cookies"`
+}
+
+// newFlareSolverrTransport creates a new transport that routes blocked requests to the hosts of the given base URLs through the FlareSolverr instance at the given address,
+// like "http://localhost:8191". Other requests are sent via the base transport.
+func newFlareSolverrTransport(base http.RoundTripper, flareSolverrURL string, baseURLs []string, logger *zap.Logger) (*flareSolverrTransport, error) {
+	hosts := map[string]bool{}
+	for _, baseURL := range baseURLs {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse base URL %v: %w", baseURL, err)
+		}
+		hosts[u.Host] = true
+	}
+	return &flareSolverrTransport{
+		base:     base,
+		endpoint: strings.TrimSuffix(flareSolverrURL, "/") + "/v1",
+		hosts:    hosts,
+		httpClient: &http.Client{
+			Transport: base,
+			// Some leeway for FlareSolverr's response after its own timeout
+			Timeout: flareSolverrTimeout + 5*time.Second,
+		},
+		clearances: map[string]flareSolverrClearance{},
+		pending:    map[string]*flareSolverrSolve{},
+		logger:     logger,
+	}, nil
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *flareSolverrTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || !t.hosts[req.URL.Host] {
+		return t.base.RoundTrip(req)
+	}
+
+	res, err := t.base.RoundTrip(t.withClearance(req))
+	if err != nil || !isCloudflareChallenge(res) {
+		return res, err
+	}
+	res.Body.Close()
+
+	t.logger.Debug("Got Cloudflare challenge, solving it via FlareSolverr", zap.String("url", req.URL.String()))
+	s := t.solve(req.URL)
+	select {
+	case <-s.done:
+	case <-req.Context().Done():
+		// The solving continues, so that the clearance can be used by later requests
+		return nil, req.Context().Err()
+	}
+	if s.err != nil {
+		return nil, fmt.Errorf("Couldn't solve Cloudflare challenge via FlareSolverr: %w", s.err)
+	}
+	if s.url == req.URL.String() {
+		return s.solution.response(req), nil
+	}
+	// The challenge was solved for another request to the same host
+	return t.base.RoundTrip(t.withClearance(req))
+}
+
+// withClearance returns a copy of the request with the cookies and user agent of the last solved challenge for the request's host.
+// If there's none, the request is returned as is.
+func (t *flareSolverrTransport) withClearance(req *http.Request) *http.Request {
+	t.lock.Lock()
+	clearance, ok := t.clearances[req.URL.Host]
+	t.lock.Unlock()
+	if !ok {
+		return req
+	}
+	req = req.Clone(req.Context())
+	for _, cookie := range clearance.cookies {
+		req.AddCookie(cookie)
+	}
+	// Cloudflare binds the clearance to the user agent
+	req.Header.Set("User-Agent", clearance.userAgent)
+	return req
+}
+
+// solve starts solving the challenge for the given URL, unless a challenge for the same host is already being solved.
+// The solving isn't bound to a request context, so that it can finish for later requests when the triggering request times out.
+func (t *flareSolverrTransport) solve(u *url.URL) *flareSolverrSolve {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if s, ok := t.pending[u.Host]; ok {
+		return s
+	}
+	s := &flareSolverrSolve{
+		url:  u.String(),
+		done: make(chan struct{}),
+	}
+	t.pending[u.Host] = s
+	go func() {
+		defer close(s.done)
+		s.solution, s.err = t.request(s.url)
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.pending, u.Host)
+		if s.err != nil {
+			t.logger.Warn("Couldn't solve Cloudflare challenge via FlareSolverr", zap.Error(s.err), zap.String("host", u.Host))
+			return
+		}
+		clearance := flareSolverrClearance{userAgent: s.solution.UserAgent}
+		for _, cookie := range s.solution.Cookies {
+			clearance.cookies = append(clearance.cookies, &http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+		t.clearances[u.Host] = clearance
+	}()
+	return s
+}
+
+// request sends a GET request for the given URL via FlareSolverr.
+func (t *flareSolverrTransport) request(reqURL string) (flareSolverrSolution, error) {
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"cmd":        "request.get",
+		"url":        reqURL,
+		"maxTimeout": flareSolverrTimeout.Milliseconds(),
+	})
+	if err != nil {
+		return flareSolverrSolution{}, fmt.Errorf("Couldn't marshal request body: %w", err)
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, t.endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return flareSolverrSolution{}, fmt.Errorf("Couldn't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := t.httpClient.Do(req)
+	if err != nil {
+		return flareSolverrSolution{}, fmt.Errorf("Couldn't send request: %w", err)
+	}
+	defer res.Body.Close()
+	var resBody struct {
+		Status   string               `json:"status"`
+		Message  string               `json:"message"`
+		Solution flareSolverrSolution `json:"solution"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+		return flareSolverrSolution{}, fmt.Errorf("Couldn't decode response (status %v): %w", res.StatusCode, err)
+	}
+	if resBody.Status != "ok" {
+		return flareSolverrSolution{}, errors.New(resBody.Message)
+	}
+	return resBody.Solution, nil
+}
+
+// response creates an HTTP response from the solution, as if it was sent by the torrent site.
+// FlareSolverr only returns the response body of HTML pages, so the content type is always HTML.
+func (s flareSolverrSolution) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", s.Status, http.StatusText(s.Status)),
+		StatusCode:    s.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/html; charset=utf-8"}},
+		Body:          ioutil.NopCloser(strings.NewReader(s.Response)),
+		ContentLength: int64(len(s.Response)),
+		Request:       req,
+	}
+}
+
+// isCloudflareChallenge returns whether the response is a Cloudflare challenge instead of the actual page.
+func isCloudflareChallenge(res *http.Response) bool {
+	if res.Header.Get("Cf-Mitigated") == "challenge" {
+		return true
+	}
+	return (res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusServiceUnavailable) &&
+		strings.HasPrefix(strings.ToLower(res.Header.Get("Server")), "cloudflare")
+}
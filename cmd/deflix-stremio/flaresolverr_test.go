@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFlareSolverrTransport(t *testing.T) {
+	siteRequests := 0
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siteRequests++
+		if cookie, err := r.Cookie("cf_clearance"); err != nil || cookie.Value != "abc" || r.UserAgent() != "Mozilla/5.0" {
+			w.Header().Set("Server", "cloudflare")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("<html>" + r.URL.Path + "</html>"))
+	}))
+	defer site.Close()
+	solverRequests := 0
+	solver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		solverRequests++
+		require.Equal(t, "/v1", r.URL.Path)
+		var reqBody map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&reqBody))
+		require.Equal(t, "request.get", reqBody["cmd"])
+		require.Equal(t, site.URL+"/foo", reqBody["url"])
+		w.Write([]byte(`{"status": "ok", "message": "", "solution": {"url": "` + site.URL + `/foo", "status": 200, "response": "<html>solved</html>", "userAgent": "Mozilla/5.0", "cookies": [{"name": "cf_clearance", "value": "abc"}]}}`))
+	}))
+	defer solver.Close()
+
+	transport, err := newFlareSolverrTransport(http.DefaultTransport, solver.URL+"/", []string{site.URL}, zap.NewNop())
+	require.NoError(t, err)
+	client := &http.Client{Transport: transport}
+
+	// The challenge is solved via FlareSolverr
+	res, err := client.Get(site.URL + "/foo")
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "<html>solved</html>", string(body))
+	require.Equal(t, 1, solverRequests)
+
+	// The clearance is reused
+	res, err = client.Get(site.URL + "/bar")
+	require.NoError(t, err)
+	body, _ = ioutil.ReadAll(res.Body)
+	require.Equal(t, "<html>/bar</html>", string(body))
+	require.Equal(t, 1, solverRequests)
+	require.Equal(t, 2, siteRequests)
+
+	// Other hosts aren't touched
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "cloudflare")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer other.Close()
+	res, err = client.Get(other.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	require.Equal(t, 1, solverRequests)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/deflix-tv/go-stremio"
+	"github.com/doingodswork/deflix-stremio/pkg/api"
+)
+
+var _ api.DeflixServer = (*apiServer)(nil)
+
+// apiServer implements the Deflix gRPC API, so that other Deflix services (like the website or bots) can use the torrent search and conversion without going through the Stremio addon endpoints.
+// It uses the same stream handlers and stream resolver as the addon endpoints, so the streams, caches and limits are shared.
+type apiServer struct {
+	api.UnimplementedDeflixServer
+	auth           *authenticator
+	streamHandlers map[string]stremio.StreamHandler
+	resolve        streamResolver
+	logger         *zap.Logger
+}
+
+func newAPIserver(auth *authenticator, streamHandlers map[string]stremio.StreamHandler, resolve streamResolver, logger *zap.Logger) *apiServer {
+	return &apiServer{
+		auth:           auth,
+		streamHandlers: streamHandlers,
+		resolve:        resolve,
+		logger:         logger,
+	}
+}
+
+// FindStreams finds the torrents for a movie or TV show episode and returns the streams that are available on the user's debrid service.
+func (s *apiServer) FindStreams(ctx context.Context, req *api.FindStreamsRequest) (*api.FindStreamsResponse, error) {
+	if !adminIMDbIDregex.MatchString(req.ImdbId) {
+		return nil, status.Error(codes.InvalidArgument, "invalid IMDb ID")
+	}
+	if (req.Season > 0) != (req.Episode > 0) {
+		return nil, status.Error(codes.InvalidArgument, "season and episode must be set both or neither")
+	}
+	// Like in the addon's stream requests
+	id := req.ImdbId
+	streamType := "movie"
+	if req.Season > 0 {
+		id += ":" + strconv.Itoa(int(req.Season)) + ":" + strconv.Itoa(int(req.Episode))
+		streamType = "series"
+	}
+	streamHandler, ok := s.streamHandlers[streamType]
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "this instance doesn't handle TV shows")
+	}
+
+	ctx, err := s.authenticate(ctx, req.UserData)
+	if err != nil {
+		return nil, err
+	}
+	// The stream handler adds the names there, like it does for the stream hints middleware
+	streamNames := map[string]string{}
+	ctx = withValue(ctx, ctxKeyStreamNames, streamNames)
+	streamItems, err := streamHandler(ctx, id, req.UserData)
+	if errors.Is(err, stremio.NotFound) {
+		return nil, status.Error(codes.NotFound, "no streams found")
+	} else if errors.Is(err, stremio.BadRequest) {
+		return nil, status.Error(codes.InvalidArgument, "bad request")
+	} else if err != nil {
+		s.logger.Error("Couldn't find streams", zap.Error(err), zap.String("id", id))
+		return nil, status.Error(codes.Internal, "couldn't find streams")
+	}
+
+	res := &api.FindStreamsResponse{}
+	for _, streamItem := range streamItems {
+		res.Streams = append(res.Streams, &api.Stream{
+			Name:       streamNames[streamItem.URL],
+			Title:      streamItem.Title,
+			RedirectId: redirectIDfromStreamURL(streamItem.URL),
+			Url:        streamItem.URL,
+		})
+	}
+	return res, nil
+}
+
+// ResolveStream converts the torrents of a stream that was previously returned by FindStreams into a debrid HTTP stream URL.
+func (s *apiServer) ResolveStream(ctx context.Context, req *api.ResolveStreamRequest) (*api.ResolveStreamResponse, error) {
+	if req.RedirectId == "" {
+		return nil, status.Error(codes.InvalidArgument, "redirect ID is empty")
+	}
+	ctx, err := s.authenticate(ctx, req.UserData)
+	if err != nil {
+		return nil, err
+	}
+	streamURL, err := s.resolve(ctx, req.UserData, req.RedirectId, nil)
+	switch {
+	case errors.Is(err, errRedirectExpired):
+		return nil, status.Error(codes.NotFound, "stream expired, call FindStreams again")
+	case errors.Is(err, errNoStream):
+		return nil, status.Error(codes.NotFound, "no stream found")
+	case errors.Is(err, errCallLimit):
+		return nil, status.Error(codes.ResourceExhausted, "debrid API call limit reached")
+	case err != nil:
+		s.logger.Error("Couldn't resolve stream", zap.Error(err), zap.String("redirectID", req.RedirectId))
+		return nil, status.Error(codes.Internal, "couldn't resolve stream")
+	}
+	return &api.ResolveStreamResponse{Url: streamURL}, nil
+}
+
+// authenticate validates the credentials in the user data and returns a context with the values that the auth middleware sets for the addon endpoints.
+func (s *apiServer) authenticate(ctx context.Context, udString string) (context.Context, error) {
+	if udString == "" {
+		return nil, status.Error(codes.Unauthenticated, "user data is empty")
+	}
+	creds, httpStatus := s.auth.authenticate(ctx, udString)
+	switch httpStatus {
+	case 0:
+		return creds.withValues(ctx), nil
+	case fiber.StatusBadRequest:
+		return nil, status.Error(codes.InvalidArgument, "invalid user data")
+	case fiber.StatusUnauthorized:
+		return nil, status.Error(codes.Unauthenticated, "debrid credentials are missing")
+	case fiber.StatusForbidden:
+		return nil, status.Error(codes.PermissionDenied, "debrid credentials are invalid")
+	default:
+		return nil, status.Error(codes.Internal, "couldn't validate debrid credentials")
+	}
+}
+
+// serve serves the API on the address until the context is canceled.
+func (s *apiServer) serve(ctx context.Context, addr string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.logger.Fatal("Couldn't listen for gRPC API", zap.Error(err), zap.String("address", addr))
+	}
+	server := grpc.NewServer()
+	api.RegisterDeflixServer(server, s)
+	go func() {
+		s.logger.Info("Starting gRPC API server", zap.String("address", addr))
+		if err := server.Serve(lis); err != nil {
+			s.logger.Fatal("Couldn't start gRPC API server", zap.Error(err))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+}
+
+// redirectIDfromStreamURL returns the redirect ID of the stream URL that the stream handler created, or an empty string if it's not a redirect URL.
+func redirectIDfromStreamURL(streamURL string) string {
+	u, err := url.Parse(streamURL)
+	if err != nil || !strings.Contains(u.Path, "/redirect/") {
+		return ""
+	}
+	return path.Base(u.Path)
+}
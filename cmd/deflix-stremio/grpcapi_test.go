@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	godebrid "github.com/deflix-tv/go-debrid"
+	"github.com/deflix-tv/go-stremio"
+	"github.com/doingodswork/deflix-stremio/pkg/api"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/torbox"
+)
+
+func TestAPIserver(t *testing.T) {
+	tbServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer valid" {
+			w.Write([]byte(`{"success": false, "detail": "invalid key"}`))
+			return
+		}
+		w.Write([]byte(`{"success": true, "data": {"plan": 1}}`))
+	}))
+	defer tbServer.Close()
+	tbClient, err := torbox.NewClient(torbox.NewClientOpts(tbServer.URL, time.Second, time.Hour, nil), godebrid.NewInMemoryCache(), godebrid.NewInMemoryCache(), zap.NewNop())
+	require.NoError(t, err)
+	auth := newAuthenticator(debrid.NewRegistry(nil, nil, nil, nil, tbClient), false, oauth2.Config{}, oauth2.Config{}, nil, zap.NewNop())
+
+	streamHandlers := map[string]stremio.StreamHandler{
+		"movie": func(ctx context.Context, id string, userDataIface interface{}) ([]stremio.StreamItem, error) {
+			if id != "tt1254207" {
+				return nil, stremio.NotFound
+			}
+			keyOrToken, err := keyOrTokenFromContext(ctx)
+			require.NoError(t, err)
+			require.Equal(t, "valid", keyOrToken)
+			streamNames := value(ctx, ctxKeyStreamNames).(map[string]string)
+			streamNames["http://localhost:8080/foo/redirect/tt1254207-tb-720p"] = "Deflix TB"
+			return []stremio.StreamItem{{URL: "http://localhost:8080/foo/redirect/tt1254207-tb-720p", Title: "720p"}}, nil
+		},
+	}
+	resolve := func(ctx context.Context, udString, redirectID string, rdRemoteOverride *bool) (string, error) {
+		if redirectID != "tt1254207-tb-720p" {
+			return "", errRedirectExpired
+		}
+		return "https://example.com/dl/abc123", nil
+	}
+
+	lis := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	api.RegisterDeflixServer(server, newAPIserver(auth, streamHandlers, resolve, zap.NewNop()))
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.DialContext(context.Background(), "bufnet", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.Dial()
+	}), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewDeflixClient(conn)
+
+	udString, err := userData{TBkey: "valid"}.encode(zap.NewNop())
+	require.NoError(t, err)
+	res, err := client.FindStreams(context.Background(), &api.FindStreamsRequest{ImdbId: "tt1254207", UserData: udString})
+	require.NoError(t, err)
+	require.Len(t, res.Streams, 1)
+	require.Equal(t, "Deflix TB", res.Streams[0].Name)
+	require.Equal(t, "720p", res.Streams[0].Title)
+	require.Equal(t, "tt1254207-tb-720p", res.Streams[0].RedirectId)
+
+	resolveRes, err := client.ResolveStream(context.Background(), &api.ResolveStreamRequest{UserData: udString, RedirectId: res.Streams[0].RedirectId})
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/dl/abc123", resolveRes.Url)
+
+	// Errors
+	_, err = client.ResolveStream(context.Background(), &api.ResolveStreamRequest{UserData: udString, RedirectId: "tt1254207-tb-1080p"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.FindStreams(context.Background(), &api.FindStreamsRequest{ImdbId: "tt0000001", UserData: udString})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.FindStreams(context.Background(), &api.FindStreamsRequest{ImdbId: "tt0944947", Season: 1, Episode: 1, UserData: udString})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.FindStreams(context.Background(), &api.FindStreamsRequest{ImdbId: "foo", UserData: udString})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.FindStreams(context.Background(), &api.FindStreamsRequest{ImdbId: "tt1254207"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	invalidUDstring, err := userData{TBkey: "invalid"}.encode(zap.NewNop())
+	require.NoError(t, err)
+	_, err = client.FindStreams(context.Background(), &api.FindStreamsRequest{ImdbId: "tt1254207", UserData: invalidUDstring})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestRedirectIDfromStreamURL(t *testing.T) {
+	require.Equal(t, "tt0944947:1:1-rd-720p", redirectIDfromStreamURL("http://localhost:8080/foo/redirect/tt0944947%3A1%3A1-rd-720p"))
+	require.Equal(t, "tt1254207-rd-best", redirectIDfromStreamURL("https://example.com/foo/redirect/tt1254207-rd-best"))
+	require.Empty(t, redirectIDfromStreamURL("https://example.com/foo/stream/movie/tt1254207.json"))
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"mime"
+	"net/http"
 	"net/url"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,31 +20,131 @@ import (
 	"github.com/gofiber/fiber/v2"
 	gocache "github.com/patrickmn/go-cache"
 	"go.uber.org/zap"
+	"golang.org/x/oauth2"
 
-	"github.com/deflix-tv/go-debrid/alldebrid"
-	"github.com/deflix-tv/go-debrid/premiumize"
-	"github.com/deflix-tv/go-debrid/realdebrid"
 	"github.com/deflix-tv/go-stremio"
+	"github.com/deflix-tv/go-stremio/pkg/cinemeta"
 	"github.com/deflix-tv/imdb2torrent"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
 )
 
 const (
 	bigBuckBunnyMagnet = `magnet:?xt=urn:btih:dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c&dn=Big+Buck+Bunny&tr=udp%3A%2F%2Fexplodie.org%3A6969&tr=udp%3A%2F%2Ftracker.coppersurfer.tk%3A6969&tr=udp%3A%2F%2Ftracker.empire-js.us%3A1337&tr=udp%3A%2F%2Ftracker.leechers-paradise.org%3A6969&tr=udp%3A%2F%2Ftracker.opentrackr.org%3A1337&tr=wss%3A%2F%2Ftracker.btorrent.xyz&tr=wss%3A%2F%2Ftracker.fastcast.nz&tr=wss%3A%2F%2Ftracker.openwebtorrent.com&ws=https%3A%2F%2Fwebtorrent.io%2Ftorrents%2F&xs=https%3A%2F%2Fwebtorrent.io%2Ftorrents%2Fbig-buck-bunny.torrent`
+	// Timeout for getting the name and size of a stream's video file from the debrid service
+	streamFileInfoTimeout = 10 * time.Second
+	// Suffix of the redirect ID of the stream that goes through the torrents of all qualities, the highest quality first
+	bestRedirectIDsuffix = "-best"
 )
 
+// Info hash at the end of the redirect ID of a stream for a single torrent, like "tt1254207-rd-1080p-dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c"
+var pinnedInfoHashRegex = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+
+// pinnedRedirectID returns the redirect ID of a stream for a single torrent of the quality's torrent list.
+// It contains the info hash instead of an index, so that it points to the same torrent after the torrents were recomputed.
+func pinnedRedirectID(qualityRedirectID, infoHash string) string {
+	return qualityRedirectID + "-" + infoHash
+}
+
+// parsePinnedRedirectID returns the redirect ID of the quality's torrent list and the info hash from a redirect ID that was created by pinnedRedirectID.
+// It returns false for other redirect IDs.
+func parsePinnedRedirectID(redirectID string) (string, string, bool) {
+	dashIndex := strings.LastIndex(redirectID, "-")
+	if dashIndex < 0 || !pinnedInfoHashRegex.MatchString(redirectID[dashIndex+1:]) {
+		return "", "", false
+	}
+	return redirectID[:dashIndex], redirectID[dashIndex+1:], true
+}
+
+// streamBehaviorHints are the "behaviorHints" of a stream item, which go-stremio's StreamItem doesn't support yet.
+// See https://github.com/Stremio/stremio-addon-sdk/blob/master/docs/api/responses/stream.md#additional-properties-to-provide-information--behaviour-flags
+type streamBehaviorHints struct {
+	// Filename of the video file. Stremio uses it for example for finding matching subtitles.
+	Filename string `json:"filename,omitempty"`
+	// Size of the video file in bytes.
+	VideoSize int64 `json:"videoSize,omitempty"`
+}
+
+// streamDiagnostics shows how the torrents of a stream response were sorted into the quality buckets,
+// so that the Deflix frontend and power users can understand why for example only 720p appeared for a title, without access to the logs.
+type streamDiagnostics struct {
+	// Number of found torrents, after applying the user's preferences
+	Found int `json:"found"`
+	// Number of found torrents that are instantly available on the debrid service
+	Available int `json:"available"`
+	// Quality (like "1080p.10bit", same as in the redirect ID) to the torrents that back its stream
+	Qualities map[string]qualityDiagnostics `json:"qualities"`
+}
+
+// qualityDiagnostics are the diagnostics of a single quality bucket.
+type qualityDiagnostics struct {
+	Torrents int `json:"torrents"`
+	// Site to the number of the bucket's torrents that the site found. Multiple sites can find the same torrent.
+	// Empty if the torrents weren't searched in this request, for example on read-only instances.
+	Sites map[string]int `json:"sites,omitempty"`
+}
+
+func newQualityDiagnostics(torrents []imdb2torrent.Result, infoHashSites map[string][]string) qualityDiagnostics {
+	result := qualityDiagnostics{
+		Torrents: len(torrents),
+	}
+	for _, torrent := range torrents {
+		for _, site := range infoHashSites[torrent.InfoHash] {
+			if result.Sites == nil {
+				result.Sites = map[string]int{}
+			}
+			result.Sites[site]++
+		}
+	}
+	return result
+}
+
 // goCacher is a go-cache-compatible interface.
 type goCacher interface {
 	Set(string, interface{}, time.Duration)
 	Get(string) (interface{}, bool)
 }
 
-func createStreamHandler(config config, searchClient *imdb2torrent.Client, rdClient *realdebrid.Client, adClient *alldebrid.Client, pmClient *premiumize.Client, redirectCache goCacher, isTVShow bool, logger *zap.Logger) stremio.StreamHandler {
+func createStreamHandler(config config, searchClient *imdb2torrent.Client, animeSearcher *nyaaClient, statsStore *torrentStatsStore, resolvers debrid.Registry, episodes *episodeClient, redirectCache, streamCache goCacher, availabilityCaches map[string]*creationCache, callLimiter *debridCallLimiter, coverage *searcherCoverage, popularity *popularityStore, recent *recentRequestStore, prefetcher *prefetcher, queuer *downloadQueuer, experiment *experiment, isTVShow bool, logger *zap.Logger) stremio.StreamHandler {
+	streamType := "movie"
+	if isTVShow {
+		streamType = "series"
+	}
+	sitePriority := parseSitePriority(config.SitePriority)
+
+	// checkAvailability returns the info hashes that are instantly available on the debrid service with the given ID.
+	checkAvailability := func(ctx context.Context, debridID, keyOrToken string, infoHashes []string) []string {
+		ctx, span := startSpan(ctx, "availability")
+		span.setAttribute("deflix.debrid", debridID)
+		span.setAttribute("deflix.torrents", strconv.Itoa(len(infoHashes)))
+		defer span.finish(nil)
+		// Availability checks have a lower priority than stream conversions, so when the user's API calls approach the limit, only cached availability data is used.
+		// If all info hashes are cached, the debrid client doesn't make an API call, so there's nothing to count. Otherwise each batch is a call.
+		cachedInfoHashes := getCachedAvailability(requestCreationCache(ctx, availabilityCaches[debridID]), config.CacheAgeXD, infoHashes)
+		if len(cachedInfoHashes) == len(infoHashes) {
+			return cachedInfoHashes
+		} else if !callLimiter.allow(debridID, keyOrToken, debrid.AvailabilityBatches(len(infoHashes)), true) {
+			logger.Info("Debrid API call limit for availability checks reached, only using cached availability", zap.String("debridID", debridID))
+			return cachedInfoHashes
+		}
+		return resolvers[debridID].CheckInstantAvailability(ctx, keyOrToken, infoHashes...)
+	}
+
 	return func(ctx context.Context, id string, userDataIface interface{}) ([]stremio.StreamItem, error) {
+		defer updateDuration(ctx, streamHandlerDuration(streamType), time.Now())
+		logger := requestLogger(ctx, logger)
+		redirectCache, streamCache := requestCache(ctx, redirectCache), requestCache(ctx, streamCache)
+
 		var imdbID string
+		var kitsuID string
 		var season int
 		var episode int
 		var err error
-		if isTVShow {
+		if strings.HasPrefix(id, kitsuIDprefix) {
+			if kitsuID, episode, err = parseKitsuID(id, isTVShow); err != nil {
+				logger.Info("Couldn't parse Kitsu ID", zap.Error(err), zap.String("id", id))
+				return nil, stremio.BadRequest
+			}
+		} else if isTVShow {
 			idParts := strings.Split(id, ":")
 			if len(idParts) != 3 {
 				logger.Info("Stream handler for TV shows called without exactly 3 ID parts", zap.String("id", id))
@@ -59,47 +165,117 @@ func createStreamHandler(config config, searchClient *imdb2torrent.Client, rdCli
 			imdbID = id
 		}
 
+		// The auth middleware already decoded and validated the user data
+		udString, _ := userDataIface.(string)
+		userData, err := userDataFromContext(ctx)
+		if err != nil {
+			logger.Error("Couldn't get user data", zap.Error(err))
+			return nil, err
+		}
+		keyOrToken, err := keyOrTokenFromContext(ctx)
+		if err != nil {
+			logger.Error("Couldn't get debrid API key or token", zap.Error(err))
+			return nil, err
+		}
+		debridID := userData.debridID()
+		userHash := sha256.Sum256([]byte(udString))
+		userHashEncoded := base64.RawURLEncoding.EncodeToString(userHash[:])
+		variant := experiment.variant(userHashEncoded, userData)
+		// The torrent lists in the redirect cache are specific to the debrid service, the user's preferences and the experiment variant
+		redirectIDprefix := id + "-" + debridID + userData.preferencesID() + experimentID(variant)
+
 		var torrents []imdb2torrent.Result
-		if isTVShow {
-			torrents, err = searchClient.FindTVShow(ctx, imdbID, season, episode)
+		var collector *searchCollector
+		if config.ReadOnly {
+			// Read-only instances don't scrape torrent sites. They only use the torrents that another instance found and put into the (shared) redirect cache.
+			torrents = getCachedTorrents(redirectCache, redirectIDprefix, streamQualities, logger)
+		} else if kitsuID != "" || (isTVShow && season == 0) {
+			// Anime with Kitsu IDs or absolute episode numbers (season 0, as used by anime catalogs) can only be searched by title, which only Nyaa does
+			if animeSearcher == nil {
+				logger.Info("Anime search is disabled, because Nyaa isn't configured")
+				return nil, stremio.NotFound
+			}
+			if kitsuID != "" {
+				torrents, err = animeSearcher.FindKitsu(ctx, kitsuID, episode)
+			} else {
+				torrents, err = animeSearcher.FindTVShow(ctx, imdbID, season, episode)
+			}
 		} else {
-			torrents, err = searchClient.FindMovie(ctx, imdbID)
+			collector = newSearchCollector()
+			searchCtx := withValue(ctx, ctxKeySearchCollector, collector)
+			if isTVShow {
+				torrents, err = searchClient.FindTVShow(searchCtx, imdbID, season, episode)
+			} else {
+				torrents, err = searchClient.FindMovie(searchCtx, imdbID)
+			}
+			if err == nil {
+				torrents = collector.merge(torrents, sitePriority)
+			}
+			if err == nil && coverage != nil && telemetryAllowed(ctx) {
+				coverage.record(collector.close())
+			}
 		}
 		if err != nil {
 			logger.Warn("Couldn't find magnets", zap.Error(err))
 			return nil, fmt.Errorf("Couldn't find magnets: %w", err)
-		} else if len(torrents) == 0 {
+		}
+		torrents = applyPreferences(torrents, userData)
+		torrents = applyExperiment(torrents, variant)
+		if len(torrents) == 0 {
 			logger.Info("No magnets found")
 			return nil, stremio.NotFound
 		}
 
-		// Parse userData.
-		// No need to check if the interface is a string or if the decoding worked, because the token middleware does that already.
-		udString := userDataIface.(string)
-		userData, _ := decodeUserData(udString, logger)
+		// Let the diagnostics middleware add the diagnostics to the response, if the client requested them
+		diagnostics, _ := value(ctx, ctxKeyDiagnostics).(*streamDiagnostics)
+		if diagnostics != nil {
+			diagnostics.Found = len(torrents)
+		}
 
 		// Filter out the ones that are not available
 		var infoHashes []string
 		for _, torrent := range torrents {
 			infoHashes = append(infoHashes, torrent.InfoHash)
 		}
-		var debridID string
-		var availableInfoHashes []string
-		keyOrToken := ctx.Value("deflix_keyOrToken").(string)
-		if userData.RDtoken != "" || userData.RDoauth2 != "" {
-			debridID = "rd"
-			availableInfoHashes = rdClient.CheckInstantAvailability(ctx, keyOrToken, infoHashes...)
-		} else if userData.ADkey != "" {
-			debridID = "ad"
-			availableInfoHashes = adClient.CheckInstantAvailability(ctx, keyOrToken, infoHashes...)
-		} else {
-			debridID = "pm"
-			availableInfoHashes = pmClient.CheckInstantAvailability(ctx, keyOrToken, infoHashes...)
+		// Let the availability refresher keep the availability of this movie's or episode's torrents up to date
+		if recent != nil {
+			if err := recent.Set(id, infoHashes); err != nil {
+				logger.Error("Couldn't store recent request", zap.Error(err))
+			}
+		}
+		availableInfoHashes := checkAvailability(ctx, debridID, keyOrToken, infoHashes)
+		// Only the user's primary debrid service is used to check the availability, unless none of the torrents are available there.
+		// Then the streams point to the fallback debrid service, which the redirect handler reads from the redirect ID.
+		if fallbackKeyOrToken := fallbackKeyOrTokenFromContext(ctx); len(availableInfoHashes) == 0 && fallbackKeyOrToken != "" {
+			fallbackID := userData.fallbackDebridID()
+			logger.Info("None of the found torrents are instantly available on the primary debrid service, checking the fallback", zap.String("debridID", debridID), zap.String("fallback", fallbackID))
+			if availableInfoHashes = checkAvailability(ctx, fallbackID, fallbackKeyOrToken, infoHashes); len(availableInfoHashes) > 0 {
+				debridID, keyOrToken = fallbackID, fallbackKeyOrToken
+				redirectIDprefix = id + "-" + debridID + userData.preferencesID() + experimentID(variant)
+			}
 		}
 		if len(availableInfoHashes) == 0 {
-			// TODO: queue for download on the debrid service, or log somewhere for an asynchronous process to go through them and queue them?
 			logger.Info("None of the found torrents are instantly available on the debrid service")
-			return nil, stremio.NotFound
+			if queuer == nil || !userData.QueueDownloads {
+				return nil, stremio.NotFound
+			}
+			// Queue the best torrent for download on the user's debrid service and respond with a placeholder stream.
+			// The placeholder points to the redirect handler like any other stream, so once the debrid service downloaded the torrent, a click on it starts the video.
+			if isTVShow && !episodes.supports(debridID) {
+				if torrents = withoutSeasonPacks(torrents); len(torrents) == 0 {
+					return nil, stremio.NotFound
+				}
+			}
+			torrent := bestTorrent(torrents)
+			redirectID := redirectIDprefix + queuedRedirectIDsuffix
+			redirectCache.Set(redirectID, []imdb2torrent.Result{torrent}, redirectExpiration)
+			queuer.queue(ctx, udString, userData, keyOrToken, redirectID, torrent)
+			stream := createStreamItem(ctx, config, udString, redirectID, torrent.Quality, []imdb2torrent.Result{torrent}, statsStore.lookup(torrent, logger), nil)
+			// The Torrentio format marks it as download in the name
+			if config.StreamFormat != streamFormatTorrentio {
+				stream.Title = "Download started on your debrid service (" + stream.Title + "), try again later"
+			}
+			return []stremio.StreamItem{stream}, nil
 		}
 		// https://github.com/golang/go/wiki/SliceTricks#filter-in-place
 		n := 0
@@ -113,70 +289,396 @@ func createStreamHandler(config config, searchClient *imdb2torrent.Client, rdCli
 			}
 		}
 		torrents = torrents[:n]
+		// On debrid services without episode file selection the largest file of a season pack would be streamed, which is the wrong episode most of the time
+		if isTVShow && !episodes.supports(debridID) {
+			if torrents = withoutSeasonPacks(torrents); len(torrents) == 0 {
+				logger.Info("Only season packs are instantly available, but the debrid service doesn't support selecting the episode's file", zap.String("debridID", debridID))
+				return nil, stremio.NotFound
+			}
+		}
 
 		// Note: The torrents slice is guaranteed to not be empty at this point, because it already contained non-duplicate info hashes and then only unavailable ones were filtered and then a `len(availableInfoHashes) == 0` was done.
 
-		// Separate all torrent results into a 720p, 1080p, 1080p 10bit, 2160p and 2160p 10bit list, so we can offer the user one stream for each quality now (or maybe just for one quality if there's no torrent for the other), cache the torrents for each apiToken-ID-quality combination and later (at the redirect endpoint) go through the respective torrent list to turn it into a streamable video URL via RealDebrid.
-		var torrents720p []imdb2torrent.Result
-		var torrents1080p []imdb2torrent.Result
-		var torrents1080p10bit []imdb2torrent.Result
-		var torrents2160p []imdb2torrent.Result
-		var torrents2160p10bit []imdb2torrent.Result
+		// Separate all torrent results into one list per stream quality (720p, 1080p, 1080p 10bit, 2160p HDR etc.), so we can offer the user one stream for each quality now (or maybe just for one quality if there's no torrent for the others), cache the torrents for each apiToken-ID-quality combination and later (at the redirect endpoint) go through the respective torrent list to turn it into a streamable video URL via RealDebrid.
+		qualityTorrents := map[string][]imdb2torrent.Result{}
 		for _, torrent := range torrents {
-			if strings.HasPrefix(torrent.Quality, "720p") {
-				torrents720p = append(torrents720p, torrent)
-			} else if strings.HasPrefix(torrent.Quality, "1080p") && strings.Contains(torrent.Quality, "10bit") {
-				torrents1080p10bit = append(torrents1080p10bit, torrent)
-			} else if strings.HasPrefix(torrent.Quality, "1080p") {
-				torrents1080p = append(torrents1080p, torrent)
-			} else if strings.HasPrefix(torrent.Quality, "2160p") && strings.Contains(torrent.Quality, "10bit") {
-				torrents2160p10bit = append(torrents2160p10bit, torrent)
-			} else if strings.HasPrefix(torrent.Quality, "2160p") {
-				torrents2160p = append(torrents2160p, torrent)
+			if quality := streamQuality(torrent); quality != "" {
+				qualityTorrents[quality] = append(qualityTorrents[quality], torrent)
 			} else {
 				logger.Warn("Unknown quality, can't sort into one of the torrent lists", zap.String("quality", torrent.Quality))
 			}
 		}
 
+		if diagnostics != nil {
+			var infoHashSites map[string][]string
+			if collector != nil {
+				infoHashSites = collector.sites()
+			}
+			diagnostics.Available = len(torrents)
+			for _, quality := range streamQualities {
+				diagnostics.Qualities[quality] = newQualityDiagnostics(qualityTorrents[quality], infoHashSites)
+			}
+		}
+
 		// Cache results to make this data available in the redirect handler. It will pick the first torrent from the list and convert it via RD / AD / PM, or pick the next if the previous didn't work.
 		// There's no need to cache this for a specific user, but it MUST be cached per debrid service - otherwise during concurrent requests, when a RD user goes to the redirect endpoint it could fetch torrents from the cache which are only available on AD / PM leading to a worse experience for the RD user.
 		// This cache *must* be a cache where items aren't evicted when the cache is full, because otherwise if the cache is full and two users fetch available streams, then the second one could lead to the first cache item being evicted before the first user clicks on the stream, leading to an error inside the redirect handler after he clicks on the stream.
-		redirectCache.Set(id+"-"+debridID+"-720p", torrents720p, redirectExpiration)
-		redirectCache.Set(id+"-"+debridID+"-1080p", torrents1080p, redirectExpiration)
-		redirectCache.Set(id+"-"+debridID+"-1080p.10bit", torrents1080p10bit, redirectExpiration)
-		redirectCache.Set(id+"-"+debridID+"-2160p", torrents2160p, redirectExpiration)
-		redirectCache.Set(id+"-"+debridID+"-2160p.10bit", torrents2160p10bit, redirectExpiration)
+		// Read-only instances don't overwrite the data of the instance that found the torrents.
+		if !config.ReadOnly {
+			for _, quality := range streamQualities {
+				redirectCache.Set(redirectIDprefix+"-"+quality, qualityTorrents[quality], redirectExpiration)
+			}
+		}
 
 		// We already respond with several URLs (one for each quality, as long as we have torrents for the different qualities), but they point to our server for now.
 		// Only when the user clicks on a stream and arrives at our redirect endpoint, we go through the list of torrents for the selected quality and try to convert them into a streamable video URL via RealDebrid.
 		// There it should usually work for the first torrent we try, because we already checked the "instant availability" on RealDebrid here. If the "instant availability" info is stale (because we cached it), the next torrent will be used.
+		// Power users can get multiple streams per quality, one for each of the top torrents, so they can pick a specific release.
+		streamsPerQuality := userData.StreamsPerQuality
+		if streamsPerQuality > config.MaxStreamsPerQuality {
+			streamsPerQuality = config.MaxStreamsPerQuality
+		}
+		var infoHashSites map[string][]string
+		if collector != nil && (streamsPerQuality > 1 || config.StreamFormat == streamFormatTorrentio) {
+			infoHashSites = collector.sites()
+		}
+		// Redirect ID -> torrents of the streams for single torrents
+		pinnedTorrents := map[string][]imdb2torrent.Result{}
 		var streams []stremio.StreamItem
-		if len(torrents720p) > 0 {
-			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-720p", "720p", torrents720p)
-			streams = append(streams, stream)
+		qualityCount := 0
+		for _, quality := range streamQualities {
+			torrentList := qualityTorrents[quality]
+			if len(torrentList) == 0 {
+				continue
+			}
+			qualityCount++
+			// Like "1080p 10bit" or "2160p HDR"
+			qualityTitle := streamQualityTitle(quality)
+			if streamsPerQuality <= 1 {
+				stream := createStreamItem(ctx, config, udString, redirectIDprefix+"-"+quality, qualityTitle, torrentList, statsStore.lookup(torrentList[0], logger), infoHashSites)
+				streams = append(streams, stream)
+				continue
+			}
+			for j, torrent := range torrentList {
+				if j == streamsPerQuality {
+					break
+				}
+				redirectID := pinnedRedirectID(redirectIDprefix+"-"+quality, torrent.InfoHash)
+				stream := createStreamItem(ctx, config, udString, redirectID, qualityTitle, []imdb2torrent.Result{torrent}, statsStore.lookup(torrent, logger), infoHashSites)
+				// The Torrentio format already contains the file name and sites
+				if config.StreamFormat != streamFormatTorrentio {
+					stream.Title += "\n" + torrent.Title
+					if sites := infoHashSites[torrent.InfoHash]; len(sites) > 0 {
+						stream.Title += "\n🔍 " + strings.Join(sites, ", ")
+					}
+				}
+				streams = append(streams, stream)
+				pinnedTorrents[redirectID] = []imdb2torrent.Result{torrent}
+			}
 		}
-		if len(torrents1080p) > 0 {
-			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-1080p", "1080p", torrents1080p)
-			streams = append(streams, stream)
+
+		// The "best" stream goes through the torrents of all qualities, the highest quality first, so users don't have to guess which quality will work.
+		// The redirect handler gets the torrents from the cache items of the single qualities, so there's no need for another one.
+		// It's only useful when there are multiple qualities.
+		var bestTorrents []imdb2torrent.Result
+		if qualityCount > 1 {
+			for _, quality := range bestQualities {
+				bestTorrents = append(bestTorrents, qualityTorrents[quality]...)
+			}
+			stream := createStreamItem(ctx, config, udString, redirectIDprefix+bestRedirectIDsuffix, "⚡ Best", bestTorrents, statsStore.lookup(bestTorrents[0], logger), infoHashSites)
+			streams = append([]stremio.StreamItem{stream}, streams...)
 		}
-		if len(torrents1080p10bit) > 0 {
-			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-1080p.10bit", "1080p 10bit", torrents1080p10bit)
-			streams = append(streams, stream)
+
+		// Let the stream hints middleware add the filename and video size to the stream items, which helps players with displaying the file info and with buffering.
+		if streamHints, ok := value(ctx, ctxKeyStreamHints).(map[string]streamBehaviorHints); ok {
+			redirectIDs := []string{redirectIDprefix + bestRedirectIDsuffix}
+			torrentLists := [][]imdb2torrent.Result{bestTorrents}
+			for _, quality := range streamQualities {
+				redirectIDs = append(redirectIDs, redirectIDprefix+"-"+quality)
+				torrentLists = append(torrentLists, qualityTorrents[quality])
+			}
+			for redirectID, torrentList := range pinnedTorrents {
+				redirectIDs = append(redirectIDs, redirectID)
+				torrentLists = append(torrentLists, torrentList)
+			}
+			for i, redirectID := range redirectIDs {
+				if len(torrentLists[i]) == 0 {
+					continue
+				}
+				hints := createStreamHints(streamCache, userHashEncoded+"-"+url.PathEscape(redirectID), torrentLists[i])
+				if hints != (streamBehaviorHints{}) {
+					streamHints[config.BaseURL+"/"+udString+"/redirect/"+url.PathEscape(redirectID)] = hints
+				}
+			}
 		}
-		if len(torrents2160p) > 0 {
-			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-2160p", "2160p", torrents2160p)
-			streams = append(streams, stream)
+
+		// Prefetch the top torrent of the highest quality, so that the user's click on it is served instantly
+		// Not when the redirect handler recomputes the torrents, because the user already clicked on a stream and it's not a new request for the movie or episode.
+		recomputation, _ := value(ctx, ctxKeyRecomputation).(bool)
+		if prefetcher != nil && !recomputation {
+			for _, quality := range bestQualities {
+				if torrentList := qualityTorrents[quality]; len(torrentList) > 0 {
+					prefetcher.prefetch(ctx, udString, userData, keyOrToken, redirectIDprefix+"-"+quality, torrentList[0])
+					break
+				}
+			}
 		}
-		if len(torrents2160p10bit) > 0 {
-			stream := createStreamItem(ctx, config, udString, id+"-"+debridID+"-2160p.10bit", "2160p 10bit", torrents2160p10bit)
-			streams = append(streams, stream)
+
+		// Count the request for the "Popular on Deflix" catalog.
+		// Only requests with instantly available streams are counted, so that the catalog only contains content that can be watched right away.
+		// The catalog only supports IMDb IDs.
+		// Like all usage statistics only if telemetry is allowed for the request.
+		if popularity != nil && len(streams) > 0 && !recomputation && imdbID != "" && telemetryAllowed(ctx) {
+			if err := popularity.Increment(streamType, imdbID); err != nil {
+				logger.Error("Couldn't increment popularity counter", zap.Error(err), zap.String("imdbID", imdbID))
+			}
 		}
 
 		return streams, nil
 	}
 }
 
-func createStreamItem(ctx context.Context, config config, encodedUserData string, redirectID, quality string, torrents []imdb2torrent.Result) stremio.StreamItem {
+// createCatalogHandler creates a handler for the "Popular on Deflix" catalog, which lists the most requested movies or TV shows for which instantly available streams were found,
+// and for the language catalogs, which list the ones of those that are in one of the given languages (ISO 639-1 codes).
+// The language is taken from the metadata of the languageMetaFetcher, because not all metadata sources contain it.
+// The catalogs are cached in memory, so that the metadata doesn't have to be fetched for every request.
+func createCatalogHandler(popularity *popularityStore, metaFetcher, languageMetaFetcher stremio.MetaFetcher, languages []string, isTVShow bool, logger *zap.Logger) stremio.CatalogHandler {
+	streamType := "movie"
+	if isTVShow {
+		streamType = "series"
+	}
+
+	// Catalog ID -> language name in the metadata, empty for the "Popular on Deflix" catalog
+	catalogLanguageNames := map[string]string{popularCatalogID: ""}
+	for _, code := range languages {
+		catalogLanguageNames[languageCatalogID(code)] = catalogLanguages[code]
+	}
+
+	type cachedCatalog struct {
+		metas   []stremio.MetaPreviewItem
+		created time.Time
+	}
+	catalogs := map[string]cachedCatalog{}
+	lock := sync.Mutex{}
+
+	return func(ctx context.Context, id string, _ interface{}) ([]stremio.MetaPreviewItem, error) {
+		language, ok := catalogLanguageNames[id]
+		if !ok {
+			return nil, stremio.NotFound
+		}
+
+		// Only one request fetches the metadata, the others wait for it and then use the cached catalog
+		lock.Lock()
+		defer lock.Unlock()
+		if catalog, ok := catalogs[id]; ok && time.Since(catalog.created) < catalogCacheAge {
+			return catalog.metas, nil
+		}
+
+		n := catalogSize
+		fetcher := metaFetcher
+		if language != "" {
+			n *= languageCatalogCandidates
+			fetcher = languageMetaFetcher
+		}
+		items, err := popularity.Top(streamType, n)
+		if err != nil {
+			logger.Error("Couldn't get most requested IMDb IDs", zap.Error(err), zap.String("type", streamType))
+			return nil, fmt.Errorf("Couldn't get most requested IMDb IDs: %w", err)
+		}
+		result := make([]stremio.MetaPreviewItem, 0, catalogSize)
+		for _, item := range items {
+			if len(result) == catalogSize {
+				break
+			}
+			var meta cinemeta.Meta
+			if isTVShow {
+				meta, err = fetcher.GetTVShow(ctx, item.IMDbID, 1, 1)
+			} else {
+				meta, err = fetcher.GetMovie(ctx, item.IMDbID)
+			}
+			if err != nil || meta.Name == "" {
+				logger.Warn("Couldn't get meta for catalog item, skipping it", zap.Error(err), zap.String("imdbID", item.IMDbID))
+				continue
+			}
+			if language != "" && !hasLanguage(meta.Language, language) {
+				continue
+			}
+			poster := meta.Poster
+			if poster == "" {
+				poster = "https://images.metahub.space/poster/medium/" + item.IMDbID + "/img"
+			}
+			result = append(result, stremio.MetaPreviewItem{
+				ID:          item.IMDbID,
+				Type:        streamType,
+				Name:        meta.Name,
+				Poster:      poster,
+				ReleaseInfo: meta.ReleaseInfo,
+				IMDbRating:  meta.IMDbRating,
+				Genres:      meta.Genres,
+				Description: meta.Description,
+			})
+		}
+		catalogs[id] = cachedCatalog{
+			metas:   result,
+			created: time.Now(),
+		}
+
+		return result, nil
+	}
+}
+
+// createStreamHints creates the behavior hints for the stream item of a list of torrents.
+// If the user previously clicked on the stream, the filename and size of the converted stream's video file are used, which let Stremio find matching subtitles.
+// Otherwise the torrent's metadata is used, but only if there's exactly one torrent, because with multiple torrents we don't know which one will be converted in the redirect handler.
+func createStreamHints(streamCache goCacher, streamCacheID string, torrents []imdb2torrent.Result) streamBehaviorHints {
+	var hints streamBehaviorHints
+	if len(torrents) == 1 {
+		hints = hintsFromMagnet(torrents[0].MagnetURL)
+	}
+	if streamURLiface, found := streamCache.Get(streamCacheID); found {
+		if streamURLitem, ok := streamURLiface.(cacheItem); ok && streamURLitem.Value != "" {
+			filename := streamURLitem.Filename
+			if filename == "" {
+				filename = filenameFromStreamURL(streamURLitem.Value)
+			}
+			if filename != "" {
+				// The size from the magnet might belong to the whole torrent and not the converted file.
+				hints = streamBehaviorHints{
+					Filename:  filename,
+					VideoSize: streamURLitem.Size,
+				}
+			}
+		}
+	}
+	return hints
+}
+
+// fillStreamFileInfo adds the name and size of the video file to the stream cache item, which debrid services send in the response headers for the stream URL.
+// It's meant to be run in the background after a conversion, so that the player doesn't have to wait for the additional request.
+// The next stream response then contains them as behavior hints.
+func fillStreamFileInfo(streamCache goCacher, streamCacheID string, item cacheItem, logger *zap.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), streamFileInfoTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", item.Value, nil)
+	if err != nil {
+		logger.Warn("Couldn't create HEAD request for stream file info", zap.Error(err))
+		return
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Info("Couldn't get stream file info", zap.Error(err))
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		logger.Info("Bad HEAD response for stream file info", zap.Int("status", res.StatusCode))
+		return
+	}
+	if res.ContentLength > 0 {
+		item.Size = res.ContentLength
+	}
+	if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		item.Filename = params["filename"]
+	}
+	streamCache.Set(streamCacheID, item, streamExpiration)
+}
+
+// formatSize formats a size in bytes for humans, like "4.2 GB" or "700 MB".
+func formatSize(size int64) string {
+	if size >= 1000*1000*1000 {
+		return strconv.FormatFloat(float64(size)/(1000*1000*1000), 'f', 1, 64) + " GB"
+	}
+	return strconv.FormatInt(size/(1000*1000), 10) + " MB"
+}
+
+// hintsFromMagnet returns the behavior hints that can be derived from a magnet URL.
+// The "dn" (display name) parameter is used as filename and the "xl" (exact length) parameter as video size.
+// The latter is rarely set by torrent sites.
+func hintsFromMagnet(magnetURL string) streamBehaviorHints {
+	var hints streamBehaviorHints
+	params := magnetParams(magnetURL)
+	hints.Filename = params.Get("dn")
+	if xl := params.Get("xl"); xl != "" {
+		if size, err := strconv.ParseInt(xl, 10, 64); err == nil && size > 0 {
+			hints.VideoSize = size
+		}
+	}
+	return hints
+}
+
+// magnetParams returns the parameters of a magnet URL, like "dn" and "tr". It returns nil if the URL is invalid.
+func magnetParams(magnetURL string) url.Values {
+	magnet, err := url.Parse(magnetURL)
+	if err != nil {
+		return nil
+	}
+	// Magnet URLs are opaque URLs, so the query is not in RawQuery.
+	query := magnet.RawQuery
+	if query == "" {
+		query = strings.TrimPrefix(magnet.Opaque, "?")
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil
+	}
+	return params
+}
+
+// filenameFromStreamURL returns the filename of a RealDebrid, AllDebrid, Premiumize, Debrid-Link or Torbox stream URL, which is the last path element for all of them.
+func filenameFromStreamURL(streamURL string) string {
+	u, err := url.Parse(streamURL)
+	if err != nil || u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return ""
+	}
+	return path.Base(u.Path)
+}
+
+// getCachedTorrents returns the torrents of the given qualities that were previously put into the redirect cache by a stream handler for the given redirect ID prefix (ID, debrid service and preferences).
+// The torrents are in the order of the qualities.
+func getCachedTorrents(redirectCache goCacher, redirectIDprefix string, qualities []string, logger *zap.Logger) []imdb2torrent.Result {
+	var torrents []imdb2torrent.Result
+	for _, quality := range qualities {
+		redirectID := redirectIDprefix + "-" + quality
+		torrentsIface, found := redirectCache.Get(redirectID)
+		if !found {
+			continue
+		}
+		qualityTorrents, ok := torrentsIface.([]imdb2torrent.Result)
+		if !ok {
+			logger.Error("Torrents cache item couldn't be cast into []imdb2torrent.Result", zap.String("cacheItemType", fmt.Sprintf("%T", torrentsIface)), zap.String("redirectID", redirectID))
+			continue
+		}
+		torrents = append(torrents, qualityTorrents...)
+	}
+	return torrents
+}
+
+// createStreamItem creates a stream item for the redirect ID. The title depends on the configured stream format.
+// stats are the ones of the first torrent. infoHashSites contains the sites that found each torrent and can be nil.
+func createStreamItem(ctx context.Context, config config, encodedUserData string, redirectID, quality string, torrents []imdb2torrent.Result, stats torrentStats, infoHashSites map[string][]string) stremio.StreamItem {
+	// We can only set the exact quality string if there's only one torrent.
+	// Otherwise maybe the upcoming RealDebrid conversion fails for one torrent, but works for the next, which has a slightly different quality string.
+	if len(torrents) == 1 {
+		quality = torrents[0].Quality
+	}
+	var name string
+	if config.StreamFormat == streamFormatTorrentio {
+		name, quality = torrentioStream(debridIDfromRedirectID(redirectID), quality, strings.HasSuffix(redirectID, queuedRedirectIDsuffix), torrents, stats, infoHashSites)
+	} else if details := formatTorrentStats(stats); details != "" {
+		// The size and seeders of the torrent that's tried first, so users can distinguish between a small re-encode and a big remux, and see how well it's seeded.
+		// They're only known if the torrent site reported them, like "1080p | 4.2 GB | 1200 seeders".
+		quality += " | " + details
+	}
+	// The video formats and languages are only known for sure for single torrents
+	if config.StreamFormat != streamFormatTorrentio && len(torrents) == 1 {
+		if labels := videoFormatLabels(torrents[0]); labels != "" {
+			quality += " | " + labels
+		}
+		if flags := languageFlags(torrents[0]); flags != "" {
+			quality += " | " + flags
+		}
+	}
+
 	// Path escaping required for TV shows, which contain ":"
 	redirectID = url.PathEscape(redirectID)
 	stream := stremio.StreamItem{
@@ -185,10 +687,9 @@ func createStreamItem(ctx context.Context, config config, encodedUserData string
 		// See https://github.com/Stremio/stremio-addon-sdk/blob/ddaa3b80def8a44e553349734dd02ec9c3fea52c/docs/api/responses/stream.md#additional-properties-to-provide-information--behaviour-flags
 		Title: quality,
 	}
-	// We can only set the exact quality string if there's only one torrent.
-	// Otherwise maybe the upcoming RealDebrid conversion fails for one torrent, but works for the next, which has a slightly different quality string.
-	if len(torrents) == 1 {
-		stream.Title = torrents[0].Quality
+	// go-stremio's stream item has no name, so the stream hints middleware adds it
+	if streamNames, ok := value(ctx, ctxKeyStreamNames).(map[string]string); ok && name != "" {
+		streamNames[stream.URL] = name
 	}
 
 	// Create and assign lock object.
@@ -202,16 +703,67 @@ func createStreamItem(ctx context.Context, config config, encodedUserData string
 	return stream
 }
 
-func createRedirectHandler(redirectCache, streamCache goCacher, rdClient *realdebrid.Client, adClient *alldebrid.Client, pmClient *premiumize.Client, forwardOriginIP bool, logger *zap.Logger) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		logger.Debug("redirectHandler called", zap.String("request", fmt.Sprintf("%+v", c.Request())))
+// Errors of the stream resolver, which the callers translate into responses
+var (
+	errRedirectExpired = errors.New("no torrents found for the redirect ID")
+	errNoStream        = errors.New("couldn't convert any of the torrents into a stream")
+	errCallLimit       = errors.New("debrid API call limit reached")
+)
 
-		udString := c.Params("userData")
-		redirectID := c.Params("id", "")
-		if redirectID == "" {
-			return c.SendStatus(fiber.StatusNotFound)
-		}
+// streamResolver converts the torrents for the redirect ID into a debrid HTTP stream URL, or returns the one that was previously converted for the user.
+// The context must contain the values that the auth middleware sets. rdRemoteOverride overrides the user's "rdRemote" option if it's not nil.
+type streamResolver func(ctx context.Context, udString, redirectID string, rdRemoteOverride *bool) (string, error)
+
+// userStreamCacheID returns the ID of the stream cache item for the user's stream, as well as the user hash that it contains.
+// Because the actual stream URLs are cached, it MUST be user-specific! No need to use the full userData string though - we just hash it and use that as "user identifier".
+func userStreamCacheID(udString, redirectID string, rdRemoteOverride *bool) (id, userHashEncoded string) {
+	userHash := sha256.Sum256([]byte(udString))
+	userHashEncoded = base64.RawURLEncoding.EncodeToString(userHash[:])
+	id = userHashEncoded + "-" + redirectID
+	// A stream that was converted with remote traffic must not be used for a request without it, and vice versa
+	if rdRemoteOverride != nil {
+		id += "-remote." + strconv.FormatBool(*rdRemoteOverride)
+	}
+	return id, userHashEncoded
+}
+
+func createStreamResolver(redirectCache, streamCache goCacher, streamHandlers map[string]stremio.StreamHandler, resolvers debrid.Registry, availabilityCaches map[string]*creationCache, callLimiter *debridCallLimiter, experiment *experiment, locker *redisLocker, audit *auditLog, analytics *analyticsStore, webhook *webhookNotifier, maxTorrentsToTry int, readOnly, raceRD bool, logger *zap.Logger) streamResolver {
+	return func(ctx context.Context, udString, redirectID string, rdRemoteOverride *bool) (string, error) {
+		start := time.Now()
+		logger := requestLogger(ctx, logger)
+		redirectCache, streamCache := requestCache(ctx, redirectCache), requestCache(ctx, streamCache)
 		zapFieldRedirectID := zap.String("redirectID", redirectID)
+		// Only conversions are recorded, because responses from the stream cache are the same stream again
+		recordAnalytics := func(userHashEncoded, debridID string, success bool) {
+			if analytics == nil || !telemetryAllowed(ctx) {
+				return
+			}
+			streamID := streamIDfromRedirectID(redirectID)
+			streamType := "movie"
+			if isTVShowID(streamID) {
+				streamType = "series"
+			}
+			entry := analyticsEntry{
+				Time:          time.Now(),
+				User:          userHashEncoded,
+				StreamID:      streamID,
+				Type:          streamType,
+				Quality:       qualityFromRedirectID(redirectID),
+				Provider:      debridID,
+				Success:       success,
+				LatencyMillis: time.Since(start).Milliseconds(),
+			}
+			if err := analytics.record(entry); err != nil {
+				logger.Error("Couldn't record analytics entry", zap.Error(err), zapFieldRedirectID)
+			}
+		}
+
+		// The stream cache is checked first (after locking, see below).
+		// Here we don't get the data that's passed from the stream handler to the redirect handler, but instead the the RD / AD / PM HTTP stream URL, which is cached after it was converted in a previous call.
+		// This cache is important, because for a single click on a stream in Stremio there are multiple requests to the redirect endpoint in a short timeframe.
+		// This cache is also useful for when a user resumes his stream via Stremio after closing it. In this case the same RealDebrid HTTP stream must be delivered (or even if it would work with another one, using the same one would be beneficial).
+		// TODO: Regarding stream resuming: We don't know how long RD / AD / PM HTTP stream URLs are valid. If it's shorter, we can shorten this as well. Also see similar TODO comment in main.go file.
+		streamCacheID, userHashEncoded := userStreamCacheID(udString, redirectID, rdRemoteOverride)
 
 		// Before we look into the cache, we need to set a lock so that concurrent calls to this endpoint (including the redirectID) don't unnecessarily lead to the full sharade of RD requests again, only because the first handling of the request wasn't fast enough to fill the cache.
 		// The lock objects are created in the stream handler. But if the service was restarted the map is empty. So we need to create lock objects in that case for the users arriving at the redirect handler without having been at the stream handler after a service restart.
@@ -222,16 +774,18 @@ func createRedirectHandler(redirectCache, streamCache goCacher, rdClient *realde
 		redirectLockMapLock.Unlock()
 		redirectLock[redirectID].Lock()
 		defer redirectLock[redirectID].Unlock()
+		// The in-process lock only covers this node. When multiple nodes share Redis, the lock must be held across all of them.
+		// The locks are also held while waiting for RealDebrid to download a torrent (up to maxRDwaitBudget), because concurrent requests would add the torrent again.
+		if locker != nil {
+			unlock, err := locker.lock(ctx, redirectID)
+			if err != nil {
+				// Without the lock there might be unnecessary debrid API calls, which is still better than failing
+				logger.Warn("Couldn't acquire distributed redirect lock", zap.Error(err), zapFieldRedirectID)
+			} else {
+				defer unlock()
+			}
+		}
 
-		// Check stream cache first.
-		// Here we don't get the data that's passed from the stream handler to this redirect handler, but instead the the RD / AD / PM HTTP stream URL, which is cached after it was converted in a previous call.
-		// This cache is important, because for a single click on a stream in Stremio there are multiple requests to this endpoint in a short timeframe.
-		// This cache is also useful for when a user resumes his stream via Stremio after closing it. In this case the same RealDebrid HTTP stream must be delivered (or even if it would work with another one, using the same one would be beneficial).
-		// Because the actual stream URLs are cached here, it MUST be user-specific! No need to use the full userData string though - we just hash it and use that as "user identifier".
-		// TODO: Regarding stream resuming: We don't know how long RD / AD / PM HTTP stream URLs are valid. If it's shorter, we can shorten this as well. Also see similar TODO comment in main.go file.
-		userHash := sha256.Sum256([]byte(udString))
-		userHashEncoded := base64.RawURLEncoding.EncodeToString(userHash[:])
-		streamCacheID := userHashEncoded + "-" + redirectID
 		if streamURLiface, found := streamCache.Get(streamCacheID); found {
 			logger.Debug("Hit stream cache", zapFieldRedirectID)
 			if streamURLitem, ok := streamURLiface.(cacheItem); !ok {
@@ -240,48 +794,158 @@ func createRedirectHandler(redirectCache, streamCache goCacher, rdClient *realde
 				logger.Warn("The torrents for this stream where previously tried to be converted into a stream but it didn't work. This was more than one minute ago though, so we'll try again.", zapFieldRedirectID)
 			} else if len(streamURLitem.Value) == 0 {
 				logger.Warn("The torrents for this stream where previously tried to be converted into a stream but it didn't work", zapFieldRedirectID)
-				return c.SendStatus(fiber.StatusNotFound)
+				return "", errNoStream
 			} else {
-				logger.Debug("Responding with redirect to stream", zap.String("redirectLocation", streamURLitem.Value), zapFieldRedirectID)
-				c.Set("Location", streamURLitem.Value)
-				return c.SendStatus(fiber.StatusMovedPermanently)
+				return streamURLitem.Value, nil
 			}
 		}
 
+		// Read-only instances don't convert torrents into streams, because that requires adding torrents to the user's debrid account.
+		if readOnly {
+			logger.Info("No stream cache item found, but instance is read-only", zapFieldRedirectID)
+			return "", errNoStream
+		}
+
 		// Here we get the data from the cache that the stream handler filled.
-		torrentsIface, found := redirectCache.Get(redirectID)
+		// For the "best" stream it's the torrents of all qualities, the highest quality first.
+		// For the stream of a single torrent it's that torrent from the cached torrents of its quality.
+		getTorrents := func() (interface{}, bool) {
+			if qualityRedirectID, infoHash, ok := parsePinnedRedirectID(redirectID); ok {
+				torrentsIface, found := redirectCache.Get(qualityRedirectID)
+				if torrents, ok := torrentsIface.([]imdb2torrent.Result); found && ok {
+					for _, torrent := range torrents {
+						if torrent.InfoHash == infoHash {
+							return []imdb2torrent.Result{torrent}, true
+						}
+					}
+				}
+				return nil, false
+			}
+			if !strings.HasSuffix(redirectID, bestRedirectIDsuffix) {
+				return redirectCache.Get(redirectID)
+			}
+			bestTorrents := getCachedTorrents(redirectCache, strings.TrimSuffix(redirectID, bestRedirectIDsuffix), bestQualities, logger)
+			return bestTorrents, len(bestTorrents) > 0
+		}
+		torrentsIface, found := getTorrents()
 		if !found {
-			logger.Warn("No torrents cache item found, did 24h pass?", zapFieldRedirectID)
-			// TODO: Just run the same stuff the stream handler does! This way we can drastically reduce the required cache time for the redirect cache, and the scraping doesn't really take long! Take care of concurrent requests - maybe lock!
-			return c.SendStatus(fiber.StatusNotFound)
+			// For example when a user resumes a stream after the redirect cache item expired.
+			// The stream handler finds the torrents and checks their availability again and fills the redirect cache.
+			// Concurrent requests for the same redirect ID wait for the lock that's held here.
+			logger.Info("No torrents cache item found, recomputing torrents", zapFieldRedirectID)
+			if recomputeTorrents(ctx, streamHandlers, udString, redirectID, logger) {
+				torrentsIface, found = getTorrents()
+			}
+		}
+		if !found {
+			logger.Warn("No torrents cache item found after recomputing torrents", zapFieldRedirectID)
+			recordAnalytics(userHashEncoded, debridIDfromRedirectID(redirectID), false)
+			return "", errRedirectExpired
 		}
 		torrents, ok := torrentsIface.([]imdb2torrent.Result)
 		if !ok {
-			logger.Error("Torrents cache item couldn't be cast into []imdb2torrent.Result", zap.String("cacheItemType", fmt.Sprintf("%T", torrentsIface)), zapFieldRedirectID)
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return "", fmt.Errorf("torrents cache item couldn't be cast into []imdb2torrent.Result, but is %T", torrentsIface)
 		}
-		// Parse userData.
-		// No need to check if decoding worked, because the token middleware does that already.
-		userData, _ := decodeUserData(udString, logger)
-		var streamURL string
-		var err error
-		keyOrToken := c.Locals("deflix_keyOrToken").(string)
-		if forwardOriginIP && len(c.IPs()) > 0 {
-			c.Locals("debrid_originIP", c.IPs()[0])
+		// The auth middleware already decoded and validated the user data
+		userData, err := userDataFromContext(ctx)
+		if err != nil {
+			return "", fmt.Errorf("couldn't get user data: %w", err)
 		}
-		for _, torrent := range torrents {
-			if userData.RDtoken != "" || userData.RDoauth2 != "" {
-				streamURL, err = rdClient.GetStreamURL(c.Context(), torrent.MagnetURL, keyOrToken, userData.RDremote)
-			} else if userData.ADkey != "" {
-				streamURL, err = adClient.GetStreamURL(c.Context(), torrent.MagnetURL, keyOrToken)
-			} else {
-				streamURL, err = pmClient.GetStreamURL(c.Context(), torrent.MagnetURL, keyOrToken)
+		keyOrToken, err := keyOrTokenFromContext(ctx)
+		if err != nil {
+			return "", fmt.Errorf("couldn't get debrid API key or token: %w", err)
+		}
+		debridID := userData.debridID()
+		fallbackID := userData.fallbackDebridID()
+		fallbackKeyOrToken := fallbackKeyOrTokenFromContext(ctx)
+		// The stream handler only points to the fallback debrid service when none of the torrents were instantly available on the primary one.
+		// There's no need to try the primary one then.
+		if fallbackKeyOrToken != "" && debridIDfromRedirectID(redirectID) == fallbackID {
+			debridID, keyOrToken = fallbackID, fallbackKeyOrToken
+			fallbackKeyOrToken = ""
+		}
+		rdRemote := userData.RDremote
+		if rdRemoteOverride != nil {
+			rdRemote = *rdRemoteOverride
+		}
+		if maxTorrentsToTry > 0 && len(torrents) > maxTorrentsToTry {
+			torrents = torrents[:maxTorrentsToTry]
+		}
+		// For season packs the episode's file must be selected
+		season, episode := seasonEpisodeFromStreamID(streamIDfromRedirectID(redirectID))
+		// Set when a RealDebrid torrent is still downloading. Concurrent conversions in race mode can set it.
+		var stillDownloading *stillDownloadingError
+		var stillDownloadingLock sync.Mutex
+		// convertTorrents converts the torrents via the debrid service with the given ID until one conversion succeeds.
+		// It returns false if the user's debrid API call limit was reached before that.
+		convertTorrents := func(debridID, keyOrToken string) (string, bool) {
+			ctx := ctx
+			// In race mode two torrents are converted at the same time
+			batchSize := 1
+			if debridID == "rd" {
+				if raceRD {
+					batchSize = 2
+				}
+				// All torrents are checked for reuse against the same torrent list
+				ctx = withRDtorrentList(ctx, callLimiter, keyOrToken, false)
+				ctx = withRDpolling(ctx, callLimiter, keyOrToken, false)
 			}
-			if err != nil {
-				logger.Warn("Couldn't get stream URL", zap.Error(err), zapFieldRedirectID)
-			} else {
-				break
+			var streamURL string
+			for i := 0; i < len(torrents) && streamURL == ""; i += batchSize {
+				batch := torrents[i:]
+				if len(batch) > batchSize {
+					batch = batch[:batchSize]
+				}
+				for range batch {
+					if !callLimiter.allow(debridID, keyOrToken, conversionCalls[debridID], false) {
+						logger.Warn("Debrid API call limit reached, not converting torrent", zap.String("debridID", debridID), zapFieldRedirectID)
+						return "", false
+					}
+				}
+				streamURL = convertFirst(ctx, batch, func(ctx context.Context, torrent imdb2torrent.Result) (string, error) {
+					streamURL, err := convertTorrent(ctx, resolvers, debridID, torrent, season, episode, keyOrToken, rdRemote)
+					audit.record(userHashEncoded, redirectID, torrent.InfoHash, debridID, "redirect", err == nil)
+					if err != nil {
+						logger.Warn("Couldn't get stream URL", zap.Error(err), zap.String("infoHash", torrent.InfoHash), zapFieldRedirectID)
+						var downloadingErr *stillDownloadingError
+						if errors.As(err, &downloadingErr) {
+							stillDownloadingLock.Lock()
+							stillDownloading = downloadingErr
+							stillDownloadingLock.Unlock()
+						}
+						// The torrent was only tried because it was (or was cached as) instantly available.
+						// Invalidate the availability so that subsequent stream requests don't keep advertising it based on the stale cache item.
+						// Not when the request or the conversion was canceled (because another one won the race), because then the conversion didn't fail due to the torrent.
+						// Placeholder streams for queued downloads weren't available in the first place.
+						if ctx.Err() == nil && !strings.HasSuffix(redirectID, queuedRedirectIDsuffix) {
+							availabilityCaches[debridID].Delete(torrent.InfoHash)
+							incCounter(ctx, availabilityFalsePositives(debridID))
+							logger.Info("Invalidated instant availability of torrent that couldn't be converted", zap.String("infoHash", torrent.InfoHash), zap.String("debridID", debridID), zapFieldRedirectID)
+						}
+					}
+					return streamURL, err
+				})
 			}
+			return streamURL, true
+		}
+		streamURL, allowed := convertTorrents(debridID, keyOrToken)
+		// The fallback debrid service might have the torrents as well, even if it wasn't used for the availability check
+		if streamURL == "" && fallbackKeyOrToken != "" {
+			logger.Info("Couldn't convert torrents via the primary debrid service, trying the fallback", zap.String("debridID", debridID), zap.String("fallback", fallbackID), zapFieldRedirectID)
+			debridID = fallbackID
+			streamURL, allowed = convertTorrents(fallbackID, fallbackKeyOrToken)
+		}
+		recordAnalytics(userHashEncoded, debridID, streamURL != "")
+		if !allowed && streamURL == "" {
+			return "", errCallLimit
+		}
+		// Not cached, so that the next request gets the stream when the download finished
+		if streamURL == "" && stillDownloading != nil {
+			return "", stillDownloading
+		}
+		// All torrents were tried, so the user hit a dead end
+		if streamURL == "" {
+			webhook.notifyFailedConversion(redirectID, debridID, len(torrents))
 		}
 
 		// Fill cache, even if no actual video stream was found, because it seems to be the current state on RealDebrid
@@ -290,137 +954,572 @@ func createRedirectHandler(redirectCache, streamCache goCacher, rdClient *realde
 			Created: time.Now(),
 		}
 		streamCache.Set(streamCacheID, streamURLitem, streamExpiration)
+		if streamURL != "" {
+			go fillStreamFileInfo(streamCache, streamCacheID, streamURLitem, logger)
+		}
+
+		// Record the outcome for the user's experiment variant.
+		// Only for conversions, because responses from the stream cache don't depend on the torrent order.
+		if variant := experiment.variant(userHashEncoded, userData); variant != "" {
+			if streamURL == "" {
+				incCounter(ctx, experimentConversions(variant, "failure"))
+			} else {
+				incCounter(ctx, experimentConversions(variant, "success"))
+				updateDuration(ctx, experimentTimeToStream(variant), start)
+			}
+		}
 
 		if streamURL == "" {
+			return "", errNoStream
+		}
+		return streamURL, nil
+	}
+}
+
+func createRedirectHandler(resolve streamResolver, streamCache goCacher, proxy *streamProxy, forwardOriginIP bool, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		defer updateDuration(c.Context(), redirectHandlerDuration, start)
+		logger := requestLogger(c.Context(), logger)
+		streamCache := requestCache(c.Context(), streamCache)
+
+		udString := c.Params("userData")
+		redirectID := c.Params("id", "")
+		// Not the whole request, because the URL contains the user data with the API key or token
+		logger.Debug("redirectHandler called", zap.String("redirectID", redirectID))
+		if redirectID == "" {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		zapFieldRedirectID := zap.String("redirectID", redirectID)
+		sendStream := func(c *fiber.Ctx, streamURL string) error {
+			if proxy != nil {
+				logger.Debug("Responding with proxied stream", zap.String("streamURL", streamURL), zapFieldRedirectID)
+				return proxy.serve(c, streamURL)
+			}
+			logger.Debug("Responding with redirect to stream", zap.String("redirectLocation", streamURL), zapFieldRedirectID)
+			c.Set("Location", streamURL)
+			return c.SendStatus(fiber.StatusMovedPermanently)
+		}
+		// Advanced users can override their "rdRemote" option per request, for example to save remote traffic for a single stream
+		var rdRemoteOverride *bool
+		if remoteQuery := c.Query("remote", ""); remoteQuery != "" {
+			rdRemote, err := strconv.ParseBool(remoteQuery)
+			if err != nil {
+				logger.Info("Redirect handler called with invalid \"remote\" value", zap.String("remote", remoteQuery), zapFieldRedirectID)
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+			rdRemoteOverride = &rdRemote
+		}
+		// And the time to wait for RealDebrid torrents that aren't instantly available, for example to wait longer for a torrent they know is being downloaded
+		if waitQuery := c.Query("wait", ""); waitQuery != "" {
+			waitBudget, err := time.ParseDuration(waitQuery)
+			if err != nil || waitBudget < 0 || waitBudget > maxRDwaitBudget {
+				logger.Info("Redirect handler called with invalid \"wait\" value", zap.String("wait", waitQuery), zapFieldRedirectID)
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+			setLocal(c, ctxKeyRDwaitBudget, waitBudget)
+		}
+
+		// Stremio sends a HEAD request before the GET when a user clicks on a stream.
+		// Converting the torrent takes several debrid API calls, so that's only done for the GET, and the HEAD is answered right away.
+		// Only if the stream is already cached, the HEAD is handled like a GET, so that the player gets the actual headers.
+		if c.Method() == fiber.MethodHead {
+			streamCacheID, _ := userStreamCacheID(udString, redirectID, rdRemoteOverride)
+			if streamURLiface, found := streamCache.Get(streamCacheID); found {
+				if streamURLitem, ok := streamURLiface.(cacheItem); ok && len(streamURLitem.Value) > 0 {
+					return sendStream(c, streamURLitem.Value)
+				}
+			}
+			logger.Debug("Responding to HEAD request without converting torrent", zapFieldRedirectID)
+			c.Set(fiber.HeaderAcceptRanges, "bytes")
+			return c.SendStatus(fiber.StatusOK)
+		}
+
+		if forwardOriginIP && len(c.IPs()) > 0 {
+			setLocal(c, ctxKeyDebridOriginIP, c.IPs()[0])
+		}
+		streamURL, err := resolve(c.Context(), udString, redirectID, rdRemoteOverride)
+		var downloadingErr *stillDownloadingError
+		switch {
+		case errors.Is(err, errRedirectExpired):
+			return sendRedirectError(c, fiber.StatusNotFound, errCodeRedirectExpired, "This stream link expired. Please go back and select the stream again in Stremio.")
+		case errors.Is(err, errNoStream):
 			return c.SendStatus(fiber.StatusNotFound)
+		case errors.Is(err, errCallLimit):
+			return c.SendStatus(fiber.StatusTooManyRequests)
+		case errors.As(err, &downloadingErr):
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(stillDownloadingRetryAfter))
+			return sendRedirectError(c, fiber.StatusServiceUnavailable, errCodeStillDownloading, fmt.Sprintf("RealDebrid is still downloading the torrent (%.0f%%). It doesn't tell how long that takes, so please try again in a few minutes.", downloadingErr.Progress))
+		case err != nil:
+			logger.Error("Couldn't resolve stream", zap.Error(err), zapFieldRedirectID)
+			return c.SendStatus(fiber.StatusInternalServerError)
 		}
 
-		logger.Debug("Responding with redirect to stream", zap.String("redirectLocation", streamURL), zapFieldRedirectID)
-		c.Set("Location", streamURL)
-		return c.SendStatus(fiber.StatusMovedPermanently)
+		return sendStream(c, streamURL)
 	}
 }
 
-func createStatusHandler(magnetSearchers map[string]imdb2torrent.MagnetSearcher, rdClient *realdebrid.Client, adClient *alldebrid.Client, pmClient *premiumize.Client, goCaches map[string]*gocache.Cache, forwardOriginIP bool, logger *zap.Logger) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		logger.Debug("statusHandler called", zap.String("request", fmt.Sprintf("%+v", c.Request())))
+// recomputeTorrents runs the stream handler for the movie or TV show episode of the redirect ID, which fills the redirect cache.
+// It returns false if the stream handler failed, for example because no torrents were found.
+// The redirect ID might still be missing in the redirect cache afterwards, for example when the user changed their preferences.
+func recomputeTorrents(ctx context.Context, streamHandlers map[string]stremio.StreamHandler, udString, redirectID string, logger *zap.Logger) bool {
+	// Like "tt1254207" for movies or "tt0944947:1:1" for TV show episodes
+	streamID := streamIDfromRedirectID(redirectID)
+	streamType := "movie"
+	if isTVShowID(streamID) {
+		streamType = "series"
+	}
+	streamHandler, ok := streamHandlers[streamType]
+	if !ok {
+		return false
+	}
+	// The auth middleware put the user data into the request context, which the stream handler requires as well
+	if _, err := streamHandler(withValue(ctx, ctxKeyRecomputation, true), streamID, udString); err != nil {
+		logger.Info("Couldn't recompute torrents", zap.Error(err), zap.String("redirectID", redirectID))
+		return false
+	}
+	return true
+}
+
+// convertFirst converts the torrents into stream URLs concurrently and returns the first stream URL that was successfully created, or an empty string if none was.
+// As soon as one conversion succeeded, the context of the other ones is canceled.
+// It only returns after all conversions are done, so the convert func doesn't outlive the request.
+func convertFirst(ctx context.Context, torrents []imdb2torrent.Result, convert func(ctx context.Context, torrent imdb2torrent.Result) (string, error)) string {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	streamURLs := make(chan string, len(torrents))
+	wg := sync.WaitGroup{}
+	wg.Add(len(torrents))
+	for _, torrent := range torrents {
+		go func(goTorrent imdb2torrent.Result) {
+			defer wg.Done()
+			if streamURL, err := convert(ctx, goTorrent); err == nil && streamURL != "" {
+				streamURLs <- streamURL
+				cancel()
+			}
+		}(torrent)
+	}
+	wg.Wait()
+	close(streamURLs)
+	// The first successful one, or the zero value if there was none
+	return <-streamURLs
+}
+
+// convertTorrent converts the torrent into a stream URL via the resolver of the debrid service with the given ID ("rd", "ad", "pm", "dl" or "tb").
+// For TV show episodes (season > 0) the episode's file is selected where supported, which matters for season packs.
+// RealDebrid conversions wait for torrents that aren't instantly available for the configured budget, and return a *stillDownloadingError when it's exceeded.
+func convertTorrent(ctx context.Context, resolvers debrid.Registry, debridID string, torrent imdb2torrent.Result, season, episode int, keyOrToken string, rdRemote bool) (streamURL string, err error) {
+	defer updateDuration(ctx, conversionDuration(debridID), time.Now())
+	ctx, span := startSpan(ctx, "convert")
+	span.setAttribute("deflix.debrid", debridID)
+	span.setAttribute("deflix.infoHash", torrent.InfoHash)
+	defer func() {
+		span.finish(err)
+	}()
+	return resolvers[debridID].GetStreamURL(ctx, torrent.MagnetURL, keyOrToken, season, episode, rdRemote)
+}
+
+// statusResult is the response of the status endpoint.
+type statusResult struct {
+	// Site name to result. Empty if the torrent sites weren't checked.
+	MagnetSearchers map[string]providerStatus `json:"magnetSearchers,omitempty"`
+	// Debrid service ID ("RD", "AD", "PM", "DL" or "TB") to result. Only contains the debrid services for which credentials are configured.
+	DebridServices map[string]providerStatus `json:"debridServices"`
+	// Cache name to number of items
+	Caches   map[string]int `json:"caches"`
+	Duration string         `json:"duration"`
+}
 
+// providerStatus is the result of checking a single torrent site or debrid service.
+type providerStatus struct {
+	Err string `json:"err,omitempty"`
+	// Number of found torrents, only for torrent sites
+	ResCount *int `json:"resCount,omitempty"`
+	// First found torrent for torrent sites, stream URL for debrid services
+	Res     string `json:"res,omitempty"`
+	Skipped string `json:"skipped,omitempty"`
+	// State of the circuit breaker, only for torrent sites
+	Breaker    string `json:"breaker,omitempty"`
+	DurationMS int64  `json:"durationMS"`
+}
+
+// createStatusHandler creates a handler that checks the torrent sites and the debrid services with the server-configured test credentials.
+// Only the debrid services for which credentials are configured are checked. The torrent sites aren't checked when the URL query contains "sites=false".
+// The requests must be authorized by the status auth middleware.
+func createStatusHandler(magnetSearchers map[string]imdb2torrent.MagnetSearcher, resolvers debrid.Registry, goCaches map[string]*gocache.Cache, rdToken, adKey, pmKey, dlKey, tbKey string, forwardOriginIP bool, logger *zap.Logger) fiber.Handler {
+	debridChecks := []struct {
+		id         string
+		keyOrToken string
+	}{
+		{"RD", rdToken},
+		{"AD", adKey},
+		{"PM", pmKey},
+		{"DL", dlKey},
+		{"TB", tbKey},
+	}
+
+	return func(c *fiber.Ctx) error {
 		imdbID := c.Query("imdbid", "")
-		rdToken := c.Query("rdtoken", "")
-		adKey := c.Query("adkey", "")
-		pmKey := c.Query("pmkey", "")
-		if imdbID == "" || rdToken == "" || adKey == "" || pmKey == "" {
-			logger.Warn("\"/status\" was called without IMDb ID or RD API token or AD API key or Premiumize API key")
+		// Not the whole request, because the header or the signed link contain the status token
+		logger.Debug("statusHandler called", zap.String("imdbID", imdbID))
+		if imdbID == "" {
+			logger.Warn("\"/status\" was called without IMDb ID")
 			return c.SendStatus(fiber.StatusBadRequest)
 		}
+		checkSites := true
+		if sites := c.Query("sites", ""); sites != "" {
+			var err error
+			if checkSites, err = strconv.ParseBool(sites); err != nil {
+				logger.Warn("\"/status\" was called with invalid \"sites\" value", zap.String("sites", sites))
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+		}
 
 		start := time.Now()
-		res := "{\n"
-
-		// Check magnet searchers
+		res := statusResult{
+			DebridServices: map[string]providerStatus{},
+			Caches:         map[string]int{},
+		}
 
-		res += "\t" + `"magnetSearchers": {` + "\n"
-		// Lock for writing to the same string
+		// The magnet searchers and debrid services are all checked concurrently, so the total duration is only the one of the slowest check.
+		// Lock for writing to the same maps
 		lock := sync.Mutex{}
 		wg := sync.WaitGroup{}
-		wg.Add(len(magnetSearchers))
-		for name, client := range magnetSearchers {
-			go func(goName string, goClient imdb2torrent.MagnetSearcher) {
+
+		// Check magnet searchers
+
+		if checkSites {
+			res.MagnetSearchers = map[string]providerStatus{}
+			wg.Add(len(magnetSearchers))
+			for name, client := range magnetSearchers {
+				go func(goName string, goClient imdb2torrent.MagnetSearcher) {
+					defer wg.Done()
+					// Read before the check, which can change it
+					status := providerStatus{Breaker: siteBreakerState(goClient)}
+					if goClient.IsSlow() {
+						status.Skipped = "quick skip"
+					} else {
+						startSearch := time.Now()
+						results, err := goClient.FindMovie(c.Context(), imdbID)
+						if err != nil {
+							status.Err = err.Error()
+						} else {
+							resCount := len(results)
+							status.ResCount = &resCount
+							if resCount > 0 {
+								status.Res = fmt.Sprintf("%+v", results[0])
+							}
+						}
+						status.DurationMS = time.Since(startSearch).Milliseconds()
+					}
+					lock.Lock()
+					defer lock.Unlock()
+					res.MagnetSearchers[goName] = status
+				}(name, client)
+			}
+		}
+
+		// Check debrid clients
+
+		// Must be set before starting the goroutines, which read it from the context
+		if forwardOriginIP && len(c.IPs()) > 0 {
+			setLocal(c, ctxKeyDebridOriginIP, c.IPs()[0])
+		}
+		for _, debridCheck := range debridChecks {
+			if debridCheck.keyOrToken == "" {
+				continue
+			}
+			wg.Add(1)
+			go func(goID, goKeyOrToken string) {
 				defer wg.Done()
-				if goClient.IsSlow() {
-					res += "\t\t" + `"` + goName + `": "quick skip",` + "\n"
-					return
-				}
-				startSearch := time.Now()
-				results, err := goClient.FindMovie(c.Context(), imdbID)
-				lock.Lock()
-				defer lock.Unlock()
-				res += "\t\t" + `"` + goName + `": {` + "\n"
+				var status providerStatus
+				startDebrid := time.Now()
+				streamURL, err := resolvers[strings.ToLower(goID)].GetStreamURL(c.Context(), bigBuckBunnyMagnet, goKeyOrToken, 0, 0, false)
 				if err != nil {
-					res += "\t\t\t" + `"err":"` + err.Error() + `",` + "\n"
+					status.Err = err.Error()
 				} else {
-					resCount := len(results)
-					res += "\t\t\t" + `"resCount":"` + strconv.Itoa(resCount) + `",` + "\n"
-					if resCount > 0 {
-						resExample := fmt.Sprintf("%+v", results[0])
-						resExample = strings.ReplaceAll(resExample, "\n", " ")
-						res += "\t\t\t" + `"resExample":"` + resExample + `",` + "\n"
-					}
+					status.Res = streamURL
 				}
-				durationSearchmillis := time.Since(startSearch).Milliseconds()
-				res += "\t\t\t" + `"duration": "` + strconv.FormatInt(durationSearchmillis, 10) + `ms"` + "\n"
-				res += "\t\t" + `},` + "\n"
-			}(name, client)
+				status.DurationMS = time.Since(startDebrid).Milliseconds()
+				lock.Lock()
+				defer lock.Unlock()
+				res.DebridServices[goID] = status
+			}(debridCheck.id, debridCheck.keyOrToken)
 		}
+
 		wg.Wait()
-		res = strings.TrimRight(res, ",\n") + "\n"
-		res += "\t" + `},` + "\n"
 
-		// Check debrid clients
+		// Check caches
 
-		if forwardOriginIP && len(c.IPs()) > 0 {
-			c.Locals("debrid_originIP", c.IPs()[0])
+		for name, cache := range goCaches {
+			res.Caches[name] = cache.ItemCount()
 		}
 
-		// Check RD client
+		res.Duration = strconv.FormatInt(time.Since(start).Milliseconds(), 10) + "ms"
 
-		res += "\t" + `"RD": {` + "\n"
-		startRD := time.Now()
-		streamURL, err := rdClient.GetStreamURL(c.Context(), bigBuckBunnyMagnet, rdToken, false)
-		if err != nil {
-			res += "\t\t" + `"err":"` + err.Error() + `",` + "\n"
-		} else {
-			res += "\t\t" + `"res":"` + streamURL + `",` + "\n"
+		logger.Debug("Responding", zap.Any("response", res))
+		return c.JSON(res)
+	}
+}
+
+// createVersionHandler creates a handler that responds with the version and telemetry settings.
+// If updates isn't nil, the response contains the result of the last update check as well, which the configure page shows.
+func createVersionHandler(disableTelemetry bool, updates *updateChecker, logger *zap.Logger) fiber.Handler {
+	type versionResponse struct {
+		Version string `json:"version"`
+		// Whether telemetry is enabled for the instance
+		Telemetry bool `json:"telemetry"`
+		// Whether telemetry is enabled for the current request, which is not the case when the client sent a "DNT: 1" header
+		TelemetryForRequest bool `json:"telemetryForRequest"`
+		// Only set when update checks are enabled and one succeeded
+		Update *updateStatus `json:"update,omitempty"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		logger.Debug("versionHandler called")
+
+		res := versionResponse{
+			Version:             version,
+			Telemetry:           !disableTelemetry,
+			TelemetryForRequest: telemetryAllowed(c.Context()),
+		}
+		if status := updates.getStatus(); !status.Checked.IsZero() {
+			res.Update = &status
 		}
-		durationRDmillis := time.Since(startRD).Milliseconds()
-		res += "\t\t" + `"duration": "` + strconv.FormatInt(durationRDmillis, 10) + `ms"` + "\n"
-		res += "\t" + `},` + "\n"
+		return c.JSON(res)
+	}
+}
 
-		// Check AD client
+// createFeaturesHandler creates a handler that responds with the features this instance supports.
+func createFeaturesHandler(features instanceFeatures, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger.Debug("featuresHandler called")
 
-		res += "\t" + `"AD": {` + "\n"
-		startAD := time.Now()
-		streamURL, err = adClient.GetStreamURL(c.Context(), bigBuckBunnyMagnet, adKey)
+		return c.JSON(features)
+	}
+}
+
+// createAccountHandler creates a handler that responds with the account info of the user's debrid service,
+// including the remaining remote traffic for RealDebrid users, so users can check it before enabling the "rdRemote" option.
+// The user data must be decoded and validated by the auth middleware.
+func createAccountHandler(accClient *accountClient, logger *zap.Logger) fiber.Handler {
+	type accountResponse struct {
+		DebridService string     `json:"debridService"`
+		Username      string     `json:"username,omitempty"`
+		Premium       bool       `json:"premium"`
+		PremiumUntil  *time.Time `json:"premiumUntil,omitempty"`
+		// Whether the user enabled the "rdRemote" option
+		RDremote bool `json:"rdRemote"`
+		// Only for RealDebrid
+		RemoteTraffic *remoteTraffic `json:"remoteTraffic,omitempty"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		logger.Debug("accountHandler called")
+
+		userData, err := userDataFromContext(c.Context())
 		if err != nil {
-			res += "\t\t" + `"err":"` + err.Error() + `",` + "\n"
-		} else {
-			res += "\t\t" + `"res":"` + streamURL + `",` + "\n"
+			logger.Error("Couldn't get user data", zap.Error(err))
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		keyOrToken, err := keyOrTokenFromContext(c.Context())
+		if err != nil {
+			logger.Error("Couldn't get debrid API key or token", zap.Error(err))
+			return c.SendStatus(fiber.StatusInternalServerError)
 		}
-		durationADmillis := time.Since(startAD).Milliseconds()
-		res += "\t\t" + `"duration": "` + strconv.FormatInt(durationADmillis, 10) + `ms"` + "\n"
-		res += "\t" + `},` + "\n"
+		debridID := userData.debridID()
+		info, err := accClient.getInfo(c.Context(), debridID, keyOrToken, userData.PMoauth2 != "")
+		if err != nil {
+			logger.Warn("Couldn't get account info", zap.Error(err), zap.String("debridID", debridID))
+			return c.SendStatus(fiber.StatusBadGateway)
+		}
+		res := accountResponse{
+			DebridService: debridID,
+			Username:      info.Username,
+			Premium:       info.Premium,
+			RDremote:      userData.RDremote,
+		}
+		if !info.PremiumUntil.IsZero() {
+			res.PremiumUntil = &info.PremiumUntil
+		}
+		if debridID == "rd" {
+			// Not all accounts have remote traffic, so it's not an error for the whole response
+			if traffic, err := accClient.getRDremoteTraffic(c.Context(), keyOrToken); err != nil {
+				logger.Info("Couldn't get RealDebrid remote traffic", zap.Error(err))
+			} else {
+				res.RemoteTraffic = &traffic
+			}
+		}
+		return c.JSON(res)
+	}
+}
 
-		// Check PM client
+// createStatsHandler creates a handler that responds with stats that help operators with the configuration, like the coverage of each magnet searcher.
+// If analytics are enabled, it includes their aggregates of the time window in the "window" query, like "168h". Default is 24 hours.
+// The requests must be authorized by the admin auth middleware.
+func createStatsHandler(coverage *searcherCoverage, analytics *analyticsStore, logger *zap.Logger) fiber.Handler {
+	type statsResponse struct {
+		// Rolling window of the coverage stats
+		CoverageWindow   string                  `json:"coverageWindow"`
+		SearcherCoverage map[string]coverageStat `json:"searcherCoverage"`
+		AnalyticsWindow  string                  `json:"analyticsWindow,omitempty"`
+		Analytics        *analyticsStats         `json:"analytics,omitempty"`
+	}
 
-		res += "\t" + `"PM": {` + "\n"
-		startPM := time.Now()
-		streamURL, err = pmClient.GetStreamURL(c.Context(), bigBuckBunnyMagnet, pmKey)
-		if err != nil {
-			res += "\t\t" + `"err":"` + err.Error() + `",` + "\n"
-		} else {
-			res += "\t\t" + `"res":"` + streamURL + `",` + "\n"
+	return func(c *fiber.Ctx) error {
+		logger.Debug("statsHandler called")
+
+		res := statsResponse{
+			CoverageWindow:   coverage.window.String(),
+			SearcherCoverage: coverage.stats(),
+		}
+		if analytics != nil {
+			window, err := time.ParseDuration(c.Query("window", "24h"))
+			if err != nil || window <= 0 {
+				logger.Info("Stats handler called with invalid window", zap.String("window", c.Query("window")))
+				return c.SendStatus(fiber.StatusBadRequest)
+			}
+			stats, err := analytics.stats(time.Now().Add(-window))
+			if err != nil {
+				logger.Error("Couldn't aggregate analytics entries", zap.Error(err))
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			res.AnalyticsWindow = window.String()
+			res.Analytics = &stats
 		}
-		durationPMmillis := time.Since(startPM).Milliseconds()
-		res += "\t\t" + `"duration": "` + strconv.FormatInt(durationPMmillis, 10) + `ms"` + "\n"
-		res += "\t" + `},` + "\n"
+		return c.JSON(res)
+	}
+}
 
-		// Check caches
+// createStatusLinkHandler creates a handler that returns a signed, expiring and single-use URL to the status endpoint.
+// This allows sharing a status link without sharing the status token.
+// The requests must be authorized by the status auth middleware.
+func createStatusLinkHandler(statusToken, baseURL string, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger.Debug("statusLinkHandler called")
 
-		res += "\t" + `"caches": {` + "\n"
-		for name, cache := range goCaches {
-			res += "\t\t" + `"` + name + `": {` + "\n"
-			res += "\t\t\t" + `"Items": "` + strconv.Itoa(cache.ItemCount()) + `"` + ",\n"
-			res += "\t\t" + `},` + "\n"
+		imdbID := c.Query("imdbid", "")
+		if imdbID == "" {
+			logger.Warn("\"/status/link\" was called without IMDb ID")
+			return c.SendStatus(fiber.StatusBadRequest)
 		}
-		res = strings.TrimRight(res, ",\n") + "\n"
-		res += "\t" + `},` + "\n"
 
-		durationMillis := time.Since(start).Milliseconds()
-		res += "\t" + `"duration": "` + strconv.FormatInt(durationMillis, 10) + `ms"` + "\n"
-		res += "}"
+		expires := strconv.FormatInt(time.Now().Add(statusLinkExpiration).Unix(), 10)
+		query := url.Values{}
+		query.Set("imdbid", imdbID)
+		query.Set("expires", expires)
+		query.Set("sig", signStatusLink(statusToken, imdbID, expires))
+		return c.SendString(baseURL + "/status?" + query.Encode())
+	}
+}
+
+// signStatusLink returns the Base64URL encoded HMAC-SHA256 of the status link parameters.
+func signStatusLink(statusToken, imdbID, expires string) string {
+	mac := hmac.New(sha256.New, []byte(statusToken))
+	mac.Write([]byte(imdbID + "|" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// createDiagnoseHandler creates a handler that checks the user's configuration and renders a human-readable result.
+// It checks the validity of the debrid credentials, the premium status of the debrid account and whether the addon is reachable at its base URL.
+// Contrary to the auth middleware it doesn't respond with an error status when a check fails.
+func createDiagnoseHandler(resolvers debrid.Registry, accClient *accountClient, useOAUTH2 bool, confRD, confPM oauth2.Config, aesKey []byte, baseURL string, logger *zap.Logger) fiber.Handler {
+	httpClient := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+
+	return func(c *fiber.Ctx) error {
+		logger.Debug("diagnoseHandler called")
+		rCtx := c.Context()
+
+		var checks []diagnosisCheck
+		render := func() error {
+			c.Type("html")
+			return diagnosisTemplate.Execute(c, checks)
+		}
+
+		checks = append(checks, checkReachability(rCtx, httpClient, baseURL))
+
+		userData, err := decodeUserData(c.Params("userData"), aesKey, logger)
+		if err != nil {
+			checks = append(checks, diagnosisCheck{Name: "Addon URL", Details: "The addon URL is malformed. Please reinstall the addon."})
+			return render()
+		}
+		checks = append(checks, diagnosisCheck{Name: "Addon URL", OK: true, Details: "The addon URL is well-formed."})
+
+		credCheck := diagnosisCheck{Name: "Credentials"}
+		var serviceName string
+		var credErr error
+		var getAccountInfo func() (accountInfo, error)
+		// Only set for RealDebrid
+		var rdToken string
+		// Same order as in the auth middleware.
+		// OAuth2 access tokens aren't taken from the auth middleware's cache, so that the diagnosis also checks refreshing them.
+		switch {
+		case useOAUTH2 && userData.RDoauth2 != "":
+			serviceName, credCheck.Name = "RealDebrid", "RealDebrid authorization"
+			var accessToken string
+			if accessToken, _, credErr = decryptAccessToken(rCtx, confRD, aesKey, userData.RDoauth2, true, httpClient, nil, logger); credErr == nil {
+				credErr = resolvers["rd"].TestCreds(rCtx, accessToken)
+			}
+			getAccountInfo = func() (accountInfo, error) { return accClient.getRDinfo(rCtx, accessToken) }
+			rdToken = accessToken
+		case useOAUTH2 && userData.PMoauth2 != "":
+			serviceName, credCheck.Name = "Premiumize", "Premiumize authorization"
+			var accessToken string
+			if accessToken, _, credErr = decryptAccessToken(rCtx, confPM, aesKey, userData.PMoauth2, false, nil, nil, logger); credErr == nil {
+				setLocal(c, ctxKeyDebridOAUTH2, struct{}{})
+				credErr = resolvers["pm"].TestCreds(rCtx, accessToken)
+			}
+			getAccountInfo = func() (accountInfo, error) { return accClient.getPMinfo(rCtx, accessToken, true) }
+		case useOAUTH2 && userData.ADoauth2 != "":
+			serviceName, credCheck.Name = "AllDebrid", "AllDebrid authorization"
+			var apiKey string
+			if apiKey, _, credErr = decryptADapiKey(aesKey, userData.ADoauth2, logger); credErr == nil {
+				credErr = resolvers["ad"].TestCreds(rCtx, apiKey)
+			}
+			getAccountInfo = func() (accountInfo, error) { return accClient.getADinfo(rCtx, apiKey) }
+		case userData.RDtoken != "":
+			serviceName, credCheck.Name = "RealDebrid", "RealDebrid API token"
+			credErr = resolvers["rd"].TestCreds(rCtx, userData.RDtoken)
+			getAccountInfo = func() (accountInfo, error) { return accClient.getRDinfo(rCtx, userData.RDtoken) }
+			rdToken = userData.RDtoken
+		case userData.ADkey != "":
+			serviceName, credCheck.Name = "AllDebrid", "AllDebrid API key"
+			credErr = resolvers["ad"].TestCreds(rCtx, userData.ADkey)
+			getAccountInfo = func() (accountInfo, error) { return accClient.getADinfo(rCtx, userData.ADkey) }
+		case userData.DLkey != "":
+			serviceName, credCheck.Name = "Debrid-Link", "Debrid-Link API key"
+			credErr = resolvers["dl"].TestCreds(rCtx, userData.DLkey)
+			getAccountInfo = func() (accountInfo, error) { return accClient.getDLinfo(rCtx, userData.DLkey) }
+		case userData.TBkey != "":
+			serviceName, credCheck.Name = "Torbox", "Torbox API key"
+			credErr = resolvers["tb"].TestCreds(rCtx, userData.TBkey)
+			getAccountInfo = func() (accountInfo, error) { return accClient.getTBinfo(rCtx, userData.TBkey) }
+		case userData.PMkey != "":
+			serviceName, credCheck.Name = "Premiumize", "Premiumize API key"
+			credErr = resolvers["pm"].TestCreds(rCtx, userData.PMkey)
+			getAccountInfo = func() (accountInfo, error) { return accClient.getPMinfo(rCtx, userData.PMkey, false) }
+		default:
+			credCheck.Details = "The addon URL doesn't contain any debrid service credentials. Please reinstall the addon."
+			checks = append(checks, credCheck)
+			return render()
+		}
+		if credErr != nil {
+			logger.Info("Credentials are invalid or validation failed", zap.Error(credErr))
+			credCheck.Details = "Your credentials are invalid or expired. Please reinstall the addon with new credentials."
+			checks = append(checks, credCheck)
+			return render()
+		}
+		credCheck.OK = true
+		credCheck.Details = "Your credentials are valid."
+		info, err := getAccountInfo()
+		checks = append(checks, credCheck, checkPremium(serviceName, info, err))
+		if rdToken != "" && userData.RDremote {
+			traffic, err := accClient.getRDremoteTraffic(rCtx, rdToken)
+			checks = append(checks, checkRemoteTraffic(traffic, err))
+		}
 
-		logger.Debug("Responding", zap.String("response", res))
-		c.Set("Content-Type", "application/json")
-		return c.SendString(res)
+		return render()
 	}
 }
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/gofiber/fiber/v2"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/go-stremio"
+	"github.com/deflix-tv/imdb2torrent"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
+)
+
+func TestHintsFromMagnet(t *testing.T) {
+	hints := hintsFromMagnet(bigBuckBunnyMagnet)
+	require.Equal(t, streamBehaviorHints{Filename: "Big Buck Bunny"}, hints)
+
+	hints = hintsFromMagnet("magnet:?xt=urn:btih:123&dn=foo.mkv&xl=1234")
+	require.Equal(t, streamBehaviorHints{Filename: "foo.mkv", VideoSize: 1234}, hints)
+
+	hints = hintsFromMagnet("magnet:?xt=urn:btih:123")
+	require.Equal(t, streamBehaviorHints{}, hints)
+}
+
+func TestFilenameFromStreamURL(t *testing.T) {
+	filename := filenameFromStreamURL("https://abc.download.real-debrid.com/d/ABC123/Big%20Buck%20Bunny.mkv")
+	require.Equal(t, "Big Buck Bunny.mkv", filename)
+
+	filename = filenameFromStreamURL("https://example.com/")
+	require.Equal(t, "", filename)
+}
+
+func TestFormatSize(t *testing.T) {
+	require.Equal(t, "4.2 GB", formatSize(4200*1000*1000))
+	require.Equal(t, "700 MB", formatSize(700*1000*1000))
+}
+
+type fakeMagnetSearcher struct {
+	results []imdb2torrent.Result
+	err     error
+	slow    bool
+}
+
+func (s fakeMagnetSearcher) FindMovie(ctx context.Context, imdbID string) ([]imdb2torrent.Result, error) {
+	return s.results, s.err
+}
+
+func (s fakeMagnetSearcher) FindTVShow(ctx context.Context, imdbID string, season, episode int) ([]imdb2torrent.Result, error) {
+	return s.results, s.err
+}
+
+func (s fakeMagnetSearcher) IsSlow() bool {
+	return s.slow
+}
+
+func TestStatusHandler(t *testing.T) {
+	magnetSearchers := map[string]imdb2torrent.MagnetSearcher{
+		"YTS":   fakeMagnetSearcher{results: []imdb2torrent.Result{{Title: `Foo "bar"`}}},
+		"TPB":   fakeMagnetSearcher{err: errors.New(`bad "response"`)},
+		"RARBG": fakeMagnetSearcher{slow: true},
+		"Nyaa":  fakeMagnetSearcher{},
+		"ibit":  fakeMagnetSearcher{},
+		"1337X": &instrumentedSearcher{MagnetSearcher: newResilientSearcher(fakeMagnetSearcher{}, "1337X", 0, 5, time.Minute, zap.NewNop()), site: "1337X"},
+	}
+	goCaches := map[string]*gocache.Cache{"stream": gocache.New(0, 0)}
+	goCaches["stream"].Set("foo", "bar", 0)
+	// No debrid credentials, so no debrid service is checked and the nil clients aren't used
+	app := fiber.New()
+	app.Get("/status", createStatusHandler(magnetSearchers, nil, goCaches, "", "", "", "", "", false, zap.NewNop()))
+
+	res, err := app.Test(httptest.NewRequest("GET", "/status?imdbid=tt1254207", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, res.StatusCode)
+	var result statusResult
+	// The quotes in the error and the torrent title must be escaped
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	require.Len(t, result.MagnetSearchers, len(magnetSearchers))
+	require.Equal(t, 1, *result.MagnetSearchers["YTS"].ResCount)
+	require.Contains(t, result.MagnetSearchers["YTS"].Res, `Foo "bar"`)
+	require.Equal(t, `bad "response"`, result.MagnetSearchers["TPB"].Err)
+	require.Equal(t, "quick skip", result.MagnetSearchers["RARBG"].Skipped)
+	require.Equal(t, breakerClosed, result.MagnetSearchers["1337X"].Breaker)
+	require.Empty(t, result.MagnetSearchers["YTS"].Breaker)
+	require.Empty(t, result.DebridServices)
+	require.Equal(t, map[string]int{"stream": 1}, result.Caches)
+
+	res, err = app.Test(httptest.NewRequest("GET", "/status?imdbid=tt1254207&sites=false", nil))
+	require.NoError(t, err)
+	result = statusResult{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	require.Empty(t, result.MagnetSearchers)
+
+	res, err = app.Test(httptest.NewRequest("GET", "/status?imdbid=tt1254207&sites=foo", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusBadRequest, res.StatusCode)
+}
+
+func TestConvertFirst(t *testing.T) {
+	torrents := []imdb2torrent.Result{{InfoHash: "slow"}, {InfoHash: "fast"}, {InfoHash: "failing"}}
+	canceled := make(chan string, len(torrents))
+	streamURL := convertFirst(context.Background(), torrents, func(ctx context.Context, torrent imdb2torrent.Result) (string, error) {
+		switch torrent.InfoHash {
+		case "fast":
+			return "https://example.com/fast.mkv", nil
+		case "failing":
+			return "", errors.New("foo")
+		}
+		// The slow conversion gets canceled when the fast one succeeded
+		select {
+		case <-ctx.Done():
+			canceled <- torrent.InfoHash
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+			return "https://example.com/slow.mkv", nil
+		}
+	})
+	require.Equal(t, "https://example.com/fast.mkv", streamURL)
+	require.Equal(t, "slow", <-canceled)
+
+	streamURL = convertFirst(context.Background(), torrents[2:], func(ctx context.Context, torrent imdb2torrent.Result) (string, error) {
+		return "", errors.New("foo")
+	})
+	require.Empty(t, streamURL)
+}
+
+func TestRecomputeTorrents(t *testing.T) {
+	var calledID, calledUserData string
+	var recomputation bool
+	streamHandlers := map[string]stremio.StreamHandler{
+		"series": func(ctx context.Context, id string, userData interface{}) ([]stremio.StreamItem, error) {
+			calledID = id
+			calledUserData, _ = userData.(string)
+			recomputation, _ = value(ctx, ctxKeyRecomputation).(bool)
+			return nil, nil
+		},
+	}
+	require.True(t, recomputeTorrents(context.Background(), streamHandlers, "foo", "tt0944947:1:1-rd-720p", zap.NewNop()))
+	require.Equal(t, "tt0944947:1:1", calledID)
+	require.Equal(t, "foo", calledUserData)
+	require.True(t, recomputation)
+
+	// No handler for movies
+	require.False(t, recomputeTorrents(context.Background(), streamHandlers, "foo", "tt1254207-rd-720p", zap.NewNop()))
+}
+
+func TestGetCachedTorrents(t *testing.T) {
+	redirectCache := gocache.New(time.Minute, 0)
+	redirectCache.Set("tt1254207-rd-720p", []imdb2torrent.Result{{InfoHash: "a"}}, 0)
+	redirectCache.Set("tt1254207-rd-2160p", []imdb2torrent.Result{{InfoHash: "b"}, {InfoHash: "c"}}, 0)
+
+	// Highest quality first, like for the "best" stream
+	torrents := getCachedTorrents(redirectCache, "tt1254207-rd", []string{"2160p.10bit", "2160p", "1080p.10bit", "1080p", "720p"}, zap.NewNop())
+	require.Equal(t, []imdb2torrent.Result{{InfoHash: "b"}, {InfoHash: "c"}, {InfoHash: "a"}}, torrents)
+
+	torrents = getCachedTorrents(redirectCache, "tt1254207-pm", []string{"2160p", "720p"}, zap.NewNop())
+	require.Empty(t, torrents)
+}
+
+func TestFillStreamFileInfo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "HEAD", r.Method)
+		w.Header().Set("Content-Disposition", `attachment; filename="Big.Buck.Bunny.2008.1080p.mkv"`)
+		w.Header().Set("Content-Length", "1234")
+	}))
+	defer server.Close()
+
+	streamCache := gocache.New(time.Minute, 0)
+	item := cacheItem{Value: server.URL + "/dl/abc123", Created: time.Now()}
+	streamCache.Set("foo", item, 0)
+	fillStreamFileInfo(streamCache, "foo", item, zap.NewNop())
+
+	hints := createStreamHints(streamCache, "foo", []imdb2torrent.Result{{MagnetURL: bigBuckBunnyMagnet}, {}})
+	require.Equal(t, streamBehaviorHints{Filename: "Big.Buck.Bunny.2008.1080p.mkv", VideoSize: 1234}, hints)
+}
+
+func TestRedirectHandlerHEAD(t *testing.T) {
+	redirectCache := gocache.New(time.Minute, 0)
+	streamCache := gocache.New(time.Minute, 0)
+	// No debrid clients, because a HEAD request must not lead to a conversion
+	resolveStream := createStreamResolver(redirectCache, streamCache, nil, nil, nil, nil, nil, nil, nil, nil, nil, 0, false, false, zap.NewNop())
+	redirectHandler := createRedirectHandler(resolveStream, streamCache, nil, false, zap.NewNop())
+	app := fiber.New()
+	app.Head("/:userData/redirect/:id", redirectHandler)
+
+	res, err := app.Test(httptest.NewRequest("HEAD", "/foo/redirect/tt1254207-rd-720p", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, res.StatusCode)
+	require.Equal(t, "bytes", res.Header.Get("Accept-Ranges"))
+
+	// Already converted streams are redirected to
+	userHash := sha256.Sum256([]byte("foo"))
+	streamCache.Set(base64.RawURLEncoding.EncodeToString(userHash[:])+"-tt1254207-rd-720p", cacheItem{Value: "https://example.com/dl/abc123", Created: time.Now()}, 0)
+	res, err = app.Test(httptest.NewRequest("HEAD", "/foo/redirect/tt1254207-rd-720p", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusMovedPermanently, res.StatusCode)
+	require.Equal(t, "https://example.com/dl/abc123", res.Header.Get("Location"))
+}
+
+// mockResolver is a debrid service with fixed results, which records the magnet URLs it converts and the episodes they're converted for.
+type mockResolver struct {
+	available  []string
+	streamURL  string
+	err        error
+	magnetURLs []string
+	episodes   []string
+}
+
+func (m *mockResolver) TestCreds(ctx context.Context, keyOrToken string) error {
+	return m.err
+}
+
+func (m *mockResolver) CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string {
+	return m.available
+}
+
+func (m *mockResolver) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, season, episode int, remote bool) (string, error) {
+	m.magnetURLs = append(m.magnetURLs, magnetURL)
+	m.episodes = append(m.episodes, fmt.Sprintf("%d:%d", season, episode))
+	return m.streamURL, m.err
+}
+
+func TestConvertTorrent(t *testing.T) {
+	adResolver := &mockResolver{streamURL: "https://ad.example/dl/abc123"}
+	tbResolver := &mockResolver{err: errors.New("torrent isn't cached")}
+	resolvers := debrid.Registry{"ad": adResolver, "tb": tbResolver}
+	torrent := imdb2torrent.Result{InfoHash: "dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c", MagnetURL: bigBuckBunnyMagnet}
+
+	streamURL, err := convertTorrent(context.Background(), resolvers, "ad", torrent, 0, 0, "foo", false)
+	require.NoError(t, err)
+	require.Equal(t, "https://ad.example/dl/abc123", streamURL)
+	require.Equal(t, []string{bigBuckBunnyMagnet}, adResolver.magnetURLs)
+
+	// The episode is passed on, so that the resolver can select its file in season packs
+	_, err = convertTorrent(context.Background(), resolvers, "ad", torrent, 1, 5, "foo", false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"0:0", "1:5"}, adResolver.episodes)
+
+	_, err = convertTorrent(context.Background(), resolvers, "tb", torrent, 0, 0, "foo", false)
+	require.Error(t, err)
+	require.Equal(t, []string{bigBuckBunnyMagnet}, tbResolver.magnetURLs)
+}
+
+func TestParsePinnedRedirectID(t *testing.T) {
+	infoHash := "dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c"
+	for _, qualityRedirectID := range []string{"tt1254207-rd-1080p.10bit", "tt0944947:1:1-rd-1a2b3c4d-720p"} {
+		parsedQualityRedirectID, parsedInfoHash, ok := parsePinnedRedirectID(pinnedRedirectID(qualityRedirectID, infoHash))
+		require.True(t, ok)
+		require.Equal(t, qualityRedirectID, parsedQualityRedirectID)
+		require.Equal(t, infoHash, parsedInfoHash)
+	}
+
+	for _, redirectID := range []string{"tt1254207-rd-1080p", "tt1254207-rd-best", "tt1254207-rd-1a2b3c4d-720p"} {
+		_, _, ok := parsePinnedRedirectID(redirectID)
+		require.False(t, ok, redirectID)
+	}
+}
+
+func TestStreamHandlerTelemetry(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	popularity := &popularityStore{db: db, keyPrefix: "popularity_"}
+	coverage := newSearcherCoverage([]string{"YTS"}, time.Hour, time.Minute)
+
+	torrent := imdb2torrent.Result{InfoHash: "dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c", MagnetURL: bigBuckBunnyMagnet, Title: "Big Buck Bunny", Quality: "720p"}
+	searchers := map[string]imdb2torrent.MagnetSearcher{
+		"YTS": &instrumentedSearcher{MagnetSearcher: fakeMagnetSearcher{results: []imdb2torrent.Result{torrent}}, site: "YTS"},
+	}
+	searchClient := imdb2torrent.NewClient(searchers, time.Second, zap.NewNop())
+	resolvers := debrid.Registry{"rd": &mockResolver{available: []string{torrent.InfoHash}}}
+	availabilityCaches := map[string]*creationCache{"rd": {cache: gocache.New(time.Hour, 0)}}
+	redirectCache := &goCache{cache: gocache.New(time.Hour, 0)}
+	streamCache := &goCache{cache: gocache.New(time.Hour, 0)}
+	streamHandler := createStreamHandler(config{}, searchClient, nil, nil, resolvers, nil, redirectCache, streamCache, availabilityCaches, newDebridCallLimiter(nil), coverage, popularity, nil, nil, nil, nil, false, zap.NewNop())
+
+	app := fiber.New()
+	app.Use(createTelemetryMiddleware(false))
+	app.Get("/:userData/stream/movie/:id", func(c *fiber.Ctx) error {
+		setLocal(c, ctxKeyUserData, userData{RDtoken: "foo"})
+		setLocal(c, ctxKeyKeyOrToken, "foo")
+		streams, err := streamHandler(c.Context(), c.Params("id"), c.Params("userData"))
+		require.NoError(t, err)
+		require.NotEmpty(t, streams)
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	// Do Not Track
+	req := httptest.NewRequest("GET", "/abc/stream/movie/tt1254207", nil)
+	req.Header.Set("DNT", "1")
+	res, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, res.StatusCode)
+	top, err := popularity.Top("movie", 10)
+	require.NoError(t, err)
+	require.Empty(t, top)
+	require.Equal(t, coverageStat{}, coverage.stats()["YTS"])
+
+	// Recorded without the header
+	res, err = app.Test(httptest.NewRequest("GET", "/abc/stream/movie/tt1254207", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, res.StatusCode)
+	top, err = popularity.Top("movie", 10)
+	require.NoError(t, err)
+	require.Equal(t, []popularityItem{{IMDbID: "tt1254207", Count: 1}}, top)
+	require.Equal(t, coverageStat{Requests: 1, Contributions: 1, Coverage: 1}, coverage.stats()["YTS"])
+}
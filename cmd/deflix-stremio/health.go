@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	readinessCheckTimeout = 3 * time.Second
+	// Readiness probes are usually sent every few seconds, so the reachability of the torrent sites and debrid services is only checked once within this duration
+	reachabilityCacheDuration = 30 * time.Second
+)
+
+// readinessResult is the response of the readiness endpoint.
+type readinessResult struct {
+	Ready bool `json:"ready"`
+	// Check name to "ok" or the error
+	Checks map[string]string `json:"checks"`
+}
+
+// readinessChecker checks whether the dependencies that are required for handling requests are available.
+type readinessChecker struct {
+	db       *badger.DB
+	postgres *postgresStore
+	rdb      *redis.Client
+	// Name to base URL
+	siteURLs   map[string]string
+	debridURLs map[string]string
+	httpClient *http.Client
+	// Last reachability results
+	reachability      map[string]string
+	reachabilityCheck time.Time
+	lock              sync.Mutex
+}
+
+// newReadinessChecker creates a new readinessChecker. postgres and rdb can be nil if PostgreSQL and Redis aren't configured.
+func newReadinessChecker(db *badger.DB, postgres *postgresStore, rdb *redis.Client, siteURLs, debridURLs map[string]string) *readinessChecker {
+	return &readinessChecker{
+		db:         db,
+		postgres:   postgres,
+		rdb:        rdb,
+		siteURLs:   siteURLs,
+		debridURLs: debridURLs,
+		httpClient: &http.Client{
+			Timeout: readinessCheckTimeout,
+			// Any response means the site is reachable
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// check checks BadgerDB, PostgreSQL and Redis (if configured) and that at least one torrent site and one debrid service are reachable.
+func (r *readinessChecker) check(ctx context.Context) readinessResult {
+	result := readinessResult{
+		Ready:  true,
+		Checks: map[string]string{},
+	}
+	fail := func(name string, err error) {
+		result.Ready = false
+		result.Checks[name] = err.Error()
+	}
+
+	if r.db.IsClosed() {
+		fail("badger", fmt.Errorf("DB is closed"))
+	} else if err := r.db.View(func(*badger.Txn) error { return nil }); err != nil {
+		fail("badger", err)
+	} else {
+		result.Checks["badger"] = "ok"
+	}
+
+	if r.postgres != nil {
+		ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+		defer cancel()
+		if err := r.postgres.db.PingContext(ctx); err != nil {
+			fail("postgres", err)
+		} else {
+			result.Checks["postgres"] = "ok"
+		}
+	}
+
+	if r.rdb != nil {
+		ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+		defer cancel()
+		if err := r.rdb.Ping(ctx).Err(); err != nil {
+			fail("redis", err)
+		} else {
+			result.Checks["redis"] = "ok"
+		}
+	}
+
+	for name, status := range r.getReachability(ctx) {
+		if status != "ok" {
+			result.Ready = false
+		}
+		result.Checks[name] = status
+	}
+
+	return result
+}
+
+// getReachability returns the status of the torrent sites and debrid services checks, which are only made when the cached ones are outdated.
+func (r *readinessChecker) getReachability(ctx context.Context) map[string]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.reachability != nil && time.Since(r.reachabilityCheck) < reachabilityCacheDuration {
+		return r.reachability
+	}
+	r.reachability = map[string]string{
+		"torrentSites":   r.anyReachable(ctx, r.siteURLs),
+		"debridServices": r.anyReachable(ctx, r.debridURLs),
+	}
+	r.reachabilityCheck = time.Now()
+	return r.reachability
+}
+
+// anyReachable sends requests to all URLs at the same time and returns "ok" if at least one responds.
+// Otherwise it returns the errors.
+func (r *readinessChecker) anyReachable(ctx context.Context, urls map[string]string) string {
+	type reachResult struct {
+		name string
+		err  error
+	}
+	results := make(chan reachResult, len(urls))
+	for name, url := range urls {
+		go func(name, url string) {
+			results <- reachResult{name, r.reach(ctx, url)}
+		}(name, url)
+	}
+	var errs []string
+	for range urls {
+		res := <-results
+		if res.err == nil {
+			return "ok"
+		}
+		errs = append(errs, res.name+": "+res.err.Error())
+	}
+	// Stable output
+	sort.Strings(errs)
+	return fmt.Sprintf("none reachable: %v", errs)
+}
+
+func (r *readinessChecker) reach(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// createLivenessHandler creates a handler that responds with 200 OK as long as the server is running.
+// It's meant for Kubernetes liveness probes, while the readiness handler checks the dependencies.
+func createLivenessHandler(logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger.Debug("livenessHandler called")
+
+		return c.SendString("ok")
+	}
+}
+
+// createReadinessHandler creates a handler that responds with the results of the readiness checks,
+// with 200 OK if all checks succeeded and 503 Service Unavailable otherwise.
+func createReadinessHandler(checker *readinessChecker, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger.Debug("readinessHandler called")
+
+		result := checker.check(c.Context())
+		if !result.Ready {
+			logger.Warn("Readiness check failed", zap.Any("checks", result.Checks))
+			c.Status(fiber.StatusServiceUnavailable)
+		}
+		return c.JSON(result)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadinessChecker(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	// Closed server, so that its URL isn't reachable
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	checker := newReadinessChecker(db, nil, nil, map[string]string{"foo": server.URL, "bar": unreachable.URL}, map[string]string{"rd": unreachable.URL})
+	result := checker.check(context.Background())
+	require.False(t, result.Ready)
+	require.Equal(t, "ok", result.Checks["badger"])
+	// Any response means the site is reachable, even an error status
+	require.Equal(t, "ok", result.Checks["torrentSites"])
+	require.Contains(t, result.Checks["debridServices"], "none reachable")
+	_, ok := result.Checks["redis"]
+	require.False(t, ok)
+
+	// Reachability results are cached
+	checker.debridURLs = map[string]string{"rd": server.URL}
+	checker.check(context.Background())
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	checker.reachability = nil
+	result = checker.check(context.Background())
+	require.True(t, result.Ready)
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
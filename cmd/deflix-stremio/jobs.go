@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+const (
+	// Interval in which idle workers check for due jobs
+	jobPollInterval = time.Second
+	// Max duration of a single job run
+	jobTimeout = 5 * time.Minute
+	// Delay of the first retry of a failed job. It's doubled with each further attempt.
+	jobRetryBaseDelay = 30 * time.Second
+	// Number of runs of a failing job, after which it's dropped
+	jobMaxAttempts = 5
+)
+
+// jobCounter returns the counter for job runs of the given type with the given result ("success", "retry", "failed" or "unknown").
+func jobCounter(jobType, result string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`jobs_total{type=%q, result=%q}`, jobType, result))
+}
+
+// jobDuration returns the histogram for the duration of job runs of the given type.
+func jobDuration(jobType string) *metrics.Histogram {
+	return metrics.GetOrCreateHistogram(fmt.Sprintf(`job_duration_seconds{type=%q}`, jobType))
+}
+
+// job is a deferred work item.
+// The payload is specific to the job type, for example JSON, and is decoded by the type's handler.
+type job struct {
+	ID      string
+	Type    string
+	Payload []byte
+	// Number of previous failed runs
+	Attempts int
+	// The job isn't run before this time
+	RunAt time.Time
+}
+
+// jobHandler runs a job with the given payload.
+// When it returns an error, the job is retried later, up to jobMaxAttempts times.
+type jobHandler func(ctx context.Context, payload []byte) error
+
+// jobStore persists jobs until they're due.
+type jobStore interface {
+	push(j job) error
+	// pop removes the due job with the earliest run time and returns it.
+	// found is false if no job is due.
+	pop(ctx context.Context) (j job, found bool, err error)
+	count(ctx context.Context) (int, error)
+}
+
+// jobQueue runs deferred work items with a pool of workers, for example cleanups or re-checks that shouldn't delay a user's request.
+// The jobs are persisted in BadgerDB or Redis, so they survive restarts. With Redis they're shared and run by all instances.
+// A job is removed from the store when a worker takes it, so a job that's running while the process crashes is lost.
+type jobQueue struct {
+	store    jobStore
+	handlers map[string]jobHandler
+	lock     sync.RWMutex
+	logger   *zap.Logger
+}
+
+func newJobQueue(store jobStore, logger *zap.Logger) *jobQueue {
+	q := &jobQueue{
+		store:    store,
+		handlers: map[string]jobHandler{},
+		logger:   logger,
+	}
+	metrics.GetOrCreateGauge("jobs_queued", func() float64 {
+		count, err := q.store.count(context.Background())
+		if err != nil {
+			return 0
+		}
+		return float64(count)
+	})
+	return q
+}
+
+// register sets the handler for jobs of the given type.
+// Handlers should be registered before running the queue, so that no job is taken without a handler.
+func (q *jobQueue) register(jobType string, handler jobHandler) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.handlers[jobType] = handler
+}
+
+// enqueue adds a job of the given type, which is run after the given delay.
+func (q *jobQueue) enqueue(jobType string, payload []byte, delay time.Duration) error {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return fmt.Errorf("Couldn't generate job ID: %w", err)
+	}
+	j := job{
+		ID:      hex.EncodeToString(idBytes),
+		Type:    jobType,
+		Payload: payload,
+		RunAt:   time.Now().Add(delay),
+	}
+	if err := q.store.push(j); err != nil {
+		return fmt.Errorf("Couldn't store job: %w", err)
+	}
+	metrics.GetOrCreateCounter(fmt.Sprintf(`jobs_enqueued_total{type=%q}`, jobType)).Inc()
+	return nil
+}
+
+// run starts the given number of workers and blocks until the context is canceled and all workers returned.
+func (q *jobQueue) run(ctx context.Context, workers int) {
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *jobQueue) work(ctx context.Context) {
+	for {
+		j, found, err := q.store.pop(ctx)
+		if err != nil {
+			q.logger.Error("Couldn't get job", zap.Error(err))
+		} else if found {
+			q.process(ctx, j)
+			// There might be more due jobs
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// process runs the job's handler and reschedules the job if it fails.
+func (q *jobQueue) process(ctx context.Context, j job) {
+	zapFieldJobID := zap.String("jobID", j.ID)
+	zapFieldJobType := zap.String("jobType", j.Type)
+
+	q.lock.RLock()
+	handler, ok := q.handlers[j.Type]
+	q.lock.RUnlock()
+	if !ok {
+		q.logger.Error("No handler for job type, dropping job", zapFieldJobID, zapFieldJobType)
+		jobCounter(j.Type, "unknown").Inc()
+		return
+	}
+
+	start := time.Now()
+	jobCtx, cancel := context.WithTimeout(ctx, jobTimeout)
+	err := handler(jobCtx, j.Payload)
+	cancel()
+	jobDuration(j.Type).UpdateDuration(start)
+	if err == nil {
+		q.logger.Debug("Ran job", zapFieldJobID, zapFieldJobType)
+		jobCounter(j.Type, "success").Inc()
+		return
+	}
+
+	j.Attempts++
+	if j.Attempts >= jobMaxAttempts {
+		q.logger.Error("Job failed too often, dropping it", zap.Error(err), zapFieldJobID, zapFieldJobType, zap.Int("attempts", j.Attempts))
+		jobCounter(j.Type, "failed").Inc()
+		return
+	}
+	j.RunAt = time.Now().Add(jobRetryDelay(j.Attempts))
+	q.logger.Warn("Job failed, retrying later", zap.Error(err), zapFieldJobID, zapFieldJobType, zap.Time("runAt", j.RunAt))
+	jobCounter(j.Type, "retry").Inc()
+	if err = q.store.push(j); err != nil {
+		q.logger.Error("Couldn't reschedule job", zap.Error(err), zapFieldJobID, zapFieldJobType)
+	}
+}
+
+// jobRetryDelay returns the delay before the next run of a job that failed the given number of times.
+func jobRetryDelay(attempts int) time.Duration {
+	return jobRetryBaseDelay << (attempts - 1)
+}
+
+var _ jobStore = (*badgerJobStore)(nil)
+
+// badgerJobStore is the job store backed by BadgerDB.
+// The keys start with the zero-padded run time, so that iterating over them returns the jobs in the order they're due.
+type badgerJobStore struct {
+	db        *badger.DB
+	keyPrefix string
+}
+
+func (s *badgerJobStore) key(j job) string {
+	return s.keyPrefix + fmt.Sprintf("%020d", j.RunAt.UnixNano()) + "_" + j.ID
+}
+
+func (s *badgerJobStore) push(j job) error {
+	return gobSet(s.db, s.key(j), j)
+}
+
+func (s *badgerJobStore) pop(_ context.Context) (job, bool, error) {
+	var result job
+	var found bool
+	prefix := []byte(s.keyPrefix)
+	now := []byte(s.keyPrefix + fmt.Sprintf("%020d", time.Now().UnixNano()))
+	err := s.db.Update(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		it.Seek(prefix)
+		// The key of a due job is lower than the key of the current time
+		if !it.ValidForPrefix(prefix) || string(it.Item().Key()) > string(now) {
+			return nil
+		}
+		item := it.Item()
+		err := item.Value(func(val []byte) error {
+			return fromGob(val, &result)
+		})
+		if err != nil {
+			return err
+		}
+		found = true
+		return txn.Delete(item.KeyCopy(nil))
+	})
+	// Another worker took the same job
+	if err == badger.ErrConflict {
+		return job{}, false, nil
+	} else if err != nil {
+		return job{}, false, err
+	}
+	return result, found, nil
+}
+
+func (s *badgerJobStore) count(_ context.Context) (int, error) {
+	prefix := []byte(s.keyPrefix)
+	count := 0
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+var _ jobStore = (*redisJobStore)(nil)
+
+// redisJobStore is the job store backed by Redis, so that jobs are shared by multiple instances.
+// The jobs are members of a sorted set, scored by their run time.
+type redisJobStore struct {
+	rdb *redis.Client
+	key string
+}
+
+func (s *redisJobStore) push(j job) error {
+	b, err := toGob(j)
+	if err != nil {
+		return fmt.Errorf("Couldn't encode job: %w", err)
+	}
+	return s.rdb.ZAdd(context.Background(), s.key, &redis.Z{
+		Score:  float64(j.RunAt.UnixNano()),
+		Member: b,
+	}).Err()
+}
+
+func (s *redisJobStore) pop(ctx context.Context) (job, bool, error) {
+	members, err := s.rdb.ZRangeByScore(ctx, s.key, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Count: 1,
+	}).Result()
+	if err != nil {
+		return job{}, false, fmt.Errorf("Couldn't get job from Redis: %w", err)
+	} else if len(members) == 0 {
+		return job{}, false, nil
+	}
+	// Only the instance that removes the member runs the job
+	removed, err := s.rdb.ZRem(ctx, s.key, members[0]).Result()
+	if err != nil {
+		return job{}, false, fmt.Errorf("Couldn't remove job from Redis: %w", err)
+	} else if removed == 0 {
+		return job{}, false, nil
+	}
+	var result job
+	if err = fromGob([]byte(members[0]), &result); err != nil {
+		return job{}, false, fmt.Errorf("Couldn't decode job: %w", err)
+	}
+	return result, true, nil
+}
+
+func (s *redisJobStore) count(ctx context.Context) (int, error) {
+	count, err := s.rdb.ZCard(ctx, s.key).Result()
+	return int(count), err
+}
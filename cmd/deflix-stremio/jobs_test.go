@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBadgerJobStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	store := &badgerJobStore{
+		db:        db,
+		keyPrefix: "job_",
+	}
+	ctx := context.Background()
+
+	_, found, err := store.pop(ctx)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	now := time.Now()
+	require.NoError(t, store.push(job{ID: "later", Type: "foo", RunAt: now.Add(time.Hour)}))
+	require.NoError(t, store.push(job{ID: "second", Type: "foo", RunAt: now.Add(-time.Minute)}))
+	require.NoError(t, store.push(job{ID: "first", Type: "foo", Payload: []byte("bar"), RunAt: now.Add(-time.Hour)}))
+	count, err := store.count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	// Due jobs are popped in the order of their run time
+	j, found, err := store.pop(ctx)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "first", j.ID)
+	require.Equal(t, []byte("bar"), j.Payload)
+	j, found, err = store.pop(ctx)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "second", j.ID)
+
+	// The remaining job isn't due yet
+	_, found, err = store.pop(ctx)
+	require.NoError(t, err)
+	require.False(t, found)
+	count, err = store.count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestJobQueue(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	store := &badgerJobStore{
+		db:        db,
+		keyPrefix: "job_",
+	}
+	q := newJobQueue(store, zap.NewNop())
+	ctx := context.Background()
+
+	payloads := make(chan string, 1)
+	q.register("succeeding", func(ctx context.Context, payload []byte) error {
+		payloads <- string(payload)
+		return nil
+	})
+	q.register("failing", func(ctx context.Context, payload []byte) error {
+		return errors.New("foo")
+	})
+
+	require.NoError(t, q.enqueue("succeeding", []byte("bar"), 0))
+	j, found, err := store.pop(ctx)
+	require.NoError(t, err)
+	require.True(t, found)
+	q.process(ctx, j)
+	require.Equal(t, "bar", <-payloads)
+	count, err := store.count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	// A failing job is rescheduled with a delay
+	require.NoError(t, q.enqueue("failing", nil, 0))
+	j, _, err = store.pop(ctx)
+	require.NoError(t, err)
+	q.process(ctx, j)
+	_, found, err = store.pop(ctx)
+	require.NoError(t, err)
+	require.False(t, found)
+	count, err = store.count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	// And dropped after the last attempt
+	j.Attempts = jobMaxAttempts - 1
+	require.NoError(t, db.DropAll())
+	q.process(ctx, j)
+	count, err = store.count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	// Jobs without handler are dropped
+	q.process(ctx, job{ID: "123", Type: "unknown"})
+	count, err = store.count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
+
+func TestJobRetryDelay(t *testing.T) {
+	require.Equal(t, jobRetryBaseDelay, jobRetryDelay(1))
+	require.Equal(t, 2*jobRetryBaseDelay, jobRetryDelay(2))
+	require.Equal(t, 8*jobRetryBaseDelay, jobRetryDelay(4))
+}
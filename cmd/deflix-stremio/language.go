@@ -0,0 +1,81 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// torrentLanguage is a language (or a language tag like "multi") that can be detected in torrent names.
+type torrentLanguage struct {
+	code  string
+	name  string
+	flag  string
+	regex *regexp.Regexp
+}
+
+// torrentLanguages are the languages that are detected in torrent names, in the order in which they're shown.
+// The tags are the ones commonly used by release groups, like "GERMAN", "iTA" or "TRUEFRENCH".
+// "vostfr" is the original audio with French subtitles, so it's separate from "fr".
+var torrentLanguages = []torrentLanguage{
+	{"multi", "Multi audio", "🌐", regexp.MustCompile(`(?i)\b(multi|dual[ .-]?audio|multi[ .-]?audio)\b`)},
+	{"en", "English", "🇬🇧", regexp.MustCompile(`(?i)\b(english|eng)\b`)},
+	{"fr", "French", "🇫🇷", regexp.MustCompile(`(?i)\b(french|truefrench|vff|vfq|vfi|vf2?)\b`)},
+	{"vostfr", "French subtitles", "🇫🇷💬", regexp.MustCompile(`(?i)\b(vostfr|subfrench)\b`)},
+	{"de", "German", "🇩🇪", regexp.MustCompile(`(?i)\b(german|deutsch|ger)\b`)},
+	{"it", "Italian", "🇮🇹", regexp.MustCompile(`(?i)\b(italian|ita)\b`)},
+	{"es", "Spanish", "🇪🇸", regexp.MustCompile(`(?i)\b(spanish|castellano|esp|latino)\b`)},
+	{"pt", "Portuguese", "🇵🇹", regexp.MustCompile(`(?i)\b(portuguese|dublado|pt[ .-]?br)\b`)},
+	{"ru", "Russian", "🇷🇺", regexp.MustCompile(`(?i)\b(russian|rus)\b`)},
+	{"hi", "Hindi", "🇮🇳", regexp.MustCompile(`(?i)\b(hindi)\b`)},
+	{"ja", "Japanese", "🇯🇵", regexp.MustCompile(`(?i)\b(japanese|jap|jpn)\b`)},
+	{"ko", "Korean", "🇰🇷", regexp.MustCompile(`(?i)\b(korean|kor)\b`)},
+}
+
+// detectLanguages returns the codes of the languages that are tagged in the torrent's title or file name, in the order of torrentLanguages.
+// Torrents without any tag are usually English, but that's not detected here, so the result is empty for them.
+func detectLanguages(torrent imdb2torrent.Result) []string {
+	// "_" is a word character, but some release names use it as separator
+	name := strings.ReplaceAll(torrent.Title+" "+hintsFromMagnet(torrent.MagnetURL).Filename, "_", " ")
+	var result []string
+	for _, language := range torrentLanguages {
+		if language.regex.MatchString(name) {
+			result = append(result, language.code)
+		}
+	}
+	return result
+}
+
+// matchesLanguages returns whether the torrent has one of the given languages.
+// Torrents with multiple audio tracks always match, and ones without any language tag are treated as English.
+func matchesLanguages(torrent imdb2torrent.Result, languages []string) bool {
+	detected := detectLanguages(torrent)
+	if len(detected) == 0 {
+		detected = []string{"en"}
+	}
+	for _, code := range detected {
+		if code == "multi" {
+			return true
+		}
+		for _, language := range languages {
+			if code == language {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// languageFlags returns the flags of the languages that are tagged in the torrent, like "🇩🇪 / 🇬🇧", or an empty string if there are none.
+func languageFlags(torrent imdb2torrent.Result) string {
+	var flags []string
+	for _, code := range detectLanguages(torrent) {
+		for _, language := range torrentLanguages {
+			if language.code == code {
+				flags = append(flags, language.flag)
+			}
+		}
+	}
+	return strings.Join(flags, " / ")
+}
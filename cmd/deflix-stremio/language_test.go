@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestDetectLanguages(t *testing.T) {
+	require.Equal(t, []string{"de"}, detectLanguages(imdb2torrent.Result{Title: "Big.Buck.Bunny.2008.GERMAN.1080p.BluRay.x264"}))
+	require.Equal(t, []string{"multi", "fr"}, detectLanguages(imdb2torrent.Result{Title: "Big Buck Bunny", MagnetURL: "magnet:?xt=urn:btih:A&dn=Big.Buck.Bunny.2008.MULTi.TRUEFRENCH.1080p"}))
+	require.Equal(t, []string{"vostfr"}, detectLanguages(imdb2torrent.Result{Title: "Big_Buck_Bunny_2008_VOSTFR_720p"}))
+	require.Equal(t, []string{"it"}, detectLanguages(imdb2torrent.Result{Title: "Big.Buck.Bunny.2008.iTA.AC3.1080p"}))
+	// No false positives from words that contain a tag
+	require.Empty(t, detectLanguages(imdb2torrent.Result{Title: "La.Dolce.Vita.1960.Germany.1080p"}))
+}
+
+func TestApplyLanguagePreference(t *testing.T) {
+	torrents := []imdb2torrent.Result{
+		{Title: "Foo.2020.1080p.BluRay"},
+		{Title: "Foo.2020.GERMAN.1080p.BluRay"},
+		{Title: "Foo.2020.MULTi.1080p.BluRay"},
+		{Title: "Foo.2020.iTA.1080p.BluRay"},
+	}
+	require.Equal(t, []imdb2torrent.Result{torrents[1], torrents[2]}, applyPreferences(torrents, userData{Languages: []string{"de"}}))
+	// Torrents without language tag are English
+	require.Equal(t, []imdb2torrent.Result{torrents[0], torrents[2], torrents[3]}, applyPreferences(torrents, userData{Languages: []string{"en", "it"}}))
+
+	require.Equal(t, "🇩🇪", languageFlags(torrents[1]))
+	require.Empty(t, languageFlags(torrents[0]))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/gofiber/fiber/v2"
+	gocache "github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+// rejectedRequestsCounter returns the counter for requests that were rejected because of the server limits, with the reason "concurrency", "bodySize", "rateIP" or "rateUser".
+func rejectedRequestsCounter(reason string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`rejected_requests_total{reason=%q}`, reason))
+}
+
+// createServerLimitsMiddleware creates a middleware that rejects requests when too many are handled at the same time or when their body is too large.
+// go-stremio creates the Fiber app itself and doesn't allow configuring its limits. Its own limits are a read timeout of 5s, write and idle timeouts of 9s,
+// and Fiber's defaults of 256k concurrent connections and a 4 MB body size, so these limits are only effective when they're lower.
+// 0 means no limit for both.
+func createServerLimitsMiddleware(maxConcurrentRequests, maxRequestBody int, logger *zap.Logger) fiber.Handler {
+	var sem chan struct{}
+	if maxConcurrentRequests > 0 {
+		sem = make(chan struct{}, maxConcurrentRequests)
+	}
+
+	return func(c *fiber.Ctx) error {
+		if maxRequestBody > 0 && len(c.Body()) > maxRequestBody {
+			logger.Info("Request body too large", zap.Int("bodySize", len(c.Body())), zap.String("url", c.OriginalURL()))
+			rejectedRequestsCounter("bodySize").Inc()
+			return c.SendStatus(fiber.StatusRequestEntityTooLarge)
+		}
+
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			default:
+				logger.Warn("Too many concurrent requests, rejecting request", zap.String("url", c.OriginalURL()))
+				rejectedRequestsCounter("concurrency").Inc()
+				// Stremio retries, so a short delay is enough
+				c.Set(fiber.HeaderRetryAfter, "1")
+				return c.SendStatus(fiber.StatusServiceUnavailable)
+			}
+		}
+
+		return c.Next()
+	}
+}
+
+// tokenBucket allows bursts of requests up to its capacity and refills continuously.
+type tokenBucket struct {
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// requestRateLimiter limits the requests per key (like a client IP) with a token bucket per key.
+type requestRateLimiter struct {
+	// Tokens per second
+	rate float64
+	// Max tokens, which is the max burst size
+	capacity float64
+	// Items expire when they're not used for long enough to be full again, because then a new bucket is the same
+	buckets *gocache.Cache
+	lock    sync.Mutex
+}
+
+// newRequestRateLimiter creates a new requestRateLimiter that allows the given number of requests per minute, all of which can be made at once.
+func newRequestRateLimiter(perMinute int) *requestRateLimiter {
+	refillDuration := time.Minute
+	return &requestRateLimiter{
+		rate:     float64(perMinute) / refillDuration.Seconds(),
+		capacity: float64(perMinute),
+		buckets:  gocache.New(refillDuration, 10*time.Minute),
+	}
+}
+
+// allow reports whether a request with the given key is allowed and if so, takes a token from its bucket.
+// If it's not allowed, it also returns the duration after which the next request is allowed.
+func (l *requestRateLimiter) allow(key string) (bool, time.Duration) {
+	bucket := l.getBucket(key)
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	now := time.Now()
+	bucket.tokens = math.Min(l.capacity, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (l *requestRateLimiter) getBucket(key string) *tokenBucket {
+	// Lock so that concurrent first requests don't create multiple buckets
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if bucketIface, found := l.buckets.Get(key); found {
+		// Extend the expiration
+		l.buckets.SetDefault(key, bucketIface)
+		return bucketIface.(*tokenBucket)
+	}
+	bucket := &tokenBucket{
+		tokens: l.capacity,
+		last:   time.Now(),
+	}
+	l.buckets.SetDefault(key, bucket)
+	return bucket
+}
+
+// createRateLimitMiddleware creates a middleware that limits the requests per minute of each client IP and of each user, identified by the hash of the user data.
+// It's meant for the stream and redirect endpoints, where misbehaving clients and scrapers would exhaust the rate limits of the torrent sites for everyone.
+// A separate middleware (with separate limits) is required for each endpoint.
+// When trustForwardedFor is true, the client IP is taken from the first "X-Forwarded-For" entry, which is required when running behind a reverse proxy.
+func createRateLimitMiddleware(perMinute int, trustForwardedFor bool, logger *zap.Logger) fiber.Handler {
+	limiter := newRequestRateLimiter(perMinute)
+
+	return func(c *fiber.Ctx) error {
+		ip := c.IP()
+		if trustForwardedFor && len(c.IPs()) > 0 {
+			ip = c.IPs()[0]
+		}
+		allowed, retryAfter := limiter.allow("ip-" + ip)
+		reason := "rateIP"
+		if allowed {
+			userHash := sha256.Sum256([]byte(c.Params("userData", "")))
+			allowed, retryAfter = limiter.allow("user-" + base64.RawURLEncoding.EncodeToString(userHash[:]))
+			reason = "rateUser"
+		}
+		if !allowed {
+			logger.Info("Rate limit exceeded, rejecting request", zap.String("reason", reason), zap.String("ip", ip))
+			rejectedRequestsCounter(reason).Inc()
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			return c.SendStatus(fiber.StatusTooManyRequests)
+		}
+		return c.Next()
+	}
+}
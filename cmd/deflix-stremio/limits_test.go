@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestServerLimitsMiddleware(t *testing.T) {
+	app := fiber.New()
+	app.Use(createServerLimitsMiddleware(1, 10, zap.NewNop()))
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		close(entered)
+		<-release
+		return c.SendStatus(fiber.StatusOK)
+	})
+	app.All("/fast", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	res, err := app.Test(httptest.NewRequest("POST", "/fast", strings.NewReader("0123456789")))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, res.StatusCode)
+	res, err = app.Test(httptest.NewRequest("POST", "/fast", strings.NewReader("0123456789a")))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusRequestEntityTooLarge, res.StatusCode)
+
+	// While the slow request is handled, no other request is allowed
+	slowDone := make(chan int)
+	go func() {
+		res, err := app.Test(httptest.NewRequest("GET", "/slow", nil), -1)
+		if err != nil {
+			slowDone <- 0
+			return
+		}
+		slowDone <- res.StatusCode
+	}()
+	<-entered
+	res, err = app.Test(httptest.NewRequest("GET", "/fast", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusServiceUnavailable, res.StatusCode)
+	require.Equal(t, "1", res.Header.Get("Retry-After"))
+	close(release)
+	require.Equal(t, fiber.StatusOK, <-slowDone)
+
+	res, err = app.Test(httptest.NewRequest("GET", "/fast", nil))
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, res.StatusCode)
+}
+
+func TestRequestRateLimiter(t *testing.T) {
+	limiter := newRequestRateLimiter(60)
+	for i := 0; i < 60; i++ {
+		allowed, _ := limiter.allow("foo")
+		require.True(t, allowed)
+	}
+	allowed, retryAfter := limiter.allow("foo")
+	require.False(t, allowed)
+	require.InDelta(t, time.Second, retryAfter, float64(100*time.Millisecond))
+	// Other keys have their own bucket
+	allowed, _ = limiter.allow("bar")
+	require.True(t, allowed)
+
+	// 1 token per second
+	bucket := limiter.getBucket("foo")
+	bucket.last = bucket.last.Add(-2 * time.Second)
+	allowed, _ = limiter.allow("foo")
+	require.True(t, allowed)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	app := fiber.New()
+	app.Use("/:userData/stream", createRateLimitMiddleware(2, true, zap.NewNop()))
+	app.Get("/:userData/stream", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	request := func(userData, ip string) int {
+		req := httptest.NewRequest("GET", "/"+userData+"/stream", nil)
+		req.Header.Set("X-Forwarded-For", ip)
+		res, err := app.Test(req)
+		require.NoError(t, err)
+		return res.StatusCode
+	}
+
+	require.Equal(t, fiber.StatusOK, request("a", "1.1.1.1"))
+	require.Equal(t, fiber.StatusOK, request("a", "1.1.1.1"))
+	// Same IP
+	require.Equal(t, fiber.StatusTooManyRequests, request("b", "1.1.1.1"))
+	// Same user
+	require.Equal(t, fiber.StatusTooManyRequests, request("a", "2.2.2.2"))
+	require.Equal(t, fiber.StatusOK, request("b", "2.2.2.2"))
+}
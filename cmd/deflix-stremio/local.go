@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// isLocalMode returns true if the addon should run in local mode, either because it was requested explicitly,
+// or because the binary was started without any configuration from a terminal (for example by a double-click on Windows).
+// Environment variables and a config file count as configuration, so that for example a container that's started with "docker run -it" and a BASE_URL isn't switched to local mode.
+func isLocalMode(c config) bool {
+	if c.Local {
+		return true
+	}
+	if len(os.Args) > 1 || len(c.explicit) > 0 {
+		return false
+	}
+	stat, err := os.Stdin.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// applyLocalMode changes the config so that the addon runs on the local machine for a single user.
+// It keeps the configured port if it's free, because the port is part of the URL of the installed addon, and otherwise picks a free one.
+// The bind address isn't changed, because it's "localhost" by default, and in a container (which might be started from a terminal as well) it must stay "0.0.0.0".
+// A port or base URL that was set explicitly is never changed.
+func (c *config) applyLocalMode(logger *zap.Logger) {
+	if !c.explicit["port"] && !isPortFree(c.BindAddr, c.Port) {
+		port, err := freePort(c.BindAddr)
+		if err != nil {
+			logger.Fatal("Couldn't find a free port", zap.Error(err))
+		}
+		logger.Info("Configured port is in use, using a free one instead", zap.Int("configuredPort", c.Port), zap.Int("port", port))
+		c.Port = port
+	}
+	if !c.explicit["baseURL"] {
+		c.BaseURL = "http://localhost:" + strconv.Itoa(c.Port)
+	}
+}
+
+// isPortFree returns true if the port on the given address can be listened on.
+func isPortFree(addr string, port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// freePort returns a port on the given address that's currently free.
+func freePort(addr string) (int, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(addr, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// welcomeLocalUser waits until the addon is listening, then prints a message with the configure URL and opens it in the browser.
+func welcomeLocalUser(ctx context.Context, baseURL string, logger *zap.Logger) {
+	if !waitForServer(ctx, baseURL+"/healthz") {
+		return
+	}
+	configureURL := baseURL + "/configure"
+	fmt.Print(`
+  ================================================================
+
+    Deflix is running!
+
+    Open this page to configure the addon and install it in Stremio:
+
+        ` + configureURL + `
+
+    Keep this window open while you watch, Stremio needs it.
+    Press Ctrl+C or close this window to stop Deflix.
+
+  ================================================================
+
+`)
+	if err := openBrowser(configureURL); err != nil {
+		logger.Info("Couldn't open browser, please open the configure page manually", zap.Error(err), zap.String("url", configureURL))
+	}
+}
+
+// waitForServer polls the URL until it responds successfully. It returns false if the context is canceled before that.
+func waitForServer(ctx context.Context, url string) bool {
+	httpClient := &http.Client{
+		Timeout: time.Second,
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false
+	}
+	for {
+		if res, err := httpClient.Do(req); err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// openBrowser opens the URL in the user's default browser.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	case "darwin":
+		cmd = exec.Command("open", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestApplyLocalMode(t *testing.T) {
+	port, err := freePort("localhost")
+	require.NoError(t, err)
+
+	// Free port is kept
+	c := config{BindAddr: "localhost", Port: port}
+	c.applyLocalMode(zap.NewNop())
+	require.Equal(t, port, c.Port)
+	require.Equal(t, "http://localhost:"+strconv.Itoa(port), c.BaseURL)
+
+	// Used port is replaced
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	require.NoError(t, err)
+	defer l.Close()
+	c = config{BindAddr: "localhost", Port: port}
+	c.applyLocalMode(zap.NewNop())
+	require.NotEqual(t, port, c.Port)
+	require.Equal(t, "http://localhost:"+strconv.Itoa(c.Port), c.BaseURL)
+}
+
+func TestApplyLocalModeExplicit(t *testing.T) {
+	port, err := freePort("localhost")
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Explicitly set port and base URL are kept, even if the port is in use
+	c := config{BindAddr: "localhost", Port: port, BaseURL: "https://deflix.example.com", explicit: map[string]bool{"port": true, "baseURL": true}}
+	c.applyLocalMode(zap.NewNop())
+	require.Equal(t, port, c.Port)
+	require.Equal(t, "https://deflix.example.com", c.BaseURL)
+
+	// Any explicit option prevents the automatic local mode
+	require.False(t, isLocalMode(config{explicit: map[string]bool{"baseURL": true}}))
+	require.True(t, isLocalMode(config{Local: true, explicit: map[string]bool{"local": true}}))
+}
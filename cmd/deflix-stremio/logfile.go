@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Timestamp format of rotated log files. It's sortable and doesn't contain colons, which aren't allowed in file names on Windows.
+const logFileTimeFormat = "2006-01-02T15-04-05.000"
+
+var _ zapcore.WriteSyncer = (*rotatingFile)(nil)
+
+// rotatingFile is a log file that's renamed with a timestamp when it reaches its max size, after which a new file is started.
+// Only the given number of rotated files are kept, and only as long as they're not older than the max age.
+type rotatingFile struct {
+	path string
+	// 0 means no rotation
+	maxSize int64
+	// 0 means all rotated files are kept
+	maxBackups int
+	// 0 means rotated files don't expire
+	maxAge time.Duration
+	file   *os.File
+	size   int64
+	lock   sync.Mutex
+}
+
+// newRotatingFile opens or creates the log file at the given path, including its directory.
+// New logs are appended to an existing file.
+func newRotatingFile(path string, maxSizeMB, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		maxAge:     maxAge,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("Couldn't create log directory: %w", err)
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	// Rotated files from previous runs might have expired in the meantime
+	r.removeOldBackups()
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("Couldn't open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Couldn't get log file info: %w", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// Write writes the log entry to the file, after rotating it if the entry would exceed the max size.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// An empty file isn't rotated, even if the single entry is larger than the max size
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Sync() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.file.Sync()
+}
+
+func (r *rotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.file.Close()
+}
+
+// rotate renames the current file to one with a timestamp and opens a new one.
+// It must only be called while holding the lock.
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("Couldn't close log file: %w", err)
+	}
+	prefix, ext := r.backupNameParts()
+	if err := os.Rename(r.path, prefix+time.Now().Format(logFileTimeFormat)+ext); err != nil {
+		return fmt.Errorf("Couldn't rename log file: %w", err)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.removeOldBackups()
+	return nil
+}
+
+// removeOldBackups removes the rotated files that exceed the max number of backups or the max age.
+// Errors are ignored, because they must not prevent logging and can't be logged.
+func (r *rotatingFile) removeOldBackups() {
+	prefix, ext := r.backupNameParts()
+	backups, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return
+	}
+	// Newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	i := 0
+	for _, backup := range backups {
+		timestamp, err := time.ParseInLocation(logFileTimeFormat, strings.TrimSuffix(strings.TrimPrefix(backup, prefix), ext), time.Local)
+		if err != nil {
+			// Not a rotated file, but a different one with a similar name
+			continue
+		}
+		if (r.maxBackups > 0 && i >= r.maxBackups) || (r.maxAge > 0 && time.Since(timestamp) > r.maxAge) {
+			_ = os.Remove(backup)
+		}
+		i++
+	}
+}
+
+// backupNameParts returns the parts of the rotated files' paths before and after the timestamp.
+// For "/foo/deflix-stremio.log" it's "/foo/deflix-stremio-" and ".log".
+func (r *rotatingFile) backupNameParts() (string, string) {
+	ext := filepath.Ext(r.path)
+	return strings.TrimSuffix(r.path, ext) + "-", ext
+}
+
+// withLogFile returns a logger that writes to the given file in addition to the original logger's output, with the same level.
+// The encoder config is the same as go-stremio's, so that the file contains the same log lines.
+func withLogFile(logger *zap.Logger, file zapcore.WriteSyncer, encoding string) *zap.Logger {
+	encoderConfig := zapcore.EncoderConfig{
+		TimeKey:        "ts",
+		LevelKey:       "level",
+		NameKey:        "logger",
+		CallerKey:      "caller",
+		MessageKey:     "msg",
+		StacktraceKey:  "stacktrace",
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeLevel:    zapcore.CapitalLevelEncoder,
+		EncodeTime:     zapcore.RFC3339TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+	}
+	var encoder zapcore.Encoder
+	if encoding == "json" {
+		encoderConfig.EncodeCaller = zapcore.ShortCallerEncoder
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	} else {
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	}
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, zapcore.NewCore(encoder, file, core))
+	}))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "deflix-logs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deflix.log")
+
+	r, err := newRotatingFile(path, 1, 2, 0)
+	require.NoError(t, err)
+	defer r.Close()
+	line := []byte(strings.Repeat("a", 400*1024) + "\n")
+	for i := 0; i < 10; i++ {
+		_, err = r.Write(line)
+		require.NoError(t, err)
+		// Rotated files with the same timestamp would overwrite each other
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	backups, err := filepath.Glob(filepath.Join(dir, "deflix-*.log"))
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	// 10 lines with 2 lines per file
+	require.Equal(t, int64(2*len(line)), info.Size())
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "deflix-logs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deflix.log")
+
+	oldBackup := filepath.Join(dir, "deflix-"+time.Now().Add(-48*time.Hour).Format(logFileTimeFormat)+".log")
+	newBackup := filepath.Join(dir, "deflix-"+time.Now().Add(-time.Hour).Format(logFileTimeFormat)+".log")
+	other := filepath.Join(dir, "deflix-other.log")
+	for _, file := range []string{oldBackup, newBackup, other} {
+		require.NoError(t, os.WriteFile(file, []byte("foo\n"), 0o644))
+	}
+
+	r, err := newRotatingFile(path, 1, 0, 24*time.Hour)
+	require.NoError(t, err)
+	defer r.Close()
+
+	require.NoFileExists(t, oldBackup)
+	require.FileExists(t, newBackup)
+	require.FileExists(t, other)
+}
+
+func TestWithLogFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "deflix-logs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deflix.log")
+
+	r, err := newRotatingFile(path, 1, 0, 0)
+	require.NoError(t, err)
+	defer r.Close()
+	// The file gets the original logger's level
+	original := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(io.Discard), zap.InfoLevel))
+	logger := withLogFile(original, r, "json")
+	logger.Debug("ignored")
+	logger.Info("foo", zap.String("bar", "baz"))
+
+	logs, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(logs), `"msg":"foo","bar":"baz"`)
+	require.NotContains(t, string(logs), "ignored")
+}
@@ -4,43 +4,58 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
-	"io/ioutil"
+	"io/fs"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/go-redis/redis/v8"
-	"github.com/markbates/pkger"
 	gocache "github.com/patrickmn/go-cache"
-	"github.com/spf13/afero"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 
-	"github.com/deflix-tv/go-debrid/alldebrid"
-	"github.com/deflix-tv/go-debrid/premiumize"
-	"github.com/deflix-tv/go-debrid/realdebrid"
 	"github.com/deflix-tv/go-stremio"
 	"github.com/deflix-tv/go-stremio/pkg/cinemeta"
 	"github.com/deflix-tv/imdb2torrent"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/alldebrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/debridlink"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/premiumize"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/realdebrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/torbox"
 	"github.com/doingodswork/deflix-stremio/pkg/logadapter"
 	"github.com/doingodswork/deflix-stremio/pkg/metafetcher"
+	"github.com/doingodswork/deflix-stremio/pkg/s3"
+	"github.com/doingodswork/deflix-stremio/pkg/torznab"
+	"github.com/doingodswork/deflix-stremio/web"
 )
 
 const (
 	version = "0.11.1"
+
+	// ID of the "Popular on Deflix" catalog
+	popularCatalogID = "deflix-popular"
+	// Number of items in the "Popular on Deflix" catalog
+	catalogSize = 100
+	// Duration for which the catalog is cached before the most requested IMDb IDs and their metadata are fetched again
+	catalogCacheAge = time.Hour
 )
 
 var manifest = stremio.Manifest{
 	ID:          "tv.deflix.stremio",
 	Name:        "Deflix - Debrid flicks",
-	Description: "Finds movies and TV shows on YTS, The Pirate Bay, 1337x, RARBG and ibit and automatically turns them into cached HTTP streams with a debrid service like RealDebrid, AllDebrid or Premiumize, for high speed 4k streaming and no P2P uploading (!). For more info see https://www.deflix.tv",
+	Description: "Finds movies and TV shows on YTS, The Pirate Bay, 1337x, RARBG and ibit and automatically turns them into cached HTTP streams with a debrid service like RealDebrid, AllDebrid, Premiumize, Debrid-Link or Torbox, for high speed 4k streaming and no P2P uploading (!). For more info see https://www.deflix.tv",
 	Version:     version,
 
 	ResourceItems: []stremio.ResourceItem{
@@ -50,10 +65,24 @@ var manifest = stremio.Manifest{
 			// Shouldn't be required as long as they're defined globally in the manifest, but some Stremio clients send stream requests for non-IMDb IDs, so maybe setting this here as well helps
 			IDprefixes: []string{"tt"},
 		},
+		{
+			Name:  "catalog",
+			Types: []string{"movie", "series"},
+		},
 	},
 	Types: []string{"movie", "series"},
-	// An empty slice is required for serializing to a JSON that Stremio expects
-	Catalogs: []stremio.CatalogItem{},
+	Catalogs: []stremio.CatalogItem{
+		{
+			Type: "movie",
+			ID:   popularCatalogID,
+			Name: "Popular on Deflix",
+		},
+		{
+			Type: "series",
+			ID:   popularCatalogID,
+			Name: "Popular on Deflix",
+		},
+	},
 
 	IDprefixes: []string{"tt"},
 	// Must use www.deflix.tv instead of just deflix.tv because GitHub takes care of redirecting non-www to www and this leads to HTTPS certificate issues.
@@ -79,15 +108,37 @@ var (
 	// 10 days: weekend -> next weekend.
 	// TODO: We don't know how long an RealDebrid stream URL is valid - so maybe this should be shorter (returning an invalid stream URL is worse then doing another torrent lookup + RealDebrid conversion, but keep in mind that the video player might have issues when another URL of the same file, or a completely other file (for example because the previous one isn't available on RealDebrid anymore) is returned). Also see similar TODO comment in handlers.go file.
 	streamExpiration = 10 * 24 * time.Hour // 10 days
-	// Expiration for cached users' RealDebrid API tokens
+	// Max expiration of redirect and stream cache items in the in-memory layer in front of BadgerDB
+	memoryLayerExpiration = time.Hour
+	// Max expiration for cached users' debrid API keys and tokens. The RealDebrid, AllDebrid and Premiumize clients check them at least once a day regardless.
 	tokenExpiration = 24 * time.Hour
+	// Cached OAuth2 access tokens are refreshed this long before they expire, so that they're still valid for the debrid API calls of the request
+	accessTokenExpiryMargin = 5 * time.Minute
+	// Expiration for signed links to the status endpoint
+	statusLinkExpiration = time.Hour
+	// Rolling window for the per-searcher coverage stats
+	coverageWindow = 24 * time.Hour
 )
 
 // Persistent stores
 var (
-	// BadgerDB
+	// BadgerDB or PostgreSQL, depending on config
 	torrentCache  *resultStore
 	cinemetaCache *metaStore
+	// Size and seeders of the torrents in torrentCache
+	foundTorrentStats *torrentStatsStore
+	// Only set if PostgreSQL is configured
+	postgres *postgresStore
+
+	// BadgerDB
+	// For the "Popular on Deflix" catalog
+	popularity *popularityStore
+	// For the availability refresher
+	recentRequests *recentRequestStore
+	// Only set if analytics are enabled
+	analytics *analyticsStore
+	// For the job queue, unless Redis is configured
+	badgerJobs *badgerJobStore
 )
 
 // In-memory caches, filled from a file on startup and persisted to a file in regular intervals.
@@ -96,19 +147,37 @@ var (
 	rdAvailabilityCache *creationCache
 	adAvailabilityCache *creationCache
 	pmAvailabilityCache *creationCache
-	tokenCache          *creationCache
-	// go-cache or Redis, depending on config
+	dlAvailabilityCache *creationCache
+	tbAvailabilityCache *creationCache
+	// Debrid service ID to cache of info hashes that weren't instantly available. Not persisted. Empty if disabled.
+	unavailabilityCaches = map[string]*creationCache{}
+	// Validity of API keys and tokens, per debrid service
+	rdTokenCache *creationCache
+	adTokenCache *creationCache
+	pmTokenCache *creationCache
+	dlTokenCache *creationCache
+	tbTokenCache *creationCache
+	// Persisted in BadgerDB, with go-cache or Redis as read-through layer, depending on config
 	redirectCache *goCache
 	streamCache   *goCache
 )
 
 // Clients
 var (
-	metaFetcher  *metafetcher.Client
-	searchClient *imdb2torrent.Client
-	rdClient     *realdebrid.Client
-	adClient     *alldebrid.Client
-	pmClient     *premiumize.Client
+	metaFetcher *metafetcher.Client
+	// For the language catalogs, because imdb2meta's metadata doesn't contain the language
+	cinemetaClient *cinemeta.Client
+	searchClient   *imdb2torrent.Client
+	// For anime with Kitsu IDs or absolute episode numbers. Only set if Nyaa is configured.
+	animeSearcher *nyaaClient
+	// Debrid service ID to resolver
+	resolvers  debrid.Registry
+	rdTorrents *rdTorrentClient
+	episodes   *episodeClient
+	pmCloud    *pmCloudClient
+	accClient  *accountClient
+	// Only set if an S3-compatible object storage is configured
+	s3Client *s3.Client
 )
 
 var (
@@ -130,7 +199,8 @@ func init() {
 }
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Create an "info" logger at first, replace later in case the logging level is configured to be something else
 	logger, err := stremio.NewLogger("info", stremio.DefaultOptions.LogEncoding)
@@ -138,11 +208,22 @@ func main() {
 		panic(err)
 	}
 
+	// The "support-bundle" command creates an archive for bug reports instead of running the addon
+	if len(os.Args) > 1 && os.Args[1] == "support-bundle" {
+		runSupportBundle(os.Args[2:], logger)
+		return
+	}
+	// The "audit-lookup" command searches the audit log instead of running the addon
+	if len(os.Args) > 1 && os.Args[1] == "audit-lookup" {
+		runAuditLookup(os.Args[2:], logger)
+		return
+	}
+
 	// Parse and validate config
 
 	logger.Info("Parsing config...")
 	config := parseConfig(logger)
-	configJSON, err := json.Marshal(config)
+	configJSON, err := json.Marshal(config.redacted())
 	if err != nil {
 		logger.Fatal("Couldn't marshal config to JSON", zap.Error(err))
 	}
@@ -154,11 +235,39 @@ func main() {
 	}
 	logger.Info("Parsed config", zap.ByteString("config", configJSON))
 
+	if config.DevMode {
+		upstreamURL, err := startDevUpstream(ctx, logger)
+		if err != nil {
+			logger.Fatal("Couldn't start fake upstream server for dev mode", zap.Error(err))
+		}
+		config.applyDevMode(upstreamURL)
+		logger.Warn("Running in dev mode, all torrent sites and debrid services are fake", zap.String("upstreamURL", upstreamURL))
+	}
+	local := isLocalMode(config)
+	if local {
+		config.applyLocalMode(logger)
+		logger.Info("Running in local mode", zap.String("baseURL", config.BaseURL))
+	}
 	config.validate(logger)
 	logger.Info("Validated config")
 
+	if config.LogFile != "" {
+		logFile, err := newRotatingFile(config.LogFile, config.LogFileMaxSize, config.LogFileMaxBackups, config.LogFileMaxAge)
+		if err != nil {
+			logger.Fatal("Couldn't open log file", zap.Error(err))
+		}
+		defer logFile.Close()
+		logger = withLogFile(logger, logFile, config.LogEncoding)
+		logger.Info("Writing logs to file", zap.String("logFile", config.LogFile))
+	}
+
 	// Load or create caches and stores
 
+	// Object storage first, because the cache files are downloaded from there
+	if config.S3endpoint != "" {
+		initObjectStorage(ctx, config, logger)
+	}
+
 	// Caches first, because some things can go wrong here, and we don't have the store closer yet, which can lead to corrupted BadgerDB files.
 	initCaches(config, logger)
 
@@ -175,17 +284,12 @@ func main() {
 
 	// Init cache maps
 
-	goCaches := map[string]*gocache.Cache{
-		"availability-rd": rdAvailabilityCache.cache,
-		"availability-ad": adAvailabilityCache.cache,
-		"availability-pm": pmAvailabilityCache.cache,
-		"token":           tokenCache.cache,
-	}
-	if redirectCache.cache != nil {
-		goCaches["redirect"] = redirectCache.cache
-	}
-	if streamCache.cache != nil {
-		goCaches["stream"] = streamCache.cache
+	// Caches in Redis aren't persisted to files
+	goCaches := map[string]*gocache.Cache{}
+	for _, creationCache := range []*creationCache{rdAvailabilityCache, adAvailabilityCache, pmAvailabilityCache, dlAvailabilityCache, tbAvailabilityCache, rdTokenCache, adTokenCache, pmTokenCache, dlTokenCache, tbTokenCache} {
+		if creationCache.cache != nil {
+			goCaches[creationCache.name] = creationCache.cache
+		}
 	}
 	// Log cache stats every hour
 	go func() {
@@ -199,69 +303,139 @@ func main() {
 
 	// Prepare addon creation
 
-	movieStreamHandler := createStreamHandler(config, searchClient, rdClient, adClient, pmClient, redirectCache, false, logger)
-	tvShowStreamHandler := createStreamHandler(config, searchClient, rdClient, adClient, pmClient, redirectCache, true, logger)
-	streamHandlers := map[string]stremio.StreamHandler{"movie": movieStreamHandler, "series": tvShowStreamHandler}
-
-	var httpFS http.FileSystem
-	if config.WebConfigurePath == "" {
-		pkgerDir := pkger.Dir("/web/configure")
-		mm := afero.NewMemMapFs()
-		// Copy all files from pkger to afero memory-mapped FS.
-		// This is a workaround so we can *write* a file to it.
-		// TODO: Replace all this as soon as Go 1.16 supports embedding files into a binary.
-		for _, fName := range []string{"/deflix.css", "/favicon.ico", "/index-apikey.html", "/index-oauth2.html", "/mvp.css"} {
-			f, err := pkgerDir.Open(fName)
-			if err != nil {
-				logger.Fatal("Couldn't open "+fName, zap.Error(err))
-			}
-			fData, err := ioutil.ReadAll(f)
-			if err != nil {
-				logger.Fatal("Couldn't read "+fName, zap.Error(err))
-			}
-			absPath := "/" + fName
-			if err = afero.WriteFile(mm, absPath, fData, 0644); err != nil {
-				logger.Fatal("Couldn't write to "+absPath, zap.Error(err))
-			}
-		}
-
-		// Rename one of the index.html files depending on OAuth2 configuration
-		var fromPath string
-		if config.UseOAUTH2 {
-			fromPath = "/index-oauth2.html"
-		} else {
-			fromPath = "/index-apikey.html"
+	var sites []string
+	for site := range searchClient.GetMagnetSearchers() {
+		sites = append(sites, site)
+	}
+	coverage := newSearcherCoverage(sites, coverageWindow, time.Hour)
+	availabilityCaches := map[string]*creationCache{
+		"rd": rdAvailabilityCache,
+		"ad": adAvailabilityCache,
+		"pm": pmAvailabilityCache,
+		"dl": dlAvailabilityCache,
+		"tb": tbAvailabilityCache,
+	}
+	tokenCaches := map[string]*creationCache{
+		"rd": rdTokenCache,
+		"ad": adTokenCache,
+		"pm": pmTokenCache,
+		"dl": dlTokenCache,
+		"tb": tbTokenCache,
+	}
+	callLimiter := newDebridCallLimiter(map[string]int{
+		"rd": config.CallsPerHourRD,
+		"ad": config.CallsPerHourAD,
+		"pm": config.CallsPerHourPM,
+		"dl": config.CallsPerHourDL,
+		"tb": config.CallsPerHourTB,
+	})
+	var audit *auditLog
+	if config.AuditLogPath != "" || config.AuditLogURL != "" {
+		var err error
+		if audit, err = newAuditLog(ctx, config.AuditLogPath, config.AuditLogRetention, config.AuditLogURL, logger); err != nil {
+			logger.Fatal("Couldn't create audit log", zap.Error(err))
 		}
-		from, err := mm.Open(fromPath)
-		if err != nil {
-			logger.Fatal("Couldn't open "+fromPath, zap.Error(err))
+		defer audit.Close()
+	}
+	var webhook *webhookNotifier
+	if config.WebhookURL != "" {
+		webhook = newWebhookNotifier(ctx, config.WebhookURL, config.WebhookFormat, logger)
+	}
+	// Read-only instances don't convert torrents into streams
+	var streamPrefetcher *prefetcher
+	if config.Prefetch && !config.ReadOnly {
+		streamPrefetcher = newPrefetcher(resolvers, streamCache, callLimiter, audit, logger)
+	}
+	// Read-only instances don't put the placeholder stream's torrent into the redirect cache, so they can't offer queueing downloads
+	var queuer *downloadQueuer
+	if !config.ReadOnly {
+		queuer = newDownloadQueuer(resolvers, streamCache, callLimiter, audit, logger)
+	}
+	// Only record recent requests when they're used
+	var recent *recentRequestStore
+	if config.AvailabilityRefresh > 0 {
+		recent = recentRequests
+		credentials := map[string]string{
+			"rd": config.StatusRDtoken,
+			"ad": config.StatusADkey,
+			"pm": config.StatusPMkey,
+			"dl": config.StatusDLkey,
+			"tb": config.StatusTBkey,
 		}
-		to, err := mm.Create("/index.html")
-		if err != nil {
-			logger.Fatal(`Couldn't create "/index.html"`, zap.Error(err))
+		refresher := newAvailabilityRefresher(resolvers, availabilityCaches, config.CacheAgeXD, credentials, recent, callLimiter, logger)
+		go refresher.run(ctx, config.AvailabilityRefresh)
+	}
+	var updates *updateChecker
+	if config.UpdateCheckInterval > 0 {
+		updates = newUpdateChecker(latestReleaseURL, logger)
+		go updates.run(ctx, config.UpdateCheckInterval)
+	}
+	// With Redis the jobs are shared by all instances
+	var jobs jobStore = badgerJobs
+	if redirectCache.rdb != nil {
+		jobs = &redisJobStore{
+			rdb: redirectCache.rdb,
+			key: "jobs",
 		}
-		fromBytes, err := ioutil.ReadAll(from)
-		if err != nil {
-			logger.Fatal("Couldn't read "+fromPath, zap.Error(err))
+	}
+	backgroundJobs := newJobQueue(jobs, logger)
+	go backgroundJobs.run(ctx, config.JobWorkers)
+	streamExperiment := newExperiment(config.Experiment, config.ExperimentPercent)
+	movieStreamHandler := createStreamHandler(config, searchClient, animeSearcher, foundTorrentStats, resolvers, episodes, redirectCache, streamCache, availabilityCaches, callLimiter, coverage, popularity, recent, streamPrefetcher, queuer, streamExperiment, false, logger)
+	streamHandlers := map[string]stremio.StreamHandler{"movie": withRDtorrentStreams(withPMcloudStreams(movieStreamHandler, pmCloud, logger), rdTorrents, metaFetcher, callLimiter, config.BaseURL, logger)}
+	catalogHandlers := map[string]stremio.CatalogHandler{"movie": createCatalogHandler(popularity, metaFetcher, cinemetaClient, config.LanguageCatalogs, false, logger)}
+	// Regular IMDb IDs or for TV shows (IMDbID:season:episode), and if Nyaa is configured Kitsu IDs of anime (kitsu:kitsuID or for TV shows kitsu:kitsuID:episode)
+	streamIDregex := `^tt\d{7,8}(:\d+:\d+)?$`
+	if animeSearcher != nil {
+		streamIDregex = `^(tt\d{7,8}(:\d+:\d+)?|kitsu:\d+(:\d+)?)$`
+		manifest.IDprefixes = append(manifest.IDprefixes, kitsuIDprefix)
+		manifest.ResourceItems[0].IDprefixes = append(manifest.ResourceItems[0].IDprefixes, kitsuIDprefix)
+	}
+	if config.DisableTVshows {
+		manifest.Description = strings.Replace(manifest.Description, "movies and TV shows", "movies", 1)
+		manifest.Types = []string{"movie"}
+		manifest.ResourceItems[0].Types = []string{"movie"}
+		manifest.ResourceItems[1].Types = []string{"movie"}
+		manifest.Catalogs = manifest.Catalogs[:1]
+		streamIDregex = `^tt\d{7,8}$`
+		if animeSearcher != nil {
+			streamIDregex = `^(tt\d{7,8}|kitsu:\d+)$`
 		}
-		_, err = to.Write(fromBytes)
+	} else {
+		seriesStreamHandler := createStreamHandler(config, searchClient, animeSearcher, foundTorrentStats, resolvers, episodes, redirectCache, streamCache, availabilityCaches, callLimiter, coverage, popularity, recent, streamPrefetcher, queuer, streamExperiment, true, logger)
+		streamHandlers["series"] = withRDtorrentStreams(withPMcloudStreams(seriesStreamHandler, pmCloud, logger), rdTorrents, metaFetcher, callLimiter, config.BaseURL, logger)
+		catalogHandlers["series"] = createCatalogHandler(popularity, metaFetcher, cinemetaClient, config.LanguageCatalogs, true, logger)
+	}
+	manifest.Catalogs = append(manifest.Catalogs, languageCatalogItems(config.LanguageCatalogs, manifest.Types)...)
+
+	features := newInstanceFeatures(config)
+	configurePageData := configurePage{
+		Version:  version,
+		BaseURL:  config.BaseURL,
+		OAUTH2:   config.UseOAUTH2,
+		Features: features,
+	}
+	var httpFS http.FileSystem
+	if config.WebConfigurePath == "" {
+		configureDir, err := fs.Sub(web.Configure, "configure")
 		if err != nil {
-			logger.Fatal(`Couldn't write "/index.html"`, zap.Error(err))
+			logger.Fatal("Couldn't get embedded web configure directory", zap.Error(err))
 		}
-
-		// Clean up memory and FS a bit by removing the unnecessary files.
-		// FS because we don't want people to access `www.example.com/index-apikey.html` for example.
-		if err = mm.Remove("/index-oauth2.html"); err != nil {
-			logger.Fatal(`Couldn't remove "/index-oauth2.html"`, zap.Error(err))
-		}
-		if err = mm.Remove("/index-apikey.html"); err != nil {
-			logger.Fatal(`Couldn't remove "/index-apikey.html"`, zap.Error(err))
+		if httpFS, err = newConfigureFS(configureDir, configurePageData); err != nil {
+			logger.Fatal("Couldn't create file system for embedded web configure files", zap.Error(err))
 		}
-		httpFS = afero.NewHttpFs(mm)
 	} else {
 		configurePath := filepath.Clean(config.WebConfigurePath)
 		logger.Info("Cleaned web configure path", zap.String("path", configurePath))
-		httpFS = http.Dir(configurePath)
+		// Custom directories without the template have their own "index.html"
+		configureDir := os.DirFS(configurePath)
+		if _, err = fs.Stat(configureDir, configureTemplate); err == nil {
+			if httpFS, err = newConfigureFS(configureDir, configurePageData); err != nil {
+				logger.Fatal("Couldn't create file system for web configure files", zap.Error(err))
+			}
+		} else {
+			httpFS = http.Dir(configurePath)
+		}
 	}
 	options := stremio.Options{
 		BindAddr: config.BindAddr,
@@ -274,13 +448,14 @@ func main() {
 		// We already have a metaFetcher Client
 		MetaClient:      metaFetcher,
 		ConfigureHTMLfs: httpFS,
-		// Regular IMDb IDs or for TV shows (IMDbID:season:episode)
-		StreamIDregex: `^tt\d{7,8}(:\d+:\d+)?$`,
+		StreamIDregex:   streamIDregex,
+		// Exposes metrics in the Prometheus format at "/metrics"
+		Metrics: !config.DisableTelemetry,
 	}
 
 	// Create addon
 
-	addon, err := stremio.NewAddon(manifest, nil, streamHandlers, options)
+	addon, err := stremio.NewAddon(manifest, catalogHandlers, streamHandlers, options)
 	if err != nil {
 		logger.Fatal("Couldn't create new addon", zap.Error(err))
 	}
@@ -309,6 +484,9 @@ func main() {
 				TokenURL: config.OAUTH2tokenURLpm,
 			},
 		}
+	}
+	// Also used for encrypted user data, which must still be decodable when OAuth2 or the encryption of new user data is disabled
+	if config.OAUTH2encryptionKey != "" {
 		// We need 32 bytes for AES-256, but the provided password might not be 32 bytes long.
 		// => Simply hash the password.
 		// Hashing it doesn't reduce the security. Also: Using a slow hash (like bcrypt) doesn't help much,
@@ -317,46 +495,178 @@ func main() {
 		// SHA-256 result is 32 bytes, exactly as many as we need.
 		aesKey = hash[:]
 	}
-	authMiddleware := createAuthMiddleware(rdClient, adClient, pmClient, config.UseOAUTH2, confRD, confPM, aesKey, logger)
+	// Rejects requests before any work is done for them
+	addon.AddMiddleware("/", createServerLimitsMiddleware(config.MaxConcurrentReqs, config.MaxRequestBody, logger))
+	// Before the other middlewares, so that they can add the request ID to their log lines
+	addon.AddMiddleware("/", createRequestIDMiddleware())
+	// Must be the first middleware after the limits so that all following middlewares and handlers can rely on the info
+	addon.AddMiddleware("/", createTelemetryMiddleware(config.DisableTelemetry))
+	// Before the other middlewares, so that their time is part of the traces
+	if config.TracingEndpoint != "" {
+		tracer := newTracer(ctx, config.TracingEndpoint, config.TracingSampleRate, logger)
+		addon.AddMiddleware("/:userData/stream/:type/:id.json", createTracingMiddleware(tracer, "stream"))
+		addon.AddMiddleware("/:userData/redirect/:id", createTracingMiddleware(tracer, "redirect"))
+	}
+	// Before the auth middleware, which makes debrid API calls
+	if config.RateLimitStream > 0 {
+		addon.AddMiddleware("/:userData/stream/:type/:id.json", createRateLimitMiddleware(config.RateLimitStream, config.ForwardOriginIP, logger))
+	}
+	if config.RateLimitRedirect > 0 {
+		addon.AddMiddleware("/:userData/redirect/:id", createRateLimitMiddleware(config.RateLimitRedirect, config.ForwardOriginIP, logger))
+	}
+	auth := newAuthenticator(resolvers, config.UseOAUTH2, confRD, confPM, aesKey, logger)
+	authMiddleware := createAuthMiddleware(auth, logger)
 	addon.AddMiddleware("/:userData/manifest.json", authMiddleware)
 	addon.AddMiddleware("/:userData/stream/:type/:id.json", authMiddleware)
 	addon.AddMiddleware("/:userData/redirect/:id", authMiddleware)
+	addon.AddMiddleware("/:userData/account", authMiddleware)
+	streamHintsMiddleware := createStreamHintsMiddleware(logger)
+	addon.AddMiddleware("/:userData/stream/:type/:id.json", streamHintsMiddleware)
+	addon.AddMiddleware("/:userData/stream/:type/:id.json", createDiagnosticsMiddleware(logger))
 	// No need to set the middleware to the stream route without user data because go-stremio blocks it (with a 400 Bad Request response) if BehaviorHints.ConfigurationRequired is true.
+	// Lets newer Stremio clients render a native configuration UI
+	addon.AddMiddleware("/manifest.json", createManifestConfigMiddleware(newManifestConfig(features), logger))
+
+	// For Kubernetes probes. go-stremio's "/health" is the same as "/healthz", but "/readyz" also checks the dependencies.
+	addon.AddEndpoint("GET", "/healthz", createLivenessHandler(logger))
+	siteURLs := map[string]string{
+		"YTS":   config.BaseURLyts,
+		"TPB":   config.BaseURLtpb,
+		"1337X": config.BaseURL1337x,
+		"ibit":  config.BaseURLibit,
+		"RARBG": config.BaseURLrarbg,
+	}
+	if config.BaseURLnyaa != "" {
+		siteURLs["Nyaa"] = config.BaseURLnyaa
+	}
+	for site := range siteURLs {
+		if !config.siteEnabled(site) {
+			delete(siteURLs, site)
+		}
+	}
+	debridURLs := map[string]string{
+		"rd": config.BaseURLrd,
+		"ad": config.BaseURLad,
+		"pm": config.BaseURLpm,
+		"dl": config.BaseURLdl,
+		"tb": config.BaseURLtorbox,
+	}
+	readinessChecker := newReadinessChecker(popularity.db, postgres, redirectCache.rdb, siteURLs, debridURLs)
+	addon.AddEndpoint("GET", "/readyz", createReadinessHandler(readinessChecker, logger))
+
+	versionHandler := createVersionHandler(config.DisableTelemetry, updates, logger)
+	addon.AddEndpoint("GET", "/version", versionHandler)
+
+	// Used by the configure page to only render the controls that this instance supports
+	featuresHandler := createFeaturesHandler(features, logger)
+	addon.AddEndpoint("GET", "/api/features", featuresHandler)
+
+	// Not available on read-only instances, because it scrapes torrent sites and converts a torrent into a stream.
+	// Requires URL query "?imdbid=123" and either the status token as bearer token or a signed link from "/status/link".
+	if !config.ReadOnly && config.StatusToken != "" {
+		statusAuthMiddleware := createStatusAuthMiddleware(config.StatusToken, logger)
+		addon.AddMiddleware("/status", statusAuthMiddleware)
+		statusEndpoint := createStatusHandler(searchClient.GetMagnetSearchers(), resolvers, goCaches, config.StatusRDtoken, config.StatusADkey, config.StatusPMkey, config.StatusDLkey, config.StatusTBkey, config.ForwardOriginIP, logger)
+		addon.AddEndpoint("GET", "/status", statusEndpoint)
+		statusLinkEndpoint := createStatusLinkHandler(config.StatusToken, config.BaseURL, logger)
+		addon.AddEndpoint("GET", "/status/link", statusLinkEndpoint)
+	}
 
-	// Requires URL query: "?imdbid=123&apitoken=foo"
-	statusEndpoint := createStatusHandler(searchClient.GetMagnetSearchers(), rdClient, adClient, pmClient, goCaches, config.ForwardOriginIP, logger)
-	addon.AddEndpoint("GET", "/status", statusEndpoint)
+	if config.AdminToken != "" {
+		addon.AddMiddleware("/admin", createAdminAuthMiddleware(config.AdminToken, logger))
+		statsHandler := createStatsHandler(coverage, analytics, logger)
+		addon.AddEndpoint("GET", "/admin/stats", statsHandler)
+		addon.AddEndpoint("GET", "/admin/cache", createCacheInfoHandler(goCaches, redirectCache.rdb, logger))
+		addon.AddEndpoint("DELETE", "/admin/cache/imdb/:id", createIMDbCachePurgeHandler(torrentCache, redirectCache, streamCache, logger))
+		addon.AddEndpoint("DELETE", "/admin/cache/user/:userData", createUserCachePurgeHandler(streamCache, tokenCaches, aesKey, logger))
+		addon.AddEndpoint("DELETE", "/admin/cache/availability/:infoHash", createAvailabilityCachePurgeHandler(availabilityCaches, logger))
+	}
 
 	// Redirects stream URLs (previously sent to Stremio) to the actual RealDebrid stream URLs
-	redirHandler := createRedirectHandler(redirectCache, streamCache, rdClient, adClient, pmClient, config.ForwardOriginIP, logger)
+	// Read-only instances don't convert torrents, so they don't need to coordinate with other nodes
+	var redirectLocker *redisLocker
+	if redirectCache.rdb != nil && !config.ReadOnly {
+		redirectLocker = newRedisLocker(redirectCache.rdb, redirectLockTTL)
+	}
+	var proxy *streamProxy
+	if config.ProxyStreams {
+		proxy = newStreamProxy(config.ProxyBandwidth*1024, logger)
+	}
+	resolveStream := createStreamResolver(redirectCache, streamCache, streamHandlers, resolvers, availabilityCaches, callLimiter, streamExperiment, redirectLocker, audit, analytics, webhook, config.MaxTorrentsToTry, config.ReadOnly, config.RaceRD, logger)
+	resolveStream = withRDtorrentRedirects(resolveStream, rdTorrents, streamCache, callLimiter, logger)
+	redirHandler := createRedirectHandler(resolveStream, streamCache, proxy, config.ForwardOriginIP, logger)
 	addon.AddEndpoint("GET", "/:userData/redirect/:id", redirHandler)
 	// Stremio sends a HEAD request before starting a stream.
 	addon.AddEndpoint("HEAD", "/:userData/redirect/:id", redirHandler)
 
+	// Account info for end-users, like the remaining RealDebrid remote traffic
+	accountHandler := createAccountHandler(accClient, logger)
+	addon.AddEndpoint("GET", "/:userData/account", accountHandler)
+
+	// Used by the configure page to tell users about invalid credentials before they install the addon
+	// With encrypted user data it also responds with the encrypted user data for the addon URL
+	var userDataKey []byte
+	if config.EncryptUserData {
+		userDataKey = aesKey
+	}
+	validateHandler := createValidateHandler(auth, accClient, userDataKey, logger)
+	addon.AddEndpoint("POST", "/api/validate", validateHandler)
+
+	// Self-diagnostics page for end-users, linked from the configure page
+	diagnoseHandler := createDiagnoseHandler(resolvers, accClient, config.UseOAUTH2, confRD, confPM, aesKey, config.BaseURL, logger)
+	addon.AddEndpoint("GET", "/diagnose/:userData", diagnoseHandler)
+
 	// For OAuth2 redirect handling for RealDebrid and Premiumize
 	isHTTPS := strings.HasPrefix(config.BaseURL, "https")
+	// AllDebrid doesn't support OAuth2, but a PIN-based flow, in which the frontend polls until the user entered the PIN on the AllDebrid website
+	if config.UseOAUTH2 {
+		adPINclient := newADpinClient(config.BaseURLad, 5*time.Second)
+		addon.AddEndpoint("GET", "/oauth2/init/ad", createADpinInitHandler(adPINclient, logger))
+		addon.AddEndpoint("GET", "/oauth2/check/ad", createADpinCheckHandler(adPINclient, aesKey, logger))
+	}
 	oauth2initHandler := createOAUTH2initHandler(confRD, confPM, isHTTPS, logger)
 	addon.AddEndpoint("GET", "/oauth2/init/:service", oauth2initHandler)
 	oauth2installHandler := createOAUTH2installHandler(confRD, confPM, aesKey, logger)
 	addon.AddEndpoint("GET", "/oauth2/install/:service", oauth2installHandler)
 
+	cacheNames := make([]string, 0, len(goCaches))
+	for name := range goCaches {
+		cacheNames = append(cacheNames, name)
+	}
+
 	// Save cache to file every hour
 	go func() {
 		for {
 			time.Sleep(time.Hour)
 			persistCaches(ctx, config.CachePath, goCaches, logger)
+			if s3Client != nil {
+				uploadCacheFiles(ctx, s3Client, config.S3keyPrefix, config.CachePath, cacheNames, logger)
+			}
 		}
 	}()
 
 	// Start addon
 
-	stoppingChan := make(chan bool, 1)
-	go func() {
-		<-stoppingChan
-		cancel()
-	}()
+	if local {
+		go welcomeLocalUser(ctx, config.BaseURL, logger)
+	}
 
-	addon.Run(stoppingChan)
+	if config.GRPCport != 0 {
+		apiServer := newAPIserver(auth, streamHandlers, resolveStream, logger)
+		apiServer.serve(ctx, net.JoinHostPort(config.BindAddr, strconv.Itoa(config.GRPCport)))
+	}
+
+	if config.tlsEnabled() {
+		tlsAddr := net.JoinHostPort(config.BindAddr, strconv.Itoa(config.TLSport))
+		tlsSrv, err := newTLSserver(tlsAddr, upstreamAddr(config.BindAddr, config.Port), config.TLScertFile, config.TLSkeyFile, config.AutocertHost, config.AutocertEmail, config.AutocertCacheDir, logger)
+		if err != nil {
+			logger.Fatal("Couldn't create HTTPS server", zap.Error(err))
+		}
+		tlsSrv.run(ctx)
+	}
+
+	// The addon handles the signals itself for shutting down the server, ctx is canceled at the same time.
+	addon.Run(nil)
 }
 
 func initStores(config config, logger *zap.Logger) (closer func() error) {
@@ -384,16 +694,82 @@ func initStores(config config, logger *zap.Logger) (closer func() error) {
 	if err != nil {
 		logger.Fatal("Couldn't open BadgerDB", zap.Error(err))
 	}
-	closers = append(closers, db.Close)
 
+	// Torrent results and metadata
+	var store Store
+	if config.StorageBackend == "postgres" {
+		logger.Info("Connecting to PostgreSQL...")
+		postgres, err = newPostgresStore(context.Background(), config.PostgresDSN, "deflix_store")
+		if err != nil {
+			logger.Fatal("Couldn't initialize PostgreSQL store", zap.Error(err))
+		}
+		logger.Info("Connection to PostgreSQL established!")
+		closers = append(closers, postgres.Close)
+		store = postgres
+	} else {
+		badgerStore := &badgerStore{
+			db: db,
+		}
+		if config.StorageFlushInterval > 0 {
+			badgerStore.writer = newBatchWriter(db, 1000, 1000, config.StorageFlushInterval, logger)
+			// Must be closed before the DB, so that the remaining batched writes are flushed
+			closers = append(closers, badgerStore.writer.Close)
+		}
+		store = badgerStore
+	}
+	closers = append(closers, db.Close)
 	torrentCache = &resultStore{
-		db:        db,
+		store:     store,
 		keyPrefix: "torrent_",
 	}
+	foundTorrentStats = &torrentStatsStore{
+		store:     store,
+		keyPrefix: "torrentstats_",
+	}
 	cinemetaCache = &metaStore{
-		db:        db,
+		store:     store,
 		keyPrefix: "meta_",
 	}
+	popularity = &popularityStore{
+		db:        db,
+		keyPrefix: "popularity_",
+	}
+	if config.Analytics {
+		analytics = &analyticsStore{
+			db:        db,
+			keyPrefix: "analytics_",
+			ttl:       config.AnalyticsRetention,
+		}
+	}
+	recentRequests = &recentRequestStore{
+		db:        db,
+		keyPrefix: "recent_",
+		ttl:       recentRequestExpiration,
+	}
+	badgerJobs = &badgerJobStore{
+		db:        db,
+		keyPrefix: "job_",
+	}
+	// The caches were created before, go-cache or Redis become the read-through layer
+	redirectCache.db = db
+	redirectCache.keyPrefix = "redirect_"
+	redirectCache.logger = logger
+	streamCache.db = db
+	streamCache.keyPrefix = "stream_"
+	streamCache.logger = logger
+
+	// Restore the DB from the object storage when starting in a fresh container, and back it up periodically
+	if s3Client != nil && config.S3backupStorage {
+		if isEmptyDB(db) {
+			restoreStorage(context.Background(), s3Client, config.S3keyPrefix, db, logger)
+		}
+		go func() {
+			for {
+				time.Sleep(time.Hour)
+				backupStorage(context.Background(), s3Client, config.S3keyPrefix, db, logger)
+			}
+		}()
+	}
 
 	// Periodically call RunValueLogGC()
 	go func() {
@@ -411,36 +787,24 @@ func initStores(config config, logger *zap.Logger) (closer func() error) {
 	return multiCloser
 }
 
-func initCaches(config config, logger *zap.Logger) {
-	logger.Info("Initializing caches...")
-	start := time.Now()
+func initObjectStorage(ctx context.Context, config config, logger *zap.Logger) {
+	logger.Info("Initializing object storage...")
 
-	rdAvailabilityCacheItems, err := loadGoCache(config.CachePath + "/availability-rd.gob")
+	var err error
+	s3ClientOpts := s3.NewClientOpts(config.S3endpoint, config.S3region, config.S3bucket, config.S3accessKeyID, config.S3secretAccessKey, s3.DefaultClientOpts.Timeout)
+	s3Client, err = s3.NewClient(s3ClientOpts)
 	if err != nil {
-		logger.Error("Couldn't load RD availability cache from file - continuing with an empty cache", zap.Error(err))
-		rdAvailabilityCacheItems = map[string]gocache.Item{}
-	}
-	rdAvailabilityCache = &creationCache{
-		cache: gocache.NewFrom(config.CacheAgeXD, 24*time.Hour, rdAvailabilityCacheItems),
+		logger.Fatal("Couldn't create S3 client", zap.Error(err))
 	}
 
-	adAvailabilityCacheItems, err := loadGoCache(config.CachePath + "/availability-ad.gob")
-	if err != nil {
-		logger.Error("Couldn't load AD availability cache from file - continuing with an empty cache", zap.Error(err))
-		adAvailabilityCacheItems = map[string]gocache.Item{}
-	}
-	adAvailabilityCache = &creationCache{
-		cache: gocache.NewFrom(config.CacheAgeXD, 24*time.Hour, adAvailabilityCacheItems),
-	}
+	downloadCacheFiles(ctx, s3Client, config.S3keyPrefix, config.CachePath, logger)
 
-	pmAvailabilityCacheItems, err := loadGoCache(config.CachePath + "/availability-pm.gob")
-	if err != nil {
-		logger.Error("Couldn't load Premiumize availability cache from file - continuing with an empty cache", zap.Error(err))
-		pmAvailabilityCacheItems = map[string]gocache.Item{}
-	}
-	pmAvailabilityCache = &creationCache{
-		cache: gocache.NewFrom(config.CacheAgeXD, 24*time.Hour, pmAvailabilityCacheItems),
-	}
+	logger.Info("Initialized object storage")
+}
+
+func initCaches(config config, logger *zap.Logger) {
+	logger.Info("Initializing caches...")
+	start := time.Now()
 
 	// TODO: Return closer func like in the stores initialization function.
 	var rdb *redis.Client
@@ -465,55 +829,93 @@ func initCaches(config config, logger *zap.Logger) {
 		logger.Info("Connection to Redis established!")
 	}
 
-	if config.RedisAddr == "" {
-		if redirectCacheItems, err := loadGoCache(config.CachePath + "/redirect.gob"); err != nil {
-			logger.Error("Couldn't load redirect cache from file - continuing with an empty cache", zap.Error(err))
-			redirectCache = &goCache{
-				cache: gocache.New(redirectExpiration, 24*time.Hour),
+	// With Redis the availability and token caches are shared by all nodes, so that they don't each make the same debrid API calls.
+	// Otherwise they're loaded from the persisted files.
+	newCreationCache := func(name, description string, expiration time.Duration) *creationCache {
+		if rdb != nil {
+			return &creationCache{
+				name:       name,
+				rdb:        rdb,
+				keyPrefix:  name + "-",
+				expiration: expiration,
+				logger:     logger,
 			}
-		} else {
-			redirectCache = &goCache{
-				cache: gocache.NewFrom(redirectExpiration, 24*time.Hour, redirectCacheItems),
+		}
+		items, err := loadGoCache(config.CachePath + "/" + name + ".gob")
+		if err != nil {
+			logger.Error("Couldn't load "+description+" cache from file - continuing with an empty cache", zap.Error(err))
+			items = map[string]gocache.Item{}
+		}
+		return &creationCache{
+			name:  name,
+			cache: gocache.NewFrom(expiration, 24*time.Hour, items),
+		}
+	}
+	rdAvailabilityCache = newCreationCache("availability-rd", "RD availability", config.CacheAgeXD)
+	adAvailabilityCache = newCreationCache("availability-ad", "AD availability", config.CacheAgeXD)
+	pmAvailabilityCache = newCreationCache("availability-pm", "Premiumize availability", config.CacheAgeXD)
+	dlAvailabilityCache = newCreationCache("availability-dl", "Debrid-Link availability", config.CacheAgeXD)
+	tbAvailabilityCache = newCreationCache("availability-tb", "Torbox availability", config.CacheAgeXD)
+	// Short-lived, so they're neither persisted nor loaded from files
+	if config.CacheAgeXDnegative > 0 {
+		for _, debridID := range []string{"rd", "ad", "pm", "dl", "tb"} {
+			name := "unavailability-" + debridID
+			if rdb != nil {
+				unavailabilityCaches[debridID] = &creationCache{
+					name:       name,
+					rdb:        rdb,
+					keyPrefix:  name + "-",
+					expiration: config.CacheAgeXDnegative,
+					logger:     logger,
+				}
+			} else {
+				unavailabilityCaches[debridID] = &creationCache{
+					name:  name,
+					cache: gocache.New(config.CacheAgeXDnegative, 10*time.Minute),
+				}
 			}
 		}
+	}
+	// Separate caches, so that each debrid service's tokens can have their own TTL, and with hashed keys so that the API keys and tokens aren't stored as they are
+	newTokenCache := func(debridID, description string, ttl time.Duration) *creationCache {
+		tokenCache := newCreationCache("token-"+debridID, description+" token", ttl)
+		tokenCache.hashKeys = true
+		return tokenCache
+	}
+	rdTokenCache = newTokenCache("rd", "RD", config.TokenCacheTTLrd)
+	adTokenCache = newTokenCache("ad", "AD", config.TokenCacheTTLad)
+	pmTokenCache = newTokenCache("pm", "Premiumize", config.TokenCacheTTLpm)
+	dlTokenCache = newTokenCache("dl", "Debrid-Link", config.TokenCacheTTLdl)
+	tbTokenCache = newTokenCache("tb", "Torbox", config.TokenCacheTTLtb)
+
+	// The redirect and stream caches are persisted in BadgerDB (see initStores), so they're not loaded from files.
+	// With Redis they're shared by all nodes.
+	if config.RedisAddr == "" {
+		redirectCache = &goCache{
+			name:  "redirect",
+			cache: gocache.New(memoryLayerExpiration, time.Hour),
+		}
+		streamCache = &goCache{
+			name:  "stream",
+			cache: gocache.New(memoryLayerExpiration, time.Hour),
+		}
 	} else {
-		var t []imdb2torrent.Result
+		var torrents []imdb2torrent.Result
 		redirectCache = &goCache{
+			name:   "redirect",
 			rdb:    rdb,
-			t:      reflect.TypeOf(t),
+			t:      reflect.TypeOf(torrents),
 			logger: logger,
 		}
-	}
-
-	if config.RedisAddr == "" {
-		if streamCacheItems, err := loadGoCache(config.CachePath + "/stream.gob"); err != nil {
-			logger.Error("Couldn't load stream cache from file - continuing with an empty cache", zap.Error(err))
-			streamCache = &goCache{
-				cache: gocache.New(streamExpiration, 24*time.Hour),
-			}
-		} else {
-			streamCache = &goCache{
-				cache: gocache.NewFrom(streamExpiration, 24*time.Hour, streamCacheItems),
-			}
-		}
-	} else {
-		var t cacheItem
+		var item cacheItem
 		streamCache = &goCache{
+			name:   "stream",
 			rdb:    rdb,
-			t:      reflect.TypeOf(t),
+			t:      reflect.TypeOf(item),
 			logger: logger,
 		}
 	}
 
-	tokenCacheItems, err := loadGoCache(config.CachePath + "/token.gob")
-	if err != nil {
-		logger.Error("Couldn't load token cache from file - continuing with an empty cache", zap.Error(err))
-		tokenCacheItems = map[string]gocache.Item{}
-	}
-	tokenCache = &creationCache{
-		cache: gocache.NewFrom(tokenExpiration, 24*time.Hour, tokenCacheItems),
-	}
-
 	duration := time.Since(start).Milliseconds()
 	durationString := strconv.FormatInt(duration, 10) + "ms"
 	logger.Info("Initialized caches", zap.String("duration", durationString))
@@ -525,20 +927,47 @@ func initClients(config config, logger *zap.Logger) {
 
 	// TODO: Return closer func like in the stores initialization function.
 	var err error
-	cinemetaClient := cinemeta.NewClient(cinemeta.DefaultClientOpts, cinemetaCache, logger)
+	cinemetaOpts := cinemeta.DefaultClientOpts
+	cinemetaOpts.BaseURL = config.BaseURLcinemeta
+	cinemetaClient = cinemeta.NewClient(cinemetaOpts, cinemetaCache, logger)
 	metaFetcher, err = metafetcher.NewClient(config.IMDB2metaAddr, cinemetaClient, logger)
 	if err != nil {
 		logger.Fatal("Couldn't create metafetcher client", zap.Error(err))
 	}
 
+	if config.SitesProxyURL != "" || len(config.SiteProxies) > 0 {
+		siteBaseURLs := map[string]string{
+			"YTS":   config.BaseURLyts,
+			"TPB":   config.BaseURLtpb,
+			"1337X": config.BaseURL1337x,
+			"ibit":  config.BaseURLibit,
+			"RARBG": config.BaseURLrarbg,
+			"Nyaa":  config.BaseURLnyaa,
+		}
+		proxies, err := siteProxies(siteBaseURLs, config.SitesProxyURL, config.SiteProxies)
+		if err != nil {
+			logger.Fatal("Couldn't configure proxies for torrent sites", zap.Error(err))
+		}
+		// Before the FlareSolverr transport, which wraps the default transport
+		http.DefaultTransport = newSiteProxyTransport(http.DefaultTransport.(*http.Transport), proxies)
+	}
+	if config.FlareSolverrURL != "" {
+		// imdb2torrent's 1337x and ibit clients use the default transport
+		http.DefaultTransport, err = newFlareSolverrTransport(http.DefaultTransport, config.FlareSolverrURL, []string{config.BaseURL1337x, config.BaseURLibit}, logger)
+		if err != nil {
+			logger.Fatal("Couldn't create FlareSolverr transport", zap.Error(err))
+		}
+	}
+
 	ytsClientOpts := imdb2torrent.NewYTSclientOpts(config.BaseURLyts, timeout, config.MaxAgeTorrents)
 	tpbClientOpts := imdb2torrent.NewTPBclientOpts(config.BaseURLtpb, config.SocksProxyAddrTPB, timeout, config.MaxAgeTorrents)
 	leetxClientOpts := imdb2torrent.NewLeetxClientOpts(config.BaseURL1337x, timeout, config.MaxAgeTorrents)
 	ibitClientOpts := imdb2torrent.NewIbitClientOpts(config.BaseURLibit, timeout, config.MaxAgeTorrents)
-	rarbgClientOpts := imdb2torrent.NewRARBGclientOpts(config.BaseURLrarbg, timeout, config.MaxAgeTorrents)
 	rdClientOpts := realdebrid.NewClientOpts(config.BaseURLrd, timeout, config.CacheAgeXD, config.ExtraHeadersXD, config.ForwardOriginIP)
 	adClientOpts := alldebrid.NewClientOpts(config.BaseURLad, timeout, config.CacheAgeXD, config.ExtraHeadersXD)
 	pmClientOpts := premiumize.NewClientOpts(config.BaseURLpm, timeout, config.CacheAgeXD, config.ExtraHeadersXD, config.ForwardOriginIP)
+	dlClientOpts := debridlink.NewClientOpts(config.BaseURLdl, timeout, config.CacheAgeXD, config.ExtraHeadersXD)
+	tbClientOpts := torbox.NewClientOpts(config.BaseURLtorbox, timeout, config.CacheAgeXD, config.ExtraHeadersXD)
 
 	tpbClient, err := imdb2torrent.NewTPBclient(tpbClientOpts, torrentCache, metaFetcher, logger, config.LogFoundTorrents)
 	if err != nil {
@@ -549,21 +978,108 @@ func initClients(config config, logger *zap.Logger) {
 		"TPB":   tpbClient,
 		"1337X": imdb2torrent.NewLeetxClient(leetxClientOpts, torrentCache, metaFetcher, logger, config.LogFoundTorrents),
 		"ibit":  imdb2torrent.NewIbitClient(ibitClientOpts, torrentCache, logger, config.LogFoundTorrents),
-		"RARBG": imdb2torrent.NewRARBGclient(rarbgClientOpts, torrentCache, logger, config.LogFoundTorrents),
+		// With Redis the token and rate limit are shared between instances
+		"RARBG": newRARBGclient(config.BaseURLrarbg, timeout, config.MaxAgeTorrents, torrentCache, foundTorrentStats, redirectCache.rdb, logger, config.LogFoundTorrents),
+	}
+	for site := range siteClients {
+		if !config.siteEnabled(site) {
+			delete(siteClients, site)
+		}
+	}
+	if config.BaseURLnyaa != "" && config.siteEnabled("Nyaa") {
+		animeSearcher = newNyaaClient(strings.TrimSuffix(config.BaseURLnyaa, "/"), timeout, config.MaxAgeTorrents, torrentCache, foundTorrentStats, metaFetcher, logger, config.LogFoundTorrents)
+		siteClients["Nyaa"] = animeSearcher
+	}
+	if config.BaseURLzilean != "" {
+		siteClients["Zilean"] = newZileanClient(strings.TrimSuffix(config.BaseURLzilean, "/"), timeout, config.MaxAgeTorrents, torrentCache, logger, config.LogFoundTorrents)
+	}
+	if config.BaseURLjackett != "" {
+		// Jackett's Torznab endpoint that aggregates all configured indexers
+		jackettClientOpts := torznab.NewClientOpts(strings.TrimSuffix(config.BaseURLjackett, "/")+"/api/v2.0/indexers/all/results/torznab/api", config.JackettAPIkey, timeout, config.MaxAgeTorrents)
+		siteClients["Jackett"], err = torznab.NewClient("Jackett", jackettClientOpts, torrentCache, logger, config.LogFoundTorrents)
+		if err != nil {
+			logger.Fatal("Couldn't create Jackett client", zap.Error(err))
+		}
+	}
+	if config.BaseURLbitmagnet != "" {
+		// Bitmagnet's Torznab endpoint supports searches by IMDb ID, like Jackett's
+		bitmagnetClientOpts := torznab.NewClientOpts(strings.TrimSuffix(config.BaseURLbitmagnet, "/")+"/torznab/api", "", timeout, config.MaxAgeTorrents)
+		siteClients["Bitmagnet"], err = torznab.NewClient("Bitmagnet", bitmagnetClientOpts, torrentCache, logger, config.LogFoundTorrents)
+		if err != nil {
+			logger.Fatal("Couldn't create Bitmagnet client", zap.Error(err))
+		}
+	}
+	for i, endpoint := range config.TorznabEndpoints {
+		endpointURL, apiKey := splitTorznabEndpoint(endpoint)
+		// The endpoints are numbered in the order of the config, because several Prowlarr indexers have the same host
+		site := "Torznab" + strconv.Itoa(i+1)
+		torznabClientOpts := torznab.NewClientOpts(endpointURL, apiKey, timeout, config.MaxAgeTorrents)
+		siteClients[site], err = torznab.NewClient(site, torznabClientOpts, torrentCache, logger, config.LogFoundTorrents)
+		if err != nil {
+			logger.Fatal("Couldn't create Torznab client", zap.Error(err), zap.String("site", site))
+		}
+	}
+	if config.SeasonPacks {
+		seasonPackFinders := map[string]seasonPackFinder{
+			"TPB":   newTPBseasonPackClient(config.BaseURLtpb, config.SocksProxyAddrTPB, timeout, config.MaxAgeTorrents, torrentCache, foundTorrentStats, metaFetcher, logger),
+			"1337X": newLeetxSeasonPackClient(config.BaseURL1337x, timeout, config.MaxAgeTorrents, torrentCache, metaFetcher, logger),
+		}
+		if rarbg, ok := siteClients["RARBG"].(*rarbgClient); ok {
+			seasonPackFinders["RARBG"] = rarbg
+		}
+		for site, finder := range seasonPackFinders {
+			if siteClient, ok := siteClients[site]; ok {
+				siteClients[site] = &seasonPackSearcher{MagnetSearcher: siteClient, packs: finder, site: site, logger: logger}
+			}
+		}
+	}
+	for site, siteClient := range siteClients {
+		// The duration includes the retries
+		siteClients[site] = &instrumentedSearcher{
+			MagnetSearcher: newResilientSearcher(siteClient, site, config.SiteRetries, config.BreakerThreshold, config.BreakerCooldown, logger),
+			site:           site,
+		}
 	}
 	searchClient = imdb2torrent.NewClient(siteClients, timeout, logger)
-	rdClient, err = realdebrid.NewClient(rdClientOpts, tokenCache, rdAvailabilityCache, logger)
+	rdClient, err := realdebrid.NewClient(rdClientOpts, rdTokenCache, rdAvailabilityCache, logger)
 	if err != nil {
 		logger.Fatal("Couldn't create RealDebrid client", zap.Error(err))
 	}
-	adClient, err = alldebrid.NewClient(adClientOpts, tokenCache, adAvailabilityCache, logger)
+	adClient, err := alldebrid.NewClient(adClientOpts, adTokenCache, adAvailabilityCache, logger)
 	if err != nil {
 		logger.Fatal("Couldn't create AllDebrid client", zap.Error(err))
 	}
-	pmClient, err = premiumize.NewClient(pmClientOpts, tokenCache, pmAvailabilityCache, logger)
+	pmClient, err := premiumize.NewClient(pmClientOpts, pmTokenCache, pmAvailabilityCache, logger)
 	if err != nil {
 		logger.Fatal("Couldn't create Premiumize client", zap.Error(err))
 	}
+	dlClient, err := debridlink.NewClient(dlClientOpts, dlTokenCache, dlAvailabilityCache, logger)
+	if err != nil {
+		logger.Fatal("Couldn't create Debrid-Link client", zap.Error(err))
+	}
+	tbClient, err := torbox.NewClient(tbClientOpts, tbTokenCache, tbAvailabilityCache, logger)
+	if err != nil {
+		logger.Fatal("Couldn't create Torbox client", zap.Error(err))
+	}
+	rdTorrents, err = newRDtorrentClient(config.BaseURLrd, config.ExtraHeadersXD, config.ForwardOriginIP, config.RDwaitBudget, config.RDpollInterval, timeout, logger)
+	if err != nil {
+		logger.Fatal("Couldn't create RealDebrid torrent client", zap.Error(err))
+	}
+	episodes = newEpisodeClient(rdTorrents, config.BaseURLad, config.BaseURLpm, config.ForwardOriginIP, timeout, logger)
+	resolvers = debrid.NewRegistry(rdClient, adClient, pmClient, dlClient, tbClient)
+	// The own clients select the episode's file in season packs, and for RealDebrid reuse already added torrents and wait for the configured budget
+	resolvers["rd"] = debrid.WithStreamURLs(resolvers["rd"], rdTorrents.convert)
+	for _, debridID := range []string{"ad", "pm"} {
+		resolvers[debridID] = debrid.WithStreamURLs(resolvers[debridID], episodes.streamURLFunc(debridID, resolvers[debridID]))
+	}
+	for debridID, unavailabilityCache := range unavailabilityCaches {
+		resolvers[debridID] = debrid.WithNegativeCache(resolvers[debridID], unavailabilityCache, config.CacheAgeXDnegative)
+	}
+	pmCloud = newPMcloudClient(config.BaseURLpm, metaFetcher, timeout, logger)
+	accClient, err = newAccountClient(config.BaseURLrd, config.BaseURLad, config.BaseURLpm, config.BaseURLdl, config.BaseURLtorbox, config.ExtraHeadersXD, timeout)
+	if err != nil {
+		logger.Fatal("Couldn't create account client", zap.Error(err))
+	}
 
 	duration := time.Since(start).Milliseconds()
 	durationString := strconv.FormatInt(duration, 10) + "ms"
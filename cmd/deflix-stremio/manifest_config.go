@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// Names of the debrid services in the manifest's config schema, mapped to their IDs
+var manifestConfigDebridServices = map[string]string{
+	"RealDebrid":  "rd",
+	"AllDebrid":   "ad",
+	"Premiumize":  "pm",
+	"Debrid-Link": "dl",
+	"Torbox":      "tb",
+}
+
+// manifestConfigItem is an element of the "config" array in the manifest, which newer Stremio clients use for rendering a native configuration UI.
+// go-stremio's Manifest doesn't support it yet.
+// See https://github.com/Stremio/stremio-addon-sdk/blob/master/docs/api/responses/manifest.md#user-data
+type manifestConfigItem struct {
+	Key      string   `json:"key"`
+	Type     string   `json:"type"`
+	Title    string   `json:"title"`
+	Options  []string `json:"options,omitempty"`
+	Default  string   `json:"default,omitempty"`
+	Required bool     `json:"required,omitempty"`
+}
+
+// newManifestConfig returns the config schema with the options that this instance supports.
+func newManifestConfig(features instanceFeatures) []manifestConfigItem {
+	var debridServices []string
+	for _, name := range []string{"RealDebrid", "AllDebrid", "Premiumize", "Debrid-Link", "Torbox"} {
+		for _, debridID := range features.DebridServices {
+			if manifestConfigDebridServices[name] == debridID {
+				debridServices = append(debridServices, name)
+			}
+		}
+	}
+	result := []manifestConfigItem{
+		{Key: "debridService", Type: "select", Title: "Debrid service", Options: debridServices, Required: true},
+		{Key: "apiKey", Type: "password", Title: "API key (RealDebrid: API token)", Required: true},
+		{Key: "rdRemote", Type: "checkbox", Title: `RealDebrid only: Use "remote traffic"`},
+	}
+	if len(features.QualityFilters) > 0 {
+		result = append(result,
+			manifestConfigItem{Key: "preferSmallest", Type: "checkbox", Title: "Prefer smaller files"},
+			manifestConfigItem{Key: "excludeCam", Type: "checkbox", Title: "Exclude cam and telesync recordings"},
+			manifestConfigItem{Key: "only10bit", Type: "checkbox", Title: "Only 10bit"},
+			manifestConfigItem{Key: "maxResolution", Type: "select", Title: "Max resolution", Options: []string{"No limit", "1080p", "720p"}, Default: "No limit"},
+		)
+		// The config schema has no multi-select, so only a single language can be chosen here
+		languageOptions := []string{"Any"}
+		for _, language := range torrentLanguages {
+			languageOptions = append(languageOptions, language.name)
+		}
+		result = append(result, manifestConfigItem{Key: "language", Type: "select", Title: "Audio language (torrents with multiple audio tracks are always included)", Options: languageOptions, Default: "Any"})
+		for _, format := range videoFormats {
+			result = append(result, manifestConfigItem{Key: "exclude-" + format.id, Type: "checkbox", Title: "Exclude " + format.label})
+		}
+	}
+	if features.QueueDownloads {
+		result = append(result, manifestConfigItem{Key: "queueDownloads", Type: "checkbox", Title: "Start a download on the debrid service when nothing is instantly available"})
+	}
+	if features.PMcloud {
+		result = append(result, manifestConfigItem{Key: "pmCloud", Type: "checkbox", Title: "Premiumize only: Show a matching file from \"My files\" as first stream"})
+	}
+	if features.RDtorrents {
+		result = append(result, manifestConfigItem{Key: "rdTorrents", Type: "checkbox", Title: "RealDebrid only: Use a matching file from \"My torrents\" instead of searching"})
+	}
+	if features.MaxStreamsPerQuality > 1 {
+		options := make([]string, features.MaxStreamsPerQuality)
+		for i := range options {
+			options[i] = strconv.Itoa(i + 1)
+		}
+		result = append(result, manifestConfigItem{Key: "streamsPerQuality", Type: "select", Title: "Streams per quality, one for each of the top torrents", Options: options, Default: "1"})
+	}
+	return result
+}
+
+// createManifestConfigMiddleware creates a middleware that adds the config schema to the manifest that go-stremio responds with.
+// It must only be used for the manifest route without user data, because the schema is only needed before the addon is configured.
+func createManifestConfigMiddleware(manifestConfig []manifestConfigItem, logger *zap.Logger) fiber.Handler {
+	manifestConfigJSON, err := json.Marshal(manifestConfig)
+	if err != nil {
+		logger.Fatal("Couldn't marshal manifest config schema", zap.Error(err))
+	}
+
+	return func(c *fiber.Ctx) error {
+		if err := c.Next(); err != nil {
+			return err
+		}
+		if c.Response().StatusCode() != fiber.StatusOK {
+			return nil
+		}
+
+		var manifest map[string]json.RawMessage
+		if err := json.Unmarshal(c.Response().Body(), &manifest); err != nil {
+			// The manifest is still fine without the config schema
+			logger.Error("Couldn't unmarshal manifest for adding the config schema", zap.Error(err))
+			return nil
+		}
+		manifest["config"] = manifestConfigJSON
+		manifestJSON, err := json.Marshal(manifest)
+		if err != nil {
+			logger.Error("Couldn't marshal manifest with config schema", zap.Error(err))
+			return nil
+		}
+		c.Response().SetBodyRaw(manifestJSON)
+		return nil
+	}
+}
+
+// decodeManifestConfigUserData decodes the user data that Stremio creates from the values of the manifest's config schema.
+// It's URL-unescaped JSON with the config keys, like `{"debridService":"RealDebrid","apiKey":"123"}`.
+// Depending on the Stremio client, checkbox values are booleans or strings like "on" or "true".
+func decodeManifestConfigUserData(data string) (userData, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &values); err != nil {
+		return userData{}, fmt.Errorf("Couldn't unmarshal user data: %w", err)
+	}
+	stringValue := func(key string) string {
+		s, _ := values[key].(string)
+		return strings.TrimSpace(s)
+	}
+	boolValue := func(key string) bool {
+		switch v := values[key].(type) {
+		case bool:
+			return v
+		case string:
+			return v == "on" || v == "true"
+		}
+		return false
+	}
+
+	apiKey := stringValue("apiKey")
+	if apiKey == "" {
+		return userData{}, errors.New("API key is empty")
+	}
+	var result userData
+	switch manifestConfigDebridServices[stringValue("debridService")] {
+	case "rd":
+		result.RDtoken = apiKey
+		result.RDremote = boolValue("rdRemote")
+	case "ad":
+		result.ADkey = apiKey
+	case "pm":
+		result.PMkey = apiKey
+	case "dl":
+		result.DLkey = apiKey
+	case "tb":
+		result.TBkey = apiKey
+	default:
+		return userData{}, fmt.Errorf("Unknown debrid service: %v", stringValue("debridService"))
+	}
+	result.PreferSmallest = boolValue("preferSmallest")
+	result.ExcludeCam = boolValue("excludeCam")
+	result.Only10bit = boolValue("only10bit")
+	if maxResolution := stringValue("maxResolution"); resolution(maxResolution) > 0 {
+		result.MaxResolution = maxResolution
+	}
+	for _, language := range torrentLanguages {
+		if language.name == stringValue("language") {
+			result.Languages = []string{language.code}
+		}
+	}
+	for _, format := range videoFormats {
+		if boolValue("exclude-" + format.id) {
+			result.ExcludeFormats = append(result.ExcludeFormats, format.id)
+		}
+	}
+	result.QueueDownloads = boolValue("queueDownloads")
+	result.PMcloud = boolValue("pmCloud")
+	result.RDtorrents = boolValue("rdTorrents")
+	if streamsPerQuality, err := strconv.Atoi(stringValue("streamsPerQuality")); err == nil && streamsPerQuality > 1 {
+		result.StreamsPerQuality = streamsPerQuality
+	}
+	return result, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deflix-tv/go-stremio"
+)
+
+func TestDecodeManifestConfigUserData(t *testing.T) {
+	logger, err := stremio.NewLogger("debug", "")
+	require.NoError(t, err)
+
+	// Percent-encoded like Stremio sends it
+	data := url.PathEscape(`{"debridService":"RealDebrid","apiKey":"foo","rdRemote":"on","excludeCam":true,"maxResolution":"No limit"}`)
+	ud, err := decodeUserData(data, nil, logger)
+	require.NoError(t, err)
+	require.Equal(t, userData{RDtoken: "foo", RDremote: true, ExcludeCam: true}, ud)
+
+	ud, err = decodeManifestConfigUserData(`{"debridService":"Torbox","apiKey":"bar","maxResolution":"720p","queueDownloads":"true"}`)
+	require.NoError(t, err)
+	require.Equal(t, userData{TBkey: "bar", MaxResolution: "720p", QueueDownloads: true}, ud)
+
+	ud, err = decodeManifestConfigUserData(`{"debridService":"AllDebrid","apiKey":"bar","streamsPerQuality":"3"}`)
+	require.NoError(t, err)
+	require.Equal(t, userData{ADkey: "bar", StreamsPerQuality: 3}, ud)
+
+	ud, err = decodeManifestConfigUserData(`{"debridService":"AllDebrid","apiKey":"bar","language":"German"}`)
+	require.NoError(t, err)
+	require.Equal(t, userData{ADkey: "bar", Languages: []string{"de"}}, ud)
+
+	ud, err = decodeManifestConfigUserData(`{"debridService":"AllDebrid","apiKey":"bar","exclude-hevc":true,"exclude-dv":"on"}`)
+	require.NoError(t, err)
+	require.Equal(t, userData{ADkey: "bar", ExcludeFormats: []string{"dv", "hevc"}}, ud)
+
+	_, err = decodeManifestConfigUserData(`{"debridService":"Foo","apiKey":"bar"}`)
+	require.Error(t, err)
+	_, err = decodeManifestConfigUserData(`{"debridService":"AllDebrid"}`)
+	require.Error(t, err)
+}
+
+func TestManifestConfigMiddleware(t *testing.T) {
+	logger, err := stremio.NewLogger("debug", "")
+	require.NoError(t, err)
+
+	features := newInstanceFeatures(config{})
+	app := fiber.New()
+	app.Use("/manifest.json", createManifestConfigMiddleware(newManifestConfig(features), logger))
+	app.Get("/manifest.json", func(c *fiber.Ctx) error {
+		return c.JSON(stremio.Manifest{ID: "foo"})
+	})
+
+	res, err := app.Test(httptest.NewRequest("GET", "/manifest.json", nil))
+	require.NoError(t, err)
+	var manifest struct {
+		ID     string               `json:"id"`
+		Config []manifestConfigItem `json:"config"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&manifest))
+	require.Equal(t, "foo", manifest.ID)
+	require.Equal(t, "debridService", manifest.Config[0].Key)
+	require.Equal(t, []string{"RealDebrid", "AllDebrid", "Premiumize", "Debrid-Link", "Torbox"}, manifest.Config[0].Options)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// parseSitePriority parses a comma-separated sitePriority config value into the site names, lowercased for case-insensitive matching.
+func parseSitePriority(sitePriority string) []string {
+	var sites []string
+	for _, site := range strings.Split(sitePriority, ",") {
+		if site = strings.TrimSpace(site); site != "" {
+			sites = append(sites, strings.ToLower(site))
+		}
+	}
+	return sites
+}
+
+// siteRank returns the rank of the site in the priority list, where a lower rank means a higher priority.
+// Sites that aren't in the list are ranked after all others.
+func siteRank(sitePriority []string, site string) int {
+	site = strings.ToLower(site)
+	for i, prioritizedSite := range sitePriority {
+		if prioritizedSite == site {
+			return i
+		}
+	}
+	return len(sitePriority)
+}
+
+// merge replaces each of the given (deduplicated) torrents by a combination of the results of all sites that found it.
+// imdb2torrent's deduplication keeps the result of whichever site responded first, which loses the metadata of the others.
+// The result of the site with the highest priority is used as base. Its missing title, display name, size and trackers are taken from the other results.
+// The order of the torrents is kept.
+func (c *searchCollector) merge(torrents []imdb2torrent.Result, sitePriority []string) []imdb2torrent.Result {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	type siteResult struct {
+		site   string
+		rank   int
+		result imdb2torrent.Result
+	}
+	infoHashResults := map[string][]siteResult{}
+	for site, results := range c.results {
+		rank := siteRank(sitePriority, site)
+		for _, result := range results {
+			infoHashResults[result.InfoHash] = append(infoHashResults[result.InfoHash], siteResult{site, rank, result})
+		}
+	}
+
+	merged := make([]imdb2torrent.Result, 0, len(torrents))
+	for _, torrent := range torrents {
+		results := infoHashResults[torrent.InfoHash]
+		if len(results) == 0 {
+			merged = append(merged, torrent)
+			continue
+		}
+		// Sites with the same rank are sorted by name, so that the result doesn't depend on the map iteration order
+		sort.SliceStable(results, func(i, j int) bool {
+			if results[i].rank != results[j].rank {
+				return results[i].rank < results[j].rank
+			}
+			return results[i].site < results[j].site
+		})
+		combined := results[0].result
+		for _, other := range results[1:] {
+			if combined.Title == "" {
+				combined.Title = other.result.Title
+			}
+			combined.MagnetURL = mergeMagnets(combined.MagnetURL, other.result.MagnetURL)
+		}
+		merged = append(merged, combined)
+	}
+	return merged
+}
+
+// mergeMagnets adds the display name and size of the other magnet URL to the primary one if it doesn't have them, and the trackers it doesn't have yet.
+// The parameters are only appended, so that the primary magnet URL stays as it is otherwise.
+func mergeMagnets(primary, other string) string {
+	primaryParams, otherParams := magnetParams(primary), magnetParams(other)
+	if primaryParams == nil || otherParams == nil {
+		return primary
+	}
+	for _, key := range []string{"dn", "xl"} {
+		if primaryParams.Get(key) == "" && otherParams.Get(key) != "" {
+			primary += "&" + key + "=" + url.QueryEscape(otherParams.Get(key))
+		}
+	}
+	trackers := map[string]struct{}{}
+	for _, tracker := range primaryParams["tr"] {
+		trackers[tracker] = struct{}{}
+	}
+	for _, tracker := range otherParams["tr"] {
+		if _, ok := trackers[tracker]; !ok {
+			primary += "&tr=" + url.QueryEscape(tracker)
+			trackers[tracker] = struct{}{}
+		}
+	}
+	return primary
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/deflix-tv/go-debrid"
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// The metrics are exposed in the Prometheus format at "/metrics" by go-stremio, unless telemetry is disabled.
+// Metrics of a request are only recorded if telemetry is allowed for the request (no "DNT" header), see telemetryAllowed.
+// With the VictoriaMetrics client library labels are part of the metric name,
+// see https://pkg.go.dev/github.com/VictoriaMetrics/metrics@v1.12.3#example-Counter-Vec.
+
+var redirectHandlerDuration = metrics.NewHistogram("redirect_handler_duration_seconds")
+
+// streamHandlerDuration returns the histogram for the duration of the stream handler for the given type ("movie" or "series").
+func streamHandlerDuration(streamType string) *metrics.Histogram {
+	return metrics.GetOrCreateHistogram(fmt.Sprintf(`stream_handler_duration_seconds{type=%q}`, streamType))
+}
+
+// searchDuration returns the histogram for the duration of searches on the given torrent site.
+func searchDuration(site string) *metrics.Histogram {
+	return metrics.GetOrCreateHistogram(fmt.Sprintf(`torrent_search_duration_seconds{site=%q}`, site))
+}
+
+// conversionDuration returns the histogram for the duration of converting a torrent into a stream with the given debrid service ("rd", "ad", "pm", "dl" or "tb").
+func conversionDuration(debridID string) *metrics.Histogram {
+	return metrics.GetOrCreateHistogram(fmt.Sprintf(`debrid_conversion_duration_seconds{service=%q}`, debridID))
+}
+
+// availabilityFalsePositives returns the counter for torrents that were (cached as) instantly available on the given debrid service ("rd", "ad", "pm", "dl" or "tb"), but couldn't be converted into a stream.
+func availabilityFalsePositives(debridID string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`availability_false_positives_total{service=%q}`, debridID))
+}
+
+// updateDuration records the duration since start in the histogram if telemetry is allowed for the request.
+func updateDuration(ctx context.Context, histogram *metrics.Histogram, start time.Time) {
+	if telemetryAllowed(ctx) {
+		histogram.UpdateDuration(start)
+	}
+}
+
+// incCounter increments the counter if telemetry is allowed for the request.
+func incCounter(ctx context.Context, counter *metrics.Counter) {
+	if telemetryAllowed(ctx) {
+		counter.Inc()
+	}
+}
+
+// countCacheAccess counts a hit or miss for the given cache.
+// The hit ratio can be calculated from the "hit" and "miss" counters.
+func countCacheAccess(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	metrics.GetOrCreateCounter(fmt.Sprintf(`cache_requests_total{cache=%q, result=%q}`, cache, result)).Inc()
+}
+
+// countingCache counts the hits and misses of a cache.
+type countingCache struct {
+	goCacher
+	name string
+}
+
+func (c countingCache) Get(k string) (interface{}, bool) {
+	v, found := c.goCacher.Get(k)
+	countCacheAccess(c.name, found)
+	return v, found
+}
+
+// requestCache returns the cache for handling a request, which counts its hits and misses if telemetry is allowed for the request.
+// Cache accesses are only counted in the handlers, because the debrid clients access their caches without the request context.
+func requestCache(ctx context.Context, cache goCacher) goCacher {
+	if c, ok := cache.(*goCache); ok && c.name != "" && telemetryAllowed(ctx) {
+		return countingCache{goCacher: cache, name: c.name}
+	}
+	return cache
+}
+
+// countingCreationCache counts the hits and misses of a creation cache.
+type countingCreationCache struct {
+	*creationCache
+}
+
+func (c countingCreationCache) Get(key string) (time.Time, bool, error) {
+	created, found, err := c.creationCache.Get(key)
+	if err == nil {
+		countCacheAccess(c.name, found)
+	}
+	return created, found, err
+}
+
+// requestCreationCache is like requestCache, for creation caches like the availability caches.
+func requestCreationCache(ctx context.Context, cache *creationCache) debrid.Cache {
+	if cache.name != "" && telemetryAllowed(ctx) {
+		return countingCreationCache{cache}
+	}
+	return cache
+}
+
+var _ imdb2torrent.MagnetSearcher = (*instrumentedSearcher)(nil)
+
+// instrumentedSearcher wraps a magnet searcher and records the duration of its searches.
+// If the request is traced, each search is a span.
+// If the context contains a search collector, the results are added to it.
+type instrumentedSearcher struct {
+	imdb2torrent.MagnetSearcher
+	site string
+}
+
+func (s *instrumentedSearcher) FindMovie(ctx context.Context, imdbID string) ([]imdb2torrent.Result, error) {
+	defer updateDuration(ctx, searchDuration(s.site), time.Now())
+	ctx, span := startSpan(ctx, "search")
+	results, err := s.MagnetSearcher.FindMovie(ctx, imdbID)
+	s.collect(ctx, span, results, err)
+	return results, err
+}
+
+func (s *instrumentedSearcher) FindTVShow(ctx context.Context, imdbID string, season, episode int) ([]imdb2torrent.Result, error) {
+	defer updateDuration(ctx, searchDuration(s.site), time.Now())
+	ctx, span := startSpan(ctx, "search")
+	results, err := s.MagnetSearcher.FindTVShow(ctx, imdbID, season, episode)
+	s.collect(ctx, span, results, err)
+	return results, err
+}
+
+func (s *instrumentedSearcher) collect(ctx context.Context, span *span, results []imdb2torrent.Result, err error) {
+	span.setAttribute("deflix.site", s.site)
+	span.setAttribute("deflix.results", strconv.Itoa(len(results)))
+	span.finish(err)
+	if err != nil {
+		return
+	}
+	if collector, ok := value(ctx, ctxKeySearchCollector).(*searchCollector); ok {
+		collector.add(s.site, results)
+	}
+}
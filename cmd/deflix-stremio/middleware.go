@@ -1,146 +1,270 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	gocache "github.com/patrickmn/go-cache"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 
-	"github.com/deflix-tv/go-debrid/alldebrid"
-	"github.com/deflix-tv/go-debrid/premiumize"
-	"github.com/deflix-tv/go-debrid/realdebrid"
+	"github.com/deflix-tv/go-stremio"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
 )
 
-// createAuthMiddleware creates a middleware that checks the validity of RealDebrid, AllDebrid and Premiumize API tokens/keys as well as Premiumize OAuth2 data.
-func createAuthMiddleware(rdClient *realdebrid.Client, adClient *alldebrid.Client, pmClient *premiumize.Client, useOAUTH2 bool, confRD, confPM oauth2.Config, aesKey []byte, logger *zap.Logger) fiber.Handler {
-	httpClient := &http.Client{
-		Timeout: 2 * time.Second,
+// credentials are the decoded user data of a request and the validated API keys or tokens for the user's debrid services.
+type credentials struct {
+	userData   userData
+	keyOrToken string
+	// Empty if the user didn't configure a fallback debrid service or if its validation failed
+	fallbackKeyOrToken string
+	// Whether one of the tokens is a Premiumize OAuth2 access token, which the Premiumize client must know
+	debridOAUTH2 bool
+}
+
+// setLocals sets the credentials for the request, so that the handlers can read them via the request context.
+func (cr credentials) setLocals(c *fiber.Ctx) {
+	setLocal(c, ctxKeyUserData, cr.userData)
+	setLocal(c, ctxKeyKeyOrToken, cr.keyOrToken)
+	if cr.fallbackKeyOrToken != "" {
+		setLocal(c, ctxKeyFallbackKeyOrToken, cr.fallbackKeyOrToken)
+	}
+	if cr.debridOAUTH2 {
+		setLocal(c, ctxKeyDebridOAUTH2, struct{}{})
 	}
+}
 
-	return func(c *fiber.Ctx) error {
-		rCtx := c.Context()
-		udString := c.Params("userData", "")
-		if udString == "" {
-			// Should never occur, because the manifest states that configuration is required and go-stremio's route matcher middleware filters these out.
-			logger.Error("User data is empty, but this should have been handled by go-stremio's router matcher middleware alraedy")
-			return c.SendStatus(fiber.StatusUnauthorized)
-		}
-		userData, err := decodeUserData(udString, logger)
-		if err != nil {
-			// The error is already logged in the decodeUserData function.
-			// It's most likely a client-side encoding error.
-			return c.SendStatus(fiber.StatusBadRequest)
+// withValues returns a copy of the context with the credentials, for calling the handlers outside of an HTTP request.
+func (cr credentials) withValues(ctx context.Context) context.Context {
+	ctx = withValue(ctx, ctxKeyUserData, cr.userData)
+	ctx = withValue(ctx, ctxKeyKeyOrToken, cr.keyOrToken)
+	if cr.fallbackKeyOrToken != "" {
+		ctx = withValue(ctx, ctxKeyFallbackKeyOrToken, cr.fallbackKeyOrToken)
+	}
+	if cr.debridOAUTH2 {
+		ctx = withValue(ctx, ctxKeyDebridOAUTH2, struct{}{})
+	}
+	return ctx
+}
+
+// authenticator checks the validity of RealDebrid, AllDebrid, Premiumize, Debrid-Link and Torbox API tokens/keys as well as Premiumize OAuth2 data.
+// It's used by the auth middleware and the gRPC API.
+type authenticator struct {
+	resolvers  debrid.Registry
+	useOAUTH2  bool
+	confRD     oauth2.Config
+	confPM     oauth2.Config
+	aesKey     []byte
+	httpClient *http.Client
+	// Refreshed OAuth2 access tokens, keyed by the hash of the encrypted OAuth2 data
+	accessTokens *gocache.Cache
+	logger       *zap.Logger
+}
+
+func newAuthenticator(resolvers debrid.Registry, useOAUTH2 bool, confRD, confPM oauth2.Config, aesKey []byte, logger *zap.Logger) *authenticator {
+	return &authenticator{
+		resolvers: resolvers,
+		useOAUTH2: useOAUTH2,
+		confRD:    confRD,
+		confPM:    confPM,
+		aesKey:    aesKey,
+		httpClient: &http.Client{
+			Timeout: 2 * time.Second,
+		},
+		accessTokens: gocache.New(time.Hour, 10*time.Minute),
+		logger:       logger,
+	}
+}
+
+// authenticate decodes the user data and checks the credentials for the user's primary debrid service and, if the user configured one, for the fallback debrid service.
+// In case of an error the returned int is the HTTP status code that's appropriate for responding to the client. Otherwise it's 0.
+func (a *authenticator) authenticate(ctx context.Context, udString string) (credentials, int) {
+	userData, err := decodeUserData(udString, a.aesKey, a.logger)
+	if err != nil {
+		// The error is already logged in the decodeUserData function.
+		// It's most likely a client-side encoding error.
+		return credentials{}, fiber.StatusBadRequest
+	}
+	result := credentials{
+		userData: userData,
+	}
+
+	// The fallback debrid service is optional, but if the user configured one, it must be usable
+	fallbackID := userData.fallbackDebridID()
+	if userData.Fallback != "" && fallbackID == "" {
+		a.logger.Info("Fallback debrid service is invalid", zap.String("fallback", userData.Fallback))
+		return credentials{}, fiber.StatusBadRequest
+	}
+
+	keyOrToken, debridOAUTH2, status := a.authenticateDebrid(ctx, userData, userData.debridID())
+	if status != 0 {
+		return credentials{}, status
+	}
+	result.keyOrToken, result.debridOAUTH2 = keyOrToken, debridOAUTH2
+
+	// When the credentials for the fallback are invalid, the user can still use the primary debrid service
+	if fallbackID != "" {
+		if fallbackKeyOrToken, debridOAUTH2, status := a.authenticateDebrid(ctx, userData, fallbackID); status == 0 {
+			result.fallbackKeyOrToken = fallbackKeyOrToken
+			result.debridOAUTH2 = result.debridOAUTH2 || debridOAUTH2
+		} else {
+			a.logger.Info("Couldn't validate the credentials for the fallback debrid service, continuing without it", zap.String("fallback", fallbackID))
 		}
+	}
+
+	return result, 0
+}
+
+// authenticateDebrid returns the validated API key or token for the debrid service with the given ID. For OAuth2 data it's the (potentially refreshed) access token.
+// The returned bool is true for Premiumize OAuth2 access tokens.
+// In case of an error the returned int is the HTTP status code that's appropriate for responding to the client. Otherwise it's 0.
+func (a *authenticator) authenticateDebrid(ctx context.Context, userData userData, debridID string) (string, bool, int) {
+	keyOrToken, debridOAUTH2, status := a.keyOrToken(ctx, userData, debridID)
+	if status != 0 {
+		return "", false, status
+	}
+	if err := a.testKeyOrToken(ctx, debridID, keyOrToken, debridOAUTH2); err != nil {
+		a.logger.Info("API key or access token is invalid or validation failed", zap.Error(err), zap.String("debridID", debridID))
+		return "", false, fiber.StatusForbidden
+	}
+	return keyOrToken, debridOAUTH2, 0
+}
 
+// keyOrToken returns the (not yet validated) API key or token for the debrid service with the given ID. For OAuth2 data it's the (potentially refreshed) access token.
+// The returned bool is true for Premiumize OAuth2 access tokens.
+// In case of an error the returned int is the HTTP status code that's appropriate for responding to the client. Otherwise it's 0.
+func (a *authenticator) keyOrToken(ctx context.Context, userData userData, debridID string) (string, bool, int) {
+	logger := a.logger
+	var keyOrToken string
+	var debridOAUTH2 bool
+	var err error
+	switch debridID {
+	case "rd":
 		// Note: Even when useOAUTH2 is true, some Stremio clients might still use the API key from the past.
-		if useOAUTH2 && (userData.RDoauth2 != "" || userData.PMoauth2 != "") {
-			if userData.RDoauth2 != "" {
-				accessToken, err, fiberErr := getAccessTokenForOAuth2data(c, confRD, aesKey, userData.RDoauth2, true, httpClient, logger)
-				if err != nil {
-					logger.Warn("Couldn't get access token for OAUTH2 data", zap.Error(err))
-					// HTTP responses are already handled
-					return fiberErr
-				}
-				if err = rdClient.TestToken(c.Context(), accessToken); err != nil {
-					logger.Info("Access token is invalid or validation failed", zap.Error(err))
-					return c.SendStatus(fiber.StatusForbidden)
-				}
-				c.Locals("deflix_keyOrToken", accessToken)
-			} else if userData.PMoauth2 != "" {
-				accessToken, err, fiberErr := getAccessTokenForOAuth2data(c, confPM, aesKey, userData.PMoauth2, false, nil, logger)
-				if err != nil {
-					logger.Warn("Couldn't get access token for OAUTH2 data", zap.Error(err))
-					// HTTP responses are already handled
-					return fiberErr
-				}
-				c.Locals("debrid_OAUTH2", struct{}{})
-				if err = pmClient.TestAPIkey(c.Context(), accessToken); err != nil {
-					logger.Info("Access token is invalid or validation failed", zap.Error(err))
-					return c.SendStatus(fiber.StatusForbidden)
-				}
-				c.Locals("deflix_keyOrToken", accessToken)
+		if a.useOAUTH2 && userData.RDoauth2 != "" {
+			var status int
+			if keyOrToken, status, err = decryptAccessToken(ctx, a.confRD, a.aesKey, userData.RDoauth2, true, a.httpClient, a.accessTokens, logger); err != nil {
+				logger.Warn("Couldn't get access token for OAUTH2 data", zap.Error(err))
+				return "", false, status
 			}
 		} else {
-			// Log "legacy" info. Only for RD and PM, because we're still using API keys for AD even if useOAUTH2 is true.
-			if useOAUTH2 && (userData.RDtoken != "" || userData.PMkey != "") {
+			// Log "legacy" info. Only for RD and PM, because AD users could always use API keys, even if useOAUTH2 is true.
+			if a.useOAUTH2 && userData.RDtoken != "" {
 				logger.Info("Using OAUTH2, but a client used an API key")
 			}
-			// We expect a user to have *either* an RD token *or* an AD key *or* a Premiumize key
-			if userData.RDtoken != "" {
-				if err := rdClient.TestToken(rCtx, userData.RDtoken); err != nil {
-					logger.Info("API key is invalid or validation failed", zap.Error(err))
-					return c.SendStatus(fiber.StatusForbidden)
-				}
-				c.Locals("deflix_keyOrToken", userData.RDtoken)
-			} else if userData.ADkey != "" {
-				if err := adClient.TestAPIkey(rCtx, userData.ADkey); err != nil {
-					logger.Info("API key is invalid or validation failed", zap.Error(err))
-					return c.SendStatus(fiber.StatusForbidden)
-				}
-				c.Locals("deflix_keyOrToken", userData.ADkey)
-			} else if userData.PMkey != "" {
-				if err := pmClient.TestAPIkey(rCtx, userData.PMkey); err != nil {
-					logger.Info("API key is invalid or validation failed", zap.Error(err))
-					return c.SendStatus(fiber.StatusForbidden)
-				}
-				c.Locals("deflix_keyOrToken", userData.PMkey)
-			} else {
-				logger.Info("API key is empty", zap.String("userData", fmt.Sprintf("%+v", userData)))
-				return c.SendStatus(fiber.StatusUnauthorized)
+			keyOrToken = userData.RDtoken
+		}
+	case "ad":
+		if a.useOAUTH2 && userData.ADoauth2 != "" {
+			var status int
+			if keyOrToken, status, err = decryptADapiKey(a.aesKey, userData.ADoauth2, logger); err != nil {
+				logger.Warn("Couldn't decrypt API key from AllDebrid PIN data", zap.Error(err))
+				return "", false, status
 			}
+		} else {
+			keyOrToken = userData.ADkey
 		}
-
-		return c.Next()
+	case "pm":
+		if a.useOAUTH2 && userData.PMoauth2 != "" {
+			var status int
+			if keyOrToken, status, err = decryptAccessToken(ctx, a.confPM, a.aesKey, userData.PMoauth2, false, nil, a.accessTokens, logger); err != nil {
+				logger.Warn("Couldn't get access token for OAUTH2 data", zap.Error(err))
+				return "", false, status
+			}
+			debridOAUTH2 = true
+		} else {
+			if a.useOAUTH2 && userData.PMkey != "" {
+				logger.Info("Using OAUTH2, but a client used an API key")
+			}
+			keyOrToken = userData.PMkey
+		}
+	case "dl":
+		keyOrToken = userData.DLkey
+	case "tb":
+		keyOrToken = userData.TBkey
 	}
+	if keyOrToken == "" {
+		logger.Info("API key is empty", zap.Object("userData", userData))
+		return "", false, fiber.StatusUnauthorized
+	}
+	return keyOrToken, debridOAUTH2, 0
 }
 
-// getAccessTokenForOAuth2data is a convenience function that decrypts the OAUTH2 data and returns a valid (potentially refreshed) access token,
-// while taking care of Fiber responses in error cases.
-// The first error return value is the error that occurred inside this function. The second is from sending the response via Fiber.
-func getAccessTokenForOAuth2data(c *fiber.Ctx, conf oauth2.Config, aesKey []byte, oauth2data string, rdWorkaround bool, httpClient *http.Client, logger *zap.Logger) (string, error, error) {
-	ciphertext, err := base64.RawURLEncoding.DecodeString(oauth2data)
-	if err != nil {
-		// It's most likely a client-side encoding error
-		return "", err, c.SendStatus(fiber.StatusBadRequest)
+// testKeyOrToken checks the API key or token via the client of the debrid service with the given ID.
+// debridOAUTH2 must be true for Premiumize OAuth2 access tokens.
+func (a *authenticator) testKeyOrToken(ctx context.Context, debridID, keyOrToken string, debridOAUTH2 bool) error {
+	// The Premiumize client must know whether it's an access token already for validating it
+	if debridOAUTH2 {
+		ctx = withValue(ctx, ctxKeyDebridOAUTH2, struct{}{})
 	}
+	resolver, ok := a.resolvers[debridID]
+	if !ok {
+		return fmt.Errorf("unknown debrid service: %v", debridID)
+	}
+	return resolver.TestCreds(ctx, keyOrToken)
+}
 
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		logger.Warn("Couldn't create block cipher from AES key", zap.Error(err))
-		return "", err, c.SendStatus(fiber.StatusInternalServerError)
+// createAuthMiddleware creates a middleware that checks the validity of the debrid credentials in the user data via the authenticator.
+// It puts the decoded user data and the validated API keys or tokens into the request context, so that the handlers don't have to decode and validate them again.
+func createAuthMiddleware(auth *authenticator, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		udString := c.Params("userData", "")
+		if udString == "" {
+			// Should never occur, because the manifest states that configuration is required and go-stremio's route matcher middleware filters these out.
+			logger.Error("User data is empty, but this should have been handled by go-stremio's router matcher middleware alraedy")
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		creds, status := auth.authenticate(c.Context(), udString)
+		if status != 0 {
+			return c.SendStatus(status)
+		}
+		creds.setLocals(c)
+
+		return c.Next()
 	}
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		logger.Error("Couldn't create AES GCM", zap.Error(err))
-		return "", err, c.SendStatus(fiber.StatusInternalServerError)
+}
+
+// decryptAccessToken decrypts the OAUTH2 data and returns a valid (potentially refreshed) access token.
+// If accessTokens isn't nil, the access token is cached in it until shortly before it expires, so that not every request leads to a round trip to the token endpoint.
+// In case of an error the returned int is the HTTP status code that's appropriate for responding to the client.
+func decryptAccessToken(ctx context.Context, conf oauth2.Config, aesKey []byte, oauth2data string, rdWorkaround bool, httpClient *http.Client, accessTokens *gocache.Cache, logger *zap.Logger) (string, int, error) {
+	// The OAuth2 data contains the refresh token, so it's not used as key as it is
+	hash := sha256.Sum256([]byte(oauth2data))
+	cacheKey := base64.RawURLEncoding.EncodeToString(hash[:])
+	if accessTokens != nil {
+		if accessToken, found := accessTokens.Get(cacheKey); found {
+			return accessToken.(string), fiber.StatusOK, nil
+		}
 	}
-	// The nonce is prepended
-	nonce := ciphertext[:aesgcm.NonceSize()]
-	ciphertext = ciphertext[aesgcm.NonceSize():]
 
-	tokenJSON, err := aesgcm.Open(nil, nonce, ciphertext, nil)
+	tokenJSON, status, err := decryptUserData(aesKey, oauth2data, logger)
 	if err != nil {
-		return "", err, c.SendStatus(fiber.StatusForbidden)
+		return "", status, err
 	}
 	token := &oauth2.Token{}
 	if err = json.Unmarshal(tokenJSON, token); err != nil {
 		// How likely is it that if the previous decoding worked, that it's now the client's fault vs ours?
-		return "", err, c.SendStatus(fiber.StatusBadRequest)
+		return "", fiber.StatusBadRequest, err
 	}
 	// This is a workaround for RD, as they don't seem to implement the OAuth2 flow the way the Go OAuth2 package expects
 	// (for example they require grant_type: "http://oauth.net/grant_type/device/1.0", instead of "refresh_token")
 	var accessToken string
+	var expiry time.Time
 	if rdWorkaround {
 		// Example call from RD docs:
 		// curl -X POST "https://api.real-debrid.com/oauth/v2/token" -d "client_id=ABCDEFGHIJKLM&client_secret=abcdefghsecret0123456789&code=ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789&grant_type=http://oauth.net/grant_type/device/1.0"
@@ -149,16 +273,16 @@ func getAccessTokenForOAuth2data(c *fiber.Ctx, conf oauth2.Config, aesKey []byte
 		data.Add("client_secret", conf.ClientSecret)
 		data.Add("code", token.RefreshToken)
 		data.Add("grant_type", "http://oauth.net/grant_type/device/1.0")
-		req, err := http.NewRequest("POST", conf.Endpoint.TokenURL, strings.NewReader(data.Encode()))
+		req, err := http.NewRequestWithContext(ctx, "POST", conf.Endpoint.TokenURL, strings.NewReader(data.Encode()))
 		if err != nil {
 			logger.Error("Couldn't create request object for RD token refresh", zap.Error(err))
-			return "", err, c.SendStatus(fiber.StatusInternalServerError)
+			return "", fiber.StatusInternalServerError, err
 		}
 		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
 		res, err := httpClient.Do(req)
 		if err != nil {
 			logger.Warn("Error during request to RD token refresh", zap.Error(err))
-			return "", err, c.SendStatus(fiber.StatusInternalServerError)
+			return "", fiber.StatusInternalServerError, err
 		}
 		defer res.Body.Close()
 		// RD API usually always responds with 200 and a JSON object (even for bad requests / invalid accounts etc),
@@ -167,29 +291,227 @@ func getAccessTokenForOAuth2data(c *fiber.Ctx, conf oauth2.Config, aesKey []byte
 		// So we have to treat non-OK responses as errors from the client side, not from us.
 		if res.StatusCode != fiber.StatusOK {
 			var errBody []byte
-			errBody, _ = ioutil.ReadAll(res.Body)
+			errBody, _ = io.ReadAll(res.Body)
 			logger.Info("RD token refresh response != OK", zap.Int("status", res.StatusCode), zap.ByteString("body", errBody))
-			return "", errors.New("RD response != OK"), c.SendStatus(fiber.StatusForbidden)
+			return "", fiber.StatusForbidden, errors.New("RD response != OK")
 		}
-		tokenJSON, err = ioutil.ReadAll(res.Body)
+		tokenJSON, err = io.ReadAll(res.Body)
 		if err != nil {
 			logger.Warn("Couldn't read response body from RD token refresh", zap.Error(err))
-			return "", err, c.SendStatus(fiber.StatusInternalServerError)
+			return "", fiber.StatusInternalServerError, err
 		}
 		if err = json.Unmarshal(tokenJSON, token); err != nil {
 			logger.Warn("Couldn't unmarshal RD response body into OAuth2 token", zap.Error(err), zap.ByteString("body", tokenJSON))
-			return "", err, c.SendStatus(fiber.StatusInternalServerError)
+			return "", fiber.StatusInternalServerError, err
 		}
 		accessToken = token.AccessToken
+		// The OAuth2 package only sets the expiry when it handles the token response itself
+		var expiresIn struct {
+			ExpiresIn int `json:"expires_in"`
+		}
+		if err = json.Unmarshal(tokenJSON, &expiresIn); err == nil && expiresIn.ExpiresIn > 0 {
+			expiry = time.Now().Add(time.Duration(expiresIn.ExpiresIn) * time.Second)
+		}
 	} else {
-		tokenSource := conf.TokenSource(c.Context(), token)
+		tokenSource := conf.TokenSource(ctx, token)
 		// The token source automatically refreshes the token with the refresh token
 		validToken, err := tokenSource.Token()
 		if err != nil {
-			return "", err, c.SendStatus(fiber.StatusForbidden)
+			return "", fiber.StatusForbidden, err
 		}
 		accessToken = validToken.AccessToken
+		expiry = validToken.Expiry
 	}
 
-	return accessToken, nil, nil
+	// Tokens without expiry aren't cached, because we don't know when to refresh them
+	if accessTokens != nil && time.Until(expiry) > accessTokenExpiryMargin {
+		accessTokens.Set(cacheKey, accessToken, time.Until(expiry)-accessTokenExpiryMargin)
+	}
+	return accessToken, fiber.StatusOK, nil
+}
+
+// createAdminAuthMiddleware creates a middleware that only lets requests pass that have the admin token as bearer token.
+func createAdminAuthMiddleware(adminToken string, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		auth := c.Get(fiber.HeaderAuthorization)
+		if auth == "" {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		} else if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+adminToken)) != 1 {
+			logger.Warn("Admin endpoint was called with invalid admin token", zap.String("path", c.Path()))
+			return c.SendStatus(fiber.StatusForbidden)
+		}
+		return c.Next()
+	}
+}
+
+// createStreamHintsMiddleware creates a middleware that adds behavior hints (like the filename and video size) and names to the stream items of a stream handler response.
+// go-stremio's StreamItem doesn't have fields for them yet, so the stream handler puts them into maps that this middleware puts into the context.
+// The map key is the stream URL.
+func createStreamHintsMiddleware(logger *zap.Logger) fiber.Handler {
+	// hintedStreamItem is a stream item with a name and behavior hints.
+	type hintedStreamItem struct {
+		stremio.StreamItem
+		Name          string               `json:"name,omitempty"`
+		BehaviorHints *streamBehaviorHints `json:"behaviorHints,omitempty"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		streamHints := map[string]streamBehaviorHints{}
+		setLocal(c, ctxKeyStreamHints, streamHints)
+		streamNames := map[string]string{}
+		setLocal(c, ctxKeyStreamNames, streamNames)
+
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		if c.Response().StatusCode() != fiber.StatusOK || (len(streamHints) == 0 && len(streamNames) == 0) {
+			return nil
+		}
+
+		var res struct {
+			Streams []stremio.StreamItem `json:"streams"`
+		}
+		if err := json.Unmarshal(c.Response().Body(), &res); err != nil {
+			logger.Error("Couldn't unmarshal stream response for adding behavior hints", zap.Error(err))
+			return nil
+		}
+		var hintedRes struct {
+			Streams []hintedStreamItem `json:"streams"`
+		}
+		for _, stream := range res.Streams {
+			hintedStream := hintedStreamItem{
+				StreamItem: stream,
+				Name:       streamNames[stream.URL],
+			}
+			if hints, ok := streamHints[stream.URL]; ok {
+				hintedStream.BehaviorHints = &hints
+			}
+			hintedRes.Streams = append(hintedRes.Streams, hintedStream)
+		}
+		resBody, err := json.Marshal(hintedRes)
+		if err != nil {
+			logger.Error("Couldn't marshal stream response with behavior hints", zap.Error(err))
+			return nil
+		}
+		c.Response().SetBody(resBody)
+		return nil
+	}
+}
+
+// createDiagnosticsMiddleware creates a middleware that adds the stream diagnostics as JSON in the "X-Deflix-Diagnostics" header to a stream handler response.
+// The diagnostics are only collected when the URL query contains "debug=true", so regular requests from Stremio don't get the header.
+func createDiagnosticsMiddleware(logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if debug, _ := strconv.ParseBool(c.Query("debug")); !debug {
+			return c.Next()
+		}
+		diagnostics := &streamDiagnostics{
+			Qualities: map[string]qualityDiagnostics{},
+		}
+		setLocal(c, ctxKeyDiagnostics, diagnostics)
+
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		diagnosticsJSON, err := json.Marshal(diagnostics)
+		if err != nil {
+			logger.Error("Couldn't marshal stream diagnostics", zap.Error(err))
+			return nil
+		}
+		c.Set("X-Deflix-Diagnostics", string(diagnosticsJSON))
+		// So that the Deflix frontend can read the header in cross-origin requests
+		c.Set(fiber.HeaderAccessControlExposeHeaders, "X-Deflix-Diagnostics")
+		return nil
+	}
+}
+
+// createTelemetryMiddleware creates a middleware that puts the info whether optional telemetry is allowed for the request into the context.
+// Telemetry is not allowed if it's disabled for the whole instance or if the client sent a "DNT: 1" (Do Not Track) header.
+// Use telemetryAllowed() to read the info.
+func createTelemetryMiddleware(disableTelemetry bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		allowed := !disableTelemetry && c.Get("DNT") != "1"
+		setLocal(c, ctxKeyTelemetry, allowed)
+		return c.Next()
+	}
+}
+
+// telemetryAllowed returns true if optional telemetry (like metrics and usage statistics) is allowed for the request.
+// It returns false if the telemetry middleware didn't run for the request.
+func telemetryAllowed(ctx context.Context) bool {
+	allowed, _ := value(ctx, ctxKeyTelemetry).(bool)
+	return allowed
+}
+
+// Request IDs that are accepted from the "X-Request-ID" header, for example from a reverse proxy
+var requestIDregex = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// createRequestIDMiddleware creates a middleware that puts an ID for the request into the context and the "X-Request-ID" response header.
+// If the request already has a valid "X-Request-ID" header, its value is used, so that the logs can be correlated with the ones of a reverse proxy.
+// Use requestLogger() to add the ID to log lines.
+func createRequestIDMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		requestID := c.Get(fiber.HeaderXRequestID)
+		if !requestIDregex.MatchString(requestID) {
+			requestID = randomHex(8)
+		} else {
+			// Fiber's values are only valid until the handler returns, but background work like prefetching uses the ID afterwards
+			requestID = utils.CopyString(requestID)
+		}
+		setLocal(c, ctxKeyRequestID, requestID)
+		c.Set(fiber.HeaderXRequestID, requestID)
+		return c.Next()
+	}
+}
+
+// requestLogger returns a logger that adds the request ID from the context to each log line, so that all log lines of a request can be correlated.
+// If the context doesn't contain a request ID, the logger is returned as is.
+func requestLogger(ctx context.Context, logger *zap.Logger) *zap.Logger {
+	if requestID, ok := value(ctx, ctxKeyRequestID).(string); ok {
+		return logger.With(zap.String("requestID", requestID))
+	}
+	return logger
+}
+
+// createStatusAuthMiddleware creates a middleware that only lets requests pass that either contain the status token as bearer token in the "Authorization" header,
+// or that have a valid signature of a link that was created by the status link handler.
+// Signed links are only valid until they expire and can only be used once.
+func createStatusAuthMiddleware(statusToken string, logger *zap.Logger) fiber.Handler {
+	// Keeps used signatures until their links expire
+	usedSigs := gocache.New(statusLinkExpiration, time.Hour)
+
+	return func(c *fiber.Ctx) error {
+		if auth := c.Get(fiber.HeaderAuthorization); auth != "" {
+			if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+statusToken)) != 1 {
+				logger.Warn("Status endpoint was called with invalid status token")
+				return c.SendStatus(fiber.StatusForbidden)
+			}
+			return c.Next()
+		}
+
+		// Signed links can't be used to create more links
+		sig := c.Query("sig", "")
+		if sig == "" || c.Path() != "/status" {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		expires := c.Query("expires", "")
+		expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		if !hmac.Equal([]byte(sig), []byte(signStatusLink(statusToken, c.Query("imdbid", ""), expires))) {
+			logger.Warn("Status endpoint was called with invalid signature")
+			return c.SendStatus(fiber.StatusForbidden)
+		} else if time.Now().Unix() > expiresUnix {
+			logger.Info("Status endpoint was called with expired link")
+			return c.SendStatus(fiber.StatusForbidden)
+		} else if err := usedSigs.Add(sig, struct{}{}, gocache.DefaultExpiration); err != nil {
+			// Add() only returns an error if the item already exists
+			logger.Info("Status endpoint was called with already used link")
+			return c.SendStatus(fiber.StatusForbidden)
+		}
+		return c.Next()
+	}
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/oauth2"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	logger := zap.New(core)
+	app := fiber.New()
+	app.Use(createRequestIDMiddleware())
+	app.Get("/", func(c *fiber.Ctx) error {
+		requestLogger(c.Context(), logger).Info("foo")
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	// Generated
+	res, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	requestID := res.Header.Get("X-Request-ID")
+	require.Len(t, requestID, 16)
+	require.Equal(t, requestID, logs.TakeAll()[0].ContextMap()["requestID"])
+
+	// From a reverse proxy
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	res, err = app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, "abc-123", res.Header.Get("X-Request-ID"))
+	require.Equal(t, "abc-123", logs.TakeAll()[0].ContextMap()["requestID"])
+
+	// Invalid ones are replaced
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "foo bar\"")
+	res, err = app.Test(req)
+	require.NoError(t, err)
+	require.Len(t, res.Header.Get("X-Request-ID"), 16)
+	require.Equal(t, res.Header.Get("X-Request-ID"), logs.TakeAll()[0].ContextMap()["requestID"])
+
+	// Without the middleware
+	requestLogger(context.Background(), logger).Info("foo")
+	require.Empty(t, logs.TakeAll()[0].ContextMap())
+}
+
+func TestDecryptAccessTokenCache(t *testing.T) {
+	var refreshes int
+	expiresIn := 3600
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refreshes++
+		w.Write([]byte(`{"access_token": "access` + strconv.Itoa(refreshes) + `", "refresh_token": "refresh", "expires_in": ` + strconv.Itoa(expiresIn) + `}`))
+	}))
+	defer tokenServer.Close()
+	conf := oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: tokenServer.URL}}
+	hash := sha256.Sum256([]byte("foo"))
+	aesKey := hash[:]
+	oauth2data, err := encryptUserData(aesKey, []byte(`{"access_token": "access0", "refresh_token": "refresh"}`))
+	require.NoError(t, err)
+	accessTokens := gocache.New(time.Hour, 0)
+
+	// The refreshed access token is cached
+	for i := 0; i < 2; i++ {
+		accessToken, _, err := decryptAccessToken(context.Background(), conf, aesKey, oauth2data, true, tokenServer.Client(), accessTokens, zap.NewNop())
+		require.NoError(t, err)
+		require.Equal(t, "access1", accessToken)
+	}
+	require.Equal(t, 1, refreshes)
+
+	// Without cache
+	accessToken, _, err := decryptAccessToken(context.Background(), conf, aesKey, oauth2data, true, tokenServer.Client(), nil, zap.NewNop())
+	require.NoError(t, err)
+	require.Equal(t, "access2", accessToken)
+
+	// Tokens that expire soon aren't cached
+	accessTokens.Flush()
+	expiresIn = 60
+	for i := 3; i < 5; i++ {
+		accessToken, _, err = decryptAccessToken(context.Background(), conf, aesKey, oauth2data, true, tokenServer.Client(), accessTokens, zap.NewNop())
+		require.NoError(t, err)
+		require.Equal(t, "access"+strconv.Itoa(i), accessToken)
+	}
+}
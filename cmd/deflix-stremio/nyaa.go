@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+var (
+	nyaaResolutionRegex = regexp.MustCompile(`(?i)\b(?:(2160|1080|720)p|(?:3840x(2160)|1920x(1080)|1280x(720))|(4k))\b`)
+	nyaa10bitRegex      = regexp.MustCompile(`(?i)\b(?:10[ -]?bits?|hi10p?)\b`)
+	nyaaBluRayRegex     = regexp.MustCompile(`(?i)\b(?:bd|bdrip|bdremux|blu-?ray)\b`)
+	nyaaWebRegex        = regexp.MustCompile(`(?i)\b(?:web|web-?dl|web-?rip)\b`)
+	nyaaSizeRegex       = regexp.MustCompile(`^([0-9.]+) ([KMGT]i)?B$`)
+	nonAlphanumRegex    = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+var _ imdb2torrent.MagnetSearcher = (*nyaaClient)(nil)
+
+// animeMetaGetter gets the metadata of movies and TV shows by their IMDb ID and of anime by their Kitsu ID.
+type animeMetaGetter interface {
+	imdb2torrent.MetaGetter
+	GetKitsuSimple(ctx context.Context, kitsuID string) (imdb2torrent.Meta, error)
+}
+
+// nyaaClient is an imdb2torrent.MagnetSearcher for nyaa.si, which has most anime torrents.
+// Anime releases rarely contain IMDb IDs, so it searches by the title from the meta getter.
+type nyaaClient struct {
+	baseURL          string
+	httpClient       *http.Client
+	cache            imdb2torrent.Cache
+	cacheAge         time.Duration
+	stats            *torrentStatsStore
+	metaGetter       animeMetaGetter
+	logger           *zap.Logger
+	logFoundTorrents bool
+}
+
+func newNyaaClient(baseURL string, timeout, cacheAge time.Duration, cache imdb2torrent.Cache, stats *torrentStatsStore, metaGetter animeMetaGetter, logger *zap.Logger, logFoundTorrents bool) *nyaaClient {
+	return &nyaaClient{
+		baseURL: baseURL,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		cache:            cache,
+		cacheAge:         cacheAge,
+		stats:            stats,
+		metaGetter:       metaGetter,
+		logger:           logger,
+		logFoundTorrents: logFoundTorrents,
+	}
+}
+
+// FindMovie searches Nyaa for torrents for the given IMDb ID.
+// If no error occured, but there are just no torrents for the movie yet, an empty result and *no* error are returned.
+func (c *nyaaClient) FindMovie(ctx context.Context, imdbID string) ([]imdb2torrent.Result, error) {
+	meta, err := c.metaGetter.GetMovieSimple(ctx, imdbID)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get movie title via Cinemeta for IMDb ID %v: %v", imdbID, err)
+	}
+	return c.find(ctx, imdbID, meta.Title, meta.Title, 0, 0)
+}
+
+// FindTVShow searches Nyaa for torrents for the given IMDb ID + season + episode.
+// Most anime releases use the episode number without season, like "[Group] Title - 05 (1080p)", so the episode number is part of the query and the season is only checked for seasons after the first one.
+// If no error occured, but there are just no torrents for the TV show yet, an empty result and *no* error are returned.
+func (c *nyaaClient) FindTVShow(ctx context.Context, imdbID string, season, episode int) ([]imdb2torrent.Result, error) {
+	id := imdbID + ":" + strconv.Itoa(season) + ":" + strconv.Itoa(episode)
+	meta, err := c.metaGetter.GetTVShowSimple(ctx, imdbID, season, episode)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get TV show title via Cinemeta for ID %v: %v", id, err)
+	}
+	query := fmt.Sprintf("%v %02d", meta.Title, episode)
+	return c.find(ctx, id, meta.Title, query, season, episode)
+}
+
+// FindKitsu searches Nyaa for torrents for the given Kitsu ID, like "11469", and for TV shows the episode.
+// Kitsu has a separate ID for each season of a TV show, so the episode number is the one within the season, which is what most anime releases use.
+// For movies the episode must be 0.
+// If no error occured, but there are just no torrents for the anime yet, an empty result and *no* error are returned.
+func (c *nyaaClient) FindKitsu(ctx context.Context, kitsuID string, episode int) ([]imdb2torrent.Result, error) {
+	id := kitsuIDprefix + kitsuID
+	if episode > 0 {
+		id += ":" + strconv.Itoa(episode)
+	}
+	meta, err := c.metaGetter.GetKitsuSimple(ctx, kitsuID)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get anime title via Kitsu for ID %v: %v", id, err)
+	}
+	query := meta.Title
+	if episode > 0 {
+		query = fmt.Sprintf("%v %02d", meta.Title, episode)
+	}
+	return c.find(ctx, id, meta.Title, query, 0, episode)
+}
+
+// IsSlow returns false, because Nyaa responds quickly.
+func (c *nyaaClient) IsSlow() bool {
+	return false
+}
+
+// find searches Nyaa with the query and returns the results whose titles contain the given title.
+// For movies season and episode must be 0.
+func (c *nyaaClient) find(ctx context.Context, id, title, query string, season, episode int) ([]imdb2torrent.Result, error) {
+	logger := requestLogger(ctx, c.logger)
+	zapFieldID := zap.String("id", id)
+	zapFieldTorrentSite := zap.String("torrentSite", "Nyaa")
+
+	// Check cache first
+	cacheKey := id + "-Nyaa"
+	torrentList, created, found, err := c.cache.Get(cacheKey)
+	if err != nil {
+		logger.Error("Couldn't get torrent results from cache", zap.Error(err), zapFieldID, zapFieldTorrentSite)
+	} else if !found {
+		logger.Debug("Torrent results not found in cache", zapFieldID, zapFieldTorrentSite)
+	} else if time.Since(created) > (c.cacheAge) {
+		expiredSince := time.Since(created.Add(c.cacheAge))
+		logger.Debug("Hit cache for torrents, but item is expired", zap.Duration("expiredSince", expiredSince), zapFieldID, zapFieldTorrentSite)
+	} else {
+		logger.Debug("Hit cache for torrents, returning results", zap.Int("torrentCount", len(torrentList)), zapFieldID, zapFieldTorrentSite)
+		return torrentList, nil
+	}
+
+	// Category 1_2 is "Anime - English-translated", which contains the vast majority of anime releases.
+	// Sorting by seeders makes sure that the first results are the ones that debrid services most likely have cached.
+	urlValues := url.Values{}
+	urlValues.Set("page", "rss")
+	urlValues.Set("c", "1_2")
+	urlValues.Set("f", "0")
+	urlValues.Set("s", "seeders")
+	urlValues.Set("o", "desc")
+	urlValues.Set("q", query)
+	reqURL := c.baseURL + "/?" + urlValues.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send GET request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Bad GET response: %v", res.StatusCode)
+	}
+	var feed nyaaRSS
+	if err = xml.NewDecoder(res.Body).Decode(&feed); err != nil {
+		return nil, fmt.Errorf("Couldn't decode response body: %v", err)
+	}
+
+	var results []imdb2torrent.Result
+	for _, item := range feed.Channel.Items {
+		if !nyaaTitleMatches(item.Title, title, season, episode) {
+			continue
+		}
+		result, err := item.toResult()
+		if err != nil {
+			logger.Debug("Skipping torrent", zap.Error(err), zap.String("title", item.Title), zapFieldID, zapFieldTorrentSite)
+			continue
+		}
+		recordTorrentStats(c.stats, result.InfoHash, parseNyaaSize(item.Size), int64(item.Seeders), logger, zapFieldID, zapFieldTorrentSite)
+		if c.logFoundTorrents {
+			logger.Debug("Found torrent", zap.String("title", result.Title), zap.String("quality", result.Quality), zap.String("infoHash", result.InfoHash), zap.String("magnet", result.MagnetURL), zapFieldID, zapFieldTorrentSite)
+		}
+		results = append(results, result)
+	}
+
+	// Fill cache, even if there are no results, because that's just the current state of the torrent site.
+	// Any actual errors would have returned earlier.
+	if err := c.cache.Set(cacheKey, results); err != nil {
+		logger.Error("Couldn't cache torrents", zap.Error(err), zap.String("cache", "torrent"), zapFieldID, zapFieldTorrentSite)
+	}
+
+	return results, nil
+}
+
+type nyaaRSS struct {
+	Channel struct {
+		Items []nyaaItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+// nyaaItem is an item of Nyaa's RSS feed.
+// The tags don't contain the "nyaa" namespace, so that they also match when the namespace URL changes.
+type nyaaItem struct {
+	Title    string `xml:"title"`
+	InfoHash string `xml:"infoHash"`
+	// Like "1.4 GiB"
+	Size    string `xml:"size"`
+	Seeders int    `xml:"seeders"`
+}
+
+// toResult converts the item into an imdb2torrent.Result.
+// It returns an error if the item isn't in one of the supported qualities, has no seeders or no valid info hash.
+func (i nyaaItem) toResult() (imdb2torrent.Result, error) {
+	quality := parseNyaaQuality(i.Title)
+	if quality == "" {
+		return imdb2torrent.Result{}, errors.New("unsupported quality")
+	}
+	// Torrents without seeders can't be downloaded by debrid services
+	if i.Seeders == 0 {
+		return imdb2torrent.Result{}, errors.New("no seeders")
+	}
+	infoHash := strings.ToUpper(i.InfoHash)
+	if len(infoHash) != 40 {
+		return imdb2torrent.Result{}, errors.New("info hash isn't 40 characters long")
+	}
+	magnetURL := "magnet:?xt=urn:btih:" + infoHash + "&dn=" + url.QueryEscape(i.Title)
+	// Keep the size, so that it can be shown to the user
+	if size := parseNyaaSize(i.Size); size > 0 {
+		magnetURL += "&xl=" + strconv.FormatInt(size, 10)
+	}
+
+	return imdb2torrent.Result{
+		Title:     i.Title,
+		Quality:   quality,
+		InfoHash:  infoHash,
+		MagnetURL: magnetURL,
+	}, nil
+}
+
+// nyaaTitleMatches checks whether the torrent title contains the movie or TV show title and, for TV shows, the episode.
+// Anime release titles are like "[SubsPlease] Sousou no Frieren - 05 (1080p) [ABCD1234].mkv" or "Title S02E05 1080p WEB".
+func nyaaTitleMatches(torrentTitle, title string, season, episode int) bool {
+	normalizedTorrentTitle := " " + normalizeTitle(torrentTitle) + " "
+	if !strings.Contains(normalizedTorrentTitle, " "+normalizeTitle(title)+" ") {
+		return false
+	}
+	if episode == 0 {
+		return true
+	}
+	if strings.Contains(normalizedTorrentTitle, fmt.Sprintf(" s%02de%02d ", season, episode)) {
+		return true
+	}
+	// Without "SxxEyy" the episode number is standalone, like " - 05 ", " 05v2 ", " E05 " or " - 05.mkv".
+	// The normalized title can't be used here, because audio channels like "5.1" would look like episode numbers.
+	episodeRegex := regexp.MustCompile(fmt.Sprintf(`(?:^|[\s_\[(]|\be|\bep)0*%d(?:v\d)?(?:$|[\s_\])]|\.mkv|\.mp4)`, episode))
+	if !episodeRegex.MatchString(strings.ToLower(torrentTitle)) {
+		return false
+	}
+	// Season 0 is for absolute episode numbers and Kitsu IDs, which don't need a season in the title either
+	if season <= 1 {
+		return true
+	}
+	seasonRegex := regexp.MustCompile(fmt.Sprintf(` (?:s0*%d|season %d|%d(?:nd|rd|th) season) `, season, season, season))
+	return seasonRegex.MatchString(normalizedTorrentTitle)
+}
+
+// normalizeTitle converts the title to lower case and replaces all non-alphanumeric characters by single spaces.
+func normalizeTitle(title string) string {
+	return strings.TrimSpace(nonAlphanumRegex.ReplaceAllString(strings.ToLower(title), " "))
+}
+
+// parseNyaaQuality returns the quality in the same format as the built-in imdb2torrent clients, like "1080p 10bit (bluray)",
+// or an empty string if it's none of the supported resolutions.
+// Anime releases have the resolution in brackets ("[1080p]", "(1920x1080)") and the source as "BD" or "WEB".
+func parseNyaaQuality(title string) string {
+	match := nyaaResolutionRegex.FindStringSubmatch(title)
+	if match == nil {
+		return ""
+	}
+	var quality string
+	switch {
+	case match[1] != "":
+		quality = match[1] + "p"
+	case match[2] != "", match[5] != "":
+		quality = "2160p"
+	case match[3] != "":
+		quality = "1080p"
+	default:
+		quality = "720p"
+	}
+
+	if nyaa10bitRegex.MatchString(title) {
+		quality += " 10bit"
+	}
+
+	// Same as the YTS types
+	if nyaaBluRayRegex.MatchString(title) {
+		quality += " (bluray)"
+	} else if nyaaWebRegex.MatchString(title) {
+		quality += " (web)"
+	}
+
+	return quality
+}
+
+// parseNyaaSize converts a size like "1.4 GiB" to bytes. It returns 0 if the size can't be parsed.
+func parseNyaaSize(size string) int64 {
+	match := nyaaSizeRegex.FindStringSubmatch(size)
+	if match == nil {
+		return 0
+	}
+	f, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0
+	}
+	switch match[2] {
+	case "Ki":
+		f *= 1 << 10
+	case "Mi":
+		f *= 1 << 20
+	case "Gi":
+		f *= 1 << 30
+	case "Ti":
+		f *= 1 << 40
+	}
+	return int64(f)
+}
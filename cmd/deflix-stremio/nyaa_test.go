@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+const nyaaFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss xmlns:atom="http://www.w3.org/2005/Atom" xmlns:nyaa="https://nyaa.si/xmlns/nyaa" version="2.0">
+  <channel>
+    <item>
+      <title>[SubsPlease] Sousou no Frieren - 05 (1080p) [ABCD1234].mkv</title>
+      <nyaa:seeders>500</nyaa:seeders>
+      <nyaa:infoHash>dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c</nyaa:infoHash>
+      <nyaa:size>1.5 GiB</nyaa:size>
+    </item>
+    <item>
+      <title>[Group] Sousou no Frieren - 15 (1080p)</title>
+      <nyaa:seeders>100</nyaa:seeders>
+      <nyaa:infoHash>abcdefabcdefabcdefabcdefabcdefabcdefabcd</nyaa:infoHash>
+      <nyaa:size>1.4 GiB</nyaa:size>
+    </item>
+    <item>
+      <title>[Group] Sousou no Frieren - 05 [BD 1920x1080 HEVC 10bit]</title>
+      <nyaa:seeders>0</nyaa:seeders>
+      <nyaa:infoHash>1234567890123456789012345678901234567890</nyaa:infoHash>
+      <nyaa:size>2 GiB</nyaa:size>
+    </item>
+  </channel>
+</rss>`
+
+type fakeMetaGetter struct{}
+
+func (fakeMetaGetter) GetMovieSimple(ctx context.Context, imdbID string) (imdb2torrent.Meta, error) {
+	return imdb2torrent.Meta{Title: "Suzume", Year: 2022}, nil
+}
+
+func (fakeMetaGetter) GetTVShowSimple(ctx context.Context, imdbID string, season, episode int) (imdb2torrent.Meta, error) {
+	return imdb2torrent.Meta{Title: "Sousou no Frieren", Year: 2023}, nil
+}
+
+func (fakeMetaGetter) GetKitsuSimple(ctx context.Context, kitsuID string) (imdb2torrent.Meta, error) {
+	return imdb2torrent.Meta{Title: "Sousou no Frieren", Year: 2023}, nil
+}
+
+func TestNyaaFindTVShow(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("q")
+		w.Write([]byte(nyaaFeed))
+	}))
+	defer server.Close()
+
+	client := newNyaaClient(server.URL, time.Second, time.Hour, imdb2torrent.NewInMemoryCache(), nil, fakeMetaGetter{}, zap.NewNop(), false)
+	results, err := client.FindTVShow(context.Background(), "tt22248376", 1, 5)
+	require.NoError(t, err)
+	require.Equal(t, "Sousou no Frieren 05", query)
+	// Episode 15 doesn't match and the BD release has no seeders
+	expected := []imdb2torrent.Result{
+		{
+			Title:     "[SubsPlease] Sousou no Frieren - 05 (1080p) [ABCD1234].mkv",
+			Quality:   "1080p",
+			InfoHash:  "DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C",
+			MagnetURL: "magnet:?xt=urn:btih:DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C&dn=%5BSubsPlease%5D+Sousou+no+Frieren+-+05+%281080p%29+%5BABCD1234%5D.mkv&xl=1610612736",
+		},
+	}
+	require.Equal(t, expected, results)
+}
+
+func TestNyaaFindKitsu(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("q")
+		w.Write([]byte(nyaaFeed))
+	}))
+	defer server.Close()
+
+	client := newNyaaClient(server.URL, time.Second, time.Hour, imdb2torrent.NewInMemoryCache(), nil, fakeMetaGetter{}, zap.NewNop(), false)
+	results, err := client.FindKitsu(context.Background(), "46474", 5)
+	require.NoError(t, err)
+	require.Equal(t, "Sousou no Frieren 05", query)
+	require.Len(t, results, 1)
+	require.Equal(t, "DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C", results[0].InfoHash)
+}
+
+func TestNyaaTitleMatches(t *testing.T) {
+	require.True(t, nyaaTitleMatches("[SubsPlease] Suzume (1080p)", "Suzume", 0, 0))
+	require.False(t, nyaaTitleMatches("[SubsPlease] Suzumenoko (1080p)", "Suzume", 0, 0))
+
+	require.True(t, nyaaTitleMatches("[Group] Frieren - 05v2 [1080p]", "Frieren", 1, 5))
+	require.True(t, nyaaTitleMatches("[Group] Frieren - 05.mkv", "Frieren", 1, 5))
+	require.True(t, nyaaTitleMatches("Frieren E05 1080p WEB", "Frieren", 1, 5))
+	require.True(t, nyaaTitleMatches("Frieren S01E05 1080p WEB", "Frieren", 1, 5))
+	require.False(t, nyaaTitleMatches("[Group] Frieren - 15 [1080p]", "Frieren", 1, 5))
+	// Audio channels aren't episode numbers
+	require.False(t, nyaaTitleMatches("[Group] Frieren - 02 [1080p AAC 5.1]", "Frieren", 1, 5))
+
+	require.True(t, nyaaTitleMatches("[Group] Frieren S2 - 05 [1080p]", "Frieren", 2, 5))
+	require.True(t, nyaaTitleMatches("[Group] Frieren 2nd Season - 05 [1080p]", "Frieren", 2, 5))
+	require.False(t, nyaaTitleMatches("[Group] Frieren - 05 [1080p]", "Frieren", 2, 5))
+
+	// Absolute episode numbers
+	require.True(t, nyaaTitleMatches("[Group] One Piece - 1045 [1080p]", "One Piece", 0, 1045))
+}
+
+func TestParseNyaaQuality(t *testing.T) {
+	require.Equal(t, "1080p", parseNyaaQuality("[SubsPlease] Foo - 01 (1080p) [ABCD1234].mkv"))
+	require.Equal(t, "1080p 10bit (bluray)", parseNyaaQuality("[Group] Foo [BD 1920x1080 HEVC 10bit FLAC]"))
+	require.Equal(t, "720p (web)", parseNyaaQuality("[Group] Foo - 01 [WEB 720p]"))
+	require.Equal(t, "2160p (bluray)", parseNyaaQuality("[Group] Foo [BDRip 2160p]"))
+	require.Equal(t, "1080p 10bit", parseNyaaQuality("[Group] Foo [1080p Hi10P]"))
+	require.Empty(t, parseNyaaQuality("[Group] Foo [480p]"))
+}
+
+func TestParseNyaaSize(t *testing.T) {
+	require.Equal(t, int64(1610612736), parseNyaaSize("1.5 GiB"))
+	require.Equal(t, int64(300*1024*1024), parseNyaaSize("300.0 MiB"))
+	require.Equal(t, int64(0), parseNyaaSize("foo"))
+}
@@ -6,6 +6,8 @@ import (
 	crand "crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
 	"net/http"
 
@@ -115,34 +117,21 @@ func createOAUTH2installHandler(confRD, confPM oauth2.Config, aesKey []byte, log
 			logger.Error("Couldn't marshal the token into JSON", zap.Error(err))
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
-		block, err := aes.NewCipher(aesKey)
+		encrypted, err := encryptUserData(aesKey, tokenJSON)
 		if err != nil {
-			logger.Warn("Couldn't create block cipher from AES key", zap.Error(err))
+			logger.Error("Couldn't encrypt the token", zap.Error(err))
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
-		aesgcm, err := cipher.NewGCM(block)
-		if err != nil {
-			logger.Error("Couldn't create AES GCM", zap.Error(err))
-			return c.SendStatus(fiber.StatusInternalServerError)
-		}
-		nonce := make([]byte, aesgcm.NonceSize())
-		if _, err = crand.Read(nonce); err != nil {
-			logger.Error("Couldn't create nonce", zap.Error(err))
-			return c.SendStatus(fiber.StatusInternalServerError)
-		}
-		// We prepend the nonce because we don't want to store it
-		ciphertext := aesgcm.Seal(nonce, nonce, tokenJSON, nil)
 
 		// Redirect to the "/configure" webpage, but with the OAuth2 data in the URL so that the site's JavaScript can read and use it.
-		// The encoding below leads to double Base64 encoding, but using `string(ciphertext)` leads to much longer and uglier Base64-encoded user data.
 		var ud userData
 		if service == "rd" {
 			ud = userData{
-				RDoauth2: base64.RawURLEncoding.EncodeToString(ciphertext),
+				RDoauth2: encrypted,
 			}
 		} else if service == "pm" {
 			ud = userData{
-				PMoauth2: base64.RawURLEncoding.EncodeToString(ciphertext),
+				PMoauth2: encrypted,
 			}
 		}
 		// else is taken care of at the start of the handler
@@ -162,3 +151,57 @@ func createOAUTH2installHandler(confRD, confPM oauth2.Config, aesKey []byte, log
 		return c.SendStatus(http.StatusTemporaryRedirect)
 	}
 }
+
+// encryptUserData encrypts data that's delivered to the Stremio client as part of the user data, like OAuth2 tokens, with AES-GCM.
+// The result is Base64URL-encoded, which leads to double Base64 encoding in the user data, but using `string(ciphertext)` leads to much longer and uglier Base64-encoded user data.
+// aesKey should be 32 bytes so that AES-256 is used.
+func encryptUserData(aesKey, plaintext []byte) (string, error) {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create block cipher from AES key: %w", err)
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create AES GCM: %w", err)
+	}
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err = crand.Read(nonce); err != nil {
+		return "", fmt.Errorf("Couldn't create nonce: %w", err)
+	}
+	// We prepend the nonce because we don't want to store it
+	ciphertext := aesgcm.Seal(nonce, nonce, plaintext, nil)
+	return base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// decryptUserData decrypts data that was encrypted with encryptUserData.
+// In case of an error the returned int is the HTTP status code that's appropriate for responding to the client.
+func decryptUserData(aesKey []byte, data string, logger *zap.Logger) ([]byte, int, error) {
+	ciphertext, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		// It's most likely a client-side encoding error
+		return nil, fiber.StatusBadRequest, err
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		logger.Warn("Couldn't create block cipher from AES key", zap.Error(err))
+		return nil, fiber.StatusInternalServerError, err
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		logger.Error("Couldn't create AES GCM", zap.Error(err))
+		return nil, fiber.StatusInternalServerError, err
+	}
+	if len(ciphertext) < aesgcm.NonceSize() {
+		return nil, fiber.StatusBadRequest, errors.New("encrypted data is too short")
+	}
+	// The nonce is prepended
+	nonce := ciphertext[:aesgcm.NonceSize()]
+	ciphertext = ciphertext[aesgcm.NonceSize():]
+
+	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fiber.StatusForbidden, err
+	}
+	return plaintext, fiber.StatusOK, nil
+}
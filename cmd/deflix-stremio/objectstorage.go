@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"go.uber.org/zap"
+
+	"github.com/doingodswork/deflix-stremio/pkg/s3"
+)
+
+// Key of the BadgerDB backup object, after the configured key prefix
+const storageBackupKey = "badger/backup.bak"
+
+// downloadCacheFiles downloads all persisted go-cache files from the object storage into the cache directory,
+// so that they're loaded on startup like the locally persisted ones.
+func downloadCacheFiles(ctx context.Context, s3Client *s3.Client, keyPrefix, cacheFilePath string, logger *zap.Logger) {
+	logger.Info("Downloading cache files from object storage...")
+	start := time.Now()
+
+	keys, err := s3Client.List(ctx, keyPrefix+"cache/")
+	if err != nil {
+		logger.Error("Couldn't list cache files in object storage", zap.Error(err))
+		return
+	}
+	if err = os.MkdirAll(cacheFilePath, 0755); err != nil {
+		logger.Error("Couldn't create cache directory", zap.Error(err), zap.String("dir", cacheFilePath))
+		return
+	}
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".gob") {
+			continue
+		}
+		if err := downloadFile(ctx, s3Client, key, cacheFilePath+"/"+path.Base(key)); err != nil {
+			logger.Error("Couldn't download cache file from object storage", zap.Error(err), zap.String("key", key))
+		}
+	}
+
+	duration := time.Since(start).Milliseconds()
+	durationString := strconv.FormatInt(duration, 10) + "ms"
+	logger.Info("Downloaded cache files from object storage", zap.Int("fileCount", len(keys)), zap.String("duration", durationString))
+}
+
+// uploadCacheFiles uploads the persisted go-cache files of the given caches from the cache directory to the object storage.
+// It's meant to be called after persistCaches().
+func uploadCacheFiles(ctx context.Context, s3Client *s3.Client, keyPrefix, cacheFilePath string, cacheNames []string, logger *zap.Logger) {
+	if ctx.Err() != nil {
+		logger.Warn("Cache file upload triggered, but server is shutting down")
+		return
+	}
+
+	logger.Info("Uploading cache files to object storage...")
+	start := time.Now()
+
+	for _, name := range cacheNames {
+		if err := uploadFile(ctx, s3Client, cacheFilePath+"/"+name+".gob", keyPrefix+"cache/"+name+".gob"); err != nil {
+			logger.Error("Couldn't upload cache file to object storage", zap.Error(err), zap.String("cache", name))
+		}
+	}
+
+	duration := time.Since(start).Milliseconds()
+	durationString := strconv.FormatInt(duration, 10) + "ms"
+	logger.Info("Uploaded cache files to object storage", zap.String("duration", durationString))
+}
+
+// backupStorage writes a full backup of the BadgerDB to a temporary file and uploads it to the object storage.
+func backupStorage(ctx context.Context, s3Client *s3.Client, keyPrefix string, db *badger.DB, logger *zap.Logger) {
+	logger.Info("Uploading DB backup to object storage...")
+	start := time.Now()
+
+	file, err := os.CreateTemp("", "deflix-stremio-backup-*.bak")
+	if err != nil {
+		logger.Error("Couldn't create temporary file for DB backup", zap.Error(err))
+		return
+	}
+	defer os.Remove(file.Name())
+	_, err = db.Backup(file, 0)
+	file.Close()
+	if err != nil {
+		logger.Error("Couldn't back up DB", zap.Error(err))
+		return
+	}
+	if err = uploadFile(ctx, s3Client, file.Name(), keyPrefix+storageBackupKey); err != nil {
+		logger.Error("Couldn't upload DB backup to object storage", zap.Error(err))
+		return
+	}
+
+	duration := time.Since(start).Milliseconds()
+	durationString := strconv.FormatInt(duration, 10) + "ms"
+	logger.Info("Uploaded DB backup to object storage", zap.String("duration", durationString))
+}
+
+// restoreStorage loads the BadgerDB backup from the object storage into the DB.
+// It must only be called with an empty DB, because existing keys with a newer version are not overwritten.
+func restoreStorage(ctx context.Context, s3Client *s3.Client, keyPrefix string, db *badger.DB, logger *zap.Logger) {
+	logger.Info("Restoring DB backup from object storage...")
+	start := time.Now()
+
+	body, err := s3Client.Get(ctx, keyPrefix+storageBackupKey)
+	if err == s3.ErrNotFound {
+		logger.Info("No DB backup found in object storage")
+		return
+	} else if err != nil {
+		logger.Error("Couldn't download DB backup from object storage", zap.Error(err))
+		return
+	}
+	defer body.Close()
+	if err = db.Load(body, 256); err != nil {
+		logger.Error("Couldn't load DB backup", zap.Error(err))
+		return
+	}
+
+	duration := time.Since(start).Milliseconds()
+	durationString := strconv.FormatInt(duration, 10) + "ms"
+	logger.Info("Restored DB backup from object storage", zap.String("duration", durationString))
+}
+
+// isEmptyDB returns true if the DB doesn't contain any keys.
+func isEmptyDB(db *badger.DB) bool {
+	empty := true
+	db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty
+}
+
+func downloadFile(ctx context.Context, s3Client *s3.Client, key, filePath string) error {
+	body, err := s3Client.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	// Write to a temporary file first, so that an aborted download doesn't replace a valid local file
+	file, err := os.Create(filePath + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, body)
+	file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), filePath)
+}
+
+func uploadFile(ctx context.Context, s3Client *s3.Client, filePath, key string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return s3Client.Put(ctx, key, file, fileInfo.Size())
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/deflix-tv/go-stremio"
+	"github.com/deflix-tv/imdb2torrent"
+	"go.uber.org/zap"
+)
+
+var pmCloudHits = metrics.NewCounter("pm_cloud_hits_total")
+
+// Max number of folders of the user's Premiumize cloud that are listed for one stream request.
+// Each folder is one request to Premiumize, and users who pre-download content usually keep it within a few folders.
+const pmCloudFolderLimit = 20
+
+// pmCloudFile is a video file in the user's Premiumize cloud.
+type pmCloudFile struct {
+	// Path within the cloud, like "Movies/Big Buck Bunny (2008)/bbb.mkv"
+	Path string
+	Size int64
+	Link string
+}
+
+// pmCloudClient finds video files in the "My files" cloud storage of Premiumize users, so that content they downloaded themselves can be streamed without a torrent search.
+// Premiumize doesn't know the IMDb IDs of the files, so they're matched by the title and year of the movie or the title and episode marker of the TV show.
+type pmCloudClient struct {
+	baseURL    string
+	metaGetter imdb2torrent.MetaGetter
+	httpClient *http.Client
+	logger     *zap.Logger
+}
+
+func newPMcloudClient(baseURL string, metaGetter imdb2torrent.MetaGetter, timeout time.Duration, logger *zap.Logger) *pmCloudClient {
+	return &pmCloudClient{
+		baseURL:    baseURL,
+		metaGetter: metaGetter,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		logger: logger,
+	}
+}
+
+// findFile returns the largest video file in the user's cloud that matches the movie, or for TV shows (season > 0) the episode.
+// The returned bool is false if there's no matching file.
+func (c *pmCloudClient) findFile(ctx context.Context, keyOrToken, imdbID string, season, episode int) (pmCloudFile, bool, error) {
+	var meta imdb2torrent.Meta
+	var err error
+	if season > 0 {
+		meta, err = c.metaGetter.GetTVShowSimple(ctx, imdbID, season, episode)
+	} else {
+		meta, err = c.metaGetter.GetMovieSimple(ctx, imdbID)
+	}
+	if err != nil {
+		return pmCloudFile{}, false, fmt.Errorf("Couldn't get title via Cinemeta for IMDb ID %v: %v", imdbID, err)
+	}
+	// The year is only in the file names of movies
+	year := meta.Year
+	if season > 0 {
+		year = 0
+	}
+
+	var result pmCloudFile
+	found := false
+	// Breadth-first, starting with the root folder (empty ID)
+	folderIDs := []string{""}
+	for i := 0; i < len(folderIDs) && i < pmCloudFolderLimit; i++ {
+		files, subfolderIDs, err := c.listFolder(ctx, keyOrToken, folderIDs[i])
+		if err != nil {
+			return pmCloudFile{}, false, err
+		}
+		folderIDs = append(folderIDs, subfolderIDs...)
+		for _, file := range files {
+			if (found && file.Size <= result.Size) || !matchesTitle(file.Path, meta.Title, year) {
+				continue
+			}
+			if season > 0 && !matchesEpisode(file.Path, season, episode) {
+				continue
+			}
+			result, found = file, true
+		}
+	}
+	return result, found, nil
+}
+
+// matchesTitle returns true if the file name or path contains the title as whole words, and the year if it's not 0.
+// It's for files that users downloaded themselves, whose names don't contain IMDb IDs.
+func matchesTitle(name, title string, year int) bool {
+	normalizedTitle := normalizeTitle(title)
+	if normalizedTitle == "" || !strings.Contains(" "+normalizeTitle(name)+" ", " "+normalizedTitle+" ") {
+		return false
+	}
+	return year == 0 || strings.Contains(name, strconv.Itoa(year))
+}
+
+// listFolder returns the video files and the IDs of the subfolders of the folder with the given ID.
+// The paths of the files contain the folder's name, so that files like "S01E05.mkv" in a folder with the TV show title can be matched.
+func (c *pmCloudClient) listFolder(ctx context.Context, keyOrToken, folderID string) ([]pmCloudFile, []string, error) {
+	query := url.Values{}
+	if value(ctx, ctxKeyDebridOAUTH2) != nil {
+		query.Set("access_token", keyOrToken)
+	} else {
+		query.Set("apikey", keyOrToken)
+	}
+	if folderID != "" {
+		query.Set("id", folderID)
+	}
+	resBody, err := c.do(ctx, c.baseURL+"/folder/list?"+query.Encode())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Couldn't list Premiumize folder: %v", err)
+	}
+	var res struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Name    string `json:"name"`
+		Content []struct {
+			ID       string `json:"id"`
+			Name     string `json:"name"`
+			Type     string `json:"type"`
+			Size     int64  `json:"size"`
+			MimeType string `json:"mime_type"`
+			Link     string `json:"link"`
+		} `json:"content"`
+	}
+	if err = json.Unmarshal(resBody, &res); err != nil {
+		return nil, nil, fmt.Errorf("Couldn't unmarshal Premiumize response: %v", err)
+	}
+	if res.Status != "success" {
+		return nil, nil, fmt.Errorf("Got error response from Premiumize: %v", res.Message)
+	}
+	var files []pmCloudFile
+	var folderIDs []string
+	for _, item := range res.Content {
+		switch {
+		case item.Type == "folder":
+			folderIDs = append(folderIDs, item.ID)
+		case strings.HasPrefix(item.MimeType, "video/") && item.Link != "":
+			path := item.Name
+			if folderID != "" {
+				path = res.Name + "/" + path
+			}
+			files = append(files, pmCloudFile{Path: path, Size: item.Size, Link: item.Link})
+		}
+	}
+	return files, folderIDs, nil
+}
+
+func (c *pmCloudClient) do(ctx context.Context, reqURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send GET request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad HTTP response status: %v", res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// withPMcloudStreams wraps the stream handler so that for Premiumize users with the "pmCloud" option a matching file from their cloud is the top stream.
+// The stream points to the file's link directly, because there's nothing to convert.
+// It's also the only stream when the torrent search finds nothing.
+func withPMcloudStreams(streamHandler stremio.StreamHandler, pmCloud *pmCloudClient, logger *zap.Logger) stremio.StreamHandler {
+	return func(ctx context.Context, id string, userDataIface interface{}) ([]stremio.StreamItem, error) {
+		userData, err := userDataFromContext(ctx)
+		// The redirect handler's recomputation only needs the torrents
+		recomputation, _ := value(ctx, ctxKeyRecomputation).(bool)
+		if err != nil || !userData.PMcloud || userData.debridID() != "pm" || recomputation || strings.HasPrefix(id, kitsuIDprefix) {
+			return streamHandler(ctx, id, userDataIface)
+		}
+		logger := requestLogger(ctx, logger)
+		keyOrToken, err := keyOrTokenFromContext(ctx)
+		if err != nil {
+			logger.Error("Couldn't get debrid API key or token", zap.Error(err))
+			return nil, err
+		}
+
+		imdbID := strings.Split(id, ":")[0]
+		season, episode := seasonEpisodeFromStreamID(id)
+		file, found, err := pmCloud.findFile(ctx, keyOrToken, imdbID, season, episode)
+		if err != nil {
+			// The torrent streams still work
+			logger.Warn("Couldn't search Premiumize cloud", zap.Error(err))
+		}
+		streams, err := streamHandler(ctx, id, userDataIface)
+		if !found {
+			return streams, err
+		}
+		incCounter(ctx, pmCloudHits)
+		if err != nil && !errors.Is(err, stremio.NotFound) {
+			logger.Warn("Couldn't get torrent streams, responding with the Premiumize cloud file only", zap.Error(err))
+		}
+
+		stream := stremio.StreamItem{
+			URL:   file.Link,
+			Title: "☁ My files | " + formatSize(file.Size) + "\n" + file.Path,
+		}
+		if streamHints, ok := value(ctx, ctxKeyStreamHints).(map[string]streamBehaviorHints); ok {
+			filename := file.Path
+			if slashIndex := strings.LastIndex(filename, "/"); slashIndex >= 0 {
+				filename = filename[slashIndex+1:]
+			}
+			streamHints[stream.URL] = streamBehaviorHints{Filename: filename, VideoSize: file.Size}
+		}
+		return append([]stremio.StreamItem{stream}, streams...), nil
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deflix-tv/go-stremio"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPMcloud(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/folder/list", r.URL.Path)
+		require.Equal(t, "foo", r.URL.Query().Get("apikey"))
+		switch r.URL.Query().Get("id") {
+		case "":
+			w.Write([]byte(`{"status": "success", "content": [
+				{"id": "1", "name": "Movies", "type": "folder"},
+				{"id": "2", "name": "Sousou no Frieren", "type": "folder"},
+				{"id": "3", "name": "Suzume.2022.720p.mkv", "type": "file", "size": 1000000000, "mime_type": "video/x-matroska", "link": "https://foo.premiumize.me/3"}
+			]}`))
+		case "1":
+			w.Write([]byte(`{"status": "success", "name": "Movies", "content": [
+				{"id": "4", "name": "Suzume.2022.1080p.mkv", "type": "file", "size": 3000000000, "mime_type": "video/x-matroska", "link": "https://foo.premiumize.me/4"},
+				{"id": "5", "name": "Suzume.2022.1080p.nfo", "type": "file", "size": 4000000000, "mime_type": "text/plain", "link": "https://foo.premiumize.me/5"},
+				{"id": "6", "name": "Suzume.2013.1080p.mkv", "type": "file", "size": 5000000000, "mime_type": "video/x-matroska", "link": "https://foo.premiumize.me/6"}
+			]}`))
+		case "2":
+			w.Write([]byte(`{"status": "success", "name": "Sousou no Frieren", "content": [
+				{"id": "7", "name": "S01E01.mkv", "type": "file", "size": 1000000000, "mime_type": "video/x-matroska", "link": "https://foo.premiumize.me/7"},
+				{"id": "8", "name": "S01E02.mkv", "type": "file", "size": 1000000000, "mime_type": "video/x-matroska", "link": "https://foo.premiumize.me/8"}
+			]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	pmCloud := newPMcloudClient(server.URL, fakeMetaGetter{}, time.Second, zap.NewNop())
+	ctx := context.Background()
+
+	// Movie: largest file with the title and year
+	file, found, err := pmCloud.findFile(ctx, "foo", "tt123", 0, 0)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, pmCloudFile{Path: "Movies/Suzume.2022.1080p.mkv", Size: 3000000000, Link: "https://foo.premiumize.me/4"}, file)
+	// TV show: title in the folder name, episode in the file name
+	file, found, err = pmCloud.findFile(ctx, "foo", "tt456", 1, 2)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "https://foo.premiumize.me/8", file.Link)
+	_, found, err = pmCloud.findFile(ctx, "foo", "tt456", 1, 3)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// The cloud file is the top stream, and the only one when the torrent search finds nothing
+	var torrentStreams []stremio.StreamItem
+	streamHandler := withPMcloudStreams(func(ctx context.Context, id string, userDataIface interface{}) ([]stremio.StreamItem, error) {
+		if torrentStreams == nil {
+			return nil, stremio.NotFound
+		}
+		return torrentStreams, nil
+	}, pmCloud, zap.NewNop())
+	ctx = withValue(ctx, ctxKeyUserData, userData{PMkey: "foo", PMcloud: true})
+	ctx = withValue(ctx, ctxKeyKeyOrToken, "foo")
+	streams, err := streamHandler(ctx, "tt123", "")
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+	require.Equal(t, "https://foo.premiumize.me/4", streams[0].URL)
+	torrentStreams = []stremio.StreamItem{{URL: "https://deflix.example/redirect/tt123"}}
+	streams, err = streamHandler(ctx, "tt123", "")
+	require.NoError(t, err)
+	require.Len(t, streams, 2)
+	require.Equal(t, "https://foo.premiumize.me/4", streams[0].URL)
+	// Not without the option
+	ctx = withValue(ctx, ctxKeyUserData, userData{PMkey: "foo"})
+	streams, err = streamHandler(ctx, "tt123", "")
+	require.NoError(t, err)
+	require.Equal(t, torrentStreams, streams)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// Matches torrents that were recorded in the cinema, like "Foo.2020.HDCAM.x264" or "Foo (2020) TS"
+var camRegex = regexp.MustCompile(`(?i)\b(cam|camrip|hdcam|ts|hdts|telesync|tc|telecine)\b`)
+
+// hasPreferences returns true if the user set any of the torrent sorting and filtering preferences.
+func (ud userData) hasPreferences() bool {
+	return ud.PreferSmallest || ud.ExcludeCam || ud.MaxResolution != "" || ud.Only10bit || len(ud.Languages) > 0 || len(ud.ExcludeFormats) > 0
+}
+
+// preferencesID returns an ID for the combination of the user's preferences, or an empty string if the user didn't set any.
+// It's used in the redirect IDs, because the torrent lists in the redirect cache are shared by all users with the same preferences.
+func (ud userData) preferencesID() string {
+	if !ud.hasPreferences() {
+		return ""
+	}
+	prefs := strconv.FormatBool(ud.PreferSmallest) + strconv.FormatBool(ud.ExcludeCam) + ud.MaxResolution + strconv.FormatBool(ud.Only10bit)
+	// Not part of the ID before languages existed, so that the IDs of existing users stay the same
+	if len(ud.Languages) > 0 {
+		languages := append([]string(nil), ud.Languages...)
+		sort.Strings(languages)
+		prefs += strings.Join(languages, ",")
+	}
+	if len(ud.ExcludeFormats) > 0 {
+		formats := append([]string(nil), ud.ExcludeFormats...)
+		sort.Strings(formats)
+		prefs += "-" + strings.Join(formats, ",")
+	}
+	hash := sha256.Sum256([]byte(prefs))
+	return "-" + hex.EncodeToString(hash[:4])
+}
+
+// applyPreferences filters and sorts the torrents according to the user's preferences.
+// The result is the same when it's applied multiple times.
+func applyPreferences(torrents []imdb2torrent.Result, ud userData) []imdb2torrent.Result {
+	if !ud.hasPreferences() {
+		return torrents
+	}
+
+	maxResolution := resolution(ud.MaxResolution)
+	var result []imdb2torrent.Result
+	for _, torrent := range torrents {
+		if ud.ExcludeCam && (camRegex.MatchString(torrent.Title) || camRegex.MatchString(torrent.Quality)) {
+			continue
+		} else if maxResolution > 0 && resolution(torrent.Quality) > maxResolution {
+			continue
+		} else if ud.Only10bit && !strings.Contains(torrent.Quality, "10bit") {
+			continue
+		} else if len(ud.Languages) > 0 && !matchesLanguages(torrent, ud.Languages) {
+			continue
+		} else if len(ud.ExcludeFormats) > 0 && hasVideoFormat(torrent, ud.ExcludeFormats) {
+			continue
+		}
+		result = append(result, torrent)
+	}
+
+	if ud.PreferSmallest {
+		sortSmallestFirst(result)
+	}
+
+	return result
+}
+
+// sortSmallestFirst sorts the torrents by size, in place.
+// The size is only known if it's part of the magnet URL. Torrents with unknown size keep their order, after the ones with a known size.
+func sortSmallestFirst(torrents []imdb2torrent.Result) {
+	sort.SliceStable(torrents, func(i, j int) bool {
+		sizeI, sizeJ := magnetSize(torrents[i].MagnetURL), magnetSize(torrents[j].MagnetURL)
+		if sizeI == 0 || sizeJ == 0 {
+			return sizeJ == 0 && sizeI != 0
+		}
+		return sizeI < sizeJ
+	})
+}
+
+// resolution returns the vertical resolution of a quality like "1080p (web)", or 0 if it's unknown.
+func resolution(quality string) int {
+	pIndex := strings.Index(quality, "p")
+	if pIndex <= 0 {
+		return 0
+	}
+	result, err := strconv.Atoi(quality[:pIndex])
+	if err != nil {
+		return 0
+	}
+	return result
+}
+
+// magnetSize returns the size in bytes from the "xl" (exact length) parameter of a magnet URL, or 0 if it's unknown.
+func magnetSize(magnetURL string) int64 {
+	return hintsFromMagnet(magnetURL).VideoSize
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestApplyPreferences(t *testing.T) {
+	torrents := []imdb2torrent.Result{
+		{Title: "Foo.2020.HDCAM.x264", Quality: "720p", MagnetURL: "magnet:?xt=urn:btih:1"},
+		{Title: "Foo.2020.1080p.BluRay", Quality: "1080p", MagnetURL: "magnet:?xt=urn:btih:2&xl=2000"},
+		{Title: "Foo.2020.1080p.WEB", Quality: "1080p (web)", MagnetURL: "magnet:?xt=urn:btih:3&xl=1000"},
+		{Title: "Foo.2020.1080p.10bit", Quality: "1080p 10bit", MagnetURL: "magnet:?xt=urn:btih:4"},
+		{Title: "Foo.2020.2160p.10bit", Quality: "2160p 10bit", MagnetURL: "magnet:?xt=urn:btih:5&xl=3000"},
+	}
+
+	// No preferences
+	require.Equal(t, torrents, applyPreferences(torrents, userData{}))
+	require.Empty(t, userData{}.preferencesID())
+
+	ud := userData{ExcludeCam: true, MaxResolution: "1080p"}
+	require.Equal(t, []imdb2torrent.Result{torrents[1], torrents[2], torrents[3]}, applyPreferences(torrents, ud))
+
+	ud = userData{Only10bit: true}
+	require.Equal(t, []imdb2torrent.Result{torrents[3], torrents[4]}, applyPreferences(torrents, ud))
+
+	ud = userData{ExcludeFormats: []string{"hevc"}}
+	hevcTorrent := imdb2torrent.Result{Title: "Foo.2020.1080p.BluRay.x265", Quality: "1080p", MagnetURL: "magnet:?xt=urn:btih:6"}
+	require.Equal(t, torrents, applyPreferences(append(torrents, hevcTorrent), ud))
+
+	// Torrents with unknown size are last
+	ud = userData{PreferSmallest: true}
+	require.Equal(t, []imdb2torrent.Result{torrents[2], torrents[1], torrents[4], torrents[0], torrents[3]}, applyPreferences(torrents, ud))
+
+	// Different preferences lead to different IDs
+	require.NotEmpty(t, ud.preferencesID())
+	require.NotEqual(t, ud.preferencesID(), userData{Only10bit: true}.preferencesID())
+	require.NotEqual(t, ud.preferencesID(), userData{PreferSmallest: true, Languages: []string{"de"}}.preferencesID())
+	require.Equal(t, userData{Languages: []string{"de", "fr"}}.preferencesID(), userData{Languages: []string{"fr", "de"}}.preferencesID())
+	require.NotEqual(t, userData{Languages: []string{"de"}}.preferencesID(), userData{ExcludeFormats: []string{"hevc"}}.preferencesID())
+	require.Equal(t, userData{ExcludeFormats: []string{"av1", "hevc"}}.preferencesID(), userData{ExcludeFormats: []string{"hevc", "av1"}}.preferencesID())
+}
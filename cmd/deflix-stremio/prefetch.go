@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
+)
+
+const (
+	// Max number of prefetches that run at the same time. Further prefetches are skipped.
+	maxConcurrentPrefetches = 10
+	prefetchTimeout         = time.Minute
+)
+
+// prefetchCounter returns the counter for prefetches with the given result ("ok", "cached", "limited" or "failed").
+func prefetchCounter(result string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`stream_prefetches_total{result=%q}`, result))
+}
+
+// prefetcher converts a torrent into a stream URL in the background and puts it into the stream cache,
+// so that when the user clicks on the stream, the redirect handler can respond instantly.
+type prefetcher struct {
+	resolvers   debrid.Registry
+	streamCache goCacher
+	callLimiter *debridCallLimiter
+	// Optional
+	audit *auditLog
+	// Limits the number of concurrent prefetches
+	sem    chan struct{}
+	logger *zap.Logger
+}
+
+func newPrefetcher(resolvers debrid.Registry, streamCache goCacher, callLimiter *debridCallLimiter, audit *auditLog, logger *zap.Logger) *prefetcher {
+	return &prefetcher{
+		resolvers:   resolvers,
+		streamCache: streamCache,
+		callLimiter: callLimiter,
+		audit:       audit,
+		sem:         make(chan struct{}, maxConcurrentPrefetches),
+		logger:      logger,
+	}
+}
+
+// prefetch asynchronously converts the torrent into a stream URL for the stream with the given redirect ID.
+// It's skipped when too many prefetches are running already.
+func (p *prefetcher) prefetch(ctx context.Context, udString string, userData userData, keyOrToken, redirectID string, torrent imdb2torrent.Result) {
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		p.logger.Debug("Too many concurrent prefetches, skipping", zap.String("redirectID", redirectID))
+		return
+	}
+
+	// The request context is canceled when the stream handler returns, so we need a new one.
+	prefetchCtx := debridContext(ctx)
+
+	go func() {
+		defer func() { <-p.sem }()
+		ctx, cancel := context.WithTimeout(prefetchCtx, prefetchTimeout)
+		defer cancel()
+		p.run(ctx, udString, userData, keyOrToken, redirectID, torrent)
+	}()
+}
+
+func (p *prefetcher) run(ctx context.Context, udString string, userData userData, keyOrToken, redirectID string, torrent imdb2torrent.Result) {
+	logger := requestLogger(ctx, p.logger)
+	// Same as in the redirect handler, which uses the path escaped redirect ID from the stream URL
+	redirectID = url.PathEscape(redirectID)
+	zapFieldRedirectID := zap.String("redirectID", redirectID)
+
+	// Lock the same way as the redirect handler, so that a click during the prefetch waits for it instead of converting the torrent a second time
+	redirectLockMapLock.Lock()
+	if _, ok := redirectLock[redirectID]; !ok {
+		redirectLock[redirectID] = &sync.Mutex{}
+	}
+	redirectLockMapLock.Unlock()
+	redirectLock[redirectID].Lock()
+	defer redirectLock[redirectID].Unlock()
+
+	userHash := sha256.Sum256([]byte(udString))
+	userHashEncoded := base64.RawURLEncoding.EncodeToString(userHash[:])
+	streamCacheID := userHashEncoded + "-" + redirectID
+	if _, found := p.streamCache.Get(streamCacheID); found {
+		incCounter(ctx, prefetchCounter("cached"))
+		return
+	}
+
+	// It's the fallback debrid service when none of the torrents were instantly available on the primary one
+	debridID := debridIDfromRedirectID(redirectID)
+	// Prefetches have a low priority, the user's actual clicks are more important
+	if !p.callLimiter.allow(debridID, keyOrToken, conversionCalls[debridID], true) {
+		logger.Debug("Debrid API call limit for prefetches reached, skipping", zap.String("debridID", debridID), zapFieldRedirectID)
+		incCounter(ctx, prefetchCounter("limited"))
+		return
+	}
+	if debridID == "rd" {
+		ctx = withRDtorrentList(ctx, p.callLimiter, keyOrToken, true)
+		ctx = withRDpolling(ctx, p.callLimiter, keyOrToken, true)
+	}
+	season, episode := seasonEpisodeFromStreamID(streamIDfromRedirectID(redirectID))
+	streamURL, err := convertTorrent(ctx, p.resolvers, debridID, torrent, season, episode, keyOrToken, userData.RDremote)
+	p.audit.record(userHashEncoded, redirectID, torrent.InfoHash, debridID, "prefetch", err == nil)
+	if err != nil {
+		// No stream cache item is created, so that the redirect handler tries all torrents when the user clicks on the stream
+		logger.Info("Couldn't prefetch stream URL", zap.Error(err), zapFieldRedirectID)
+		incCounter(ctx, prefetchCounter("failed"))
+		return
+	}
+	streamURLitem := cacheItem{
+		Value:   streamURL,
+		Created: time.Now(),
+	}
+	p.streamCache.Set(streamCacheID, streamURLitem, streamExpiration)
+	fillStreamFileInfo(p.streamCache, streamCacheID, streamURLitem, logger)
+	logger.Debug("Prefetched stream URL", zapFieldRedirectID)
+	incCounter(ctx, prefetchCounter("ok"))
+}
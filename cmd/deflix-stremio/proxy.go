@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"go.uber.org/zap"
+)
+
+var (
+	proxiedStreams = metrics.NewCounter("proxied_streams_total")
+	proxiedBytes   = metrics.NewCounter("proxied_bytes_total")
+)
+
+// Response headers of the debrid services that are forwarded to the player
+var proxiedHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Content-Disposition", "Last-Modified", "ETag"}
+
+// streamProxy streams the video files from the debrid services through this service, instead of redirecting the players to them.
+// This is for users whose networks block the hostnames of the debrid services.
+type streamProxy struct {
+	httpClient *http.Client
+	// Shared by all proxied streams. Nil means no limit.
+	limiter *bandwidthLimiter
+	logger  *zap.Logger
+}
+
+// newStreamProxy creates a new streamProxy. The bytes per second are the max bandwidth of all proxied streams combined, 0 means no limit.
+func newStreamProxy(bytesPerSecond int, logger *zap.Logger) *streamProxy {
+	var limiter *bandwidthLimiter
+	if bytesPerSecond > 0 {
+		limiter = newBandwidthLimiter(bytesPerSecond)
+	}
+	return &streamProxy{
+		httpClient: &http.Client{
+			// No overall timeout, because streaming a movie takes hours
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: timeout,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+		limiter: limiter,
+		logger:  logger,
+	}
+}
+
+// serve responds with the video file behind the stream URL.
+// The "Range" header is forwarded, so that players can seek.
+// The response is written to the hijacked connection, because the server's write timeout, which is fixed by go-stremio, would abort the stream after a few seconds.
+func (p *streamProxy) serve(c *fiber.Ctx, streamURL string) error {
+	// The request context can't be used, because the response body is read in the hijack handler, after fasthttp released the context
+	method := utils.CopyString(c.Method())
+	req, err := http.NewRequest(method, streamURL, nil)
+	if err != nil {
+		p.logger.Error("Couldn't create request for proxying stream", zap.Error(err))
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if rangeHeader := c.Get(fiber.HeaderRange); rangeHeader != "" {
+		req.Header.Set(fiber.HeaderRange, rangeHeader)
+	}
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logger.Warn("Couldn't get stream for proxying", zap.Error(err))
+		return c.SendStatus(fiber.StatusBadGateway)
+	}
+	incCounter(c.Context(), proxiedStreams)
+	// Fiber's context can't be used in the hijack handler
+	telemetry := telemetryAllowed(c.Context())
+
+	c.Context().HijackSetNoResponse(true)
+	c.Context().Hijack(func(conn net.Conn) {
+		defer res.Body.Close()
+		bw := bufio.NewWriter(conn)
+		fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", res.StatusCode, http.StatusText(res.StatusCode))
+		header := http.Header{}
+		for _, key := range proxiedHeaders {
+			if value := res.Header.Get(key); value != "" {
+				header.Set(key, value)
+			}
+		}
+		// The hijacked connection is closed after the response, which also marks the end of the body if the debrid service didn't send its length
+		header.Set("Connection", "close")
+		if err := header.Write(bw); err != nil {
+			return
+		}
+		bw.WriteString("\r\n")
+		if method != fiber.MethodHead {
+			var body io.Reader = res.Body
+			if p.limiter != nil {
+				body = &throttledReader{r: body, limiter: p.limiter}
+			}
+			n, err := io.Copy(bw, body)
+			if telemetry {
+				proxiedBytes.Add(int(n))
+			}
+			if err != nil {
+				// Usually because the player closed the connection, for example when seeking
+				p.logger.Debug("Proxying stream stopped", zap.Error(err), zap.Int64("bytes", n))
+				return
+			}
+		}
+		bw.Flush()
+	})
+	return nil
+}
+
+// bandwidthLimiter limits the combined rate of multiple readers.
+type bandwidthLimiter struct {
+	bytesPerSecond int
+	lock           sync.Mutex
+	// When the bytes that were read so far are within the limit
+	next time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		bytesPerSecond: bytesPerSecond,
+	}
+}
+
+// wait blocks until the bytes that were read so far, including the given ones, are within the limit.
+func (l *bandwidthLimiter) wait(n int) {
+	l.lock.Lock()
+	now := time.Now()
+	// Unused bandwidth isn't saved up for later
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.bytesPerSecond) * float64(time.Second)))
+	wait := l.next.Sub(now)
+	l.lock.Unlock()
+	time.Sleep(wait)
+}
+
+// throttledReader limits the rate at which data is read from the underlying reader.
+// Readers that share a limiter are limited together.
+type throttledReader struct {
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the rate smooth
+	if len(p) > t.limiter.bytesPerSecond {
+		p = p[:t.limiter.bytesPerSecond]
+	}
+	n, err := t.r.Read(p)
+	t.limiter.wait(n)
+	return n, err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStreamProxy(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	debridServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="foo.mkv"`)
+		w.Header().Set("X-Not-Forwarded", "foo")
+		http.ServeContent(w, r, "foo.mkv", time.Time{}, strings.NewReader(content))
+	}))
+	defer debridServer.Close()
+
+	proxy := newStreamProxy(0, zap.NewNop())
+	app := fiber.New()
+	app.Get("/stream", func(c *fiber.Ctx) error {
+		return proxy.serve(c, debridServer.URL)
+	})
+	app.Head("/stream", func(c *fiber.Ctx) error {
+		return proxy.serve(c, debridServer.URL)
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go app.Listener(l)
+	defer app.Shutdown()
+	url := "http://" + l.Addr().String() + "/stream"
+
+	// Full file
+	res, err := http.Get(url)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, content, string(body))
+	require.Equal(t, `attachment; filename="foo.mkv"`, res.Header.Get("Content-Disposition"))
+	require.Empty(t, res.Header.Get("X-Not-Forwarded"))
+
+	// Range
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Range", "bytes=10-19")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusPartialContent, res.StatusCode)
+	require.Equal(t, "0123456789", string(body))
+	require.Equal(t, "bytes 10-19/10000", res.Header.Get("Content-Range"))
+
+	// HEAD
+	res, err = http.Head(url)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, int64(len(content)), res.ContentLength)
+}
+
+func TestThrottledReader(t *testing.T) {
+	content := bytes.Repeat([]byte{'a'}, 300)
+	r := &throttledReader{r: bytes.NewReader(content), limiter: newBandwidthLimiter(1000)}
+	start := time.Now()
+	read, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, content, read)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(300*time.Millisecond))
+
+	// Readers that share a limiter are limited together
+	limiter := newBandwidthLimiter(1000)
+	start = time.Now()
+	reads := make([][]byte, 2)
+	var wg sync.WaitGroup
+	for i := range reads {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reads[i], _ = ioutil.ReadAll(&throttledReader{r: bytes.NewReader(content), limiter: limiter})
+		}(i)
+	}
+	wg.Wait()
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(600*time.Millisecond))
+	for _, read := range reads {
+		require.Equal(t, content, read)
+	}
+
+	// Reads are limited to the bytes per second
+	r = &throttledReader{r: bytes.NewReader(content), limiter: newBandwidthLimiter(100)}
+	n, err := io.ReadFull(r, make([]byte, 50))
+	require.NoError(t, err)
+	require.Equal(t, 50, n)
+	n, err = r.Read(make([]byte, 200))
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+}
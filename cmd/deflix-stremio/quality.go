@@ -0,0 +1,124 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// streamQualities are the qualities the torrents are grouped into, one stream each, in the order of the streams in the response.
+// They're part of the redirect IDs, like "tt1254207-rd-2160p.hdr". The "best" stream goes through them in reverse order.
+var streamQualities = []string{"720p", "1080p", "1080p.10bit", "1080p.remux", "2160p", "2160p.10bit", "2160p.hdr", "2160p.dv", "2160p.remux"}
+
+// bestQualities are the stream qualities in the order in which the "best" stream tries them.
+var bestQualities = func() []string {
+	result := make([]string, len(streamQualities))
+	for i, quality := range streamQualities {
+		result[len(streamQualities)-1-i] = quality
+	}
+	return result
+}()
+
+// videoFormat is a video format or codec that's detected in torrent names.
+type videoFormat struct {
+	id    string
+	label string
+	regex *regexp.Regexp
+}
+
+// videoFormats are the video formats that are detected in torrent names, in the order in which they're shown.
+// The torrent sites only detect the resolution and 10bit, so the formats are detected in the title and file name of the torrents.
+var videoFormats = []videoFormat{
+	{"remux", "Remux", regexp.MustCompile(`(?i)\bremux\b`)},
+	{"dv", "DV", regexp.MustCompile(`(?i)\b(dv|dovi|dolby[ .-]?vision)\b`)},
+	// Also matches "HDR10+", because "+" isn't a word character
+	{"hdr", "HDR", regexp.MustCompile(`(?i)\b(hdr(10)?|hdr10plus|hlg)\b`)},
+	{"hevc", "HEVC", regexp.MustCompile(`(?i)\b(x265|h\.?265|hevc)\b`)},
+	{"av1", "AV1", regexp.MustCompile(`(?i)\bav1\b`)},
+}
+
+// detectVideoFormats returns the IDs of the video formats that are tagged in the torrent's title or file name, in the order of videoFormats.
+func detectVideoFormats(torrent imdb2torrent.Result) []string {
+	// "_" is a word character, but some release names use it as separator
+	name := strings.ReplaceAll(torrent.Title+" "+hintsFromMagnet(torrent.MagnetURL).Filename, "_", " ")
+	var result []string
+	for _, format := range videoFormats {
+		if format.regex.MatchString(name) {
+			result = append(result, format.id)
+		}
+	}
+	return result
+}
+
+// videoFormatLabels returns the labels of the video formats that are tagged in the torrent, like "HDR HEVC", or an empty string if there are none.
+func videoFormatLabels(torrent imdb2torrent.Result) string {
+	var labels []string
+	for _, id := range detectVideoFormats(torrent) {
+		for _, format := range videoFormats {
+			if format.id == id {
+				labels = append(labels, format.label)
+			}
+		}
+	}
+	return strings.Join(labels, " ")
+}
+
+// streamQuality returns the stream quality the torrent belongs to, like "2160p.hdr", or an empty string if its resolution is unknown.
+// Remux has precedence over Dolby Vision, which has precedence over HDR, which has precedence over 10bit.
+// Remuxes, Dolby Vision and HDR only have their own stream for 2160p, and remuxes for 1080p as well.
+func streamQuality(torrent imdb2torrent.Result) string {
+	var base string
+	if strings.HasPrefix(torrent.Quality, "720p") {
+		return "720p"
+	} else if strings.HasPrefix(torrent.Quality, "1080p") {
+		base = "1080p"
+	} else if strings.HasPrefix(torrent.Quality, "2160p") {
+		base = "2160p"
+	} else {
+		return ""
+	}
+
+	formats := map[string]bool{}
+	for _, id := range detectVideoFormats(torrent) {
+		formats[id] = true
+	}
+	switch {
+	case formats["remux"]:
+		return base + ".remux"
+	case base == "2160p" && formats["dv"]:
+		return base + ".dv"
+	case base == "2160p" && formats["hdr"]:
+		return base + ".hdr"
+	case strings.Contains(torrent.Quality, "10bit"):
+		return base + ".10bit"
+	}
+	return base
+}
+
+// streamQualityTitle returns the title of a stream quality, like "2160p HDR" for "2160p.hdr".
+func streamQualityTitle(quality string) string {
+	parts := strings.SplitN(quality, ".", 2)
+	if len(parts) == 1 {
+		return quality
+	}
+	for _, format := range videoFormats {
+		if format.id == parts[1] {
+			return parts[0] + " " + format.label
+		}
+	}
+	// Like "1080p 10bit"
+	return parts[0] + " " + parts[1]
+}
+
+// hasVideoFormat returns whether the torrent is tagged with one of the given video formats.
+func hasVideoFormat(torrent imdb2torrent.Result, formatIDs []string) bool {
+	for _, id := range detectVideoFormats(torrent) {
+		for _, formatID := range formatIDs {
+			if id == formatID {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestDetectVideoFormats(t *testing.T) {
+	require.Equal(t, []string{"hdr", "hevc"}, detectVideoFormats(imdb2torrent.Result{Title: "Big.Buck.Bunny.2008.2160p.UHD.BluRay.HDR10+.x265"}))
+	require.Equal(t, []string{"remux", "dv"}, detectVideoFormats(imdb2torrent.Result{Title: "Big Buck Bunny", MagnetURL: "magnet:?xt=urn:btih:A&dn=Big.Buck.Bunny.2008.2160p.BluRay.REMUX.DoVi.TrueHD"}))
+	require.Equal(t, []string{"dv", "hevc"}, detectVideoFormats(imdb2torrent.Result{Title: "Big_Buck_Bunny_2008_2160p_Dolby_Vision_H.265"}))
+	require.Equal(t, []string{"av1"}, detectVideoFormats(imdb2torrent.Result{Title: "Big.Buck.Bunny.2008.1080p.WEB.AV1"}))
+	// No false positives from words that contain a tag
+	require.Empty(t, detectVideoFormats(imdb2torrent.Result{Title: "Big.Buck.Bunny.2008.DVDRip.HDRip.x264"}))
+
+	require.Equal(t, "HDR HEVC", videoFormatLabels(imdb2torrent.Result{Title: "Big.Buck.Bunny.2008.2160p.HDR.HEVC"}))
+	require.Empty(t, videoFormatLabels(imdb2torrent.Result{Title: "Big.Buck.Bunny.2008.1080p.x264"}))
+}
+
+func TestStreamQuality(t *testing.T) {
+	tests := []struct {
+		torrent imdb2torrent.Result
+		quality string
+	}{
+		{imdb2torrent.Result{Title: "Foo.720p.x265", Quality: "720p"}, "720p"},
+		{imdb2torrent.Result{Title: "Foo.1080p", Quality: "1080p (web)"}, "1080p"},
+		{imdb2torrent.Result{Title: "Foo.1080p.10bit", Quality: "1080p 10bit"}, "1080p.10bit"},
+		// HDR only has its own stream for 2160p
+		{imdb2torrent.Result{Title: "Foo.1080p.HDR.10bit", Quality: "1080p 10bit"}, "1080p.10bit"},
+		{imdb2torrent.Result{Title: "Foo.1080p.BluRay.REMUX", Quality: "1080p"}, "1080p.remux"},
+		{imdb2torrent.Result{Title: "Foo.2160p.x265", Quality: "2160p"}, "2160p"},
+		{imdb2torrent.Result{Title: "Foo.2160p.10bit", Quality: "2160p 10bit"}, "2160p.10bit"},
+		{imdb2torrent.Result{Title: "Foo.2160p.HDR10.10bit", Quality: "2160p 10bit"}, "2160p.hdr"},
+		{imdb2torrent.Result{Title: "Foo.2160p.DV.HDR", Quality: "2160p"}, "2160p.dv"},
+		{imdb2torrent.Result{Title: "Foo.2160p.REMUX.DV.HDR", Quality: "2160p"}, "2160p.remux"},
+		{imdb2torrent.Result{Title: "Foo.480p", Quality: "480p"}, ""},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.quality, streamQuality(test.torrent), test.torrent.Title)
+	}
+
+	require.Equal(t, "2160p HDR", streamQualityTitle("2160p.hdr"))
+	require.Equal(t, "1080p 10bit", streamQualityTitle("1080p.10bit"))
+	require.Equal(t, "720p", streamQualityTitle("720p"))
+	require.Equal(t, "2160p.remux", bestQualities[0])
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	gocache "github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
+)
+
+const (
+	// Max number of download queueings that run at the same time. Further ones are skipped.
+	maxConcurrentQueueings = 10
+	queueTimeout           = time.Minute
+	// A torrent is queued only once per user within this time, so that repeatedly opening the stream list doesn't add it to the debrid account again and again.
+	queueDedupExpiration = 6 * time.Hour
+	// Suffix of the redirect ID of the placeholder stream
+	queuedRedirectIDsuffix = "-queued"
+)
+
+// queueCounter returns the counter for download queueings with the given result ("queued", "downloaded", "duplicate", "limited" or "skipped").
+func queueCounter(result string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`download_queueings_total{result=%q}`, result))
+}
+
+// downloadQueuer adds torrents that aren't instantly available to the users' debrid accounts in the background,
+// so that the debrid service downloads them and the user can watch them later.
+type downloadQueuer struct {
+	resolvers   debrid.Registry
+	streamCache goCacher
+	callLimiter *debridCallLimiter
+	// Optional
+	audit *auditLog
+	// Info hashes that were queued recently, per user
+	queued *gocache.Cache
+	// Limits the number of concurrent queueings
+	sem    chan struct{}
+	logger *zap.Logger
+}
+
+func newDownloadQueuer(resolvers debrid.Registry, streamCache goCacher, callLimiter *debridCallLimiter, audit *auditLog, logger *zap.Logger) *downloadQueuer {
+	return &downloadQueuer{
+		resolvers:   resolvers,
+		streamCache: streamCache,
+		callLimiter: callLimiter,
+		audit:       audit,
+		queued:      gocache.New(queueDedupExpiration, time.Hour),
+		sem:         make(chan struct{}, maxConcurrentQueueings),
+		logger:      logger,
+	}
+}
+
+// queue asynchronously adds the torrent to the user's debrid account.
+// The debrid clients don't offer a way to only add a torrent, so the regular conversion is used, which adds the torrent, selects the video file and only waits a few seconds for the download.
+// It's expected to fail for torrents that aren't instantly available, but the debrid service keeps downloading them.
+func (q *downloadQueuer) queue(ctx context.Context, udString string, userData userData, keyOrToken, redirectID string, torrent imdb2torrent.Result) {
+	userHash := sha256.Sum256([]byte(udString))
+	userHashEncoded := base64.RawURLEncoding.EncodeToString(userHash[:])
+	if q.queued.Add(userHashEncoded+"-"+torrent.InfoHash, struct{}{}, gocache.DefaultExpiration) != nil {
+		incCounter(ctx, queueCounter("duplicate"))
+		return
+	}
+
+	select {
+	case q.sem <- struct{}{}:
+	default:
+		q.logger.Debug("Too many concurrent download queueings, skipping", zap.String("redirectID", redirectID))
+		// Allow another try with the next request
+		q.queued.Delete(userHashEncoded + "-" + torrent.InfoHash)
+		incCounter(ctx, queueCounter("skipped"))
+		return
+	}
+
+	// The request context is canceled when the stream handler returns, so we need a new one.
+	queueCtx := debridContext(ctx)
+
+	go func() {
+		defer func() { <-q.sem }()
+		ctx, cancel := context.WithTimeout(queueCtx, queueTimeout)
+		defer cancel()
+		q.run(ctx, userHashEncoded, userData, keyOrToken, redirectID, torrent)
+	}()
+}
+
+func (q *downloadQueuer) run(ctx context.Context, userHashEncoded string, userData userData, keyOrToken, redirectID string, torrent imdb2torrent.Result) {
+	logger := requestLogger(ctx, q.logger)
+	zapFieldRedirectID := zap.String("redirectID", redirectID)
+	debridID := userData.debridID()
+	if !q.callLimiter.allow(debridID, keyOrToken, conversionCalls[debridID], true) {
+		logger.Debug("Debrid API call limit for download queueings reached, skipping", zap.String("debridID", debridID), zapFieldRedirectID)
+		q.queued.Delete(userHashEncoded + "-" + torrent.InfoHash)
+		incCounter(ctx, queueCounter("limited"))
+		return
+	}
+	if debridID == "rd" {
+		ctx = withRDtorrentList(ctx, q.callLimiter, keyOrToken, true)
+		ctx = withRDpolling(ctx, q.callLimiter, keyOrToken, true)
+	}
+	season, episode := seasonEpisodeFromStreamID(streamIDfromRedirectID(redirectID))
+	streamURL, err := convertTorrent(ctx, q.resolvers, debridID, torrent, season, episode, keyOrToken, userData.RDremote)
+	q.audit.record(userHashEncoded, redirectID, torrent.InfoHash, debridID, "queue", err == nil)
+	if err != nil {
+		logger.Debug("Queued torrent for download", zap.String("conversionError", err.Error()), zapFieldRedirectID)
+		incCounter(ctx, queueCounter("queued"))
+		return
+	}
+	// The torrent was downloaded faster than expected. Same as in the redirect handler, which uses the path escaped redirect ID from the stream URL.
+	q.streamCache.Set(userHashEncoded+"-"+url.PathEscape(redirectID), cacheItem{
+		Value:   streamURL,
+		Created: time.Now(),
+	}, streamExpiration)
+	logger.Debug("Queued torrent is downloaded already", zapFieldRedirectID)
+	incCounter(ctx, queueCounter("downloaded"))
+}
+
+// bestTorrent returns the first torrent of the highest quality.
+// The torrents must not be empty.
+func bestTorrent(torrents []imdb2torrent.Result) imdb2torrent.Result {
+	result := torrents[0]
+	for _, torrent := range torrents[1:] {
+		if qualityRank(torrent.Quality) > qualityRank(result.Quality) {
+			result = torrent
+		}
+	}
+	return result
+}
+
+// qualityRank returns a number that's higher for better qualities, with 10bit being better than 8bit of the same resolution.
+func qualityRank(quality string) int {
+	rank := 2 * resolution(quality)
+	if strings.Contains(quality, "10bit") {
+		rank++
+	}
+	return rank
+}
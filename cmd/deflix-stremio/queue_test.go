@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestBestTorrent(t *testing.T) {
+	torrents := []imdb2torrent.Result{
+		{InfoHash: "1", Quality: "720p"},
+		{InfoHash: "2", Quality: "1080p (web)"},
+		{InfoHash: "3", Quality: "1080p 10bit"},
+		{InfoHash: "4", Quality: "1080p"},
+	}
+	require.Equal(t, "3", bestTorrent(torrents).InfoHash)
+
+	// The first one wins when the quality is the same
+	require.Equal(t, "2", bestTorrent([]imdb2torrent.Result{torrents[1], torrents[3]}).InfoHash)
+
+	torrents = append(torrents, imdb2torrent.Result{InfoHash: "5", Quality: "2160p"})
+	require.Equal(t, "5", bestTorrent(torrents).InfoHash)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+const (
+	// torrentapi.org allows one request per 2 seconds
+	rarbgRequestInterval = 2 * time.Second
+	// Tokens expire after 15 minutes
+	rarbgTokenTTL = 14 * time.Minute
+	// Redis keys, shared by all instances
+	rarbgTokenKey       = "rarbg_token"
+	rarbgLastRequestKey = "rarbg_lastRequest"
+)
+
+// Like "btih:dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c&"
+var rarbgInfoHashRegex = regexp.MustCompile(`btih:([0-9a-fA-F]{40})(?:&|$)`)
+
+// torrentapi.org error codes for missing, invalid and expired tokens
+var rarbgTokenErrorCodes = map[int64]struct{}{1: {}, 2: {}, 4: {}}
+
+// rarbgCoordinator coordinates the API token and the rate limit of torrentapi.org between concurrent requests.
+type rarbgCoordinator interface {
+	// token returns the current token, or an empty string if there's none
+	token(ctx context.Context) (string, error)
+	setToken(ctx context.Context, token string) error
+	deleteToken(ctx context.Context) error
+	// wait blocks until the next request may be sent, or the context is canceled
+	wait(ctx context.Context) error
+}
+
+var _ rarbgCoordinator = (*localRARBGcoordinator)(nil)
+
+// localRARBGcoordinator coordinates the requests of a single instance.
+type localRARBGcoordinator struct {
+	interval     time.Duration
+	currentToken string
+	tokenCreated time.Time
+	nextRequest  time.Time
+	lock         sync.Mutex
+}
+
+func (c *localRARBGcoordinator) token(_ context.Context) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.tokenCreated) > rarbgTokenTTL {
+		return "", nil
+	}
+	return c.currentToken, nil
+}
+
+func (c *localRARBGcoordinator) setToken(_ context.Context, token string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.currentToken = token
+	c.tokenCreated = time.Now()
+	return nil
+}
+
+func (c *localRARBGcoordinator) deleteToken(_ context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.currentToken = ""
+	return nil
+}
+
+func (c *localRARBGcoordinator) wait(ctx context.Context) error {
+	// Each request reserves its slot, so that concurrent requests are spread out
+	c.lock.Lock()
+	now := time.Now()
+	slot := c.nextRequest
+	if slot.Before(now) {
+		slot = now
+	}
+	c.nextRequest = slot.Add(c.interval)
+	c.lock.Unlock()
+
+	timer := time.NewTimer(slot.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+var _ rarbgCoordinator = (*redisRARBGcoordinator)(nil)
+
+// redisRARBGcoordinator coordinates the requests of all instances that share a Redis instance,
+// so that a scaled deployment uses a single token and stays within the rate limit like a single instance.
+type redisRARBGcoordinator struct {
+	rdb      *redis.Client
+	interval time.Duration
+}
+
+func (c *redisRARBGcoordinator) token(ctx context.Context) (string, error) {
+	token, err := c.rdb.Get(ctx, rarbgTokenKey).Result()
+	if err == redis.Nil {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("Couldn't get token from Redis: %w", err)
+	}
+	return token, nil
+}
+
+func (c *redisRARBGcoordinator) setToken(ctx context.Context, token string) error {
+	return c.rdb.Set(ctx, rarbgTokenKey, token, rarbgTokenTTL).Err()
+}
+
+func (c *redisRARBGcoordinator) deleteToken(ctx context.Context) error {
+	return c.rdb.Del(ctx, rarbgTokenKey).Err()
+}
+
+func (c *redisRARBGcoordinator) wait(ctx context.Context) error {
+	// The key exists for the interval after each request, so only one instance can set it per interval
+	for {
+		acquired, err := c.rdb.SetNX(ctx, rarbgLastRequestKey, 1, c.interval).Result()
+		if err != nil {
+			return fmt.Errorf("Couldn't reserve request in Redis: %w", err)
+		} else if acquired {
+			return nil
+		}
+		wait, err := c.rdb.PTTL(ctx, rarbgLastRequestKey).Result()
+		if err != nil {
+			return fmt.Errorf("Couldn't get remaining time of the last request from Redis: %w", err)
+		}
+		// Negative when the key expired in the meantime or has no TTL
+		if wait <= 0 {
+			wait = redirectLockRetryInterval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+var _ imdb2torrent.MagnetSearcher = (*rarbgClient)(nil)
+
+// rarbgClient is an imdb2torrent.MagnetSearcher for RARBG's torrentapi.org.
+// It's like the one of imdb2torrent, but the token and rate limit are coordinated via a rarbgCoordinator, which can share them between instances.
+type rarbgClient struct {
+	baseURL          string
+	httpClient       *http.Client
+	cache            imdb2torrent.Cache
+	cacheAge         time.Duration
+	stats            *torrentStatsStore
+	coordinator      rarbgCoordinator
+	logger           *zap.Logger
+	logFoundTorrents bool
+}
+
+// newRARBGclient creates a new rarbgClient.
+// If rdb is nil, the token and rate limit are only coordinated within this instance.
+func newRARBGclient(baseURL string, timeout, cacheAge time.Duration, cache imdb2torrent.Cache, stats *torrentStatsStore, rdb *redis.Client, logger *zap.Logger, logFoundTorrents bool) *rarbgClient {
+	var coordinator rarbgCoordinator = &localRARBGcoordinator{interval: rarbgRequestInterval}
+	if rdb != nil {
+		coordinator = &redisRARBGcoordinator{rdb: rdb, interval: rarbgRequestInterval}
+	}
+	return &rarbgClient{
+		baseURL: baseURL,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		cache:            cache,
+		cacheAge:         cacheAge,
+		stats:            stats,
+		coordinator:      coordinator,
+		logger:           logger,
+		logFoundTorrents: logFoundTorrents,
+	}
+}
+
+// FindMovie uses RARBG's API to find torrents for the given IMDb ID.
+// If no error occured, but there are just no torrents for the movie yet, an empty result and *no* error are returned.
+func (c *rarbgClient) FindMovie(ctx context.Context, imdbID string) ([]imdb2torrent.Result, error) {
+	query := url.Values{}
+	query.Set("search_imdb", imdbID)
+	return c.find(ctx, imdbID, query)
+}
+
+// FindTVShow uses RARBG's API to find torrents for the given IMDb ID + season + episode.
+// torrentapi.org supports the search by the TV show's IMDb ID and additionally filters by name, which is used for the season and episode.
+// If no error occured, but there are just no torrents for the TV show yet, an empty result and *no* error are returned.
+func (c *rarbgClient) FindTVShow(ctx context.Context, imdbID string, season, episode int) ([]imdb2torrent.Result, error) {
+	id := fmt.Sprintf("%v:%d:%d", imdbID, season, episode)
+	query := url.Values{}
+	query.Set("search_imdb", imdbID)
+	query.Set("search_string", fmt.Sprintf("S%02dE%02d", season, episode))
+	return c.find(ctx, id, query)
+}
+
+// FindSeasonPack uses RARBG's API to find packs of the given season of the TV show with the IMDb ID.
+// Only "S01" is used as filter, because each request counts towards the rate limit. The name filter matches substrings, so it also finds names like "Show.S01.COMPLETE".
+func (c *rarbgClient) FindSeasonPack(ctx context.Context, imdbID string, season int) ([]imdb2torrent.Result, error) {
+	id := fmt.Sprintf("%v:%d", imdbID, season)
+	query := url.Values{}
+	query.Set("search_imdb", imdbID)
+	query.Set("search_string", fmt.Sprintf("S%02d", season))
+	// The episodes of the season match the filter as well
+	query.Set("limit", "100")
+	torrents, err := c.find(ctx, id, query)
+	if err != nil {
+		return nil, err
+	}
+	var results []imdb2torrent.Result
+	for _, torrent := range torrents {
+		if isSeasonPack(torrent.Title, season) {
+			results = append(results, newSeasonPackResult(torrent.Title, torrent.Quality, torrent.InfoHash, torrent.MagnetURL))
+		}
+	}
+	return results, nil
+}
+
+// IsSlow returns true, because of the rate limit.
+func (c *rarbgClient) IsSlow() bool {
+	return true
+}
+
+func (c *rarbgClient) find(ctx context.Context, id string, query url.Values) ([]imdb2torrent.Result, error) {
+	logger := requestLogger(ctx, c.logger)
+	zapFieldID := zap.String("id", id)
+	zapFieldTorrentSite := zap.String("torrentSite", "RARBG")
+
+	// Check cache first
+	cacheKey := id + "-RARBG"
+	torrentList, created, found, err := c.cache.Get(cacheKey)
+	if err != nil {
+		logger.Error("Couldn't get torrent results from cache", zap.Error(err), zapFieldID, zapFieldTorrentSite)
+	} else if !found {
+		logger.Debug("Torrent results not found in cache", zapFieldID, zapFieldTorrentSite)
+	} else if time.Since(created) > (c.cacheAge) {
+		expiredSince := time.Since(created.Add(c.cacheAge))
+		logger.Debug("Hit cache for torrents, but item is expired", zap.Duration("expiredSince", expiredSince), zapFieldID, zapFieldTorrentSite)
+	} else {
+		logger.Debug("Hit cache for torrents, returning results", zap.Int("torrentCount", len(torrentList)), zapFieldID, zapFieldTorrentSite)
+		return torrentList, nil
+	}
+
+	token, err := c.getToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get token: %w", err)
+	}
+	query.Set("app_id", "deflix")
+	query.Set("mode", "search")
+	query.Set("sort", "seeders")
+	query.Set("ranked", "0")
+	// For the size and number of seeders
+	query.Set("format", "json_extended")
+	query.Set("token", token)
+	resBody, err := c.get(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if errorCode := gjson.GetBytes(resBody, "error_code").Int(); errorCode != 0 {
+		// 20 means that there are no results
+		if errorCode == 20 {
+			resBody = nil
+		} else {
+			if _, ok := rarbgTokenErrorCodes[errorCode]; ok {
+				// So that the next search gets a new one, on any instance
+				if err = c.coordinator.deleteToken(ctx); err != nil {
+					logger.Error("Couldn't delete invalid token", zap.Error(err), zapFieldTorrentSite)
+				}
+			}
+			return nil, fmt.Errorf("Got error response from torrentapi: %v", gjson.GetBytes(resBody, "error").String())
+		}
+	}
+
+	// Nil slice is ok, because it can be checked with len()
+	var results []imdb2torrent.Result
+	for _, torrent := range gjson.GetBytes(resBody, "torrent_results").Array() {
+		// "title" in the extended format, "filename" in the normal one
+		filename := torrent.Get("title").String()
+		if filename == "" {
+			filename = torrent.Get("filename").String()
+		}
+		quality := ""
+		if strings.Contains(filename, "720p") {
+			quality = "720p"
+		} else if strings.Contains(filename, "1080p") {
+			quality = "1080p"
+		} else if strings.Contains(filename, "2160p") {
+			quality = "2160p"
+		} else {
+			continue
+		}
+		if strings.Contains(filename, "10bit") {
+			quality += " 10bit"
+		}
+
+		magnet := torrent.Get("download").String()
+		match := rarbgInfoHashRegex.FindStringSubmatch(magnet)
+		if match == nil {
+			logger.Error("Couldn't find info hash in magnet URL", zap.String("magnet", magnet), zapFieldID, zapFieldTorrentSite)
+			continue
+		}
+		infoHash := strings.ToUpper(match[1])
+		// Not in the magnet URL as "xl", because for season packs it would be misleading as video size
+		recordTorrentStats(c.stats, infoHash, torrent.Get("size").Int(), torrent.Get("seeders").Int(), logger, zapFieldID, zapFieldTorrentSite)
+
+		if c.logFoundTorrents {
+			logger.Debug("Found torrent", zap.String("quality", quality), zap.String("infoHash", infoHash), zap.String("magnet", magnet), zapFieldID, zapFieldTorrentSite)
+		}
+		results = append(results, imdb2torrent.Result{
+			Title:     filename,
+			Quality:   quality,
+			InfoHash:  infoHash,
+			MagnetURL: magnet,
+		})
+	}
+
+	// Fill cache, even if there are no results, because that's just the current state of the torrent site.
+	// Any actual errors would have returned earlier.
+	if err := c.cache.Set(cacheKey, results); err != nil {
+		logger.Error("Couldn't cache torrents", zap.Error(err), zap.String("cache", "torrent"), zapFieldID, zapFieldTorrentSite)
+	}
+
+	return results, nil
+}
+
+// getToken returns the shared token, or requests a new one if there's none.
+// Concurrent searches on different instances might request a token at the same time, but then the last one is shared.
+func (c *rarbgClient) getToken(ctx context.Context) (string, error) {
+	token, err := c.coordinator.token(ctx)
+	if err != nil {
+		return "", err
+	} else if token != "" {
+		return token, nil
+	}
+	query := url.Values{}
+	query.Set("app_id", "deflix")
+	query.Set("get_token", "get_token")
+	resBody, err := c.get(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	token = gjson.GetBytes(resBody, "token").String()
+	if token == "" {
+		return "", errors.New("Token is empty")
+	}
+	if err = c.coordinator.setToken(ctx, token); err != nil {
+		return "", fmt.Errorf("Couldn't store token: %w", err)
+	}
+	return token, nil
+}
+
+// get sends a GET request to the API after waiting for the rate limit.
+func (c *rarbgClient) get(ctx context.Context, query url.Values) ([]byte, error) {
+	if err := c.coordinator.wait(ctx); err != nil {
+		return nil, fmt.Errorf("Couldn't wait for rate limit: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/pubapi_v2.php?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send GET request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Bad GET response: %v", res.StatusCode)
+	}
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read response body: %v", err)
+	}
+	return resBody, nil
+}
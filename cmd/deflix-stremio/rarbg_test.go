@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deflix-tv/imdb2torrent"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRARBGclient(t *testing.T) {
+	tokenRequests := 0
+	validToken := "token1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/pubapi_v2.php", r.URL.Path)
+		query := r.URL.Query()
+		require.Equal(t, "deflix", query.Get("app_id"))
+		if query.Get("get_token") != "" {
+			tokenRequests++
+			w.Write([]byte(`{"token": "` + validToken + `"}`))
+			return
+		}
+		if query.Get("token") != validToken {
+			w.Write([]byte(`{"error": "Invalid token. Use get_token for a new one!", "error_code": 4}`))
+			return
+		}
+		require.Equal(t, "json_extended", query.Get("format"))
+		switch query.Get("search_imdb") {
+		case "tt1254207":
+			w.Write([]byte(`{"torrent_results": [
+				{"title": "Big.Buck.Bunny.2008.1080p.BluRay.x264", "download": "magnet:?xt=urn:btih:dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c&dn=foo", "seeders": 1200, "size": 4200000000},
+				{"title": "Big.Buck.Bunny.2008.2160p.10bit.HDR", "download": "magnet:?xt=urn:btih:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"},
+				{"title": "Big.Buck.Bunny.2008.DVDRip", "download": "magnet:?xt=urn:btih:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb&dn=foo", "seeders": 50, "size": 700000000}
+			]}`))
+		case "tt0944947":
+			require.Regexp(t, `^S01E0\d$`, query.Get("search_string"))
+			w.Write([]byte(`{"error": "No results found", "error_code": 20}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	stats := &torrentStatsStore{store: &badgerStore{db: db}, keyPrefix: "torrentstats_"}
+	client := newRARBGclient(server.URL, time.Second, time.Hour, imdb2torrent.NewInMemoryCache(), stats, nil, zap.NewNop(), false)
+	client.coordinator = &localRARBGcoordinator{interval: time.Millisecond}
+	ctx := context.Background()
+
+	results, err := client.FindMovie(ctx, "tt1254207")
+	require.NoError(t, err)
+	require.Equal(t, []imdb2torrent.Result{
+		{Title: "Big.Buck.Bunny.2008.1080p.BluRay.x264", Quality: "1080p", InfoHash: "DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C", MagnetURL: "magnet:?xt=urn:btih:dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c&dn=foo"},
+		{Title: "Big.Buck.Bunny.2008.2160p.10bit.HDR", Quality: "2160p 10bit", InfoHash: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", MagnetURL: "magnet:?xt=urn:btih:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"},
+	}, results)
+	// The size and seeders of the extended format are stored
+	require.Equal(t, torrentStats{Size: 4200000000, Seeders: 1200}, stats.lookup(results[0], zap.NewNop()))
+	require.Equal(t, torrentStats{}, stats.lookup(results[1], zap.NewNop()))
+
+	// No results isn't an error, and the token is reused
+	results, err = client.FindTVShow(ctx, "tt0944947", 1, 5)
+	require.NoError(t, err)
+	require.Empty(t, results)
+	require.Equal(t, 1, tokenRequests)
+
+	// An invalid token is deleted, so that the next search gets a new one
+	validToken = "token2"
+	_, err = client.FindTVShow(ctx, "tt0944947", 1, 6)
+	require.Error(t, err)
+	_, err = client.FindTVShow(ctx, "tt0944947", 1, 7)
+	require.NoError(t, err)
+	require.Equal(t, 2, tokenRequests)
+}
+
+func TestLocalRARBGcoordinatorWait(t *testing.T) {
+	coordinator := &localRARBGcoordinator{interval: 50 * time.Millisecond}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, coordinator.wait(context.Background()))
+		}()
+	}
+	wg.Wait()
+	// The first request is sent right away, the others are spread out
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+
+	// Canceled while waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, coordinator.wait(ctx))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	gocache "github.com/patrickmn/go-cache"
+
+	debrid "github.com/deflix-tv/go-debrid"
+)
+
+// Approximate number of debrid API calls that are required to convert a torrent into a stream, per debrid service.
+// RealDebrid for example requires adding the magnet, selecting the files, fetching the torrent info and unrestricting the link.
+// Fetching the RealDebrid torrent list for reusing torrents is counted separately, because it's only done once per request (see rdTorrentList).
+var conversionCalls = map[string]int{
+	"rd": 5,
+	"ad": 3,
+	"pm": 1,
+	"dl": 1,
+	"tb": 3,
+}
+
+// Share of the hourly limit that low priority operations (like availability checks) may use.
+// The rest is reserved for high priority operations (like stream conversions).
+const lowPriorityShare = 0.8
+
+// callWindow counts the API calls of a single user within an hour.
+type callWindow struct {
+	lock  sync.Mutex
+	count int
+}
+
+// debridCallLimiter tracks the number of debrid API calls that are made on behalf of each user per hour
+// and limits them to stay below the debrid service's rate limits, protecting users' accounts from bans.
+// Low priority operations are throttled first.
+type debridCallLimiter struct {
+	// Debrid ID ("rd", "ad", "pm", "dl" or "tb") -> max calls per hour. 0 means no limit.
+	limits map[string]int
+	// Items expire one hour after the first call
+	windows *gocache.Cache
+	lock    sync.Mutex
+}
+
+func newDebridCallLimiter(limits map[string]int) *debridCallLimiter {
+	return &debridCallLimiter{
+		limits:  limits,
+		windows: gocache.New(time.Hour, 10*time.Minute),
+	}
+}
+
+// allow reports whether the given number of calls can be made on behalf of the user with the given key or token and if so, counts them.
+func (l *debridCallLimiter) allow(debridID, keyOrToken string, calls int, lowPriority bool) bool {
+	limit := l.limits[debridID]
+	if limit <= 0 {
+		return true
+	}
+	if lowPriority {
+		limit = int(float64(limit) * lowPriorityShare)
+	}
+
+	window := l.getWindow(debridID + "-" + keyOrToken)
+	window.lock.Lock()
+	defer window.lock.Unlock()
+	if window.count+calls > limit {
+		return false
+	}
+	window.count += calls
+	return true
+}
+
+func (l *debridCallLimiter) getWindow(key string) *callWindow {
+	// Lock so that concurrent first calls don't create multiple windows
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if windowIface, found := l.windows.Get(key); found {
+		return windowIface.(*callWindow)
+	}
+	window := &callWindow{}
+	l.windows.SetDefault(key, window)
+	return window
+}
+
+// getCachedAvailability returns the info hashes that are cached as instantly available.
+// It's the same logic as the debrid clients use before making an API call.
+func getCachedAvailability(availabilityCache debrid.Cache, cacheAge time.Duration, infoHashes []string) []string {
+	var result []string
+	for _, infoHash := range infoHashes {
+		if created, found, err := availabilityCache.Get(infoHash); err == nil && found && time.Since(created) <= cacheAge {
+			result = append(result, infoHash)
+		}
+	}
+	return result
+}
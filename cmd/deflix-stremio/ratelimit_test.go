@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebridCallLimiter(t *testing.T) {
+	limiter := newDebridCallLimiter(map[string]int{"rd": 10})
+
+	// Low priority operations may only use 80% of the limit
+	for i := 0; i < 8; i++ {
+		require.True(t, limiter.allow("rd", "foo", 1, true))
+	}
+	require.False(t, limiter.allow("rd", "foo", 1, true))
+	// High priority operations may use the rest
+	require.True(t, limiter.allow("rd", "foo", 2, false))
+	require.False(t, limiter.allow("rd", "foo", 1, false))
+
+	// Other users aren't affected
+	require.True(t, limiter.allow("rd", "bar", 5, false))
+	// No limit
+	require.True(t, limiter.allow("ad", "foo", 1000, false))
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/deflix-tv/go-stremio"
+	"github.com/deflix-tv/imdb2torrent"
+	"go.uber.org/zap"
+)
+
+var rdTorrentReuses = metrics.NewCounter("rd_torrent_reuses_total")
+
+// Number of the user's most recently added torrents that are checked for a torrent that can be reused.
+// Users who resume a stream usually do that within days, so the torrent is among the recent ones.
+const rdTorrentReuseLimit = 100
+
+// Prefix of the last part of the redirect ID of a file from the user's torrents, which is followed by the torrent ID and the index of the file's link,
+// like "tt1254207-rd-mytorrents.ABCDEF.0"
+const rdTorrentRedirectIDprefix = "mytorrents."
+
+// Number of debrid API calls for resolving a file from the user's torrents: Fetching the torrent info and unrestricting the link
+const rdTorrentFileCalls = 2
+
+// Max time that a single request can wait for a torrent to be downloaded, because it keeps the player waiting.
+// Well below the timeout of players, so that they get the "still downloading" response instead of timing out.
+const maxRDwaitBudget = 20 * time.Second
+
+// stillDownloadingError is returned when a RealDebrid torrent wasn't downloaded within the wait budget.
+// RealDebrid doesn't tell how long the download takes, only the progress.
+type stillDownloadingError struct {
+	Status string
+	// Percent
+	Progress float64
+}
+
+func (e *stillDownloadingError) Error() string {
+	return fmt.Sprintf("torrent still %v on RealDebrid (%.0f%%), ETA unknown", e.Status, e.Progress)
+}
+
+// rdTorrentClient finds torrents that a RealDebrid user already added, so they can be reused instead of adding the same torrent again.
+// go-debrid always adds the torrent, which fills the users' torrent lists with duplicates when they pause and resume the same movie.
+type rdTorrentClient struct {
+	baseURL         string
+	extraHeaders    map[string]string
+	forwardOriginIP bool
+	// How long to wait for torrents that aren't instantly available, and how often to check their status meanwhile
+	waitBudget   time.Duration
+	pollInterval time.Duration
+	httpClient   *http.Client
+	logger       *zap.Logger
+}
+
+func newRDtorrentClient(baseURL string, extraHeaders []string, forwardOriginIP bool, waitBudget, pollInterval, timeout time.Duration, logger *zap.Logger) (*rdTorrentClient, error) {
+	extraHeaderMap := make(map[string]string, len(extraHeaders))
+	for _, extraHeader := range extraHeaders {
+		colonIndex := strings.Index(extraHeader, ":")
+		if colonIndex <= 0 || colonIndex == len(extraHeader)-1 {
+			return nil, errors.New("extraHeaders elements must have a format like \"X-Foo: bar\"")
+		}
+		extraHeaderMap[extraHeader[:colonIndex]] = strings.TrimSpace(extraHeader[colonIndex+1:])
+	}
+	return &rdTorrentClient{
+		baseURL:         baseURL,
+		extraHeaders:    extraHeaderMap,
+		forwardOriginIP: forwardOriginIP,
+		waitBudget:      waitBudget,
+		pollInterval:    pollInterval,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		logger: logger,
+	}, nil
+}
+
+// rdTorrent is an element of RealDebrid's torrent list.
+type rdTorrent struct {
+	ID       string   `json:"id"`
+	Filename string   `json:"filename"`
+	Bytes    int64    `json:"bytes"`
+	Hash     string   `json:"hash"`
+	Status   string   `json:"status"`
+	Links    []string `json:"links"`
+}
+
+// getTorrents returns the user's most recently added torrents.
+func (c *rdTorrentClient) getTorrents(ctx context.Context, token string) ([]rdTorrent, error) {
+	resBody, err := c.do(ctx, "GET", fmt.Sprintf("%v/rest/1.0/torrents?limit=%d", c.baseURL, rdTorrentReuseLimit), token, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get RealDebrid torrents: %v", err)
+	}
+	var torrents []rdTorrent
+	if err = json.Unmarshal(resBody, &torrents); err != nil {
+		return nil, fmt.Errorf("Couldn't unmarshal RealDebrid torrents: %v", err)
+	}
+	return torrents, nil
+}
+
+// rdTorrentList is a user's torrent list that's fetched at most once per request, so that all torrents that a request tries can be checked for reuse with a single API call.
+type rdTorrentList struct {
+	once     sync.Once
+	torrents []rdTorrent
+	err      error
+	// Counts the API call against the user's debrid API call limit, and returns false if it's reached
+	allow func() bool
+}
+
+// withRDtorrentList returns a context with a torrent list for the RealDebrid user with the token, whose API call is counted by the call limiter.
+func withRDtorrentList(ctx context.Context, callLimiter *debridCallLimiter, token string, lowPriority bool) context.Context {
+	return withValue(ctx, ctxKeyRDtorrentList, &rdTorrentList{
+		allow: func() bool {
+			return callLimiter.allow("rd", token, 1, lowPriority)
+		},
+	})
+}
+
+// torrentsForReuse returns the user's torrents from the context's torrent list, which is fetched on the first call.
+// Without a torrent list in the context the torrents aren't checked for reuse, because the API call couldn't be counted.
+func (c *rdTorrentClient) torrentsForReuse(ctx context.Context, token string) ([]rdTorrent, error) {
+	list, ok := value(ctx, ctxKeyRDtorrentList).(*rdTorrentList)
+	if !ok {
+		return nil, nil
+	}
+	list.once.Do(func() {
+		if !list.allow() {
+			list.err = errCallLimit
+			return
+		}
+		list.torrents, list.err = c.getTorrents(ctx, token)
+	})
+	return list.torrents, list.err
+}
+
+// findStreamURL returns a stream URL for an already added and downloaded torrent with the info hash, or an empty string if the user has no such torrent.
+// Torrents with multiple selected files are skipped, because it's unclear which file go-debrid would have selected.
+// The torrents are taken from the context's torrent list, see torrentsForReuse.
+func (c *rdTorrentClient) findStreamURL(ctx context.Context, infoHash, token string, remote bool) (string, error) {
+	torrents, err := c.torrentsForReuse(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	link := ""
+	for _, torrent := range torrents {
+		if strings.EqualFold(torrent.Hash, infoHash) && torrent.Status == "downloaded" && len(torrent.Links) == 1 {
+			link = torrent.Links[0]
+			break
+		}
+	}
+	if link == "" {
+		return "", nil
+	}
+
+	streamURL, err := c.unrestrict(ctx, link, token, remote)
+	if err != nil {
+		return "", err
+	}
+	incCounter(ctx, rdTorrentReuses)
+	return streamURL, nil
+}
+
+// rdPolling is how a request waits for torrents that RealDebrid is still downloading.
+type rdPolling struct {
+	// Counts a status check against the user's debrid API call limit, and returns false if it's reached
+	allow func() bool
+}
+
+// withRDpolling returns a context in which conversions wait for torrents that RealDebrid is still downloading, with each status check counted by the call limiter.
+func withRDpolling(ctx context.Context, callLimiter *debridCallLimiter, token string, lowPriority bool) context.Context {
+	return withValue(ctx, ctxKeyRDpolling, rdPolling{
+		allow: func() bool {
+			return callLimiter.allow("rd", token, 1, lowPriority)
+		},
+	})
+}
+
+// getStreamURL adds the torrent and returns a stream URL for the file of the TV show episode (season > 0), or of the largest file for movies and if no file matches.
+// It's the same flow as go-debrid's, except that go-debrid always selects the largest file and always waits 5 seconds for torrents that aren't instantly available.
+// Here the wait is the client's wait budget, unless the request overrides it. When it's exceeded, the error is a *stillDownloadingError.
+// Without polling in the context (see withRDpolling) the status is only checked once, because the status checks couldn't be counted.
+func (c *rdTorrentClient) getStreamURL(ctx context.Context, magnetURL, token string, season, episode int, remote bool) (string, error) {
+	data := url.Values{}
+	data.Set("magnet", magnetURL)
+	resBody, err := c.post(ctx, "/rest/1.0/torrents/addMagnet", token, data)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't add torrent to RealDebrid: %v", err)
+	}
+	var addRes struct {
+		ID string `json:"id"`
+	}
+	if err = json.Unmarshal(resBody, &addRes); err != nil || addRes.ID == "" {
+		return "", fmt.Errorf("Couldn't determine torrent ID in RealDebrid response: %v", err)
+	}
+
+	info, err := c.getTorrentInfo(ctx, addRes.ID, token)
+	if err != nil {
+		return "", err
+	}
+	files := make([]debridFile, len(info.Files))
+	for i, file := range info.Files {
+		files[i] = debridFile{Name: file.Path, Size: file.Bytes}
+	}
+	var i int
+	if season > 0 {
+		i = selectEpisodeFile(files, season, episode)
+	} else {
+		i = selectLargestFile(files)
+	}
+	if i < 0 {
+		return "", errors.New("Couldn't find proper file in torrent")
+	}
+	data = url.Values{}
+	data.Set("files", strconv.Itoa(info.Files[i].ID))
+	if _, err = c.post(ctx, "/rest/1.0/torrents/selectFiles/"+addRes.ID, token, data); err != nil {
+		return "", fmt.Errorf("Couldn't add torrent to RealDebrid downloads: %v", err)
+	}
+
+	waitBudget := c.waitBudget
+	if override, ok := value(ctx, ctxKeyRDwaitBudget).(time.Duration); ok {
+		waitBudget = override
+	}
+	polling, ok := value(ctx, ctxKeyRDpolling).(rdPolling)
+	if !ok {
+		waitBudget = 0
+	}
+	deadline := time.Now().Add(waitBudget)
+	for polled := false; ; polled = true {
+		// The first status check is part of the conversion's calls
+		if polled && !polling.allow() {
+			return "", &stillDownloadingError{Status: info.Status, Progress: info.Progress}
+		}
+		if info, err = c.getTorrentInfo(ctx, addRes.ID, token); err != nil {
+			return "", err
+		}
+		switch info.Status {
+		case "downloaded":
+			if len(info.Links) == 0 {
+				return "", errors.New("RealDebrid torrent doesn't contain links")
+			}
+			return c.unrestrict(ctx, info.Links[0], token, remote)
+		case "magnet_error", "error", "virus", "dead":
+			return "", fmt.Errorf("Bad torrent status: %v", info.Status)
+		}
+		if !time.Now().Before(deadline) {
+			return "", &stillDownloadingError{Status: info.Status, Progress: info.Progress}
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
+
+// rdTorrentInfo is the info of a single RealDebrid torrent.
+type rdTorrentInfo struct {
+	Status string `json:"status"`
+	// Download progress in percent
+	Progress float64 `json:"progress"`
+	Files    []struct {
+		ID    int    `json:"id"`
+		Path  string `json:"path"`
+		Bytes int64  `json:"bytes"`
+		// 1 if the file was selected for download, which is when it has a link
+		Selected int `json:"selected"`
+	} `json:"files"`
+	Links []string `json:"links"`
+}
+
+func (c *rdTorrentClient) getTorrentInfo(ctx context.Context, torrentID, token string) (rdTorrentInfo, error) {
+	resBody, err := c.do(ctx, "GET", c.baseURL+"/rest/1.0/torrents/info/"+torrentID, token, nil)
+	if err != nil {
+		return rdTorrentInfo{}, fmt.Errorf("Couldn't get torrent info from RealDebrid: %v", err)
+	}
+	var info rdTorrentInfo
+	if err = json.Unmarshal(resBody, &info); err != nil {
+		return rdTorrentInfo{}, fmt.Errorf("Couldn't unmarshal RealDebrid torrent info: %v", err)
+	}
+	return info, nil
+}
+
+// unrestrict turns a RealDebrid torrent link into a stream URL.
+func (c *rdTorrentClient) unrestrict(ctx context.Context, link, token string, remote bool) (string, error) {
+	data := url.Values{}
+	data.Set("link", link)
+	if remote {
+		data.Set("remote", "1")
+	}
+	resBody, err := c.post(ctx, "/rest/1.0/unrestrict/link", token, data)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't unrestrict link: %v", err)
+	}
+	var res struct {
+		Download string `json:"download"`
+	}
+	if err = json.Unmarshal(resBody, &res); err != nil {
+		return "", fmt.Errorf("Couldn't unmarshal unrestricted link: %v", err)
+	}
+	if res.Download == "" {
+		return "", errors.New("RealDebrid didn't return an unrestricted link")
+	}
+	return res.Download, nil
+}
+
+// post sends a POST request to the RealDebrid API.
+func (c *rdTorrentClient) post(ctx context.Context, path, token string, data url.Values) ([]byte, error) {
+	// Like go-debrid, because RealDebrid asks for the original IP for all POST requests
+	if ip, ok := value(ctx, ctxKeyDebridOriginIP).(string); c.forwardOriginIP && ok {
+		data.Set("ip", ip)
+	}
+	return c.do(ctx, "POST", c.baseURL+path, token, data)
+}
+
+// convert is the conversion for the RealDebrid resolver in the debrid registry, instead of go-debrid's, which always selects the largest file and has a fixed wait.
+// For movies an already added torrent is reused if possible. For TV show episodes (season > 0) the episode's file is selected,
+// and torrents aren't reused, because an already added season pack can have another episode's file selected.
+func (c *rdTorrentClient) convert(ctx context.Context, magnetURL, token string, season, episode int, remote bool) (string, error) {
+	if infoHash := infoHashFromMagnet(magnetURL); season == 0 && infoHash != "" {
+		if streamURL := c.reusableStreamURL(ctx, infoHash, token, remote); streamURL != "" {
+			return streamURL, nil
+		}
+	}
+	return c.getStreamURL(ctx, magnetURL, token, season, episode, remote)
+}
+
+// infoHashFromMagnet returns the info hash of the magnet URL, or an empty string if it doesn't contain one.
+func infoHashFromMagnet(magnetURL string) string {
+	query, err := url.ParseQuery(strings.TrimPrefix(magnetURL, "magnet:?"))
+	if err != nil {
+		return ""
+	}
+	for _, xt := range query["xt"] {
+		if strings.HasPrefix(xt, "urn:btih:") {
+			return strings.ToUpper(strings.TrimPrefix(xt, "urn:btih:"))
+		}
+	}
+	return ""
+}
+
+// reusableStreamURL is like findStreamURL, but errors are only logged, because adding the torrent again still works.
+func (c *rdTorrentClient) reusableStreamURL(ctx context.Context, infoHash, token string, remote bool) string {
+	logger := requestLogger(ctx, c.logger)
+	streamURL, err := c.findStreamURL(ctx, infoHash, token, remote)
+	if err != nil {
+		logger.Warn("Couldn't check RealDebrid torrents for reuse", zap.Error(err), zap.String("infoHash", infoHash))
+		return ""
+	}
+	if streamURL != "" {
+		logger.Debug("Reusing RealDebrid torrent", zap.String("infoHash", infoHash))
+	}
+	return streamURL
+}
+
+func (c *rdTorrentClient) do(ctx context.Context, method, reqURL, token string, data url.Values) ([]byte, error) {
+	var body io.Reader
+	if data != nil {
+		body = strings.NewReader(data.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create %v request: %v", method, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if data != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for headerKey, headerVal := range c.extraHeaders {
+		req.Header.Add(headerKey, headerVal)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send %v request: %v", method, err)
+	}
+	defer res.Body.Close()
+
+	// Different RealDebrid API endpoints return different success status codes
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("bad HTTP response status: %v", res.Status)
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+// rdTorrentFile is a downloaded file of one of the user's RealDebrid torrents.
+type rdTorrentFile struct {
+	// Torrent name, and for torrents with multiple files the path within the torrent
+	Path string
+	Size int64
+	Link string
+	// For resolving the file's link again later
+	TorrentID string
+	LinkIndex int
+}
+
+// findTitleFile returns the largest downloaded file among the user's torrents that matches the movie, or for TV shows (season > 0) the episode.
+// Unlike findStreamURL it doesn't need the info hash, so it finds torrents that the user added via the RealDebrid website as well.
+// The returned bool is false if there's no matching file.
+// allow is called before each API call, so that it can be counted against the user's debrid API call limit. If it returns false, errCallLimit is returned.
+func (c *rdTorrentClient) findTitleFile(ctx context.Context, token string, meta imdb2torrent.Meta, season, episode int, allow func() bool) (rdTorrentFile, bool, error) {
+	if !allow() {
+		return rdTorrentFile{}, false, errCallLimit
+	}
+	torrents, err := c.getTorrents(ctx, token)
+	if err != nil {
+		return rdTorrentFile{}, false, err
+	}
+	// The year is only in the torrent names of movies
+	year := meta.Year
+	if season > 0 {
+		year = 0
+	}
+	var result rdTorrentFile
+	found := false
+	for _, torrent := range torrents {
+		if torrent.Status != "downloaded" || len(torrent.Links) == 0 || !matchesTitle(torrent.Filename, meta.Title, year) {
+			continue
+		}
+		files := []rdTorrentFile{{Path: torrent.Filename, Size: torrent.Bytes, Link: torrent.Links[0], TorrentID: torrent.ID}}
+		if len(torrent.Links) > 1 {
+			if !allow() {
+				return rdTorrentFile{}, false, errCallLimit
+			}
+			if files, err = c.getTorrentFiles(ctx, torrent, token); err != nil {
+				return rdTorrentFile{}, false, err
+			}
+		}
+		for _, file := range files {
+			if (found && file.Size <= result.Size) || (season > 0 && !matchesEpisode(file.Path, season, episode)) {
+				continue
+			}
+			result, found = file, true
+		}
+	}
+	return result, found, nil
+}
+
+// getTorrentFiles returns the downloaded files of a torrent with multiple links, like a season pack.
+// RealDebrid lists the links in the order of the selected files.
+func (c *rdTorrentClient) getTorrentFiles(ctx context.Context, torrent rdTorrent, token string) ([]rdTorrentFile, error) {
+	info, err := c.getTorrentInfo(ctx, torrent.ID, token)
+	if err != nil {
+		return nil, err
+	}
+	var files []rdTorrentFile
+	for _, file := range info.Files {
+		if file.Selected != 1 {
+			continue
+		}
+		if len(files) == len(info.Links) {
+			return nil, errors.New("RealDebrid torrent has more selected files than links")
+		}
+		files = append(files, rdTorrentFile{Path: torrent.Filename + file.Path, Size: file.Bytes, Link: info.Links[len(files)], TorrentID: torrent.ID, LinkIndex: len(files)})
+	}
+	return files, nil
+}
+
+// rdTorrentRedirectID returns the redirect ID of a file from the user's torrents.
+func rdTorrentRedirectID(streamID string, file rdTorrentFile) string {
+	return streamID + "-rd-" + rdTorrentRedirectIDprefix + file.TorrentID + "." + strconv.Itoa(file.LinkIndex)
+}
+
+// parseRDtorrentRedirectID returns the torrent ID and the index of the file's link from a redirect ID that was created by rdTorrentRedirectID.
+// It returns false for other redirect IDs.
+func parseRDtorrentRedirectID(redirectID string) (string, int, bool) {
+	dashIndex := strings.LastIndex(redirectID, "-")
+	if dashIndex < 0 || !strings.HasPrefix(redirectID[dashIndex+1:], rdTorrentRedirectIDprefix) {
+		return "", 0, false
+	}
+	parts := strings.Split(strings.TrimPrefix(redirectID[dashIndex+1:], rdTorrentRedirectIDprefix), ".")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, false
+	}
+	linkIndex, err := strconv.Atoi(parts[1])
+	if err != nil || linkIndex < 0 {
+		return "", 0, false
+	}
+	return parts[0], linkIndex, true
+}
+
+// getFileStreamURL returns a stream URL for the file with the link index of one of the user's torrents.
+func (c *rdTorrentClient) getFileStreamURL(ctx context.Context, torrentID string, linkIndex int, token string, remote bool) (string, error) {
+	info, err := c.getTorrentInfo(ctx, torrentID, token)
+	if err != nil {
+		return "", err
+	}
+	if info.Status != "downloaded" || linkIndex >= len(info.Links) {
+		return "", fmt.Errorf("RealDebrid torrent with status %v has no link with index %d", info.Status, linkIndex)
+	}
+	return c.unrestrict(ctx, info.Links[linkIndex], token, remote)
+}
+
+// withRDtorrentStreams wraps the stream handler so that for RealDebrid users with the "rdTorrents" option a matching file from their torrents ("My torrents") is the only stream.
+// The torrent search and the availability checks are skipped then, because the file is already downloaded.
+// When no file matches, the stream handler responds as usual.
+// The stream points to the redirect endpoint, where the file's link is unrestricted when the user clicks on it, see withRDtorrentRedirects.
+func withRDtorrentStreams(streamHandler stremio.StreamHandler, rdTorrents *rdTorrentClient, metaGetter imdb2torrent.MetaGetter, callLimiter *debridCallLimiter, baseURL string, logger *zap.Logger) stremio.StreamHandler {
+	return func(ctx context.Context, id string, userDataIface interface{}) ([]stremio.StreamItem, error) {
+		userData, err := userDataFromContext(ctx)
+		// The redirect handler's recomputation only needs the torrents
+		recomputation, _ := value(ctx, ctxKeyRecomputation).(bool)
+		if err != nil || !userData.RDtorrents || userData.debridID() != "rd" || recomputation || strings.HasPrefix(id, kitsuIDprefix) {
+			return streamHandler(ctx, id, userDataIface)
+		}
+		logger := requestLogger(ctx, logger)
+		keyOrToken, err := keyOrTokenFromContext(ctx)
+		if err != nil {
+			logger.Error("Couldn't get debrid API key or token", zap.Error(err))
+			return nil, err
+		}
+
+		imdbID := strings.Split(id, ":")[0]
+		season, episode := seasonEpisodeFromStreamID(id)
+		var meta imdb2torrent.Meta
+		if season > 0 {
+			meta, err = metaGetter.GetTVShowSimple(ctx, imdbID, season, episode)
+		} else {
+			meta, err = metaGetter.GetMovieSimple(ctx, imdbID)
+		}
+		if err != nil {
+			logger.Warn("Couldn't get title via Cinemeta for matching RealDebrid torrents", zap.Error(err))
+			return streamHandler(ctx, id, userDataIface)
+		}
+		// Lower priority than stream conversions, like availability checks
+		allow := func() bool {
+			return callLimiter.allow("rd", keyOrToken, 1, true)
+		}
+		file, found, err := rdTorrents.findTitleFile(ctx, keyOrToken, meta, season, episode, allow)
+		if err != nil {
+			// The search still works
+			logger.Warn("Couldn't search RealDebrid torrents", zap.Error(err))
+			return streamHandler(ctx, id, userDataIface)
+		} else if !found {
+			return streamHandler(ctx, id, userDataIface)
+		}
+
+		udString, _ := userDataIface.(string)
+		stream := stremio.StreamItem{
+			// Path escaping required for TV shows, which contain ":"
+			URL:   baseURL + "/" + udString + "/redirect/" + url.PathEscape(rdTorrentRedirectID(id, file)),
+			Title: "📂 My torrents | " + formatSize(file.Size) + "\n" + file.Path,
+		}
+		if streamHints, ok := value(ctx, ctxKeyStreamHints).(map[string]streamBehaviorHints); ok {
+			filename := file.Path
+			if slashIndex := strings.LastIndex(filename, "/"); slashIndex >= 0 {
+				filename = filename[slashIndex+1:]
+			}
+			streamHints[stream.URL] = streamBehaviorHints{Filename: filename, VideoSize: file.Size}
+		}
+		return []stremio.StreamItem{stream}, nil
+	}
+}
+
+// withRDtorrentRedirects wraps the stream resolver so that it resolves the redirect IDs of files from the user's torrents, which withRDtorrentStreams creates.
+// Their links are unrestricted, which is counted against the user's debrid API call limit, and the stream URLs are cached like the ones of converted torrents.
+// Other redirect IDs are resolved by the wrapped stream resolver.
+func withRDtorrentRedirects(resolve streamResolver, rdTorrents *rdTorrentClient, streamCache goCacher, callLimiter *debridCallLimiter, logger *zap.Logger) streamResolver {
+	return func(ctx context.Context, udString, redirectID string, rdRemoteOverride *bool) (string, error) {
+		torrentID, linkIndex, ok := parseRDtorrentRedirectID(redirectID)
+		if !ok {
+			return resolve(ctx, udString, redirectID, rdRemoteOverride)
+		}
+		logger := requestLogger(ctx, logger)
+		zapFieldRedirectID := zap.String("redirectID", redirectID)
+
+		streamCacheID, _ := userStreamCacheID(udString, redirectID, rdRemoteOverride)
+		if streamURLiface, found := streamCache.Get(streamCacheID); found {
+			if streamURLitem, ok := streamURLiface.(cacheItem); ok && len(streamURLitem.Value) > 0 {
+				return streamURLitem.Value, nil
+			}
+		}
+
+		// The auth middleware already decoded and validated the user data
+		userData, err := userDataFromContext(ctx)
+		if err != nil {
+			return "", fmt.Errorf("couldn't get user data: %w", err)
+		}
+		keyOrToken, err := keyOrTokenFromContext(ctx)
+		if err != nil {
+			return "", fmt.Errorf("couldn't get debrid API key or token: %w", err)
+		}
+		if userData.debridID() != "rd" {
+			return "", errNoStream
+		}
+		rdRemote := userData.RDremote
+		if rdRemoteOverride != nil {
+			rdRemote = *rdRemoteOverride
+		}
+		if !callLimiter.allow("rd", keyOrToken, rdTorrentFileCalls, false) {
+			logger.Warn("Debrid API call limit reached, not resolving file from RealDebrid torrents", zapFieldRedirectID)
+			return "", errCallLimit
+		}
+		streamURL, err := rdTorrents.getFileStreamURL(ctx, torrentID, linkIndex, keyOrToken, rdRemote)
+		if err != nil {
+			// For example when the user deleted the torrent
+			logger.Warn("Couldn't get stream URL of file from RealDebrid torrents", zap.Error(err), zapFieldRedirectID)
+			return "", errNoStream
+		}
+		incCounter(ctx, rdTorrentReuses)
+		streamCache.Set(streamCacheID, cacheItem{
+			Value:   streamURL,
+			Created: time.Now(),
+		}, streamExpiration)
+		return streamURL, nil
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deflix-tv/go-stremio"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRDtorrentClientFindStreamURL(t *testing.T) {
+	unrestricted := ""
+	listRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer foo", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/rest/1.0/torrents":
+			listRequests++
+			w.Write([]byte(`[
+				{"id": "A", "hash": "aaa", "status": "downloading", "links": []},
+				{"id": "B", "hash": "bbb", "status": "downloaded", "links": ["https://real-debrid.com/d/B1", "https://real-debrid.com/d/B2"]},
+				{"id": "C", "hash": "ccc", "status": "downloaded", "links": ["https://real-debrid.com/d/C1"]}
+			]`))
+		case "/rest/1.0/unrestrict/link":
+			require.NoError(t, r.ParseForm())
+			unrestricted = r.PostForm.Get("link")
+			require.Equal(t, "1", r.PostForm.Get("remote"))
+			w.Write([]byte(`{"download": "https://foo.download.real-debrid.com/d/C1/foo.mkv"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := newRDtorrentClient(server.URL, nil, false, 5*time.Second, time.Second, time.Second, zap.NewNop())
+	require.NoError(t, err)
+
+	callLimiter := newDebridCallLimiter(map[string]int{"rd": 100})
+	ctx := withRDtorrentList(context.Background(), callLimiter, "foo", false)
+
+	// Info hashes are compared case-insensitively
+	streamURL, err := client.findStreamURL(ctx, "CCC", "foo", true)
+	require.NoError(t, err)
+	require.Equal(t, "https://foo.download.real-debrid.com/d/C1/foo.mkv", streamURL)
+	require.Equal(t, "https://real-debrid.com/d/C1", unrestricted)
+
+	// Not downloaded yet, multiple files, not added
+	for _, infoHash := range []string{"aaa", "bbb", "ddd"} {
+		unrestricted = ""
+		streamURL, err = client.findStreamURL(ctx, infoHash, "foo", true)
+		require.NoError(t, err)
+		require.Empty(t, streamURL)
+		require.Empty(t, unrestricted)
+	}
+
+	// The torrent list was fetched once for the request, and counted against the call limit
+	require.Equal(t, 1, listRequests)
+	require.True(t, callLimiter.allow("rd", "foo", 99, false))
+	require.False(t, callLimiter.allow("rd", "foo", 1, false))
+
+	// Without a torrent list in the context torrents aren't reused
+	streamURL, err = client.findStreamURL(context.Background(), "CCC", "foo", true)
+	require.NoError(t, err)
+	require.Empty(t, streamURL)
+	require.Equal(t, 1, listRequests)
+}
+
+func TestRDtorrentStreams(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer foo", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/rest/1.0/torrents":
+			w.Write([]byte(`[
+				{"id": "A", "filename": "Suzume.2022.1080p.mkv", "bytes": 3000000000, "hash": "aaa", "status": "downloading", "links": []},
+				{"id": "B", "filename": "Suzume.2022.720p.mkv", "bytes": 1000000000, "hash": "bbb", "status": "downloaded", "links": ["https://real-debrid.com/d/B1"]},
+				{"id": "C", "filename": "Sousou.no.Frieren.S01.1080p", "bytes": 5000000000, "hash": "ccc", "status": "downloaded", "links": ["https://real-debrid.com/d/C1", "https://real-debrid.com/d/C2"]}
+			]`))
+		case "/rest/1.0/torrents/info/C":
+			w.Write([]byte(`{"status": "downloaded", "files": [
+				{"id": 1, "path": "/Sousou.no.Frieren.S01E01.mkv", "bytes": 2000000000, "selected": 1},
+				{"id": 2, "path": "/Sousou.no.Frieren.S01E01.nfo", "bytes": 100, "selected": 0},
+				{"id": 3, "path": "/Sousou.no.Frieren.S01E02.mkv", "bytes": 2000000000, "selected": 1}
+			], "links": ["https://real-debrid.com/d/C1", "https://real-debrid.com/d/C2"]}`))
+		case "/rest/1.0/unrestrict/link":
+			require.NoError(t, r.ParseForm())
+			w.Write([]byte(`{"download": "` + r.PostForm.Get("link") + `/unrestricted"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client, err := newRDtorrentClient(server.URL, nil, false, 5*time.Second, time.Second, time.Second, zap.NewNop())
+	require.NoError(t, err)
+
+	searched := false
+	callLimiter := newDebridCallLimiter(map[string]int{"rd": 100})
+	streamHandler := withRDtorrentStreams(func(ctx context.Context, id string, userDataIface interface{}) ([]stremio.StreamItem, error) {
+		searched = true
+		return nil, stremio.NotFound
+	}, client, fakeMetaGetter{}, callLimiter, "https://example.com", zap.NewNop())
+	ctx := withValue(context.Background(), ctxKeyUserData, userData{RDtoken: "foo", RDtorrents: true})
+	ctx = withValue(ctx, ctxKeyKeyOrToken, "foo")
+
+	// Only downloaded torrents. The link is only unrestricted when the user clicks on the stream.
+	streams, err := streamHandler(ctx, "tt123", "abc")
+	require.NoError(t, err)
+	require.False(t, searched)
+	require.Len(t, streams, 1)
+	require.Equal(t, "https://example.com/abc/redirect/tt123-rd-mytorrents.B.0", streams[0].URL)
+	// The episode's file of a season pack
+	streams, err = streamHandler(ctx, "tt456:1:2", "abc")
+	require.NoError(t, err)
+	require.False(t, searched)
+	require.Len(t, streams, 1)
+	require.Equal(t, "https://example.com/abc/redirect/tt456:1:2-rd-mytorrents.C.1", streams[0].URL)
+	// Searching when no file matches
+	_, err = streamHandler(ctx, "tt456:1:3", "abc")
+	require.Equal(t, stremio.NotFound, err)
+	require.True(t, searched)
+
+	// Three torrent list requests and two info requests of the season pack were counted
+	require.True(t, callLimiter.allow("rd", "foo", 95, false))
+	require.False(t, callLimiter.allow("rd", "foo", 1, false))
+}
+
+func TestRDtorrentRedirects(t *testing.T) {
+	unrestricted := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer foo", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/rest/1.0/torrents/info/C":
+			w.Write([]byte(`{"status": "downloaded", "links": ["https://real-debrid.com/d/C1", "https://real-debrid.com/d/C2"]}`))
+		case "/rest/1.0/unrestrict/link":
+			require.NoError(t, r.ParseForm())
+			unrestricted = r.PostForm.Get("link")
+			w.Write([]byte(`{"download": "` + unrestricted + `/unrestricted"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client, err := newRDtorrentClient(server.URL, nil, false, 5*time.Second, time.Second, time.Second, zap.NewNop())
+	require.NoError(t, err)
+
+	resolved := ""
+	streamCache := &goCache{cache: gocache.New(time.Minute, 0)}
+	callLimiter := newDebridCallLimiter(map[string]int{"rd": 3})
+	resolveStream := withRDtorrentRedirects(func(ctx context.Context, udString, redirectID string, rdRemoteOverride *bool) (string, error) {
+		resolved = redirectID
+		return "https://example.com/foo.mkv", nil
+	}, client, streamCache, callLimiter, zap.NewNop())
+	ctx := withValue(context.Background(), ctxKeyUserData, userData{RDtoken: "foo", RDtorrents: true})
+	ctx = withValue(ctx, ctxKeyKeyOrToken, "foo")
+
+	// Other redirect IDs are resolved by the wrapped resolver
+	streamURL, err := resolveStream(ctx, "abc", "tt123-rd-720p", nil)
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/foo.mkv", streamURL)
+	require.Equal(t, "tt123-rd-720p", resolved)
+
+	streamURL, err = resolveStream(ctx, "abc", "tt456:1:2-rd-mytorrents.C.1", nil)
+	require.NoError(t, err)
+	require.Equal(t, "https://real-debrid.com/d/C2/unrestricted", streamURL)
+	require.Equal(t, "https://real-debrid.com/d/C2", unrestricted)
+
+	// Cached, so the call limit isn't reached
+	unrestricted = ""
+	streamURL, err = resolveStream(ctx, "abc", "tt456:1:2-rd-mytorrents.C.1", nil)
+	require.NoError(t, err)
+	require.Equal(t, "https://real-debrid.com/d/C2/unrestricted", streamURL)
+	require.Empty(t, unrestricted)
+
+	// The other file's conversion exceeds the call limit
+	_, err = resolveStream(ctx, "abc", "tt456:1:1-rd-mytorrents.C.0", nil)
+	require.Equal(t, errCallLimit, err)
+	require.Empty(t, unrestricted)
+
+	// Deleted torrents and out of range links
+	callLimiter = newDebridCallLimiter(map[string]int{"rd": 100})
+	resolveStream = withRDtorrentRedirects(nil, client, streamCache, callLimiter, zap.NewNop())
+	for _, redirectID := range []string{"tt456:1:1-rd-mytorrents.D.0", "tt456:1:3-rd-mytorrents.C.2"} {
+		_, err = resolveStream(ctx, "abc", redirectID, nil)
+		require.Equal(t, errNoStream, err)
+	}
+}
+
+func TestParseRDtorrentRedirectID(t *testing.T) {
+	torrentID, linkIndex, ok := parseRDtorrentRedirectID(rdTorrentRedirectID("tt456:1:2", rdTorrentFile{TorrentID: "C", LinkIndex: 1}))
+	require.True(t, ok)
+	require.Equal(t, "C", torrentID)
+	require.Equal(t, 1, linkIndex)
+	for _, redirectID := range []string{"tt123-rd-720p", "tt123-rd-mytorrents.C", "tt123-rd-mytorrents..1", "tt123-rd-mytorrents.C.-1", "tt123-rd-mytorrents.C.x"} {
+		_, _, ok = parseRDtorrentRedirectID(redirectID)
+		require.False(t, ok, redirectID)
+	}
+	require.Equal(t, "mytorrents", qualityFromRedirectID("tt456:1:2-rd-mytorrents.C.1"))
+}
+
+func TestRDtorrentClientWaitBudget(t *testing.T) {
+	infoRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rest/1.0/torrents/addMagnet":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": "ABC"}`))
+		case "/rest/1.0/torrents/info/ABC":
+			infoRequests++
+			w.Write([]byte(`{"status": "downloading", "progress": 42, "files": [{"id": 1, "path": "/foo.mkv", "bytes": 3000}]}`))
+		case "/rest/1.0/torrents/selectFiles/ABC":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := newRDtorrentClient(server.URL, nil, false, 50*time.Millisecond, 10*time.Millisecond, time.Second, zap.NewNop())
+	require.NoError(t, err)
+	callLimiter := newDebridCallLimiter(map[string]int{"rd": 100})
+	ctx := withRDpolling(context.Background(), callLimiter, "foo", false)
+	_, err = client.getStreamURL(ctx, "magnet:?xt=urn:btih:abc", "foo", 0, 0, false)
+	var downloadingErr *stillDownloadingError
+	require.True(t, errors.As(err, &downloadingErr), err)
+	require.Equal(t, "downloading", downloadingErr.Status)
+	require.Equal(t, 42.0, downloadingErr.Progress)
+	require.Greater(t, infoRequests, 2)
+	// The status checks after the first one were counted
+	require.True(t, callLimiter.allow("rd", "foo", 100-(infoRequests-2), false))
+	require.False(t, callLimiter.allow("rd", "foo", 1, false))
+
+	// The status checks stop at the call limit
+	infoRequests = 0
+	ctx = withRDpolling(context.Background(), newDebridCallLimiter(map[string]int{"rd": 1}), "foo", false)
+	_, err = client.getStreamURL(ctx, "magnet:?xt=urn:btih:abc", "foo", 0, 0, false)
+	require.True(t, errors.As(err, &downloadingErr), err)
+	require.Equal(t, 3, infoRequests)
+
+	// The request's budget overrides the client's, so with 0 the status is only checked once after selecting the file
+	infoRequests = 0
+	ctx = withValue(ctx, ctxKeyRDwaitBudget, time.Duration(0))
+	_, err = client.getStreamURL(ctx, "magnet:?xt=urn:btih:abc", "foo", 0, 0, false)
+	require.True(t, errors.As(err, &downloadingErr), err)
+	require.Equal(t, 2, infoRequests)
+
+	// Without polling in the context as well, because the status checks couldn't be counted
+	infoRequests = 0
+	_, err = client.getStreamURL(context.Background(), "magnet:?xt=urn:btih:abc", "foo", 0, 0, false)
+	require.True(t, errors.As(err, &downloadingErr), err)
+	require.Equal(t, 2, infoRequests)
+}
+
+func TestRDtorrentClientConvert(t *testing.T) {
+	added := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rest/1.0/torrents":
+			w.Write([]byte(`[{"id": "A", "hash": "aaa", "status": "downloaded", "links": ["https://real-debrid.com/d/A1"]}]`))
+		case "/rest/1.0/unrestrict/link":
+			w.Write([]byte(`{"download": "https://foo.download.real-debrid.com/d/A1/foo.mkv"}`))
+		case "/rest/1.0/torrents/addMagnet":
+			added = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := newRDtorrentClient(server.URL, nil, false, 5*time.Second, time.Second, time.Second, zap.NewNop())
+	require.NoError(t, err)
+
+	// Movies reuse the already added torrent
+	ctx := withRDtorrentList(context.Background(), newDebridCallLimiter(nil), "foo", false)
+	streamURL, err := client.convert(ctx, "magnet:?xt=urn:btih:AAA&dn=foo", "foo", 0, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, "https://foo.download.real-debrid.com/d/A1/foo.mkv", streamURL)
+	require.False(t, added)
+
+	// TV show episodes don't, because the season pack might have another episode's file selected
+	_, err = client.convert(ctx, "magnet:?xt=urn:btih:AAA&dn=foo", "foo", 1, 2, false)
+	require.Error(t, err)
+	require.True(t, added)
+}
+
+func TestInfoHashFromMagnet(t *testing.T) {
+	require.Equal(t, "DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C", infoHashFromMagnet(bigBuckBunnyMagnet))
+	require.Equal(t, "ABC", infoHashFromMagnet("magnet:?dn=foo&xt=urn:btih:abc"))
+	require.Empty(t, infoHashFromMagnet("magnet:?dn=foo"))
+}
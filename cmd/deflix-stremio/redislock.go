@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// Max duration a lock is held, in case the node that holds it crashes or the conversion takes longer than expected.
+	// Debrid conversions usually take a few seconds, but can take longer when the debrid service is slow.
+	redirectLockTTL = 2 * time.Minute
+	// Interval for trying to acquire a lock that another node holds
+	redirectLockRetryInterval = 100 * time.Millisecond
+)
+
+// Only deletes the lock if it's still held by the same owner, so that a lock that expired and was acquired by another node isn't released.
+var unlockScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+else
+	return 0
+end`)
+
+// redisLocker is a distributed lock across multiple nodes that share a Redis instance.
+// The redirect handler uses it in addition to its in-process lock, so that concurrent requests for the same redirect ID on different nodes don't each convert the torrents via the debrid service.
+type redisLocker struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+func newRedisLocker(rdb *redis.Client, ttl time.Duration) *redisLocker {
+	return &redisLocker{
+		rdb: rdb,
+		ttl: ttl,
+	}
+}
+
+// lock blocks until the lock with the given key is acquired, the lock of another node expired or the context is canceled.
+// The returned function releases the lock.
+func (l *redisLocker) lock(ctx context.Context, key string) (func(), error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, fmt.Errorf("Couldn't generate lock token: %w", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+	key = "lock-" + key
+
+	ticker := time.NewTicker(redirectLockRetryInterval)
+	defer ticker.Stop()
+	for {
+		acquired, err := l.rdb.SetNX(ctx, key, token, l.ttl).Result()
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't acquire lock in Redis: %w", err)
+		} else if acquired {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return func() {
+		// Not with the request context, because the lock must be released even if the request was canceled
+		_ = unlockScript.Run(context.Background(), l.rdb, []string{key}, token).Err()
+	}, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisLocker(t *testing.T) {
+	// Same Redis as in TestRedis
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	skipWithoutRedis(t, rdb)
+	// Two nodes
+	locker1 := newRedisLocker(rdb, time.Second)
+	locker2 := newRedisLocker(rdb, time.Second)
+	k := strconv.Itoa(rand.Intn(math.MaxUint32))
+
+	unlock, err := locker1.lock(context.Background(), k)
+	require.NoError(t, err)
+	// The second node has to wait
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = locker2.lock(ctx, k)
+	require.Equal(t, context.DeadlineExceeded, err)
+	unlock()
+	unlock2, err := locker2.lock(context.Background(), k)
+	require.NoError(t, err)
+
+	// Only the owner can release a lock, so the first node's unlock doesn't release the second node's lock
+	unlock()
+	ctx, cancel2 := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel2()
+	_, err = locker1.lock(ctx, k)
+	require.Equal(t, context.DeadlineExceeded, err)
+	unlock2()
+
+	// Expired locks can be acquired
+	_, err = locker1.lock(context.Background(), k)
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = locker2.lock(context.Background(), k)
+	require.NoError(t, err)
+	require.Greater(t, int64(time.Since(start)), int64(500*time.Millisecond))
+}
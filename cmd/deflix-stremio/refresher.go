@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"go.uber.org/zap"
+
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
+)
+
+const (
+	// How long a request is considered to be recent, so its torrents' availability gets refreshed
+	recentRequestExpiration  = 24 * time.Hour
+	availabilityCheckTimeout = 10 * time.Second
+)
+
+// availabilityRefreshCounter returns the counter for the availability checks that the refresher made for the debrid service with the given ID.
+func availabilityRefreshCounter(debridID string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`availability_refreshes_total{debridID=%q}`, debridID))
+}
+
+// availabilityRefresher periodically checks the instant availability of the torrents of recently requested movies and TV show episodes,
+// so that the availability caches are warm when users request them again.
+// The availability is the same for all users of a debrid service, so the checks are made with the instance's own credentials.
+type availabilityRefresher struct {
+	resolvers          debrid.Registry
+	availabilityCaches map[string]*creationCache
+	cacheAge           time.Duration
+	// Debrid service ID to API key or token. Services without credentials are skipped.
+	credentials map[string]string
+	recent      *recentRequestStore
+	callLimiter *debridCallLimiter
+	logger      *zap.Logger
+}
+
+func newAvailabilityRefresher(resolvers debrid.Registry, availabilityCaches map[string]*creationCache, cacheAge time.Duration, credentials map[string]string, recent *recentRequestStore, callLimiter *debridCallLimiter, logger *zap.Logger) *availabilityRefresher {
+	return &availabilityRefresher{
+		resolvers:          resolvers,
+		availabilityCaches: availabilityCaches,
+		cacheAge:           cacheAge,
+		credentials:        credentials,
+		recent:             recent,
+		callLimiter:        callLimiter,
+		logger:             logger,
+	}
+}
+
+// run refreshes the availability in the given interval until the context is canceled.
+func (r *availabilityRefresher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.refresh(ctx)
+		}
+	}
+}
+
+// refresh checks the availability of all info hashes of recent requests that aren't cached as available.
+// Info hashes whose cached availability is still valid are skipped, so the debrid clients don't make API calls for requests whose torrents are all cached.
+func (r *availabilityRefresher) refresh(ctx context.Context) {
+	start := time.Now()
+	infoHashLists, err := r.recent.InfoHashes()
+	if err != nil {
+		r.logger.Error("Couldn't get info hashes of recent requests", zap.Error(err))
+		return
+	}
+	for debridID, keyOrToken := range r.credentials {
+		if keyOrToken == "" {
+			continue
+		}
+		checks := 0
+		for _, infoHashes := range infoHashLists {
+			if ctx.Err() != nil {
+				return
+			}
+			if len(getCachedAvailability(r.availabilityCaches[debridID], r.cacheAge, infoHashes)) == len(infoHashes) {
+				continue
+			}
+			// Low priority, so that the instance's credentials can still be used for other things like the status endpoint
+			if !r.callLimiter.allow(debridID, keyOrToken, debrid.AvailabilityBatches(len(infoHashes)), true) {
+				r.logger.Info("Debrid API call limit for availability refreshes reached", zap.String("debridID", debridID))
+				break
+			}
+			r.check(ctx, debridID, keyOrToken, infoHashes)
+			availabilityRefreshCounter(debridID).Inc()
+			checks++
+		}
+		r.logger.Info("Refreshed availability", zap.String("debridID", debridID), zap.Int("requests", len(infoHashLists)), zap.Int("checks", checks))
+	}
+	r.logger.Info("Finished availability refresh", zap.Duration("duration", time.Since(start)))
+}
+
+// check makes the availability check, which fills the availability cache.
+func (r *availabilityRefresher) check(ctx context.Context, debridID, keyOrToken string, infoHashes []string) {
+	ctx, cancel := context.WithTimeout(ctx, availabilityCheckTimeout)
+	defer cancel()
+	r.resolvers[debridID].CheckInstantAvailability(ctx, keyOrToken, infoHashes...)
+}
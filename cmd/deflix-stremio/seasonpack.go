@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// Appended to the quality of season pack results, like the "(web)" of YTS results, so that it's shown to the user and the results can be recognized later
+const seasonPackQualitySuffix = " (season pack)"
+
+// Max number of torrent pages that are visited on 1337x per season, because each is a separate request
+const leetxMaxSeasonPackPages = 10
+
+var (
+	// Season markers like "S01", "Season 1", "S01-S03" or "Season 1 to 3". The episode markers of episodeMarkerRegex are checked separately.
+	seasonMarkerRegex = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(?:s|season[ ._-]?)(\d{1,2})(?:[ ._-]?(?:-|to)[ ._-]?(?:s|season[ ._-]?)?(\d{1,2}))?(?:[^0-9]|$)`)
+	// Links to torrent pages in 1337x's search results, like `<a href="/torrent/1234567/Show-S01-1080p/">Show.S01.1080p</a>`
+	leetxTorrentLinkRegex = regexp.MustCompile(`<a href="(/torrent/\d+/[^"]+)">([^<]+)</a>`)
+	leetxMagnetRegex      = regexp.MustCompile(`href="(magnet:\?xt=urn:btih:[^"]+)"`)
+)
+
+// Trackers for the magnet URLs of season packs from TPB, which only returns the info hash
+var seasonPackTrackers = []string{
+	"udp://tracker.opentrackr.org:1337/announce",
+	"udp://open.stealth.si:80/announce",
+	"udp://tracker.torrent.eu.org:451/announce",
+	"udp://exodus.desync.com:6969/announce",
+}
+
+// isSeasonPack returns true if the torrent name is the one of a pack that contains the whole season, like "Show.S01.1080p" or "Show Season 1 Complete",
+// or a pack of multiple seasons that includes it, like "Show S01-S03".
+func isSeasonPack(name string, season int) bool {
+	// Single episodes and packs of a few episodes, like "S01E01-E05"
+	if episodeMarkerRegex.MatchString(name) || episodeMarkerAltRegex.MatchString(name) {
+		return false
+	}
+	for _, match := range seasonMarkerRegex.FindAllStringSubmatch(name, -1) {
+		first, _ := strconv.Atoi(match[1])
+		last := first
+		if match[2] != "" {
+			last, _ = strconv.Atoi(match[2])
+		}
+		if first <= season && season <= last {
+			return true
+		}
+	}
+	return false
+}
+
+// isSeasonPackResult returns true if the torrent was found by a season pack search.
+func isSeasonPackResult(torrent imdb2torrent.Result) bool {
+	return strings.HasSuffix(torrent.Quality, seasonPackQualitySuffix)
+}
+
+// withoutSeasonPacks filters the season packs out of the torrents, in place.
+func withoutSeasonPacks(torrents []imdb2torrent.Result) []imdb2torrent.Result {
+	// https://github.com/golang/go/wiki/SliceTricks#filter-in-place
+	n := 0
+	for _, torrent := range torrents {
+		if !isSeasonPackResult(torrent) {
+			torrents[n] = torrent
+			n++
+		}
+	}
+	return torrents[:n]
+}
+
+// seasonPackFinder finds torrents that contain a whole season of a TV show.
+// The results are marked via seasonPackQualitySuffix.
+type seasonPackFinder interface {
+	FindSeasonPack(ctx context.Context, imdbID string, season int) ([]imdb2torrent.Result, error)
+}
+
+var _ imdb2torrent.MagnetSearcher = (*seasonPackSearcher)(nil)
+
+// seasonPackSearcher is an imdb2torrent.MagnetSearcher that additionally searches for season packs of TV shows, because many shows only exist as full-season torrents.
+// The season packs are appended to the episode's results, so torrents of the single episode are preferred.
+type seasonPackSearcher struct {
+	imdb2torrent.MagnetSearcher
+	packs  seasonPackFinder
+	site   string
+	logger *zap.Logger
+}
+
+// FindTVShow searches for the episode and for season packs concurrently.
+// When only the season pack search succeeds, its results are returned without error.
+func (s *seasonPackSearcher) FindTVShow(ctx context.Context, imdbID string, season, episode int) ([]imdb2torrent.Result, error) {
+	logger := requestLogger(ctx, s.logger)
+	packsChan := make(chan []imdb2torrent.Result, 1)
+	go func() {
+		packs, err := s.packs.FindSeasonPack(ctx, imdbID, season)
+		if err != nil {
+			logger.Warn("Couldn't find season packs", zap.Error(err), zap.String("torrentSite", s.site), zap.String("imdbID", imdbID), zap.Int("season", season))
+		}
+		packsChan <- packs
+	}()
+	results, err := s.MagnetSearcher.FindTVShow(ctx, imdbID, season, episode)
+	packs := <-packsChan
+	if err != nil {
+		if len(packs) == 0 {
+			return nil, err
+		}
+		logger.Warn("Couldn't find episode torrents, only using season packs", zap.Error(err), zap.String("torrentSite", s.site))
+	}
+	return append(results, packs...), nil
+}
+
+// newSeasonPackResult creates a result for a season pack.
+// The size of the whole season isn't added to the magnet URL, because it would be misleading as video size.
+func newSeasonPackResult(name, quality, infoHash, magnetURL string) imdb2torrent.Result {
+	return imdb2torrent.Result{
+		Title:     name,
+		Quality:   quality + seasonPackQualitySuffix,
+		InfoHash:  strings.ToUpper(infoHash),
+		MagnetURL: magnetURL,
+	}
+}
+
+// seasonPackQueries returns the search queries for season packs of the TV show, like "Show S01" and "Show Season 1".
+func seasonPackQueries(title string, season int) []string {
+	return []string{fmt.Sprintf("%v S%02d", title, season), fmt.Sprintf("%v Season %d", title, season)}
+}
+
+// seasonPackMatches returns true if the torrent name contains the TV show title and is a pack of the season.
+func seasonPackMatches(name, title string, season int) bool {
+	return strings.Contains(" "+normalizeTitle(name)+" ", " "+normalizeTitle(title)+" ") && isSeasonPack(name, season)
+}
+
+// cachedSeasonPacks returns the season packs from the torrent cache, or finds and caches them if they're not cached or expired.
+func cachedSeasonPacks(ctx context.Context, cache imdb2torrent.Cache, cacheAge time.Duration, id, site string, logger *zap.Logger, find func() ([]imdb2torrent.Result, error)) ([]imdb2torrent.Result, error) {
+	zapFieldID := zap.String("id", id)
+	zapFieldTorrentSite := zap.String("torrentSite", site)
+	cacheKey := id + "-" + site + "-packs"
+	torrentList, created, found, err := cache.Get(cacheKey)
+	if err != nil {
+		logger.Error("Couldn't get season packs from cache", zap.Error(err), zapFieldID, zapFieldTorrentSite)
+	} else if found && time.Since(created) <= cacheAge {
+		logger.Debug("Hit cache for season packs, returning results", zap.Int("torrentCount", len(torrentList)), zapFieldID, zapFieldTorrentSite)
+		return torrentList, nil
+	}
+
+	results, err := find()
+	if err != nil {
+		return nil, err
+	}
+	// Fill cache, even if there are no results, because that's just the current state of the torrent site
+	if err := cache.Set(cacheKey, results); err != nil {
+		logger.Error("Couldn't cache season packs", zap.Error(err), zap.String("cache", "torrent"), zapFieldID, zapFieldTorrentSite)
+	}
+	return results, nil
+}
+
+var _ seasonPackFinder = (*tpbSeasonPackClient)(nil)
+
+// tpbSeasonPackClient finds season packs on TPB.
+// imdb2torrent's TPB client only searches for single episodes, like "Show S01E05".
+type tpbSeasonPackClient struct {
+	baseURL    string
+	httpClient *http.Client
+	cache      imdb2torrent.Cache
+	cacheAge   time.Duration
+	stats      *torrentStatsStore
+	metaGetter imdb2torrent.MetaGetter
+	logger     *zap.Logger
+}
+
+// newTPBseasonPackClient creates a new tpbSeasonPackClient.
+// If socksProxyAddr isn't empty, the requests are sent via the SOCKS5 proxy, like the ones of imdb2torrent's TPB client.
+func newTPBseasonPackClient(baseURL, socksProxyAddr string, timeout, cacheAge time.Duration, cache imdb2torrent.Cache, stats *torrentStatsStore, metaGetter imdb2torrent.MetaGetter, logger *zap.Logger) *tpbSeasonPackClient {
+	httpClient := &http.Client{
+		Timeout: timeout,
+	}
+	if socksProxyAddr != "" {
+		httpClient.Transport = &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "socks5", Host: socksProxyAddr}),
+		}
+	}
+	return &tpbSeasonPackClient{
+		baseURL:    baseURL,
+		httpClient: httpClient,
+		cache:      cache,
+		cacheAge:   cacheAge,
+		stats:      stats,
+		metaGetter: metaGetter,
+		logger:     logger,
+	}
+}
+
+// FindSeasonPack searches TPB for packs of the season with the TV show's title.
+func (c *tpbSeasonPackClient) FindSeasonPack(ctx context.Context, imdbID string, season int) ([]imdb2torrent.Result, error) {
+	logger := requestLogger(ctx, c.logger)
+	id := imdbID + ":" + strconv.Itoa(season)
+	return cachedSeasonPacks(ctx, c.cache, c.cacheAge, id, "TPB", logger, func() ([]imdb2torrent.Result, error) {
+		// The episode is irrelevant for the title
+		meta, err := c.metaGetter.GetTVShowSimple(ctx, imdbID, season, 1)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get TV show title via Cinemeta for ID %v: %v", id, err)
+		}
+		// Nil slice is ok, because it can be checked with len()
+		var results []imdb2torrent.Result
+		infoHashes := map[string]struct{}{}
+		for _, query := range seasonPackQueries(meta.Title, season) {
+			torrents, err := c.search(ctx, query)
+			if err != nil {
+				return nil, err
+			}
+			for _, torrent := range torrents {
+				name, infoHash := torrent.Get("name").String(), torrent.Get("info_hash").String()
+				// Torrents without seeders can't be downloaded by debrid services
+				if len(infoHash) != 40 || torrent.Get("seeders").Int() == 0 || !seasonPackMatches(name, meta.Title, season) {
+					continue
+				}
+				quality := parseNyaaQuality(name)
+				if quality == "" {
+					continue
+				}
+				if _, ok := infoHashes[strings.ToUpper(infoHash)]; ok {
+					continue
+				}
+				infoHashes[strings.ToUpper(infoHash)] = struct{}{}
+				recordTorrentStats(c.stats, infoHash, torrent.Get("size").Int(), torrent.Get("seeders").Int(), logger, zap.String("id", id), zap.String("torrentSite", "TPB"))
+				magnetURL := "magnet:?xt=urn:btih:" + infoHash + "&dn=" + url.QueryEscape(name)
+				for _, tracker := range seasonPackTrackers {
+					magnetURL += "&tr=" + url.QueryEscape(tracker)
+				}
+				results = append(results, newSeasonPackResult(name, quality, infoHash, magnetURL))
+			}
+		}
+		return results, nil
+	})
+}
+
+// search returns the torrents of TPB's search API for the query.
+func (c *tpbSeasonPackClient) search(ctx context.Context, query string) ([]gjson.Result, error) {
+	// Category 208 is "HD - TV shows"
+	reqURL := c.baseURL + "/q.php?q=" + url.QueryEscape(query) + "&cat=208"
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send GET request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Bad GET response: %v", res.StatusCode)
+	}
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read response body: %v", err)
+	}
+	return gjson.ParseBytes(resBody).Array(), nil
+}
+
+var _ seasonPackFinder = (*leetxSeasonPackClient)(nil)
+
+// leetxSeasonPackClient finds season packs on 1337x.
+// The magnet URLs are only on the torrent pages, so each found season pack requires another request.
+type leetxSeasonPackClient struct {
+	baseURL    string
+	httpClient *http.Client
+	cache      imdb2torrent.Cache
+	cacheAge   time.Duration
+	metaGetter imdb2torrent.MetaGetter
+	logger     *zap.Logger
+}
+
+func newLeetxSeasonPackClient(baseURL string, timeout, cacheAge time.Duration, cache imdb2torrent.Cache, metaGetter imdb2torrent.MetaGetter, logger *zap.Logger) *leetxSeasonPackClient {
+	return &leetxSeasonPackClient{
+		baseURL: baseURL,
+		// Without a transport, like imdb2torrent's 1337x client, so that the FlareSolverr transport is used if it's configured
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		cache:      cache,
+		cacheAge:   cacheAge,
+		metaGetter: metaGetter,
+		logger:     logger,
+	}
+}
+
+// FindSeasonPack searches 1337x's TV category for packs of the season with the TV show's title.
+func (c *leetxSeasonPackClient) FindSeasonPack(ctx context.Context, imdbID string, season int) ([]imdb2torrent.Result, error) {
+	logger := requestLogger(ctx, c.logger)
+	id := imdbID + ":" + strconv.Itoa(season)
+	return cachedSeasonPacks(ctx, c.cache, c.cacheAge, id, "1337x", logger, func() ([]imdb2torrent.Result, error) {
+		meta, err := c.metaGetter.GetTVShowSimple(ctx, imdbID, season, 1)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get TV show title via Cinemeta for ID %v: %v", id, err)
+		}
+		// Paths and names of the torrent pages, in the order of the search results
+		var paths, names []string
+		seenPaths := map[string]struct{}{}
+		for _, query := range seasonPackQueries(meta.Title, season) {
+			page, err := c.get(ctx, "/category-search/"+url.PathEscape(query)+"/TV/1/")
+			if err != nil {
+				return nil, err
+			}
+			for _, match := range leetxTorrentLinkRegex.FindAllStringSubmatch(page, -1) {
+				name := html.UnescapeString(match[2])
+				if _, ok := seenPaths[match[1]]; ok || len(paths) == leetxMaxSeasonPackPages || !seasonPackMatches(name, meta.Title, season) || parseNyaaQuality(name) == "" {
+					continue
+				}
+				seenPaths[match[1]] = struct{}{}
+				paths = append(paths, match[1])
+				names = append(names, name)
+			}
+		}
+
+		// Visit the torrent pages in parallel. Each goroutine only writes its own element.
+		results := make([]imdb2torrent.Result, len(paths))
+		var wg sync.WaitGroup
+		for i := range paths {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				page, err := c.get(ctx, paths[i])
+				if err != nil {
+					logger.Warn("Couldn't get torrent page", zap.Error(err), zap.String("path", paths[i]), zap.String("torrentSite", "1337x"))
+					return
+				}
+				match := leetxMagnetRegex.FindStringSubmatch(page)
+				if match == nil {
+					logger.Warn("Couldn't find magnet URL on torrent page, did the HTML change?", zap.String("path", paths[i]), zap.String("torrentSite", "1337x"))
+					return
+				}
+				magnetURL := html.UnescapeString(match[1])
+				if infoHashMatch := rarbgInfoHashRegex.FindStringSubmatch(magnetURL); infoHashMatch != nil {
+					results[i] = newSeasonPackResult(names[i], parseNyaaQuality(names[i]), infoHashMatch[1], magnetURL)
+				}
+			}(i)
+		}
+		wg.Wait()
+		// https://github.com/golang/go/wiki/SliceTricks#filter-in-place
+		n := 0
+		for _, result := range results {
+			if result.InfoHash != "" {
+				results[n] = result
+				n++
+			}
+		}
+		return results[:n], nil
+	})
+}
+
+// get returns the HTML of the page with the given path.
+func (c *leetxSeasonPackClient) get(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+path, nil)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't send GET request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Bad GET response: %v", res.StatusCode)
+	}
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't read response body: %v", err)
+	}
+	return string(resBody), nil
+}
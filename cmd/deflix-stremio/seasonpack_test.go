@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestIsSeasonPack(t *testing.T) {
+	require.True(t, isSeasonPack("Game.of.Thrones.S01.1080p.BluRay.x264", 1))
+	require.True(t, isSeasonPack("Game of Thrones Season 1 Complete 720p", 1))
+	require.True(t, isSeasonPack("Game.of.Thrones.S01-S03.1080p", 2))
+	require.True(t, isSeasonPack("Game of Thrones Season 1 to 3 720p", 3))
+	require.False(t, isSeasonPack("Game.of.Thrones.S01.1080p", 2))
+	require.False(t, isSeasonPack("Game.of.Thrones.S01E05.1080p", 1))
+	require.False(t, isSeasonPack("Game.of.Thrones.S01E01-E05.1080p", 1))
+	require.False(t, isSeasonPack("Game.of.Thrones.1x05.720p", 1))
+	require.False(t, isSeasonPack("Game.of.Thrones.1080p.DTS.x264", 1))
+}
+
+type fakeSeasonPackFinder struct {
+	results []imdb2torrent.Result
+	err     error
+}
+
+func (f fakeSeasonPackFinder) FindSeasonPack(ctx context.Context, imdbID string, season int) ([]imdb2torrent.Result, error) {
+	return f.results, f.err
+}
+
+func TestSeasonPackSearcher(t *testing.T) {
+	episode := imdb2torrent.Result{Title: "Foo.S01E05.1080p", Quality: "1080p", InfoHash: "A"}
+	pack := imdb2torrent.Result{Title: "Foo.S01.1080p", Quality: "1080p" + seasonPackQualitySuffix, InfoHash: "B"}
+
+	// Packs are appended
+	s := &seasonPackSearcher{MagnetSearcher: fakeMagnetSearcher{results: []imdb2torrent.Result{episode}}, packs: fakeSeasonPackFinder{results: []imdb2torrent.Result{pack}}, site: "TPB", logger: zap.NewNop()}
+	results, err := s.FindTVShow(context.Background(), "tt0944947", 1, 5)
+	require.NoError(t, err)
+	require.Equal(t, []imdb2torrent.Result{episode, pack}, results)
+	require.True(t, isSeasonPackResult(results[1]))
+	require.Equal(t, []imdb2torrent.Result{episode}, withoutSeasonPacks(results))
+
+	// Failing pack searches don't fail the episode search
+	s.packs = fakeSeasonPackFinder{err: errors.New("foo")}
+	results, err = s.FindTVShow(context.Background(), "tt0944947", 1, 5)
+	require.NoError(t, err)
+	require.Equal(t, []imdb2torrent.Result{episode}, results)
+
+	// Packs are returned when only the episode search fails
+	s.MagnetSearcher = fakeMagnetSearcher{err: errors.New("foo")}
+	s.packs = fakeSeasonPackFinder{results: []imdb2torrent.Result{pack}}
+	results, err = s.FindTVShow(context.Background(), "tt0944947", 1, 5)
+	require.NoError(t, err)
+	require.Equal(t, []imdb2torrent.Result{pack}, results)
+
+	s.packs = fakeSeasonPackFinder{}
+	_, err = s.FindTVShow(context.Background(), "tt0944947", 1, 5)
+	require.Error(t, err)
+}
+
+func TestTPBseasonPackClient(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/q.php", r.URL.Path)
+		require.Equal(t, "208", r.URL.Query().Get("cat"))
+		queries = append(queries, r.URL.Query().Get("q"))
+		w.Write([]byte(`[
+			{"name": "Sousou no Frieren S01 1080p WEB", "info_hash": "dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c", "seeders": "12"},
+			{"name": "Sousou no Frieren S01E05 1080p WEB", "info_hash": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "seeders": "12"},
+			{"name": "Sousou no Frieren S01 720p", "info_hash": "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "seeders": "0"},
+			{"name": "Other Show S01 1080p", "info_hash": "cccccccccccccccccccccccccccccccccccccccc", "seeders": "5"}
+		]`))
+	}))
+	defer server.Close()
+
+	client := newTPBseasonPackClient(server.URL, "", time.Second, time.Hour, imdb2torrent.NewInMemoryCache(), nil, fakeMetaGetter{}, zap.NewNop())
+	results, err := client.FindSeasonPack(context.Background(), "tt22248376", 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Sousou no Frieren S01", "Sousou no Frieren Season 1"}, queries)
+	// Both queries found the same torrent
+	require.Len(t, results, 1)
+	require.Equal(t, "DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C", results[0].InfoHash)
+	require.Equal(t, "1080p (web)"+seasonPackQualitySuffix, results[0].Quality)
+	require.Contains(t, results[0].MagnetURL, "&dn=Sousou+no+Frieren+S01+1080p+WEB")
+
+	// Cached
+	_, err = client.FindSeasonPack(context.Background(), "tt22248376", 1)
+	require.NoError(t, err)
+	require.Len(t, queries, 2)
+}
+
+func TestLeetxSeasonPackClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/category-search/Sousou no Frieren S01/TV/1/", "/category-search/Sousou no Frieren Season 1/TV/1/":
+			w.Write([]byte(`<table class="table-list"><tbody>
+				<tr><td class="coll-1 name"><a href="/sub/41/0/" class="icon"></a><a href="/torrent/123/Sousou-no-Frieren-S01-1080p/">Sousou no Frieren S01 1080p</a></td></tr>
+				<tr><td class="coll-1 name"><a href="/sub/41/0/" class="icon"></a><a href="/torrent/124/Sousou-no-Frieren-S01E05-1080p/">Sousou no Frieren S01E05 1080p</a></td></tr>
+			</tbody></table>`))
+		case "/torrent/123/Sousou-no-Frieren-S01-1080p/":
+			w.Write([]byte(`<ul><li><a href="magnet:?xt=urn:btih:dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c&amp;dn=Sousou+no+Frieren+S01+1080p">Magnet Download</a></li></ul>`))
+		default:
+			t.Errorf("Unexpected request: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := newLeetxSeasonPackClient(server.URL, time.Second, time.Hour, imdb2torrent.NewInMemoryCache(), fakeMetaGetter{}, zap.NewNop())
+	results, err := client.FindSeasonPack(context.Background(), "tt22248376", 1)
+	require.NoError(t, err)
+	require.Equal(t, []imdb2torrent.Result{{
+		Title:     "Sousou no Frieren S01 1080p",
+		Quality:   "1080p" + seasonPackQualitySuffix,
+		InfoHash:  "DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C",
+		MagnetURL: "magnet:?xt=urn:btih:dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c&dn=Sousou+no+Frieren+S01+1080p",
+	}}, results)
+}
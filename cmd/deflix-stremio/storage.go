@@ -3,12 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v2"
@@ -35,13 +41,84 @@ func registerTypes() {
 type cacheItem struct {
 	Value   string
 	Created time.Time
+	// Only for stream cache items: Name and size in bytes of the video file, which are only known after the torrent was converted into a stream URL.
+	// Empty if unknown.
+	Filename string
+	Size     int64
+}
+
+// Store is the backend of the persistent stores for torrent results and metadata.
+// BadgerDB can only be opened by a single process, so multiple instances that should share the stored data must use PostgreSQL.
+type Store interface {
+	// Set stores the item, which is gob encoded.
+	Set(key string, item interface{}) error
+	// Get decodes the stored item into the target, which must be a pointer.
+	// found is false if no item is stored for the key.
+	Get(key string, target interface{}) (found bool, err error)
+	// DeletePrefix deletes all items whose key starts with the prefix and returns how many were deleted.
+	DeletePrefix(prefix string) (int, error)
+}
+
+var _ Store = (*badgerStore)(nil)
+
+// badgerStore is the Store backed by BadgerDB.
+type badgerStore struct {
+	db *badger.DB
+	// Optional. If set, writes are batched instead of being written in their own transactions.
+	writer *batchWriter
+}
+
+// Set implements the Store interface.
+func (s *badgerStore) Set(key string, item interface{}) error {
+	if s.writer != nil {
+		b, err := toGob(item)
+		if err != nil {
+			return fmt.Errorf("Couldn't encode item: %v", err)
+		}
+		s.writer.Set(key, b)
+		return nil
+	}
+	return gobSet(s.db, key, item)
+}
+
+// Get implements the Store interface.
+func (s *badgerStore) Get(key string, target interface{}) (bool, error) {
+	return gobGet(s.db, key, target)
+}
+
+// DeletePrefix implements the Store interface.
+// Items that are still in the batch writer's queue aren't deleted.
+func (s *badgerStore) DeletePrefix(prefix string) (int, error) {
+	deleted := 0
+	err := s.db.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		// Keys must not be deleted while iterating
+		var keys [][]byte
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
 }
 
 var _ imdb2torrent.Cache = (*resultStore)(nil)
 
-// resultStore is the store for imdb2torrent.Result objects, backed by BadgerDB.
+// resultStore is the store for imdb2torrent.Result objects.
 type resultStore struct {
-	db        *badger.DB
+	store     Store
 	keyPrefix string
 }
 
@@ -51,21 +128,26 @@ func (c *resultStore) Set(key string, results []imdb2torrent.Result) error {
 		Results: results,
 		Created: time.Now(),
 	}
-	return gobSet(c.db, c.keyPrefix+key, item)
+	return c.store.Set(c.keyPrefix+key, item)
 }
 
 // Get implements the imdb2torrent.Cache interface.
 func (c *resultStore) Get(key string) ([]imdb2torrent.Result, time.Time, bool, error) {
 	var item imdb2torrent.CacheItem
-	found, err := gobGet(c.db, c.keyPrefix+key, &item)
+	found, err := c.store.Get(c.keyPrefix+key, &item)
 	return item.Results, item.Created, found, err
 }
 
+// DeletePrefix deletes the results of all torrent sites for keys that start with the prefix, like "tt1254207-".
+func (c *resultStore) DeletePrefix(prefix string) (int, error) {
+	return c.store.DeletePrefix(c.keyPrefix + prefix)
+}
+
 var _ cinemeta.Cache = (*metaStore)(nil)
 
-// metaStore is the store for cinemeta.Meta objects, backed by BadgerDB.
+// metaStore is the store for cinemeta.Meta objects.
 type metaStore struct {
-	db        *badger.DB
+	store     Store
 	keyPrefix string
 }
 
@@ -75,13 +157,13 @@ func (c *metaStore) Set(key string, meta cinemeta.Meta) error {
 		Meta:    meta,
 		Created: time.Now(),
 	}
-	return gobSet(c.db, c.keyPrefix+key, item)
+	return c.store.Set(c.keyPrefix+key, item)
 }
 
 // Get implements the cinemeta.Cache interface.
 func (c *metaStore) Get(key string) (cinemeta.Meta, time.Time, bool, error) {
 	var item cinemeta.CacheItem
-	found, err := gobGet(c.db, c.keyPrefix+key, &item)
+	found, err := c.store.Get(c.keyPrefix+key, &item)
 	if err != nil {
 		return cinemeta.Meta{}, time.Time{}, found, err
 	} else if !found {
@@ -90,21 +172,197 @@ func (c *metaStore) Get(key string) (cinemeta.Meta, time.Time, bool, error) {
 	return item.Meta, item.Created, found, nil
 }
 
+// popularityStore counts the stream requests per IMDb ID for which instantly available streams were found, backed by BadgerDB.
+type popularityStore struct {
+	db        *badger.DB
+	keyPrefix string
+}
+
+type popularityItem struct {
+	IMDbID string
+	Count  uint64
+}
+
+// Increment increments the counter of the IMDb ID for the given type ("movie" or "series").
+func (s *popularityStore) Increment(streamType, imdbID string) error {
+	key := []byte(s.keyPrefix + streamType + "_" + imdbID)
+	var err error
+	// Concurrent requests for the same IMDb ID lead to transaction conflicts, in which case we just try again.
+	for i := 0; i < 3; i++ {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			var count uint64
+			item, err := txn.Get(key)
+			if err == nil {
+				err = item.Value(func(val []byte) error {
+					if len(val) == 8 {
+						count = binary.BigEndian.Uint64(val)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			val := make([]byte, 8)
+			binary.BigEndian.PutUint64(val, count+1)
+			return txn.Set(key, val)
+		})
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+	return err
+}
+
+// Top returns the n IMDb IDs with the highest counters for the given type ("movie" or "series"), sorted by the counter in descending order.
+func (s *popularityStore) Top(streamType string, n int) ([]popularityItem, error) {
+	prefix := []byte(s.keyPrefix + streamType + "_")
+	var result []popularityItem
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			var count uint64
+			err := item.Value(func(val []byte) error {
+				if len(val) == 8 {
+					count = binary.BigEndian.Uint64(val)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			result = append(result, popularityItem{
+				IMDbID: string(bytes.TrimPrefix(item.Key(), prefix)),
+				Count:  count,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Count > result[j].Count
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result, nil
+}
+
+// recentRequestStore stores the info hashes of recently requested movies and TV show episodes, backed by BadgerDB.
+// The items expire automatically.
+type recentRequestStore struct {
+	db        *badger.DB
+	keyPrefix string
+	ttl       time.Duration
+}
+
+// Set stores the info hashes for the given stream ID (like "tt1254207" or "tt0944947:1:1") and resets the item's expiration.
+func (s *recentRequestStore) Set(id string, infoHashes []string) error {
+	entry := badger.NewEntry([]byte(s.keyPrefix+id), []byte(strings.Join(infoHashes, ","))).WithTTL(s.ttl)
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(entry)
+	})
+}
+
+// InfoHashes returns the info hashes of all recent requests, grouped by request.
+func (s *recentRequestStore) InfoHashes() ([][]string, error) {
+	prefix := []byte(s.keyPrefix)
+	var result [][]string
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(val []byte) error {
+				if len(val) > 0 {
+					result = append(result, strings.Split(string(val), ","))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
 var _ debrid.Cache = (*creationCache)(nil)
 
 // creationCache caches if a key exists and the time this was cached.
+// If the Redis client is not nil, it's the one that's used exclusively, so that multiple nodes share the cached data. Otherwise go-cache is used.
 type creationCache struct {
+	// For metrics, see requestCache. No metrics are recorded if empty.
+	name  string
 	cache *gocache.Cache
+	rdb   *redis.Client
+	// Only required when using Redis. Separates the keys of different caches.
+	keyPrefix string
+	// Only required when using Redis. With go-cache it's the cache's default expiration.
+	expiration time.Duration
+	// Only required when using Redis.
+	logger *zap.Logger
+	// Whether keys are stored as hash instead of as they are, for example so that API keys don't end up in Redis or the persisted cache files
+	hashKeys bool
 }
 
-// Set implements the cinemeta.Cache interface.
+// Set implements the debrid.Cache interface.
 func (c *creationCache) Set(key string) error {
+	key = c.key(key)
+	if c.rdb != nil {
+		// Unix nanoseconds are simpler to store than a gob of a time.Time, and keep the precision
+		if err := c.rdb.Set(context.Background(), c.keyPrefix+key, time.Now().UnixNano(), c.expiration).Err(); err != nil {
+			return fmt.Errorf("Couldn't set value in Redis: %w", err)
+		}
+		return nil
+	}
 	c.cache.Set(key, time.Now(), 0)
 	return nil
 }
 
-// Get implements the cinemeta.Cache interface.
+// Delete removes the key, for example when a cached instant availability turned out to be wrong.
+func (c *creationCache) Delete(key string) {
+	key = c.key(key)
+	if c.rdb != nil {
+		if err := c.rdb.Del(context.Background(), c.keyPrefix+key).Err(); err != nil {
+			c.logger.Error("Couldn't delete value in Redis", zap.Error(err))
+		}
+		return
+	}
+	c.cache.Delete(key)
+}
+
+// Get implements the debrid.Cache interface.
 func (c *creationCache) Get(key string) (time.Time, bool, error) {
+	return c.get(c.key(key))
+}
+
+// key returns the key under which the item is stored.
+func (c *creationCache) key(key string) string {
+	if !c.hashKeys {
+		return key
+	}
+	hash := sha256.Sum256([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func (c *creationCache) get(key string) (time.Time, bool, error) {
+	if c.rdb != nil {
+		createdNanos, err := c.rdb.Get(context.Background(), c.keyPrefix+key).Int64()
+		if err == redis.Nil {
+			return time.Time{}, false, nil
+		} else if err != nil {
+			return time.Time{}, false, fmt.Errorf("Couldn't get value from Redis: %w", err)
+		}
+		return time.Unix(0, createdNanos), true, nil
+	}
+
 	createdIface, found := c.cache.Get(key)
 	if !found {
 		return time.Time{}, found, nil
@@ -122,16 +380,34 @@ var _ goCacher = (*goCache)(nil)
 // If the Redis client is not nil, it's the one that's used exclusively. Otherwise go-cache is used.
 // The data in this cache is meant to be temporary, while also important to be the same across multiple nodes.
 // This is why there's no reason to for example read data from Redis and (during the same Get call) store the fetched data in go-cache to have a local copy in case of a Redis connection error, or to store data in both at the same time during a Set call.
+//
+// If the BadgerDB is not nil, the items are persisted in it with their expiration as TTL, so they're neither lost on restarts nor when go-cache evicts them.
+// go-cache or Redis are then a read-through layer in front of BadgerDB. Items are only kept in go-cache for up to memoryLayerExpiration.
 type goCache struct {
+	// For metrics, see requestCache. No metrics are recorded if empty.
+	name  string
 	cache *gocache.Cache
 	rdb   *redis.Client
+	db    *badger.DB
+	// Only required when using BadgerDB. Separates the keys of different caches.
+	keyPrefix string
 	// Only required when using Redis. Must be the actual type. So if you have a pointer, set this to the "element" of the pointer.
 	t reflect.Type
-	// Only required when using Redis.
+	// Only required when using Redis or BadgerDB.
 	logger *zap.Logger
 }
 
 func (c *goCache) Set(k string, v interface{}, d time.Duration) {
+	if c.db != nil {
+		c.setInDB(k, v, d)
+		if c.rdb == nil && d > memoryLayerExpiration {
+			d = memoryLayerExpiration
+		}
+	}
+	c.setInLayer(k, v, d)
+}
+
+func (c *goCache) setInLayer(k string, v interface{}, d time.Duration) {
 	if c.rdb != nil {
 		// Note: We can only decode into a pointer. And when working with interfaces gob requires to encode a pointer.
 		if b, err := toGob(&v); err != nil {
@@ -145,6 +421,22 @@ func (c *goCache) Set(k string, v interface{}, d time.Duration) {
 }
 
 func (c *goCache) Get(k string) (interface{}, bool) {
+	v, found := c.getFromLayer(k)
+	if found || c.db == nil {
+		return v, found
+	}
+	v, ttl, found := c.getFromDB(k)
+	if found {
+		// Read-through, so that subsequent calls don't hit the DB
+		if c.rdb == nil && (ttl == 0 || ttl > memoryLayerExpiration) {
+			ttl = memoryLayerExpiration
+		}
+		c.setInLayer(k, v, ttl)
+	}
+	return v, found
+}
+
+func (c *goCache) getFromLayer(k string) (interface{}, bool) {
 	if c.rdb != nil {
 		if v, err := c.rdb.Get(context.Background(), k).Result(); err != nil && err != redis.Nil {
 			// Note: We only log this when there's an error *and* it's not `redis.Nil` (which just indicates that the value was not found).
@@ -170,6 +462,122 @@ func (c *goCache) Get(k string) (interface{}, bool) {
 	}
 }
 
+func (c *goCache) setInDB(k string, v interface{}, d time.Duration) {
+	// Same as for Redis, gob requires a pointer when working with interfaces
+	b, err := toGob(&v)
+	if err != nil {
+		c.logger.Error("Couldn't encode value as gob", zap.Error(err))
+		return
+	}
+	entry := badger.NewEntry([]byte(c.keyPrefix+k), b)
+	if d > 0 {
+		entry = entry.WithTTL(d)
+	}
+	if err = c.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(entry)
+	}); err != nil {
+		c.logger.Error("Couldn't set value in BadgerDB", zap.Error(err))
+	}
+}
+
+// getFromDB returns the item and its remaining TTL, which is 0 if the item doesn't expire.
+func (c *goCache) getFromDB(k string) (interface{}, time.Duration, bool) {
+	var vi interface{}
+	var ttl time.Duration
+	err := c.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(c.keyPrefix + k))
+		if err != nil {
+			return err
+		}
+		if expiresAt := item.ExpiresAt(); expiresAt != 0 {
+			ttl = time.Until(time.Unix(int64(expiresAt), 0))
+		}
+		return item.Value(func(val []byte) error {
+			return fromGob(val, &vi)
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, 0, false
+	} else if err != nil {
+		// Like with Redis we don't return `nil, true`, because callers would assume they can work with the value
+		c.logger.Error("Couldn't get value from BadgerDB", zap.Error(err))
+		return nil, 0, false
+	}
+	// BadgerDB has a granularity of seconds, so an item can be expired without being removed yet
+	if ttl < 0 {
+		return nil, 0, false
+	}
+	return vi, ttl, true
+}
+
+// deleteFunc deletes all items whose key matches and returns how many were deleted.
+// With Redis only the keys that match the glob-style pattern (like "tt1254207-*") are checked, because the keys of all caches are in the same keyspace.
+func (c *goCache) deleteFunc(ctx context.Context, pattern string, match func(key string) bool) (int, error) {
+	if c.db != nil {
+		// The DB has all items, the layer only a subset, so the number of deleted items from the DB is the relevant one
+		if _, err := c.deleteFuncFromLayer(ctx, pattern, match); err != nil {
+			return 0, err
+		}
+		return c.deleteFuncFromDB(match)
+	}
+	return c.deleteFuncFromLayer(ctx, pattern, match)
+}
+
+func (c *goCache) deleteFuncFromDB(match func(key string) bool) (int, error) {
+	deleted := 0
+	prefix := []byte(c.keyPrefix)
+	err := c.db.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		// Keys must not be deleted while iterating
+		var keys [][]byte
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if key := it.Item().KeyCopy(nil); match(string(key[len(prefix):])) {
+				keys = append(keys, key)
+			}
+		}
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't delete values in BadgerDB: %w", err)
+	}
+	return deleted, nil
+}
+
+func (c *goCache) deleteFuncFromLayer(ctx context.Context, pattern string, match func(key string) bool) (int, error) {
+	deleted := 0
+	if c.rdb != nil {
+		iter := c.rdb.Scan(ctx, 0, pattern, 0).Iterator()
+		for iter.Next(ctx) {
+			if key := iter.Val(); match(key) {
+				if err := c.rdb.Del(ctx, key).Err(); err != nil {
+					return deleted, fmt.Errorf("Couldn't delete value in Redis: %w", err)
+				}
+				deleted++
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return deleted, fmt.Errorf("Couldn't scan keys in Redis: %w", err)
+		}
+		return deleted, nil
+	}
+	for key := range c.cache.Items() {
+		if match(key) {
+			c.cache.Delete(key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
 func toGob(v interface{}) ([]byte, error) {
 	writer := bytes.Buffer{}
 	encoder := gob.NewEncoder(&writer)
@@ -188,6 +596,123 @@ func fromGob(b []byte, v interface{}) error {
 	return nil
 }
 
+type batchEntry struct {
+	key   []byte
+	value []byte
+}
+
+// batchWriter is a write-behind queue for BadgerDB.
+// It batches writes into single transactions, which reduces the write amplification when many writes occur at the same time,
+// for example when the results of multiple torrent sites arrive simultaneously.
+// When the queue is full, Set blocks until there's space again (backpressure).
+// Note that values are only readable after they have been flushed.
+type batchWriter struct {
+	db            *badger.DB
+	queue         chan batchEntry
+	maxBatchSize  int
+	flushInterval time.Duration
+	done          chan struct{}
+	// Guards sending to the queue against closing it
+	closedLock sync.RWMutex
+	closed     bool
+	logger     *zap.Logger
+}
+
+// newBatchWriter creates a new batchWriter and starts its flushing goroutine.
+// The batch is flushed either when it reaches maxBatchSize or when flushInterval has passed, whichever comes first.
+// Call Close() to flush the remaining entries before closing the DB.
+func newBatchWriter(db *badger.DB, queueSize, maxBatchSize int, flushInterval time.Duration, logger *zap.Logger) *batchWriter {
+	w := &batchWriter{
+		db:            db,
+		queue:         make(chan batchEntry, queueSize),
+		maxBatchSize:  maxBatchSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+		logger:        logger,
+	}
+	go w.run()
+	return w
+}
+
+// Set queues a value for writing.
+// After Close the value is written synchronously instead, for example by requests that are still being handled during the shutdown.
+func (w *batchWriter) Set(key string, value []byte) {
+	w.closedLock.RLock()
+	defer w.closedLock.RUnlock()
+	if w.closed {
+		err := w.db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte(key), value)
+		})
+		if err != nil {
+			w.logger.Error("Couldn't write entry to BadgerDB after closing the batch writer", zap.Error(err), zap.String("key", key))
+		}
+		return
+	}
+	w.queue <- batchEntry{
+		key:   []byte(key),
+		value: value,
+	}
+}
+
+// Close flushes the remaining entries and stops the flushing goroutine.
+// It waits for concurrent calls to Set. Calling it more than once has no effect.
+func (w *batchWriter) Close() error {
+	w.closedLock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.closedLock.Unlock()
+	<-w.done
+	return nil
+}
+
+func (w *batchWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]batchEntry, 0, w.maxBatchSize)
+	for {
+		select {
+		case entry, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= w.maxBatchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (w *batchWriter) flush(batch []batchEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	wb := w.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, entry := range batch {
+		if err := wb.Set(entry.key, entry.value); err != nil {
+			w.logger.Error("Couldn't add entry to BadgerDB write batch", zap.Error(err), zap.ByteString("key", entry.key))
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		w.logger.Error("Couldn't flush BadgerDB write batch", zap.Error(err), zap.Int("entryCount", len(batch)))
+		return
+	}
+	w.logger.Debug("Flushed BadgerDB write batch", zap.Int("entryCount", len(batch)))
+}
+
 func gobSet(db *badger.DB, key string, item interface{}) error {
 	b, err := toGob(item)
 	if err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"math"
 	"math/rand"
 	"os"
@@ -9,10 +10,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v2"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/go-cmp/cmp"
 	gocache "github.com/patrickmn/go-cache"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 
 	"github.com/deflix-tv/go-stremio"
 	"github.com/deflix-tv/imdb2torrent"
@@ -32,6 +35,40 @@ func TestGoCacheItem(t *testing.T) {
 	require.Equal(t, exp, actual)
 }
 
+func TestCreationCacheHashedKeys(t *testing.T) {
+	cache := &creationCache{
+		cache:    gocache.New(time.Hour, 0),
+		hashKeys: true,
+	}
+	require.NoError(t, cache.Set("secret-api-key"))
+	_, found, err := cache.Get("secret-api-key")
+	require.NoError(t, err)
+	require.True(t, found)
+	_, found, err = cache.Get("other-api-key")
+	require.NoError(t, err)
+	require.False(t, found)
+	// The key isn't stored as it is
+	_, found = cache.cache.Get("secret-api-key")
+	require.False(t, found)
+	require.Len(t, cache.cache.Items(), 1)
+
+	cache.Delete("secret-api-key")
+	_, found, err = cache.Get("secret-api-key")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// Items expire after the cache's TTL, so that the debrid clients check the tokens again
+	cache = &creationCache{
+		cache:    gocache.New(10*time.Millisecond, 0),
+		hashKeys: true,
+	}
+	require.NoError(t, cache.Set("secret-api-key"))
+	time.Sleep(20 * time.Millisecond)
+	_, found, err = cache.Get("secret-api-key")
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
 func TestGoCachePersistence(t *testing.T) {
 	registerTypes()
 
@@ -71,11 +108,145 @@ func TestGoCachePersistence(t *testing.T) {
 	require.True(t, equal)
 }
 
+func TestBatchWriter(t *testing.T) {
+	registerTypes()
+
+	logger, err := stremio.NewLogger("debug", "")
+	require.NoError(t, err)
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	writer := newBatchWriter(db, 10, 2, time.Hour, logger)
+	store := &resultStore{
+		store: &badgerStore{
+			db:     db,
+			writer: writer,
+		},
+		keyPrefix: "torrent_",
+	}
+	exp := []imdb2torrent.Result{
+		{Title: "Big Buck Bunny"},
+	}
+	for _, key := range []string{"1", "2", "3"} {
+		err = store.Set(key, exp)
+		require.NoError(t, err)
+	}
+	// Flushes the remaining item
+	err = writer.Close()
+	require.NoError(t, err)
+
+	for _, key := range []string{"1", "2", "3"} {
+		actual, _, found, err := store.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, exp, actual)
+	}
+
+	// After closing, for example during the shutdown, entries are written synchronously
+	err = store.Set("4", exp)
+	require.NoError(t, err)
+	actual, _, found, err := store.Get("4")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, exp, actual)
+	require.NoError(t, writer.Close())
+}
+
+func TestGoCacheBadger(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+	cache := &goCache{
+		cache:     gocache.New(memoryLayerExpiration, time.Hour),
+		db:        db,
+		keyPrefix: "stream_",
+		logger:    zap.NewNop(),
+	}
+	exp := cacheItem{
+		Value:   "foo",
+		Created: time.Now().Round(0),
+	}
+	cache.Set("123", exp, 24*time.Hour)
+	cache.Set("456", exp, 24*time.Hour)
+
+	// The in-memory layer only keeps the item for a limited time
+	_, expiration, found := cache.cache.GetWithExpiration("123")
+	require.True(t, found)
+	require.WithinDuration(t, time.Now().Add(memoryLayerExpiration), expiration, time.Minute)
+
+	// Read-through when the item isn't in the in-memory layer anymore
+	cache.cache.Flush()
+	actual, found := cache.Get("123")
+	require.True(t, found)
+	require.Equal(t, exp, actual)
+	_, found = cache.cache.Get("123")
+	require.True(t, found)
+
+	deleted, err := cache.deleteFunc(context.Background(), "*", func(key string) bool {
+		return key == "456"
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	_, found = cache.Get("456")
+	require.False(t, found)
+	_, found = cache.Get("123")
+	require.True(t, found)
+}
+
+func TestPopularityStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := &popularityStore{
+		db:        db,
+		keyPrefix: "popularity_",
+	}
+	for _, imdbID := range []string{"tt1", "tt2", "tt2", "tt3", "tt3", "tt3"} {
+		err = store.Increment("movie", imdbID)
+		require.NoError(t, err)
+	}
+	err = store.Increment("series", "tt4")
+	require.NoError(t, err)
+
+	top, err := store.Top("movie", 2)
+	require.NoError(t, err)
+	require.Equal(t, []popularityItem{{IMDbID: "tt3", Count: 3}, {IMDbID: "tt2", Count: 2}}, top)
+	top, err = store.Top("series", 10)
+	require.NoError(t, err)
+	require.Equal(t, []popularityItem{{IMDbID: "tt4", Count: 1}}, top)
+}
+
+func TestRecentRequestStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := &recentRequestStore{
+		db:        db,
+		keyPrefix: "recent_",
+		ttl:       time.Hour,
+	}
+	require.NoError(t, store.Set("tt1", []string{"A", "B"}))
+	require.NoError(t, store.Set("tt2:1:1", []string{"C"}))
+	// Overwrites the previous item
+	require.NoError(t, store.Set("tt1", []string{"A", "D"}))
+
+	infoHashes, err := store.InfoHashes()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"A", "D"}, {"C"}}, infoHashes)
+}
+
 func TestRedis(t *testing.T) {
 	// Doesn't work on Windows: https://github.com/testcontainers/testcontainers-go/issues/152
 	// ip, port, deferFunc := startRedis(t)
 	// defer deferFunc()
 	ip, port := "localhost", "6379"
+	rdb := redis.NewClient(&redis.Options{
+		Addr: ip + ":" + port,
+	})
+	skipWithoutRedis(t, rdb)
 
 	logger, err := stremio.NewLogger("debug", "")
 	require.NoError(t, err)
@@ -84,9 +255,7 @@ func TestRedis(t *testing.T) {
 
 	var type1 []imdb2torrent.Result
 	gc := goCache{
-		rdb: redis.NewClient(&redis.Options{
-			Addr: ip + ":" + port,
-		}),
+		rdb:    rdb,
 		t:      reflect.TypeOf(type1),
 		logger: logger,
 	}
@@ -135,6 +304,15 @@ func TestRedis(t *testing.T) {
 	require.Equal(t, v2, res)
 }
 
+// skipWithoutRedis skips the test if the Redis instance isn't reachable, for example when running the tests without a local Redis.
+func skipWithoutRedis(t *testing.T, rdb *redis.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		t.Skipf("Redis isn't reachable: %v", err)
+	}
+}
+
 // Doesn't work on Windows in v0.9.0: https://github.com/testcontainers/testcontainers-go/issues/152
 // We need to comment out the function to not have the dependency in the go.mod, which leads to compile errors due to the linked bug.
 // func startRedis(t *testing.T) (string, string, func()) {
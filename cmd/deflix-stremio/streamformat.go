@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// Formats of the stream items
+const (
+	streamFormatDeflix    = "deflix"
+	streamFormatTorrentio = "torrentio"
+)
+
+// torrentioStream returns the name and title of a stream in the layout of the Torrentio addon, which several Stremio skins and clients parse.
+// The name is like "[RD+] Deflix\n1080p", where "+" means the torrent is cached on the debrid service, and the title like "Big.Buck.Bunny.1080p.BluRay.x264\n👤 1200 💾 1.4 GB ⚙️ YTS, RARBG\n🇩🇪 / 🇬🇧", where the last line are the tagged languages.
+// For streams that go through multiple torrents, the title is the one of the torrent that's tried first, and stats are the ones of that torrent.
+func torrentioStream(debridID, quality string, queued bool, torrents []imdb2torrent.Result, stats torrentStats, infoHashSites map[string][]string) (name, title string) {
+	debridTag := strings.ToUpper(debridID)
+	if queued {
+		debridTag += " download"
+	} else {
+		debridTag += "+"
+	}
+	// Without the markers in additional lines, like 1337x's "(⚠️guessed match)"
+	quality = strings.SplitN(quality, "\n", 2)[0]
+	name = "[" + debridTag + "] Deflix\n" + quality
+
+	torrent := torrents[0]
+	title = hintsFromMagnet(torrent.MagnetURL).Filename
+	if title == "" {
+		title = torrent.Title
+	}
+	var details []string
+	if stats.Seeders > 0 {
+		details = append(details, "👤 "+strconv.Itoa(stats.Seeders))
+	}
+	if stats.Size > 0 {
+		details = append(details, "💾 "+formatSize(stats.Size))
+	}
+	if sites := infoHashSites[torrent.InfoHash]; len(sites) > 0 {
+		details = append(details, "⚙️ "+strings.Join(sites, ", "))
+	}
+	if len(details) > 0 {
+		title += "\n" + strings.Join(details, " ")
+	}
+	if flags := languageFlags(torrent); flags != "" {
+		title += "\n" + flags
+	}
+	return name, title
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestTorrentioStream(t *testing.T) {
+	torrents := []imdb2torrent.Result{
+		{Title: "Big Buck Bunny", Quality: "1080p\n(⚠️guessed match)", InfoHash: "A", MagnetURL: "magnet:?xt=urn:btih:A&dn=Big.Buck.Bunny.1080p.BluRay&xl=1400000000"},
+		{Title: "Big Buck Bunny", Quality: "1080p", InfoHash: "B", MagnetURL: "magnet:?xt=urn:btih:B"},
+	}
+	infoHashSites := map[string][]string{"A": {"YTS", "RARBG"}}
+
+	name, title := torrentioStream("rd", torrents[0].Quality, false, torrents, torrentStats{Size: 1400000000, Seeders: 1200}, infoHashSites)
+	require.Equal(t, "[RD+] Deflix\n1080p", name)
+	require.Equal(t, "Big.Buck.Bunny.1080p.BluRay\n👤 1200 💾 1.4 GB ⚙️ YTS, RARBG", title)
+
+	// Without file name, stats and sites
+	name, title = torrentioStream("ad", "1080p", true, torrents[1:], torrentStats{}, nil)
+	require.Equal(t, "[AD download] Deflix\n1080p", name)
+	require.Equal(t, "Big Buck Bunny", title)
+}
+
+func TestFormatTorrentStats(t *testing.T) {
+	require.Equal(t, "4.2 GB | 1200 seeders", formatTorrentStats(torrentStats{Size: 4200000000, Seeders: 1200}))
+	require.Equal(t, "700 MB | 1 seeder", formatTorrentStats(torrentStats{Size: 700000000, Seeders: 1}))
+	require.Equal(t, "35 seeders", formatTorrentStats(torrentStats{Seeders: 35}))
+	require.Equal(t, "4.2 GB", formatTorrentStats(torrentStats{Size: 4200000000}))
+	require.Equal(t, "", formatTorrentStats(torrentStats{}))
+}
+
+func TestCreateStreamItemStats(t *testing.T) {
+	torrents := []imdb2torrent.Result{{Title: "Big Buck Bunny", Quality: "1080p", InfoHash: "A", MagnetURL: "magnet:?xt=urn:btih:A"}}
+	stream := createStreamItem(context.Background(), config{StreamFormat: streamFormatDeflix}, "ud", "tt1254207-rd-1080p", "1080p", torrents, torrentStats{Size: 4200000000, Seeders: 1200}, nil)
+	require.Equal(t, "1080p | 4.2 GB | 1200 seeders", stream.Title)
+}
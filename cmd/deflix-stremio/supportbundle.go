@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	redactedValue = "REDACTED"
+	// Number of log lines at the end of the log file that are added to the support bundle
+	supportBundleLogLines = 1000
+)
+
+var (
+	// Log fields that contain API keys, tokens or user data, in JSON or console encoding, like `"keyOrToken": "123"`
+	secretLogFieldRegex = regexp.MustCompile(`"(keyOrToken|apiKey|apiToken|token|accessToken|userData|udString)":\s?"[^"]*"`)
+	// User data in request URLs, like "/eyJyZFRva2VuIjoiMTIzIn0/stream/movie/tt1254207.json"
+	userDataPathRegex = regexp.MustCompile(`/[^/"\s]+/(manifest\.json|stream/|redirect/|configure)`)
+)
+
+// runSupportBundle creates an archive with the information that's required for investigating bug reports:
+// The version, the config with secrets redacted, the recent logs, stats of the persisted caches and the responses of a running instance's "/status" and "/admin/stats" endpoints.
+// It's run with `deflix-stremio support-bundle [support bundle options] [-- regular options]`, so that it uses the same config as the instance.
+func runSupportBundle(args []string, logger *zap.Logger) {
+	fs := flag.NewFlagSet("support-bundle", flag.ExitOnError)
+	out := fs.String("out", "deflix-stremio-support-bundle-"+time.Now().Format("20060102-150405")+".zip", "Path of the archive to create")
+	logFile := fs.String("logFile", "", "Path to the file with the logs of the instance. The last "+strconv.Itoa(supportBundleLogLines)+" lines are added. If empty, the logFile option is used. If that's empty as well, no logs are added.")
+	addonURL := fs.String("addonURL", "", `URL of the running instance, for example "http://localhost:8080". If empty, it's determined from the bindAddr and port options.`)
+	imdbID := fs.String("imdbID", "tt1254207", `IMDb ID for the "/status" endpoint, which requires the statusToken option`)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s support-bundle [options] [-- regular options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	// The regular options after "--" are parsed by parseConfig via the global flag set
+	os.Args = append([]string{os.Args[0]}, fs.Args()...)
+	config := parseConfig(logger)
+	config.validate(logger)
+	if *logFile == "" {
+		*logFile = config.LogFile
+	}
+	if *addonURL == "" {
+		host := config.BindAddr
+		if host == "0.0.0.0" || host == "" {
+			host = "localhost"
+		}
+		*addonURL = "http://" + host + ":" + strconv.Itoa(config.Port)
+	}
+	*addonURL = strings.TrimSuffix(*addonURL, "/")
+	sanitize := newSanitizer(config)
+
+	file, err := os.Create(*out)
+	if err != nil {
+		logger.Fatal("Couldn't create support bundle file", zap.Error(err))
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+
+	// Problems while collecting the data don't stop the creation of the bundle, but are added to it
+	var problems []string
+	addFile := func(name string, data []byte) {
+		w, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			logger.Fatal("Couldn't add file to support bundle", zap.Error(err), zap.String("file", name))
+		}
+	}
+	addJSON := func(name string, v interface{}) {
+		data, err := json.MarshalIndent(v, "", "\t")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Couldn't marshal %v: %v", name, err))
+			return
+		}
+		addFile(name, data)
+	}
+
+	addJSON("version.json", map[string]string{
+		"version":   version,
+		"goVersion": runtime.Version(),
+		"os":        runtime.GOOS,
+		"arch":      runtime.GOARCH,
+		"created":   time.Now().Format(time.RFC3339),
+	})
+	addJSON("config.json", config.redacted())
+	cacheStats, err := collectCacheStats(config)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	addJSON("caches.json", cacheStats)
+
+	if *logFile != "" {
+		if logs, err := tailFile(*logFile, supportBundleLogLines); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			addFile("logs.txt", []byte(sanitize(logs)))
+		}
+	} else {
+		problems = append(problems, "No log file was given")
+	}
+
+	// Data of the running instance
+	instanceEndpoints := []struct {
+		fileName      string
+		path          string
+		token         string
+		requiresToken bool
+	}{
+		{"instance-version.json", "/version", "", false},
+		{"instance-features.json", "/api/features", "", false},
+		{"status.json", "/status?imdbid=" + *imdbID, config.StatusToken, true},
+		{"stats.json", "/admin/stats", config.AdminToken, true},
+	}
+	httpClient := &http.Client{
+		// The status endpoint searches all torrent sites and checks the availability on all debrid services
+		Timeout: time.Minute,
+	}
+	// Ctrl+C cancels the requests, so that the bundle is still created with what was fetched so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for _, endpoint := range instanceEndpoints {
+		if endpoint.requiresToken && endpoint.token == "" {
+			problems = append(problems, fmt.Sprintf("Skipped %v, because its token isn't configured", endpoint.fileName))
+			continue
+		}
+		body, err := fetchInstanceEndpoint(ctx, httpClient, *addonURL+endpoint.path, endpoint.token)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		addFile(endpoint.fileName, []byte(sanitize(body)))
+	}
+
+	if len(problems) > 0 {
+		addFile("problems.txt", []byte(strings.Join(problems, "\n")+"\n"))
+	}
+	if err = archive.Close(); err != nil {
+		logger.Fatal("Couldn't finish support bundle", zap.Error(err))
+	}
+	logger.Info("Created support bundle. Please check its contents before attaching it to a GitHub issue.", zap.String("file", *out), zap.Strings("problems", problems))
+}
+
+// redacted returns a copy of the config with all secrets replaced.
+// It's meant for logging and support bundles, so unset secrets stay empty to show that they're not configured.
+func (c config) redacted() config {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redactedValue
+		}
+	}
+	redact(&c.RedisCreds)
+	redact(&c.PostgresDSN)
+	// Might contain credentials
+	redact(&c.AuditLogURL)
+	redact(&c.WebhookURL)
+	redact(&c.S3accessKeyID)
+	redact(&c.S3secretAccessKey)
+	redact(&c.JackettAPIkey)
+	// Proxy URLs can contain credentials
+	redact(&c.SitesProxyURL)
+	redact(&c.OAUTH2clientSecretRD)
+	redact(&c.OAUTH2clientSecretPM)
+	redact(&c.OAUTH2encryptionKey)
+	redact(&c.StatusToken)
+	redact(&c.AdminToken)
+	redact(&c.StatusRDtoken)
+	redact(&c.StatusADkey)
+	redact(&c.StatusPMkey)
+	redact(&c.StatusDLkey)
+	redact(&c.StatusTBkey)
+
+	// Don't modify the original slices
+	torznabEndpoints := make([]string, 0, len(c.TorznabEndpoints))
+	for _, endpoint := range c.TorznabEndpoints {
+		if endpointURL, apiKey := splitTorznabEndpoint(endpoint); apiKey != "" {
+			endpoint = endpointURL + "|" + redactedValue
+		}
+		torznabEndpoints = append(torznabEndpoints, endpoint)
+	}
+	c.TorznabEndpoints = torznabEndpoints
+	// Extra headers are like "X-Foo: bar" and often contain credentials for a proxy
+	extraHeaders := make([]string, 0, len(c.ExtraHeadersXD))
+	for _, header := range c.ExtraHeadersXD {
+		if colonIndex := strings.Index(header, ":"); colonIndex >= 0 {
+			header = header[:colonIndex+1] + " " + redactedValue
+		}
+		extraHeaders = append(extraHeaders, header)
+	}
+	c.ExtraHeadersXD = extraHeaders
+	siteProxies := make([]string, 0, len(c.SiteProxies))
+	for _, siteProxy := range c.SiteProxies {
+		site, _ := splitSiteProxy(siteProxy)
+		siteProxies = append(siteProxies, site+"|"+redactedValue)
+	}
+	c.SiteProxies = siteProxies
+
+	return c
+}
+
+// newSanitizer returns a function that removes the configured secrets, API keys and tokens in log fields and user data in URLs from the given text.
+func newSanitizer(c config) func(string) string {
+	var secrets []string
+	for _, secret := range []string{c.RedisCreds, c.S3accessKeyID, c.S3secretAccessKey, c.JackettAPIkey, c.OAUTH2clientSecretRD, c.OAUTH2clientSecretPM, c.OAUTH2encryptionKey,
+		c.StatusToken, c.AdminToken, c.StatusRDtoken, c.StatusADkey, c.StatusPMkey, c.StatusDLkey, c.StatusTBkey} {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	for _, endpoint := range c.TorznabEndpoints {
+		if _, apiKey := splitTorznabEndpoint(endpoint); apiKey != "" {
+			secrets = append(secrets, apiKey)
+		}
+	}
+
+	return func(s string) string {
+		for _, secret := range secrets {
+			s = strings.ReplaceAll(s, secret, redactedValue)
+		}
+		s = secretLogFieldRegex.ReplaceAllString(s, `"$1": "`+redactedValue+`"`)
+		return userDataPathRegex.ReplaceAllString(s, "/"+redactedValue+"/$1")
+	}
+}
+
+type cacheFileStats struct {
+	Items    int       `json:"items,omitempty"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// collectCacheStats returns the stats of the persisted go-cache files and the size of the BadgerDB directory.
+func collectCacheStats(c config) (map[string]cacheFileStats, error) {
+	result := map[string]cacheFileStats{}
+	cacheFiles, err := filepath.Glob(filepath.Join(c.CachePath, "*.gob"))
+	if err != nil {
+		return result, fmt.Errorf("Couldn't list cache files: %v", err)
+	}
+	for _, cacheFile := range cacheFiles {
+		info, err := os.Stat(cacheFile)
+		if err != nil {
+			result[filepath.Base(cacheFile)] = cacheFileStats{Error: err.Error()}
+			continue
+		}
+		stats := cacheFileStats{
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		}
+		if items, err := loadGoCache(cacheFile); err != nil {
+			stats.Error = err.Error()
+		} else {
+			stats.Items = len(items)
+		}
+		result[filepath.Base(cacheFile)] = stats
+	}
+
+	var storageStats cacheFileStats
+	err = filepath.Walk(c.StoragePath, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		storageStats.Size += info.Size()
+		if info.ModTime().After(storageStats.Modified) {
+			storageStats.Modified = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		storageStats.Error = err.Error()
+	}
+	result["badger"] = storageStats
+
+	return result, nil
+}
+
+// tailFile returns the last lines of the file.
+func tailFile(filePath string, lines int) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't open log file: %v", err)
+	}
+	defer file.Close()
+	var result []string
+	scanner := bufio.NewScanner(file)
+	// Log lines with stack traces or responses can be long
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		result = append(result, scanner.Text())
+		if len(result) > lines {
+			result = result[1:]
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", fmt.Errorf("Couldn't read log file: %v", err)
+	}
+	return strings.Join(result, "\n") + "\n", nil
+}
+
+func fetchInstanceEndpoint(ctx context.Context, httpClient *http.Client, url, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't fetch %v: %v", req.URL.Path, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't read response of %v: %v", req.URL.Path, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Bad response status of %v: %v", req.URL.Path, res.StatusCode)
+	}
+	return string(body), nil
+}
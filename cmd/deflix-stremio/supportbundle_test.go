@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigRedacted(t *testing.T) {
+	c := config{
+		Port:             8080,
+		RedisCreds:       "user:pass",
+		StatusRDtoken:    "123",
+		TorznabEndpoints: []string{"http://localhost:9696/1/api|secret", "http://localhost:9696/2/api"},
+		ExtraHeadersXD:   []string{"X-Foo: bar"},
+	}
+	redactedConfig := c.redacted()
+	require.Equal(t, 8080, redactedConfig.Port)
+	require.Equal(t, "REDACTED", redactedConfig.RedisCreds)
+	require.Equal(t, "REDACTED", redactedConfig.StatusRDtoken)
+	// Unset secrets stay empty
+	require.Empty(t, redactedConfig.AdminToken)
+	require.Equal(t, []string{"http://localhost:9696/1/api|REDACTED", "http://localhost:9696/2/api"}, redactedConfig.TorznabEndpoints)
+	require.Equal(t, []string{"X-Foo: REDACTED"}, redactedConfig.ExtraHeadersXD)
+
+	// The original isn't modified
+	require.Equal(t, "user:pass", c.RedisCreds)
+	require.Equal(t, "http://localhost:9696/1/api|secret", c.TorznabEndpoints[0])
+	require.Equal(t, "X-Foo: bar", c.ExtraHeadersXD[0])
+}
+
+func TestSanitizer(t *testing.T) {
+	sanitize := newSanitizer(config{StatusToken: "statussecret"})
+
+	require.Equal(t, `Called with REDACTED`, sanitize(`Called with statussecret`))
+	require.Equal(t, `DEBUG	Token OK	{"debridSite": "RealDebrid", "keyOrToken": "REDACTED"}`,
+		sanitize(`DEBUG	Token OK	{"debridSite": "RealDebrid", "keyOrToken": "123"}`))
+	require.Equal(t, `{"level":"info","url":"/REDACTED/stream/movie/tt1254207.json"}`,
+		sanitize(`{"level":"info","url":"/eyJyZFRva2VuIjoiMTIzIn0/stream/movie/tt1254207.json"}`))
+	require.Equal(t, `"url": "/manifest.json"`, sanitize(`"url": "/manifest.json"`))
+}
+
+func TestTailFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "log.txt")
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, strings.Repeat("x", i))
+	}
+	require.NoError(t, os.WriteFile(filePath, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+
+	tail, err := tailFile(filePath, 3)
+	require.NoError(t, err)
+	require.Equal(t, "xxxxxxx\nxxxxxxxx\nxxxxxxxxx\n", tail)
+}
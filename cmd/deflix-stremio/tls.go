@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsServer serves the addon via HTTPS by forwarding the requests to the addon's HTTP server.
+// go-stremio only serves HTTP and doesn't accept a listener, so the TLS termination happens in a separate server in the same process,
+// which saves self-hosters from setting up a reverse proxy just for HTTPS.
+type tlsServer struct {
+	server *http.Server
+	logger *zap.Logger
+}
+
+// newTLSserver creates a new HTTPS server that listens on the given address and forwards the requests to the addon's HTTP server at the given address.
+// The certificate is either loaded from the cert and key files or requested from Let's Encrypt for the autocert host.
+func newTLSserver(addr, upstreamAddr, certFile, keyFile, autocertHost, autocertEmail, autocertCacheDir string, logger *zap.Logger) (*tlsServer, error) {
+	var tlsConfig *tls.Config
+	if autocertHost != "" {
+		// Uses the TLS-ALPN-01 challenge, so no HTTP server on port 80 is required
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(autocertHost),
+			Cache:      autocert.DirCache(autocertCacheDir),
+			Email:      autocertEmail,
+		}
+		tlsConfig = manager.TLSConfig()
+	} else {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+	tlsConfig.MinVersion = tls.VersionTLS12
+
+	upstream := &url.URL{Scheme: "http", Host: upstreamAddr}
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	// Flush immediately, for proxied streams
+	proxy.FlushInterval = -1
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		// Keeps the Host header of the original request
+		director(req)
+		req.Header.Set("X-Forwarded-Proto", "https")
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		logger.Warn("Couldn't forward HTTPS request", zap.Error(err))
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	return &tlsServer{
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           proxy,
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: 10 * time.Second,
+			// No write timeout, because proxied streams can take hours. The addon's HTTP server has its own timeouts.
+			IdleTimeout: 9 * time.Second,
+			ErrorLog:    zap.NewStdLog(logger),
+		},
+		logger: logger,
+	}, nil
+}
+
+// run starts the server and shuts it down when the context is canceled.
+// It doesn't block.
+func (s *tlsServer) run(ctx context.Context) {
+	go func() {
+		s.logger.Info("Starting HTTPS server", zap.String("address", s.server.Addr))
+		// The certificates are in the TLS config
+		if err := s.server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			s.logger.Fatal("Couldn't start HTTPS server", zap.Error(err))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 9*time.Second)
+		defer cancel()
+		if err := s.server.Shutdown(shutdownCtx); err != nil {
+			s.logger.Error("Couldn't shut down HTTPS server", zap.Error(err))
+		}
+	}()
+}
+
+// upstreamAddr returns the address at which the HTTPS server reaches the addon's HTTP server.
+// When the HTTP server binds to all interfaces, it's reached via the loopback interface.
+func upstreamAddr(bindAddr string, port int) string {
+	if ip := net.ParseIP(bindAddr); bindAddr == "" || (ip != nil && ip.IsUnspecified()) {
+		bindAddr = "localhost"
+	}
+	return net.JoinHostPort(bindAddr, strconv.Itoa(port))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestTLSserver(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.Header.Get("X-Forwarded-Proto") + " " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	certFile, keyFile := writeTestCertificate(t)
+	s, err := newTLSserver("localhost:0", strings.TrimPrefix(upstream.URL, "http://"), certFile, keyFile, "", "", "", zap.NewNop())
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(s.server.Handler)
+	server.TLS = s.server.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+
+	certPEM, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	rootCAs := x509.NewCertPool()
+	require.True(t, rootCAs.AppendCertsFromPEM(certPEM))
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+		},
+	}
+	res, err := client.Get(server.URL + "/manifest.json")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	// The original host is kept
+	require.Equal(t, strings.TrimPrefix(server.URL, "https://")+" https /manifest.json", string(body))
+
+	_, err = newTLSserver("localhost:0", "localhost:8080", filepath.Join(t.TempDir(), "missing.pem"), keyFile, "", "", "", zap.NewNop())
+	require.Error(t, err)
+}
+
+func TestUpstreamAddr(t *testing.T) {
+	require.Equal(t, "localhost:8080", upstreamAddr("0.0.0.0", 8080))
+	require.Equal(t, "localhost:8080", upstreamAddr("::", 8080))
+	require.Equal(t, "localhost:8080", upstreamAddr("localhost", 8080))
+	require.Equal(t, "192.168.1.2:8080", upstreamAddr("192.168.1.2", 8080))
+}
+
+// writeTestCertificate writes a self-signed certificate and its key to PEM files and returns their paths.
+func writeTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+// torrentStats are the size and number of seeders of a torrent, as reported by the torrent site that found it.
+// Zero values mean they're unknown.
+type torrentStats struct {
+	Size    int64
+	Seeders int
+}
+
+// torrentStatsStore is the store for torrentStats, keyed by info hash.
+// imdb2torrent.Result has no fields for them, so the searchers that get them from the torrent site's API put them here,
+// next to the cached results. Methods on a nil store are no-ops.
+type torrentStatsStore struct {
+	store     Store
+	keyPrefix string
+}
+
+// Set stores the stats of the torrent with the info hash. Unknown values don't overwrite known ones.
+// When multiple sites found the same torrent, the highest number of seeders is kept.
+func (s *torrentStatsStore) Set(infoHash string, stats torrentStats) error {
+	if s == nil || (stats.Size <= 0 && stats.Seeders <= 0) {
+		return nil
+	}
+	key := s.keyPrefix + strings.ToUpper(infoHash)
+	var stored torrentStats
+	if _, err := s.store.Get(key, &stored); err != nil {
+		return err
+	}
+	if stats.Size <= 0 {
+		stats.Size = stored.Size
+	}
+	if stats.Seeders < stored.Seeders {
+		stats.Seeders = stored.Seeders
+	}
+	if stats == stored {
+		return nil
+	}
+	return s.store.Set(key, stats)
+}
+
+// Get returns the stored stats of the torrent with the info hash.
+func (s *torrentStatsStore) Get(infoHash string) (torrentStats, bool, error) {
+	var stats torrentStats
+	if s == nil {
+		return stats, false, nil
+	}
+	found, err := s.store.Get(s.keyPrefix+strings.ToUpper(infoHash), &stats)
+	return stats, found, err
+}
+
+// lookup returns the stats of the torrent. If no size is stored, it's taken from the magnet URL.
+// Errors are only logged, because the stats are just additional information for the user.
+func (s *torrentStatsStore) lookup(torrent imdb2torrent.Result, logger *zap.Logger) torrentStats {
+	stats, _, err := s.Get(torrent.InfoHash)
+	if err != nil {
+		logger.Error("Couldn't get torrent stats", zap.Error(err), zap.String("infoHash", torrent.InfoHash))
+	}
+	if stats.Size <= 0 {
+		stats.Size = magnetSize(torrent.MagnetURL)
+	}
+	return stats
+}
+
+// recordTorrentStats stores the stats of a found torrent and only logs errors, like the searchers do for their caches.
+func recordTorrentStats(stats *torrentStatsStore, infoHash string, size, seeders int64, logger *zap.Logger, zapFields ...zap.Field) {
+	if err := stats.Set(infoHash, torrentStats{Size: size, Seeders: int(seeders)}); err != nil {
+		logger.Error("Couldn't store torrent stats", append(zapFields, zap.Error(err), zap.String("infoHash", infoHash))...)
+	}
+}
+
+// formatTorrentStats formats the known stats for a stream title, like "4.2 GB | 1200 seeders".
+func formatTorrentStats(stats torrentStats) string {
+	var parts []string
+	if stats.Size > 0 {
+		parts = append(parts, formatSize(stats.Size))
+	}
+	if stats.Seeders == 1 {
+		parts = append(parts, "1 seeder")
+	} else if stats.Seeders > 1 {
+		parts = append(parts, strconv.Itoa(stats.Seeders)+" seeders")
+	}
+	return strings.Join(parts, " | ")
+}
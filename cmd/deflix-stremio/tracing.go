@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	// Number of ended spans that are buffered for the exporter. Further spans are dropped while the collector is too slow.
+	tracingBufferSize = 2048
+	// Max number of spans per export request
+	tracingBatchSize   = 512
+	tracingBatchPeriod = 5 * time.Second
+	tracingTimeout     = 5 * time.Second
+)
+
+// W3C Trace Context header, like "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+var traceparentRegex = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+var (
+	tracingDroppedSpans = metrics.NewCounter("tracing_dropped_spans_total")
+	tracingExportErrors = metrics.NewCounter("tracing_export_errors_total")
+)
+
+// tracer exports spans to an OpenTelemetry collector via OTLP/HTTP with JSON encoding.
+// The OpenTelemetry SDK can't be used, because go-redis depends on an old, incompatible version of the OpenTelemetry API.
+// Spans are passed along in the request context, so only requests that went through the tracing middleware are traced.
+type tracer struct {
+	// Like "http://localhost:4318/v1/traces"
+	endpoint      string
+	samplePercent int
+	spans         chan *span
+	httpClient    *http.Client
+	logger        *zap.Logger
+}
+
+// newTracer creates a new tracer that exports the spans of the given percentage of requests to the endpoint until the context is canceled.
+func newTracer(ctx context.Context, endpoint string, samplePercent int, logger *zap.Logger) *tracer {
+	t := &tracer{
+		endpoint:      endpoint,
+		samplePercent: samplePercent,
+		spans:         make(chan *span, tracingBufferSize),
+		httpClient: &http.Client{
+			Timeout: tracingTimeout,
+		},
+		logger: logger,
+	}
+	go t.run(ctx)
+	return t
+}
+
+// span is a timed operation of a trace, like a search on a torrent site or a debrid API call.
+// Its methods are safe to call on a nil span, which is returned when the request isn't traced.
+type span struct {
+	tracer       *tracer
+	traceID      string
+	spanID       string
+	parentSpanID string
+	// True for the root span of a request, which the middleware creates
+	server     bool
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+	lock       sync.Mutex
+}
+
+// startSpan starts a child span of the span in the context.
+// It returns the context with the new span, which must be ended by the caller.
+// If the context doesn't contain a span, the request isn't traced and the span is nil.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	parent, ok := value(ctx, ctxKeySpan).(*span)
+	if !ok || parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(parent.traceID, parent.spanID, name)
+	return withValue(ctx, ctxKeySpan, s), s
+}
+
+func (t *tracer) newSpan(traceID, parentSpanID, name string) *span {
+	return &span{
+		tracer:       t,
+		traceID:      traceID,
+		spanID:       randomHex(8),
+		parentSpanID: parentSpanID,
+		name:         name,
+		start:        time.Now(),
+		attributes:   map[string]string{},
+	}
+}
+
+// setAttribute adds an attribute to the span, like the torrent site or the debrid service.
+func (s *span) setAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+// finish ends the span with the error of the operation, which can be nil, and queues it for the export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.lock.Unlock()
+	select {
+	case s.tracer.spans <- s:
+	default:
+		tracingDroppedSpans.Inc()
+	}
+}
+
+// createTracingMiddleware creates a middleware that starts a trace for the request, which the handlers add their spans to.
+// If the request has a W3C Trace Context header of a sampled trace, the spans are added to that trace.
+// Requests for which telemetry isn't allowed aren't traced, so the middleware must run after the telemetry middleware.
+func createTracingMiddleware(t *tracer, name string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !telemetryAllowed(c.Context()) {
+			return c.Next()
+		}
+		traceID, parentSpanID := "", ""
+		if match := traceparentRegex.FindStringSubmatch(c.Get("traceparent")); match != nil {
+			if match[3] != "01" {
+				// The caller decided to not sample the trace
+				return c.Next()
+			}
+			traceID, parentSpanID = match[1], match[2]
+		} else if !t.sample() {
+			return c.Next()
+		} else {
+			traceID = randomHex(16)
+		}
+
+		s := t.newSpan(traceID, parentSpanID, name)
+		s.server = true
+		s.setAttribute("http.method", c.Method())
+		if requestID, ok := value(c.Context(), ctxKeyRequestID).(string); ok {
+			s.setAttribute("deflix.requestID", requestID)
+		}
+		// Not the path, because it contains the user data
+		if id := c.Params("id"); id != "" {
+			s.setAttribute("deflix.id", id)
+		}
+		setLocal(c, ctxKeySpan, s)
+		err := c.Next()
+		s.setAttribute("http.status_code", strconv.Itoa(c.Response().StatusCode()))
+		s.finish(err)
+		return err
+	}
+}
+
+func (t *tracer) sample() bool {
+	if t.samplePercent >= 100 {
+		return true
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(100))
+	return err == nil && int(n.Int64()) < t.samplePercent
+}
+
+// run exports the ended spans in batches until the context is canceled.
+func (t *tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(tracingBatchPeriod)
+	defer ticker.Stop()
+	var batch []*span
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(ctx, batch); err != nil {
+			t.logger.Warn("Couldn't export spans", zap.Error(err), zap.Int("spans", len(batch)))
+			tracingExportErrors.Inc()
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= tracingBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		}
+	}
+}
+
+// OTLP/HTTP JSON encoding, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type (
+	otlpKeyValue struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	}
+	otlpStatus struct {
+		// 1 is OK, 2 is error
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+)
+
+func newOTLPkeyValue(key, value string) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	kv.Value.StringValue = value
+	return kv
+}
+
+// otlpRequest returns the body of an OTLP/HTTP export request with the spans.
+func otlpRequest(spans []*span) ([]byte, error) {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.lock.Lock()
+		exported := otlpSpan{
+			TraceID:      s.traceID,
+			SpanID:       s.spanID,
+			ParentSpanID: s.parentSpanID,
+			Name:         s.name,
+			// Internal, or server for the root span
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: 1},
+		}
+		if s.server {
+			exported.Kind = 2
+		}
+		for key, value := range s.attributes {
+			exported.Attributes = append(exported.Attributes, newOTLPkeyValue(key, value))
+		}
+		if s.err != nil {
+			exported.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		s.lock.Unlock()
+		otlpSpans = append(otlpSpans, exported)
+	}
+
+	req := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{newOTLPkeyValue("service.name", "deflix-stremio"), newOTLPkeyValue("service.version", version)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "deflix-stremio"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+	return json.Marshal(req)
+}
+
+func (t *tracer) export(ctx context.Context, spans []*span) error {
+	body, err := otlpRequest(spans)
+	if err != nil {
+		return fmt.Errorf("Couldn't encode spans: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Couldn't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := t.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Couldn't send request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad HTTP response status: %v", res.Status)
+	}
+	return nil
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	// crypto/rand doesn't fail on supported platforms
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	// Not started, so the ended spans stay in the channel
+	tr := &tracer{
+		samplePercent: 100,
+		spans:         make(chan *span, 10),
+		logger:        zap.NewNop(),
+	}
+	app := fiber.New()
+	app.Use(createTelemetryMiddleware(false))
+	app.Use("/:userData/redirect/:id", createTracingMiddleware(tr, "redirect"))
+	app.Get("/:userData/redirect/:id", func(c *fiber.Ctx) error {
+		_, s := startSpan(c.Context(), "convert")
+		s.setAttribute("deflix.debrid", "rd")
+		s.finish(errors.New("foo"))
+		return c.SendStatus(fiber.StatusNotFound)
+	})
+
+	req := httptest.NewRequest("GET", "/secret/redirect/tt1254207-rd-720p", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	res, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusNotFound, res.StatusCode)
+
+	require.Len(t, tr.spans, 2)
+	child, root := <-tr.spans, <-tr.spans
+	require.Equal(t, "redirect", root.name)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.traceID)
+	require.Equal(t, "00f067aa0ba902b7", root.parentSpanID)
+	require.Equal(t, map[string]string{"http.method": "GET", "http.status_code": "404", "deflix.id": "tt1254207-rd-720p"}, root.attributes)
+	require.Equal(t, "convert", child.name)
+	require.Equal(t, root.traceID, child.traceID)
+	require.Equal(t, root.spanID, child.parentSpanID)
+	require.EqualError(t, child.err, "foo")
+
+	// Not sampled by the caller
+	req = httptest.NewRequest("GET", "/secret/redirect/tt1254207-rd-720p", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, err = app.Test(req)
+	require.NoError(t, err)
+	require.Len(t, tr.spans, 0)
+
+	// Do Not Track
+	req = httptest.NewRequest("GET", "/secret/redirect/tt1254207-rd-720p", nil)
+	req.Header.Set("DNT", "1")
+	_, err = app.Test(req)
+	require.NoError(t, err)
+	require.Len(t, tr.spans, 0)
+}
+
+func TestOTLPrequest(t *testing.T) {
+	tr := &tracer{}
+	root := tr.newSpan("4bf92f3577b34da6a3ce929d0e0e4736", "", "stream")
+	root.server = true
+	child := tr.newSpan(root.traceID, root.spanID, "search")
+	child.setAttribute("deflix.site", "YTS")
+	child.err = errors.New("foo")
+
+	body, err := otlpRequest([]*span{root, child})
+	require.NoError(t, err)
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	require.NoError(t, json.Unmarshal(body, &req))
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+	require.Equal(t, 2, spans[0].Kind)
+	require.Equal(t, otlpStatus{Code: 1}, spans[0].Status)
+	require.Equal(t, root.spanID, spans[1].ParentSpanID)
+	require.Equal(t, 1, spans[1].Kind)
+	require.Equal(t, otlpStatus{Code: 2, Message: "foo"}, spans[1].Status)
+	require.Equal(t, []otlpKeyValue{newOTLPkeyValue("deflix.site", "YTS")}, spans[1].Attributes)
+}
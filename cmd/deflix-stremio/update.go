@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const latestReleaseURL = "https://api.github.com/repos/doingodswork/deflix-stremio/releases/latest"
+
+// updateStatus is the result of the last update check.
+type updateStatus struct {
+	// Version of the latest GitHub release, without "v" prefix
+	LatestVersion   string    `json:"latestVersion"`
+	UpdateAvailable bool      `json:"updateAvailable"`
+	ReleaseURL      string    `json:"releaseURL"`
+	Checked         time.Time `json:"checked"`
+}
+
+// updateChecker compares the running version with the latest GitHub release, so that self-hosters learn about fixes.
+type updateChecker struct {
+	releaseURL string
+	httpClient *http.Client
+	status     updateStatus
+	lock       sync.RWMutex
+	logger     *zap.Logger
+}
+
+func newUpdateChecker(releaseURL string, logger *zap.Logger) *updateChecker {
+	return &updateChecker{
+		releaseURL: releaseURL,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		logger: logger,
+	}
+}
+
+// run checks for updates right away and then in the given interval, until the context is canceled.
+func (u *updateChecker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := u.check(ctx); err != nil {
+			u.logger.Warn("Couldn't check for updates", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check fetches the latest GitHub release and compares it with the running version.
+// A newer version is logged with every check, so it doesn't get lost in the logs.
+func (u *updateChecker) check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.releaseURL, nil)
+	if err != nil {
+		return fmt.Errorf("Couldn't create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("User-Agent", "deflix-stremio/"+version)
+	res, err := u.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Couldn't fetch latest release: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Bad response status: %v", res.StatusCode)
+	}
+	release := struct {
+		TagName string `json:"tag_name"`
+		HTMLURL string `json:"html_url"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(&release); err != nil {
+		return fmt.Errorf("Couldn't decode latest release: %w", err)
+	}
+	latest := strings.TrimPrefix(release.TagName, "v")
+	newer, err := isNewerVersion(latest, version)
+	if err != nil {
+		return err
+	}
+
+	u.lock.Lock()
+	u.status = updateStatus{
+		LatestVersion:   latest,
+		UpdateAvailable: newer,
+		ReleaseURL:      release.HTMLURL,
+		Checked:         time.Now(),
+	}
+	u.lock.Unlock()
+
+	if newer {
+		u.logger.Warn("A newer version of deflix-stremio is available. Please update, as it might contain important fixes.", zap.String("version", version), zap.String("latestVersion", latest), zap.String("releaseURL", release.HTMLURL))
+	} else {
+		u.logger.Info("deflix-stremio is up to date", zap.String("version", version))
+	}
+	return nil
+}
+
+// getStatus returns the result of the last successful check.
+// It's safe to call on a nil updateChecker, which returns an empty status.
+func (u *updateChecker) getStatus() updateStatus {
+	if u == nil {
+		return updateStatus{}
+	}
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.status
+}
+
+// isNewerVersion returns true if version a, like "1.2.3", is newer than version b.
+// Pre-release suffixes like "-beta" are ignored.
+func isNewerVersion(a, b string) (bool, error) {
+	aParts, err := parseVersion(a)
+	if err != nil {
+		return false, err
+	}
+	bParts, err := parseVersion(b)
+	if err != nil {
+		return false, err
+	}
+	for i := range aParts {
+		if aParts[i] != bParts[i] {
+			return aParts[i] > bParts[i], nil
+		}
+	}
+	return false, nil
+}
+
+func parseVersion(v string) ([3]int, error) {
+	var result [3]int
+	if dashIndex := strings.Index(v, "-"); dashIndex >= 0 {
+		v = v[:dashIndex]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return result, fmt.Errorf("Invalid version %q", v)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return result, fmt.Errorf("Invalid version %q: %w", v, err)
+		}
+		result[i] = n
+	}
+	return result, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestIsNewerVersion(t *testing.T) {
+	newer, err := isNewerVersion("0.12.0", "0.11.1")
+	require.NoError(t, err)
+	require.True(t, newer)
+
+	newer, err = isNewerVersion("0.11.1", "0.11.1")
+	require.NoError(t, err)
+	require.False(t, newer)
+
+	newer, err = isNewerVersion("0.9.10", "0.11.1")
+	require.NoError(t, err)
+	require.False(t, newer)
+
+	newer, err = isNewerVersion("1.0.0-beta", "0.11.1")
+	require.NoError(t, err)
+	require.True(t, newer)
+
+	_, err = isNewerVersion("foo", "0.11.1")
+	require.Error(t, err)
+}
+
+func TestUpdateChecker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"tag_name": "v99.0.0", "html_url": "https://github.com/doingodswork/deflix-stremio/releases/tag/v99.0.0"}`))
+	}))
+	defer server.Close()
+
+	var nilChecker *updateChecker
+	require.Equal(t, updateStatus{}, nilChecker.getStatus())
+
+	u := newUpdateChecker(server.URL, zap.NewNop())
+	require.NoError(t, u.check(context.Background()))
+	status := u.getStatus()
+	require.Equal(t, "99.0.0", status.LatestVersion)
+	require.True(t, status.UpdateAvailable)
+	require.Equal(t, "https://github.com/doingodswork/deflix-stremio/releases/tag/v99.0.0", status.ReleaseURL)
+	require.False(t, status.Checked.IsZero())
+}
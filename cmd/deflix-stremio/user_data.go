@@ -5,11 +5,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"sort"
 	"strings"
 
+	"github.com/VictoriaMetrics/metrics"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
+// Counts how often user data had to be percent-decoded before it could be decoded
+var userDataUnescapeCounter = metrics.NewCounter("userdata_unescape_fallbacks_total")
+
+// Prefix of encrypted user data. Plain Base64URL-encoded JSON without prefix is version 1.
+const userDataV2prefix = "v2:"
+
 type userData struct {
 	// RealDebrid
 	RDtoken  string `json:"rdToken,omitempty"`
@@ -17,9 +27,97 @@ type userData struct {
 	RDremote bool   `json:"rdRemote,omitempty"`
 	// AllDebrid
 	ADkey string `json:"adKey,omitempty"`
+	// Encrypted API key from AllDebrid's PIN-based authorization, which is AllDebrid's equivalent to OAuth2
+	ADoauth2 string `json:"adOAUTH2,omitempty"`
 	// Premiumize
 	PMkey    string `json:"pmKey,omitempty"`
 	PMoauth2 string `json:"pmOAUTH2,omitempty"`
+	// Debrid-Link
+	DLkey string `json:"dlKey,omitempty"`
+	// Torbox
+	TBkey string `json:"tbKey,omitempty"`
+	// ID of the debrid service that's used when none of the torrents are instantly available on the primary one, or when their conversion fails ("rd", "ad", "pm", "dl" or "tb").
+	// The credentials for it are in the fields above, next to the ones of the primary debrid service.
+	Fallback string `json:"fallback,omitempty"`
+
+	// Torrent sorting and filtering preferences
+
+	// Sorts the torrents of each quality by size, so that the smallest one is tried first
+	PreferSmallest bool `json:"preferSmallest,omitempty"`
+	// Excludes torrents that were recorded in the cinema ("CAM", "TS" etc.)
+	ExcludeCam bool `json:"excludeCam,omitempty"`
+	// For example "1080p". Empty means no limit.
+	MaxResolution string `json:"maxResolution,omitempty"`
+	Only10bit     bool   `json:"only10bit,omitempty"`
+	// Codes of the audio languages, like "de" or "multi" (see torrentLanguages). Empty means all languages.
+	Languages []string `json:"languages,omitempty"`
+	// IDs of video formats, like "hevc" for devices that can't play x265 (see videoFormats). Torrents with any of them are excluded.
+	ExcludeFormats []string `json:"excludeFormats,omitempty"`
+
+	// Number of streams per quality, one for each of the top torrents, instead of a single one that tries all torrents of the quality.
+	// 0 and 1 mean a single one. It's limited by the instance's max.
+	StreamsPerQuality int `json:"streamsPerQuality,omitempty"`
+
+	// Queues the best torrent for download on the debrid service when none is instantly available
+	QueueDownloads bool `json:"queueDownloads,omitempty"`
+
+	// Shows a matching file from the user's Premiumize cloud ("My files") as top stream
+	PMcloud bool `json:"pmCloud,omitempty"`
+	// Responds with a matching file from the user's RealDebrid torrents ("My torrents") instead of searching torrents
+	RDtorrents bool `json:"rdTorrents,omitempty"`
+}
+
+var _ zapcore.ObjectMarshaler = userData{}
+
+// redactedUserData has the fields, but not the methods of userData, so that it can be printed with "%+v" without calling String().
+type redactedUserData userData
+
+// redacted returns a copy of the user data with the API keys and tokens replaced, like config.redacted().
+// Unset ones stay empty, so the logs still show which debrid services the user configured.
+func (ud userData) redacted() redactedUserData {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redactedValue
+		}
+	}
+	redact(&ud.RDtoken)
+	redact(&ud.RDoauth2)
+	redact(&ud.ADkey)
+	redact(&ud.ADoauth2)
+	redact(&ud.PMkey)
+	redact(&ud.PMoauth2)
+	redact(&ud.DLkey)
+	redact(&ud.TBkey)
+	return redactedUserData(ud)
+}
+
+// String implements fmt.Stringer without the API keys and tokens.
+func (ud userData) String() string {
+	return fmt.Sprintf("%+v", ud.redacted())
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler without the API keys and tokens, so that the user data can be logged with zap.Object.
+// The field names are the JSON ones, like in the addon URL.
+func (ud userData) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	userDataJSON, err := json.Marshal(ud.redacted())
+	if err != nil {
+		return err
+	}
+	fields := map[string]interface{}{}
+	if err = json.Unmarshal(userDataJSON, &fields); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err = enc.AddReflected(key, fields[key]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (ud userData) encode(logger *zap.Logger) (string, error) {
@@ -32,8 +130,108 @@ func (ud userData) encode(logger *zap.Logger) (string, error) {
 	return userDataEncoded, nil
 }
 
-func decodeUserData(data string, logger *zap.Logger) (userData, error) {
-	logger.Debug("Decoding user data", zap.String("userData", data))
+// encrypt encodes the user data like encode, but encrypted with the AES key, so that API keys aren't visible in the addon URL.
+// The result has the "v2:" prefix.
+// aesKey should be 32 bytes so that AES-256 is used.
+func (ud userData) encrypt(aesKey []byte, logger *zap.Logger) (string, error) {
+	logger.Debug("Encrypting user data")
+	userDataJSON, err := json.Marshal(ud)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := encryptUserData(aesKey, userDataJSON)
+	if err != nil {
+		return "", err
+	}
+	return userDataV2prefix + encrypted, nil
+}
+
+// debridID returns the ID of the primary debrid service the user data is for ("rd", "ad", "pm", "dl" or "tb").
+func (ud userData) debridID() string {
+	for _, debridID := range []string{"rd", "ad", "dl", "tb"} {
+		if debridID != ud.Fallback && ud.hasCredentials(debridID) {
+			return debridID
+		}
+	}
+	return "pm"
+}
+
+// fallbackDebridID returns the ID of the fallback debrid service, or an empty string if the user didn't configure one or if it's invalid,
+// for example because it's the same as the primary one or because there are no credentials for it.
+func (ud userData) fallbackDebridID() string {
+	if ud.Fallback == "" || ud.Fallback == ud.debridID() || !ud.hasCredentials(ud.Fallback) {
+		return ""
+	}
+	return ud.Fallback
+}
+
+// hasCredentials returns true if the user data contains an API key or token or OAuth2 data for the debrid service with the given ID.
+func (ud userData) hasCredentials(debridID string) bool {
+	switch debridID {
+	case "rd":
+		return ud.RDtoken != "" || ud.RDoauth2 != ""
+	case "ad":
+		return ud.ADkey != "" || ud.ADoauth2 != ""
+	case "pm":
+		return ud.PMkey != "" || ud.PMoauth2 != ""
+	case "dl":
+		return ud.DLkey != ""
+	case "tb":
+		return ud.TBkey != ""
+	}
+	return false
+}
+
+// decodeUserData decodes the user data from an addon URL. It supports all formats: Legacy (plain RD API token), version 1 (Base64URL-encoded JSON),
+// version 2 (encrypted JSON with "v2:" prefix) and the JSON from the config schema in the manifest.
+// aesKey is only required for version 2. It can be nil if the instance doesn't have an encryption key.
+func decodeUserData(data string, aesKey []byte, logger *zap.Logger) (userData, error) {
+	// Not the data itself, because except for the encrypted format it contains the API keys and tokens in plain text
+	logger.Debug("Decoding user data", zap.Int("length", len(data)), zap.Bool("encrypted", strings.HasPrefix(data, userDataV2prefix)))
+
+	// Some Stremio clients percent-encode the user data again.
+	// Neither Base64URL nor the legacy user data contain "%", so we can safely unescape once in that case.
+	if strings.Contains(data, "%") {
+		unescaped, err := url.PathUnescape(data)
+		if err != nil {
+			logger.Warn("Couldn't unescape user data", zap.Error(err))
+			return userData{}, err
+		}
+		logger.Info("User data was percent-encoded, probably by the Stremio client")
+		userDataUnescapeCounter.Inc()
+		data = unescaped
+	}
+
+	if strings.HasPrefix(data, userDataV2prefix) {
+		if aesKey == nil {
+			logger.Warn("Got encrypted user data, but no encryption key is configured")
+			return userData{}, errors.New("encrypted user data without encryption key")
+		}
+		// The status is only relevant for OAuth2 data
+		userDataJSON, _, err := decryptUserData(aesKey, strings.TrimPrefix(data, userDataV2prefix), logger)
+		if err != nil {
+			// Could be a client-side encoding error, or the encryption key changed
+			logger.Warn("Couldn't decrypt user data", zap.Error(err))
+			return userData{}, err
+		}
+		ud := userData{}
+		if err := json.Unmarshal(userDataJSON, &ud); err != nil {
+			logger.Warn("Couldn't unmarshal decrypted user data", zap.Error(err))
+			return userData{}, err
+		}
+		return ud, nil
+	}
+
+	// User data from the config schema in the manifest, when the addon was configured in the Stremio client instead of on the configure page
+	if strings.HasPrefix(data, "{") {
+		ud, err := decodeManifestConfigUserData(data)
+		if err != nil {
+			logger.Warn("Couldn't decode user data from the manifest config", zap.Error(err))
+			return userData{}, err
+		}
+		logger.Debug("Decoded user data from the manifest config", zap.Object("userData", ud))
+		return ud, nil
+	}
 
 	// Legacy user data (plain string, RD only).
 	// - If it's ending with "-remote" it's 100% clear
@@ -72,6 +270,6 @@ func decodeUserData(data string, logger *zap.Logger) (userData, error) {
 		logger.Warn("Couldn't unmarshal user data", zap.Error(err))
 		return userData{}, err
 	}
-	logger.Debug("Decoded user data", zap.String("userData", fmt.Sprintf("%+v", ud)))
+	logger.Debug("Decoded user data", zap.Object("userData", ud))
 	return ud, nil
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/deflix-tv/go-stremio"
+)
+
+func TestDecodeUserData(t *testing.T) {
+	logger, err := stremio.NewLogger("debug", "")
+	require.NoError(t, err)
+
+	exp := userData{
+		RDtoken:  "foo",
+		RDremote: true,
+	}
+	encoded, err := exp.encode(logger)
+	require.NoError(t, err)
+
+	// Regular
+	actual, err := decodeUserData(encoded, nil, logger)
+	require.NoError(t, err)
+	require.Equal(t, exp, actual)
+
+	// Padded and percent-encoded by the client
+	actual, err = decodeUserData(encoded+"%3D", nil, logger)
+	require.NoError(t, err)
+	require.Equal(t, exp, actual)
+
+	// Legacy
+	actual, err = decodeUserData("foo-remote", nil, logger)
+	require.NoError(t, err)
+	require.Equal(t, exp, actual)
+
+	// Invalid
+	_, err = decodeUserData("%foo", nil, logger)
+	require.Error(t, err)
+
+	// Encrypted
+	hash := sha256.Sum256([]byte("foo"))
+	aesKey := hash[:]
+	encrypted, err := exp.encrypt(aesKey, logger)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(encrypted, "v2:"))
+	require.NotContains(t, encrypted, encoded)
+	actual, err = decodeUserData(encrypted, aesKey, logger)
+	require.NoError(t, err)
+	require.Equal(t, exp, actual)
+	// Percent-encoded by the client
+	actual, err = decodeUserData(url.PathEscape(encrypted), aesKey, logger)
+	require.NoError(t, err)
+	require.Equal(t, exp, actual)
+	// Unencrypted user data still works with a key
+	actual, err = decodeUserData(encoded, aesKey, logger)
+	require.NoError(t, err)
+	require.Equal(t, exp, actual)
+	// Without key or with a different one
+	_, err = decodeUserData(encrypted, nil, logger)
+	require.Error(t, err)
+	otherHash := sha256.Sum256([]byte("bar"))
+	_, err = decodeUserData(encrypted, otherHash[:], logger)
+	require.Error(t, err)
+}
+
+func TestFallbackDebridID(t *testing.T) {
+	// Without fallback
+	ud := userData{RDtoken: "foo"}
+	require.Equal(t, "rd", ud.debridID())
+	require.Equal(t, "", ud.fallbackDebridID())
+
+	// The fallback isn't the primary debrid service, even if it comes first
+	ud = userData{RDtoken: "foo", PMkey: "bar", Fallback: "rd"}
+	require.Equal(t, "pm", ud.debridID())
+	require.Equal(t, "rd", ud.fallbackDebridID())
+	ud = userData{RDtoken: "foo", PMkey: "bar", Fallback: "pm"}
+	require.Equal(t, "rd", ud.debridID())
+	require.Equal(t, "pm", ud.fallbackDebridID())
+
+	// Invalid without credentials
+	ud = userData{RDtoken: "foo", Fallback: "ad"}
+	require.Equal(t, "rd", ud.debridID())
+	require.Equal(t, "", ud.fallbackDebridID())
+}
+
+func TestUserDataRedacted(t *testing.T) {
+	ud := userData{RDtoken: "secret1", ADkey: "secret2", Fallback: "ad", ExcludeCam: true}
+	require.NotContains(t, ud.String(), "secret")
+	require.Contains(t, ud.String(), "RDtoken:REDACTED")
+	require.Contains(t, ud.String(), "PMkey: ")
+
+	// Neither the encoded user data nor the decoded one are logged with the keys
+	core, logs := observer.New(zap.DebugLevel)
+	encoded, err := ud.encode(zap.NewNop())
+	require.NoError(t, err)
+	_, err = decodeUserData(encoded, nil, zap.New(core))
+	require.NoError(t, err)
+	entries := logs.TakeAll()
+	require.NotEmpty(t, entries)
+	for _, entry := range entries {
+		fields := fmt.Sprintf("%v", entry.ContextMap())
+		require.NotContains(t, fields, "secret")
+		require.NotContains(t, fields, encoded)
+	}
+	require.Equal(t, map[string]interface{}{"rdToken": redactedValue, "adKey": redactedValue, "fallback": "ad", "excludeCam": true}, entries[len(entries)-1].ContextMap()["userData"])
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// Codes of validation errors, so that clients can react to them without parsing the message
+const (
+	validationInvalidUserData    = "invalid_user_data"
+	validationMissingCredentials = "missing_credentials"
+	validationInvalidKey         = "invalid_key"
+	validationAccountLocked      = "account_locked"
+	validationPremiumExpired     = "premium_expired"
+	validationFailed             = "validation_failed"
+)
+
+// Names of the debrid services for messages to users, mapped by their IDs
+var debridNames = map[string]string{
+	"rd": "RealDebrid",
+	"ad": "AllDebrid",
+	"pm": "Premiumize",
+	"dl": "Debrid-Link",
+	"tb": "Torbox",
+}
+
+// validationError is the reason why user data can't be used for the addon.
+type validationError struct {
+	Code string `json:"code"`
+	// ID of the debrid service whose credentials are the problem. Empty if the error is about the user data as a whole.
+	DebridService string `json:"debridService,omitempty"`
+	// Message that can be shown to the user
+	Message string `json:"message"`
+	// HTTP response status
+	status int
+}
+
+// validationResponse is the response of the validate endpoint.
+type validationResponse struct {
+	Valid bool `json:"valid"`
+	// ID of the user's primary debrid service
+	DebridService string `json:"debridService,omitempty"`
+	// Only set if the debrid service reported it
+	PremiumUntil *time.Time `json:"premiumUntil,omitempty"`
+	// Encrypted user data for the addon URL, if the instance encrypts user data
+	UserData string           `json:"userData,omitempty"`
+	Error    *validationError `json:"error,omitempty"`
+}
+
+// createValidateHandler creates a handler that validates candidate user data, so that the configure page can tell users about problems before they install the addon.
+// Otherwise users only find out via "Unable to Fetch" errors in Stremio.
+// It expects a JSON body with the encoded user data, like `{"userData": "eyJyZFRva2VuIjoiZm9vIn0"}`.
+// Different from the auth middleware, a configured fallback debrid service must be valid as well.
+// If encryptKey isn't nil, the response to valid user data contains the user data encrypted with it, which the configure page then uses in the addon URL.
+func createValidateHandler(auth *authenticator, accClient *accountClient, encryptKey []byte, logger *zap.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger.Debug("validateHandler called")
+
+		var req struct {
+			UserData string `json:"userData"`
+		}
+		if err := json.Unmarshal(c.Body(), &req); err != nil || req.UserData == "" {
+			return respondValidation(c, validationResponse{Error: &validationError{
+				Code:    validationInvalidUserData,
+				Message: "The request must contain the encoded user data.",
+				status:  fiber.StatusBadRequest,
+			}})
+		}
+		userData, err := decodeUserData(req.UserData, auth.aesKey, logger)
+		if err != nil {
+			return respondValidation(c, validationResponse{Error: &validationError{
+				Code:    validationInvalidUserData,
+				Message: "The user data is malformed.",
+				status:  fiber.StatusBadRequest,
+			}})
+		}
+
+		debridID := userData.debridID()
+		if debridID == "" {
+			return respondValidation(c, validationResponse{Error: &validationError{
+				Code:    validationMissingCredentials,
+				Message: "The user data doesn't contain any debrid service credentials.",
+				status:  fiber.StatusBadRequest,
+			}})
+		}
+		res := validationResponse{DebridService: debridID}
+		var premiumUntil time.Time
+		if premiumUntil, res.Error = validateDebrid(c.Context(), auth, accClient, userData, debridID, logger); res.Error != nil {
+			return respondValidation(c, res)
+		}
+		if !premiumUntil.IsZero() {
+			res.PremiumUntil = &premiumUntil
+		}
+
+		if userData.Fallback != "" {
+			fallbackID := userData.fallbackDebridID()
+			if fallbackID == "" {
+				res.Error = &validationError{
+					Code:    validationInvalidUserData,
+					Message: "The fallback debrid service is invalid.",
+					status:  fiber.StatusBadRequest,
+				}
+				return respondValidation(c, res)
+			}
+			if _, res.Error = validateDebrid(c.Context(), auth, accClient, userData, fallbackID, logger); res.Error != nil {
+				return respondValidation(c, res)
+			}
+		}
+
+		if encryptKey != nil {
+			if res.UserData, err = userData.encrypt(encryptKey, logger); err != nil {
+				logger.Error("Couldn't encrypt user data", zap.Error(err))
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+		res.Valid = true
+		return respondValidation(c, res)
+	}
+}
+
+// validateDebrid checks the credentials in the user data for the debrid service with the given ID, as well as the premium status of the account.
+// It returns when the premium status expires, if the debrid service reported it.
+func validateDebrid(ctx context.Context, auth *authenticator, accClient *accountClient, userData userData, debridID string, logger *zap.Logger) (time.Time, *validationError) {
+	serviceName := debridNames[debridID]
+	keyOrToken, debridOAUTH2, status := auth.keyOrToken(ctx, userData, debridID)
+	switch status {
+	case 0:
+	case fiber.StatusBadRequest:
+		return time.Time{}, &validationError{Code: validationInvalidUserData, DebridService: debridID, Message: "The " + serviceName + " authorization data is malformed. Please authorize Deflix again.", status: fiber.StatusBadRequest}
+	case fiber.StatusUnauthorized:
+		return time.Time{}, &validationError{Code: validationMissingCredentials, DebridService: debridID, Message: "The " + serviceName + " API key is empty.", status: fiber.StatusBadRequest}
+	case fiber.StatusForbidden:
+		return time.Time{}, &validationError{Code: validationInvalidKey, DebridService: debridID, Message: "The " + serviceName + " authorization was revoked or expired. Please authorize Deflix again.", status: fiber.StatusForbidden}
+	default:
+		return time.Time{}, &validationError{Code: validationFailed, DebridService: debridID, Message: "Couldn't validate the " + serviceName + " authorization. Please try again later.", status: fiber.StatusBadGateway}
+	}
+
+	if err := auth.testKeyOrToken(ctx, debridID, keyOrToken, debridOAUTH2); err != nil {
+		logger.Info("API key or access token is invalid or validation failed", zap.Error(err), zap.String("debridID", debridID))
+		// The debrid clients don't have typed errors, so we have to rely on their messages
+		errMsg := strings.ToLower(err.Error())
+		switch {
+		case strings.Contains(errMsg, "locked") || strings.Contains(errMsg, "banned"):
+			return time.Time{}, &validationError{Code: validationAccountLocked, DebridService: debridID, Message: "Your " + serviceName + " account is locked. Please contact " + serviceName + ".", status: fiber.StatusForbidden}
+		case strings.Contains(errMsg, "isn't premium") || strings.Contains(errMsg, "paid plan"):
+			return time.Time{}, &validationError{Code: validationPremiumExpired, DebridService: debridID, Message: "Your " + serviceName + " account doesn't have an active premium subscription.", status: fiber.StatusForbidden}
+		case strings.Contains(errMsg, "couldn't send") || strings.Contains(errMsg, "bad http response status: 5"):
+			return time.Time{}, &validationError{Code: validationFailed, DebridService: debridID, Message: "Couldn't reach " + serviceName + " to validate the API key. Please try again later.", status: fiber.StatusBadGateway}
+		default:
+			return time.Time{}, &validationError{Code: validationInvalidKey, DebridService: debridID, Message: "The " + serviceName + " API key is invalid.", status: fiber.StatusForbidden}
+		}
+	}
+
+	// Some debrid services accept the keys of free accounts, but the addon can't convert torrents with them
+	info, err := accClient.getInfo(ctx, debridID, keyOrToken, debridOAUTH2)
+	if err != nil {
+		// The credentials are valid, so we don't keep users from installing the addon
+		logger.Warn("Couldn't get account info", zap.Error(err), zap.String("debridID", debridID))
+		return time.Time{}, nil
+	}
+	if !info.Premium {
+		return time.Time{}, &validationError{Code: validationPremiumExpired, DebridService: debridID, Message: "Your " + serviceName + " account doesn't have an active premium subscription.", status: fiber.StatusForbidden}
+	}
+	return info.PremiumUntil, nil
+}
+
+func respondValidation(c *fiber.Ctx, res validationResponse) error {
+	if res.Error != nil {
+		c.Status(res.Error.status)
+	}
+	return c.JSON(res)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+
+	godebrid "github.com/deflix-tv/go-debrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/torbox"
+)
+
+func TestValidateHandler(t *testing.T) {
+	tbServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer premium":
+			w.Write([]byte(`{"success": true, "data": {"plan": 1, "premium_expires_at": "2030-01-01T00:00:00Z"}}`))
+		case "Bearer free":
+			w.Write([]byte(`{"success": true, "data": {"plan": 0}}`))
+		case "Bearer down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"success": false, "detail": "invalid key"}`))
+		}
+	}))
+	defer tbServer.Close()
+	tbClient, err := torbox.NewClient(torbox.NewClientOpts(tbServer.URL, time.Second, time.Hour, nil), godebrid.NewInMemoryCache(), godebrid.NewInMemoryCache(), zap.NewNop())
+	require.NoError(t, err)
+	auth := newAuthenticator(debrid.NewRegistry(nil, nil, nil, nil, tbClient), false, oauth2.Config{}, oauth2.Config{}, nil, zap.NewNop())
+	accClient, err := newAccountClient("", "", "", "", tbServer.URL, nil, time.Second)
+	require.NoError(t, err)
+
+	app := fiber.New()
+	app.Post("/api/validate", createValidateHandler(auth, accClient, nil, zap.NewNop()))
+
+	encode := func(ud userData) string {
+		udString, err := ud.encode(zap.NewNop())
+		require.NoError(t, err)
+		return `{"userData": "` + udString + `"}`
+	}
+	tests := []struct {
+		name      string
+		body      string
+		expStatus int
+		expCode   string
+	}{
+		{"valid", encode(userData{TBkey: "premium"}), fiber.StatusOK, ""},
+		{"no body", ``, fiber.StatusBadRequest, validationInvalidUserData},
+		{"malformed", `{"userData": "%%%"}`, fiber.StatusBadRequest, validationInvalidUserData},
+		{"no credentials", encode(userData{}), fiber.StatusBadRequest, validationMissingCredentials},
+		{"invalid key", encode(userData{TBkey: "invalid"}), fiber.StatusForbidden, validationInvalidKey},
+		{"free account", encode(userData{TBkey: "free"}), fiber.StatusForbidden, validationPremiumExpired},
+		{"debrid service down", encode(userData{TBkey: "down"}), fiber.StatusBadGateway, validationFailed},
+		{"invalid fallback", encode(userData{TBkey: "premium", Fallback: "foo"}), fiber.StatusBadRequest, validationInvalidUserData},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/validate", strings.NewReader(test.body))
+			req.Header.Set("Content-Type", "application/json")
+			res, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, test.expStatus, res.StatusCode)
+			var validation validationResponse
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&validation))
+			if test.expCode == "" {
+				require.True(t, validation.Valid)
+				require.Equal(t, "tb", validation.DebridService)
+				require.NotNil(t, validation.PremiumUntil)
+				require.Nil(t, validation.Error)
+			} else {
+				require.False(t, validation.Valid)
+				require.Equal(t, test.expCode, validation.Error.Code)
+				require.NotEmpty(t, validation.Error.Message)
+			}
+		})
+	}
+	// Instances that encrypt user data respond with the encrypted user data
+	hash := sha256.Sum256([]byte("foo"))
+	aesKey := hash[:]
+	app = fiber.New()
+	app.Post("/api/validate", createValidateHandler(auth, accClient, aesKey, zap.NewNop()))
+	req := httptest.NewRequest("POST", "/api/validate", strings.NewReader(encode(userData{TBkey: "premium", ExcludeCam: true})))
+	res, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, res.StatusCode)
+	var validation validationResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&validation))
+	require.True(t, strings.HasPrefix(validation.UserData, userDataV2prefix))
+	ud, err := decodeUserData(validation.UserData, aesKey, zap.NewNop())
+	require.NoError(t, err)
+	require.Equal(t, userData{TBkey: "premium", ExcludeCam: true}, ud)
+}
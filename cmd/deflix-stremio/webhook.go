@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	gocache "github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+const (
+	webhookFormatJSON    = "json"
+	webhookFormatDiscord = "discord"
+	webhookFormatSlack   = "slack"
+	// Number of notifications that are buffered. Further ones are dropped while the webhook is too slow.
+	webhookBufferSize = 100
+	webhookTimeout    = 5 * time.Second
+	// A stream that keeps failing leads to one notification in this interval, so that a popular dead end doesn't flood the channel
+	webhookDedupInterval = time.Hour
+)
+
+var webhookErrors = metrics.NewCounter("webhook_errors_total")
+
+// failedConversionEvent is sent to the webhook when none of the torrents of a stream could be converted into a stream URL.
+// It doesn't contain the user data or any user identifier.
+type failedConversionEvent struct {
+	Time time.Time `json:"time"`
+	// IMDb ID, for TV shows including season and episode, like "tt0944947:1:1"
+	IMDbID string `json:"imdbID"`
+	// Like "1080p" or "best"
+	Quality string `json:"quality"`
+	// Debrid service ID ("rd", "ad", "pm", "dl" or "tb")
+	Provider string `json:"provider"`
+	// Number of torrents that were tried
+	Torrents int `json:"torrents"`
+}
+
+// webhookNotifier sends notifications about failed conversions to a webhook, so that operators learn about dead ends that users hit.
+// The body depends on the format: Discord and Slack get a message, other webhooks get the event as JSON.
+type webhookNotifier struct {
+	url        string
+	format     string
+	queue      chan failedConversionEvent
+	sent       *gocache.Cache
+	httpClient *http.Client
+	logger     *zap.Logger
+}
+
+// newWebhookNotifier creates a new webhookNotifier and starts sending notifications to the URL until the context is canceled.
+func newWebhookNotifier(ctx context.Context, url, format string, logger *zap.Logger) *webhookNotifier {
+	n := &webhookNotifier{
+		url:    url,
+		format: format,
+		queue:  make(chan failedConversionEvent, webhookBufferSize),
+		sent:   gocache.New(webhookDedupInterval, webhookDedupInterval),
+		httpClient: &http.Client{
+			Timeout: webhookTimeout,
+		},
+		logger: logger,
+	}
+	go n.run(ctx)
+	return n
+}
+
+// notifyFailedConversion queues a notification about the stream with the given redirect ID, for which none of the torrents could be converted via the debrid service.
+// It's safe to call on a nil webhookNotifier, in which case nothing is sent.
+func (n *webhookNotifier) notifyFailedConversion(redirectID, debridID string, torrents int) {
+	if n == nil {
+		return
+	}
+	event := failedConversionEvent{
+		Time:     time.Now().UTC(),
+		IMDbID:   streamIDfromRedirectID(redirectID),
+		Quality:  qualityFromRedirectID(redirectID),
+		Provider: debridID,
+		Torrents: torrents,
+	}
+	// Different users' preferences lead to different redirect IDs for the same stream, so they're not part of the key
+	if err := n.sent.Add(event.IMDbID+"-"+event.Quality+"-"+event.Provider, struct{}{}, gocache.DefaultExpiration); err != nil {
+		n.logger.Debug("Already notified webhook about failed conversion", zap.String("redirectID", redirectID))
+		return
+	}
+	select {
+	case n.queue <- event:
+	default:
+		n.logger.Warn("Webhook queue is full, dropping notification")
+		webhookErrors.Inc()
+	}
+}
+
+// run sends the queued notifications until the context is canceled.
+func (n *webhookNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-n.queue:
+			if err := n.send(ctx, event); err != nil {
+				n.logger.Error("Couldn't send webhook notification", zap.Error(err))
+				webhookErrors.Inc()
+			}
+		}
+	}
+}
+
+func (n *webhookNotifier) send(ctx context.Context, event failedConversionEvent) error {
+	body, err := n.body(event)
+	if err != nil {
+		return fmt.Errorf("Couldn't encode body: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Couldn't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := n.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Couldn't send request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Bad response status: %v", res.StatusCode)
+	}
+	return nil
+}
+
+// body returns the request body for the event in the notifier's format.
+func (n *webhookNotifier) body(event failedConversionEvent) ([]byte, error) {
+	message := fmt.Sprintf("Couldn't convert any of the %d torrents of %v (%v) via %v", event.Torrents, event.IMDbID, event.Quality, strings.ToUpper(event.Provider))
+	switch n.format {
+	case webhookFormatDiscord:
+		return json.Marshal(map[string]string{"content": message})
+	case webhookFormatSlack:
+		return json.Marshal(map[string]string{"text": message})
+	default:
+		return json.Marshal(event)
+	}
+}
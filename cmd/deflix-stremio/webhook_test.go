@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "POST", r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := newWebhookNotifier(ctx, server.URL, webhookFormatJSON, zap.NewNop())
+	n.notifyFailedConversion("tt0944947:1:1-rd-1a2b3c4d-1080p", "rd", 3)
+	var event failedConversionEvent
+	require.NoError(t, json.Unmarshal(<-bodies, &event))
+	require.Equal(t, "tt0944947:1:1", event.IMDbID)
+	require.Equal(t, "1080p", event.Quality)
+	require.Equal(t, "rd", event.Provider)
+	require.Equal(t, 3, event.Torrents)
+
+	// The same stream with other preferences isn't notified again, but another quality is
+	n.notifyFailedConversion("tt0944947:1:1-rd-1080p", "rd", 2)
+	n.notifyFailedConversion("tt0944947:1:1-rd-720p", "rd", 1)
+	require.NoError(t, json.Unmarshal(<-bodies, &event))
+	require.Equal(t, "720p", event.Quality)
+	require.Empty(t, bodies)
+
+	// Nil notifier
+	var nilNotifier *webhookNotifier
+	nilNotifier.notifyFailedConversion("tt1254207-rd-720p", "rd", 1)
+}
+
+func TestWebhookBody(t *testing.T) {
+	event := failedConversionEvent{IMDbID: "tt1254207", Quality: "best", Provider: "pm", Torrents: 5}
+	body, err := (&webhookNotifier{format: webhookFormatDiscord}).body(event)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"content": "Couldn't convert any of the 5 torrents of tt1254207 (best) via PM"}`, string(body))
+	body, err = (&webhookNotifier{format: webhookFormatSlack}).body(event)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"text": "Couldn't convert any of the 5 torrents of tt1254207 (best) via PM"}`, string(body))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+var _ imdb2torrent.MagnetSearcher = (*zileanClient)(nil)
+
+// zileanClient is an imdb2torrent.MagnetSearcher for Zilean, which serves the hash lists of Debrid Media Manager (DMM).
+// DMM users share the info hashes of the torrents in their debrid accounts, so most of the found torrents are already cached on the debrid services.
+// Zilean stores the IMDb IDs of the torrents, so no title search is required.
+type zileanClient struct {
+	baseURL          string
+	httpClient       *http.Client
+	cache            imdb2torrent.Cache
+	cacheAge         time.Duration
+	logger           *zap.Logger
+	logFoundTorrents bool
+}
+
+func newZileanClient(baseURL string, timeout, cacheAge time.Duration, cache imdb2torrent.Cache, logger *zap.Logger, logFoundTorrents bool) *zileanClient {
+	return &zileanClient{
+		baseURL: baseURL,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		cache:            cache,
+		cacheAge:         cacheAge,
+		logger:           logger,
+		logFoundTorrents: logFoundTorrents,
+	}
+}
+
+// FindMovie searches Zilean for torrents for the given IMDb ID.
+// If no error occured, but there are just no torrents for the movie yet, an empty result and *no* error are returned.
+func (c *zileanClient) FindMovie(ctx context.Context, imdbID string) ([]imdb2torrent.Result, error) {
+	query := url.Values{}
+	query.Set("ImdbId", imdbID)
+	return c.find(ctx, imdbID, query, 0)
+}
+
+// FindTVShow searches Zilean for torrents for the given IMDb ID + season + episode.
+// Zilean's results for the season also contain season packs, which are marked as such.
+// If no error occured, but there are just no torrents for the TV show yet, an empty result and *no* error are returned.
+func (c *zileanClient) FindTVShow(ctx context.Context, imdbID string, season, episode int) ([]imdb2torrent.Result, error) {
+	id := imdbID + ":" + strconv.Itoa(season) + ":" + strconv.Itoa(episode)
+	query := url.Values{}
+	query.Set("ImdbId", imdbID)
+	query.Set("Season", strconv.Itoa(season))
+	query.Set("Episode", strconv.Itoa(episode))
+	return c.find(ctx, id, query, season)
+}
+
+// IsSlow returns false, because Zilean is usually self-hosted next to Deflix.
+func (c *zileanClient) IsSlow() bool {
+	return false
+}
+
+// find searches Zilean's filtered DMM endpoint with the query. For movies season must be 0.
+func (c *zileanClient) find(ctx context.Context, id string, query url.Values, season int) ([]imdb2torrent.Result, error) {
+	logger := requestLogger(ctx, c.logger)
+	zapFieldID := zap.String("id", id)
+	zapFieldTorrentSite := zap.String("torrentSite", "Zilean")
+
+	// Check cache first
+	cacheKey := id + "-Zilean"
+	torrentList, created, found, err := c.cache.Get(cacheKey)
+	if err != nil {
+		logger.Error("Couldn't get torrent results from cache", zap.Error(err), zapFieldID, zapFieldTorrentSite)
+	} else if !found {
+		logger.Debug("Torrent results not found in cache", zapFieldID, zapFieldTorrentSite)
+	} else if time.Since(created) > (c.cacheAge) {
+		expiredSince := time.Since(created.Add(c.cacheAge))
+		logger.Debug("Hit cache for torrents, but item is expired", zap.Duration("expiredSince", expiredSince), zapFieldID, zapFieldTorrentSite)
+	} else {
+		logger.Debug("Hit cache for torrents, returning results", zap.Int("torrentCount", len(torrentList)), zapFieldID, zapFieldTorrentSite)
+		return torrentList, nil
+	}
+
+	reqURL := c.baseURL + "/dmm/filtered?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send GET request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Bad GET response: %v", res.StatusCode)
+	}
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read response body: %v", err)
+	}
+
+	// Nil slice is ok, because it can be checked with len()
+	var results []imdb2torrent.Result
+	for _, torrent := range gjson.ParseBytes(resBody).Array() {
+		title := torrent.Get("raw_title").String()
+		infoHash := strings.ToUpper(torrent.Get("info_hash").String())
+		if len(infoHash) != 40 {
+			logger.Debug("Skipping torrent with invalid info hash", zap.String("title", title), zapFieldID, zapFieldTorrentSite)
+			continue
+		}
+		// Same format as the built-in imdb2torrent clients
+		quality := parseNyaaQuality(title)
+		if quality == "" {
+			continue
+		}
+		magnetURL := "magnet:?xt=urn:btih:" + infoHash + "&dn=" + url.QueryEscape(title)
+		result := imdb2torrent.Result{
+			Title:     title,
+			Quality:   quality,
+			InfoHash:  infoHash,
+			MagnetURL: magnetURL,
+		}
+		if season > 0 && isSeasonPack(title, season) {
+			result = newSeasonPackResult(title, quality, infoHash, magnetURL)
+		} else if size := torrent.Get("size").Int(); size > 0 {
+			// Keep the size, so that it can be shown to the user
+			result.MagnetURL += "&xl=" + strconv.FormatInt(size, 10)
+		}
+		if c.logFoundTorrents {
+			logger.Debug("Found torrent", zap.String("title", result.Title), zap.String("quality", result.Quality), zap.String("infoHash", result.InfoHash), zap.String("magnet", result.MagnetURL), zapFieldID, zapFieldTorrentSite)
+		}
+		results = append(results, result)
+	}
+
+	// Fill cache, even if there are no results, because that's just the current state of the hash list.
+	// Any actual errors would have returned earlier.
+	if err := c.cache.Set(cacheKey, results); err != nil {
+		logger.Error("Couldn't cache torrents", zap.Error(err), zap.String("cache", "torrent"), zapFieldID, zapFieldTorrentSite)
+	}
+
+	return results, nil
+}
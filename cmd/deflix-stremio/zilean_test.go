@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+func TestZileanFindTVShow(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		require.Equal(t, "/dmm/filtered", r.URL.Path)
+		require.Equal(t, "tt0944947", r.URL.Query().Get("ImdbId"))
+		require.Equal(t, "1", r.URL.Query().Get("Season"))
+		require.Equal(t, "5", r.URL.Query().Get("Episode"))
+		w.Write([]byte(`[
+			{"raw_title": "Game.of.Thrones.S01E05.1080p.BluRay.x264", "info_hash": "dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c", "size": "1500000000"},
+			{"raw_title": "Game.of.Thrones.S01.2160p.WEB", "info_hash": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "size": 30000000000},
+			{"raw_title": "Game.of.Thrones.S01E05.DVDRip", "info_hash": "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+			{"raw_title": "Game.of.Thrones.S01E05.720p", "info_hash": "invalid"}
+		]`))
+	}))
+	defer server.Close()
+
+	client := newZileanClient(server.URL, time.Second, time.Hour, imdb2torrent.NewInMemoryCache(), zap.NewNop(), false)
+	results, err := client.FindTVShow(context.Background(), "tt0944947", 1, 5)
+	require.NoError(t, err)
+	require.Equal(t, []imdb2torrent.Result{
+		{
+			Title:     "Game.of.Thrones.S01E05.1080p.BluRay.x264",
+			Quality:   "1080p (bluray)",
+			InfoHash:  "DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C",
+			MagnetURL: "magnet:?xt=urn:btih:DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C&dn=Game.of.Thrones.S01E05.1080p.BluRay.x264&xl=1500000000",
+		},
+		{
+			Title:     "Game.of.Thrones.S01.2160p.WEB",
+			Quality:   "2160p (web)" + seasonPackQualitySuffix,
+			InfoHash:  "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+			MagnetURL: "magnet:?xt=urn:btih:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA&dn=Game.of.Thrones.S01.2160p.WEB",
+		},
+	}, results)
+
+	// Cached
+	_, err = client.FindTVShow(context.Background(), "tt0944947", 1, 5)
+	require.NoError(t, err)
+	require.Equal(t, 1, requests)
+}
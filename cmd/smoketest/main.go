@@ -0,0 +1,331 @@
+// Smoke test for the deflix-stremio Docker image.
+//
+// It starts a fake upstream server that acts as YTS and RealDebrid, runs the image with all torrent sites and debrid services pointed at it,
+// and then checks that the container starts, binds, serves the manifest and configure page
+// and resolves a stream of the fake movie end-to-end, from the stream list to the redirect to the debrid service's stream URL.
+// This catches packaging issues that unit tests can't catch, like missing web assets in the image.
+//
+// The container uses the host network, so that it can reach the fake upstream server and vice versa.
+// This requires Docker on Linux.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The Shawshank Redemption
+	fakeIMDbID   = "tt0111161"
+	fakeInfoHash = "0123456789ABCDEF0123456789ABCDEF01234567"
+	fakeRDtoken  = "smoketest"
+	fakeTorrent  = "SMOKETEST"
+	// Path of the stream URL that the fake RealDebrid returns
+	fakeStreamPath = "/download/smoketest.mkv"
+)
+
+var (
+	image        = flag.String("image", "doingodswork/deflix-stremio", "Docker image to test")
+	port         = flag.Int("port", 18080, "Port that the addon in the container binds to")
+	upstreamPort = flag.Int("upstreamPort", 18081, "Port of the fake upstream server")
+	timeout      = flag.Duration("timeout", 2*time.Minute, "Timeout for the whole smoke test")
+	keep         = flag.Bool("keep", false, "Keep the container running after the smoke test, for debugging")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		log.Fatalf("Smoke test failed: %v", err)
+	}
+	log.Println("Smoke test passed")
+}
+
+func run() error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	upstreamURL := "http://localhost:" + strconv.Itoa(*upstreamPort)
+	addonURL := "http://localhost:" + strconv.Itoa(*port)
+
+	listener, err := net.Listen("tcp", "localhost:"+strconv.Itoa(*upstreamPort))
+	if err != nil {
+		return fmt.Errorf("Couldn't start fake upstream server: %w", err)
+	}
+	upstream := &http.Server{Handler: newFakeUpstream(upstreamURL)}
+	go upstream.Serve(listener)
+	defer upstream.Close()
+	log.Printf("Started fake upstream server at %v", upstreamURL)
+
+	containerID, err := startContainer(ctx, upstreamURL, addonURL)
+	if err != nil {
+		return err
+	}
+	log.Printf("Started container %v", containerID)
+	defer func() {
+		if *keep {
+			log.Printf("Keeping container %v", containerID)
+			return
+		}
+		if err := exec.Command("docker", "rm", "-f", containerID).Run(); err != nil {
+			log.Printf("Couldn't remove container %v: %v", containerID, err)
+		}
+	}()
+
+	checks := []struct {
+		name  string
+		check func(context.Context, string) error
+	}{
+		{"health", checkHealth},
+		{"manifest", checkManifest},
+		{"configure page", checkConfigure},
+		{"stream", func(ctx context.Context, addonURL string) error { return checkStream(ctx, addonURL, upstreamURL) }},
+	}
+	for _, c := range checks {
+		if err := c.check(ctx, addonURL); err != nil {
+			printContainerLogs(containerID)
+			return fmt.Errorf("Check %q failed: %w", c.name, err)
+		}
+		log.Printf("Check %q passed", c.name)
+	}
+	return nil
+}
+
+// startContainer runs the image in the background and returns the container ID.
+func startContainer(ctx context.Context, upstreamURL, addonURL string) (string, error) {
+	args := []string{"run", "-d", "--network", "host",
+		"-e", "BIND_ADDR=localhost",
+		"-e", "PORT=" + strconv.Itoa(*port),
+		"-e", "BASE_URL=" + addonURL,
+		"-e", "LOG_LEVEL=debug",
+	}
+	// All sites and services must point to the fake upstream server, so that the test doesn't depend on the real ones
+	for _, envVar := range []string{"BASE_URL_YTS", "BASE_URL_TPB", "BASE_URL_1337X", "BASE_URL_IBIT", "BASE_URL_RARBG", "BASE_URL_NYAA",
+		"BASE_URL_RD", "BASE_URL_AD", "BASE_URL_PM", "BASE_URL_DL", "BASE_URL_TORBOX"} {
+		args = append(args, "-e", envVar+"="+upstreamURL)
+	}
+	args = append(args, *image)
+
+	out, err := exec.CommandContext(ctx, "docker", args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("Couldn't start container: %w: %s", err, exitErr.Stderr)
+		}
+		return "", fmt.Errorf("Couldn't start container: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func printContainerLogs(containerID string) {
+	cmd := exec.Command("docker", "logs", containerID)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("Couldn't get container logs: %v", err)
+	}
+}
+
+// checkHealth waits until the addon responds to health checks, which means it started and binds to the port.
+func checkHealth(ctx context.Context, addonURL string) error {
+	for {
+		res, err := get(ctx, http.DefaultClient, addonURL+"/health")
+		if err == nil && res.StatusCode == http.StatusOK {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Addon didn't become healthy: %w", ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func checkManifest(ctx context.Context, addonURL string) error {
+	res, err := get(ctx, http.DefaultClient, addonURL+"/manifest.json")
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Bad status code: %v", res.StatusCode)
+	}
+	var manifest struct {
+		ID      string   `json:"id"`
+		Version string   `json:"version"`
+		Types   []string `json:"types"`
+	}
+	if err := json.Unmarshal(res.Body, &manifest); err != nil {
+		return fmt.Errorf("Couldn't unmarshal manifest: %w", err)
+	}
+	if manifest.ID == "" || manifest.Version == "" || len(manifest.Types) == 0 {
+		return fmt.Errorf("Manifest is incomplete: %s", res.Body)
+	}
+	return nil
+}
+
+// checkConfigure checks the configure page and its assets, which are the files that must be packaged into the image.
+func checkConfigure(ctx context.Context, addonURL string) error {
+	for _, path := range []string{"/configure", "/configure/deflix.css", "/configure/mvp.css", "/configure/favicon.ico"} {
+		res, err := get(ctx, http.DefaultClient, addonURL+path)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("Bad status code for %v: %v", path, res.StatusCode)
+		}
+		if len(res.Body) == 0 {
+			return fmt.Errorf("Empty response body for %v", path)
+		}
+	}
+	return nil
+}
+
+// checkStream requests the stream list of the fake movie and follows the first stream's redirect, which must lead to the stream URL of the fake RealDebrid.
+func checkStream(ctx context.Context, addonURL, upstreamURL string) error {
+	userData := base64.RawURLEncoding.EncodeToString([]byte(`{"rdToken":"` + fakeRDtoken + `"}`))
+	res, err := get(ctx, http.DefaultClient, addonURL+"/"+userData+"/stream/movie/"+fakeIMDbID+".json")
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Bad status code for stream list: %v", res.StatusCode)
+	}
+	var streams struct {
+		Streams []struct {
+			URL string `json:"url"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(res.Body, &streams); err != nil {
+		return fmt.Errorf("Couldn't unmarshal stream list: %w", err)
+	}
+	if len(streams.Streams) == 0 || streams.Streams[0].URL == "" {
+		return fmt.Errorf("No streams found: %s", res.Body)
+	}
+
+	noRedirectClient := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err = get(ctx, noRedirectClient, streams.Streams[0].URL)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 300 || res.StatusCode > 399 {
+		return fmt.Errorf("Bad status code for redirect: %v", res.StatusCode)
+	}
+	if location := res.Header.Get("Location"); location != upstreamURL+fakeStreamPath {
+		return fmt.Errorf("Unexpected redirect location: %v", location)
+	}
+	return nil
+}
+
+type response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func get(ctx context.Context, client *http.Client, url string) (response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return response{}, fmt.Errorf("Couldn't create request: %w", err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return response{}, fmt.Errorf("Couldn't send request to %v: %w", url, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return response{}, fmt.Errorf("Couldn't read response body from %v: %w", url, err)
+	}
+	return response{
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Body:       body,
+	}, nil
+}
+
+// newFakeUpstream creates a handler that responds like YTS and RealDebrid for the fake movie and torrent.
+// All other requests get a 404 response, which the torrent sites and debrid services must handle gracefully.
+func newFakeUpstream(upstreamURL string) http.Handler {
+	mux := http.NewServeMux()
+
+	// YTS
+	mux.HandleFunc("/api/v2/list_movies.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("query_term") != fakeIMDbID {
+			writeJSON(w, http.StatusOK, `{"status":"ok","data":{"movie_count":0}}`)
+			return
+		}
+		writeJSON(w, http.StatusOK, `{"status":"ok","data":{"movie_count":1,"movies":[{"title":"Smoke Test","torrents":[{"quality":"1080p","type":"bluray","hash":"`+fakeInfoHash+`"}]}]}}`)
+	})
+
+	// RealDebrid
+	mux.HandleFunc("/rest/1.0/user", func(w http.ResponseWriter, r *http.Request) {
+		if !checkRDtoken(w, r) {
+			return
+		}
+		writeJSON(w, http.StatusOK, `{"id":1,"username":"smoketest","type":"premium"}`)
+	})
+	mux.HandleFunc("/rest/1.0/torrents/instantAvailability/", func(w http.ResponseWriter, r *http.Request) {
+		if !checkRDtoken(w, r) {
+			return
+		}
+		writeJSON(w, http.StatusOK, `{"`+strings.ToLower(fakeInfoHash)+`":{"rd":[{"1":{"filename":"smoketest.mkv","filesize":1000000}}]}}`)
+	})
+	mux.HandleFunc("/rest/1.0/torrents/addMagnet", func(w http.ResponseWriter, r *http.Request) {
+		if !checkRDtoken(w, r) {
+			return
+		}
+		writeJSON(w, http.StatusCreated, `{"id":"`+fakeTorrent+`","uri":"`+upstreamURL+`/rest/1.0/torrents/info/`+fakeTorrent+`"}`)
+	})
+	mux.HandleFunc("/rest/1.0/torrents/info/"+fakeTorrent, func(w http.ResponseWriter, r *http.Request) {
+		if !checkRDtoken(w, r) {
+			return
+		}
+		writeJSON(w, http.StatusOK, `{"id":"`+fakeTorrent+`","status":"downloaded","files":[{"id":1,"path":"/smoketest.mkv","bytes":1000000}],"links":["`+upstreamURL+`/d/`+fakeTorrent+`"]}`)
+	})
+	mux.HandleFunc("/rest/1.0/torrents/selectFiles/"+fakeTorrent, func(w http.ResponseWriter, r *http.Request) {
+		if !checkRDtoken(w, r) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/rest/1.0/unrestrict/link", func(w http.ResponseWriter, r *http.Request) {
+		if !checkRDtoken(w, r) {
+			return
+		}
+		writeJSON(w, http.StatusOK, `{"id":"`+fakeTorrent+`","download":"`+upstreamURL+fakeStreamPath+`"}`)
+	})
+
+	return mux
+}
+
+func checkRDtoken(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") != "Bearer "+fakeRDtoken {
+		writeJSON(w, http.StatusUnauthorized, `{"error":"bad_token","error_code":8}`)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if _, err := w.Write([]byte(body)); err != nil {
+		log.Printf("Couldn't write fake upstream response: %v", err)
+	}
+}
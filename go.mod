@@ -1,8 +1,9 @@
 module github.com/doingodswork/deflix-stremio
 
-go 1.15
+go 1.16
 
 require (
+	github.com/VictoriaMetrics/metrics v1.12.3
 	github.com/deflix-tv/go-debrid v0.1.0
 	github.com/deflix-tv/go-stremio v0.9.2-0.20210202204625-e3e7a578d4d7
 	github.com/deflix-tv/imdb2meta v0.2.1
@@ -10,13 +11,17 @@ require (
 	github.com/dgraph-io/badger/v2 v2.2007.2
 	github.com/go-redis/redis/v8 v8.4.10
 	github.com/gofiber/fiber/v2 v2.3.3
+	github.com/golang/protobuf v1.4.3
 	github.com/google/go-cmp v0.5.4
-	github.com/markbates/pkger v0.17.1
+	github.com/lib/pq v1.10.9
 	github.com/patrickmn/go-cache v2.1.0+incompatible
-	github.com/spf13/afero v1.5.1
 	github.com/stretchr/testify v1.7.0
+	github.com/tidwall/gjson v1.6.7
 	go.uber.org/multierr v1.6.0
 	go.uber.org/zap v1.16.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	golang.org/x/oauth2 v0.0.0-20210113205817-d3ed898aa8a3
 	google.golang.org/grpc v1.35.0
+	google.golang.org/protobuf v1.25.0
+	gopkg.in/yaml.v3 v3.0.1
 )
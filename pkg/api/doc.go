@@ -0,0 +1,7 @@
+// Package api contains the protobuf messages and the gRPC client and server code of the Deflix API,
+// which exposes the torrent search and the conversion into debrid HTTP streams to other Deflix services, like the website or bots.
+//
+// The server is part of deflix-stremio and is enabled with its "grpcPort" option.
+package api
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative api.proto
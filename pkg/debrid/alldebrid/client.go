@@ -0,0 +1,296 @@
+package alldebrid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	debrid "github.com/deflix-tv/go-debrid"
+)
+
+type ClientOptions struct {
+	BaseURL      string
+	Timeout      time.Duration
+	CacheAge     time.Duration
+	ExtraHeaders []string
+}
+
+func NewClientOpts(baseURL string, timeout, cacheAge time.Duration, extraHeaders []string) ClientOptions {
+	return ClientOptions{
+		BaseURL:      baseURL,
+		Timeout:      timeout,
+		CacheAge:     cacheAge,
+		ExtraHeaders: extraHeaders,
+	}
+}
+
+var DefaultClientOpts = ClientOptions{
+	BaseURL:  "https://api.alldebrid.com",
+	Timeout:  5 * time.Second,
+	CacheAge: 24 * time.Hour,
+}
+
+// Client is an AllDebrid client with the same methods as the one of go-debrid.
+// Unlike that one it sends all requests with the context.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	// For API key validity
+	apiKeyCache debrid.Cache
+	// For info_hash instant availability
+	availabilityCache debrid.Cache
+	cacheAge          time.Duration
+	extraHeaders      map[string]string
+	logger            *zap.Logger
+}
+
+func NewClient(opts ClientOptions, apiKeyCache, availabilityCache debrid.Cache, logger *zap.Logger) (*Client, error) {
+	// Precondition check
+	if opts.BaseURL == "" {
+		return nil, errors.New("opts.BaseURL must not be empty")
+	}
+	extraHeaderMap := make(map[string]string, len(opts.ExtraHeaders))
+	for _, extraHeader := range opts.ExtraHeaders {
+		if extraHeader == "" {
+			continue
+		}
+		colonIndex := strings.Index(extraHeader, ":")
+		if colonIndex <= 0 || colonIndex == len(extraHeader)-1 {
+			return nil, errors.New("opts.ExtraHeaders elements must have a format like \"X-Foo: bar\"")
+		}
+		extraHeaderMap[extraHeader[:colonIndex]] = strings.TrimSpace(extraHeader[colonIndex+1:])
+	}
+
+	return &Client{
+		baseURL: opts.BaseURL,
+		httpClient: &http.Client{
+			Timeout: opts.Timeout,
+		},
+		apiKeyCache:       apiKeyCache,
+		availabilityCache: availabilityCache,
+		cacheAge:          opts.CacheAge,
+		extraHeaders:      extraHeaderMap,
+		logger:            logger,
+	}, nil
+}
+
+func (c *Client) TestAPIkey(ctx context.Context, apiKey string) error {
+	zapFieldDebridSite := zap.String("debridSite", "AllDebrid")
+	c.logger.Debug("Testing API key...", zapFieldDebridSite)
+
+	// Check cache first.
+	// Note: Only when an API key is valid a cache item is created, because an invalid API key might become valid again soon when the user extends their subscription.
+	created, found, err := c.apiKeyCache.Get(apiKey)
+	if err != nil {
+		c.logger.Error("Couldn't decode API key cache item", zap.Error(err), zapFieldDebridSite)
+	} else if !found {
+		c.logger.Debug("API key not found in cache", zapFieldDebridSite)
+	} else if time.Since(created) > (24 * time.Hour) {
+		expiredSince := time.Since(created.Add(24 * time.Hour))
+		c.logger.Debug("API key cached as valid, but item is expired", zap.Duration("expiredSince", expiredSince), zapFieldDebridSite)
+	} else {
+		c.logger.Debug("API key cached as valid", zapFieldDebridSite)
+		return nil
+	}
+
+	if _, err = c.do(ctx, "GET", "/v4/user", apiKey, nil); err != nil {
+		return fmt.Errorf("Couldn't fetch user info from AllDebrid with the provided API key: %v", err)
+	}
+
+	c.logger.Debug("API key OK", zapFieldDebridSite)
+
+	// Create cache item
+	if err = c.apiKeyCache.Set(apiKey); err != nil {
+		c.logger.Error("Couldn't cache API key", zap.Error(err), zapFieldDebridSite)
+	}
+
+	return nil
+}
+
+// CheckInstantAvailability returns the info hashes of the torrents that are instantly available. A failed check is only logged.
+func (c *Client) CheckInstantAvailability(ctx context.Context, apiKey string, infoHashes ...string) []string {
+	result, _ := c.CheckInstantAvailabilityErr(ctx, apiKey, infoHashes...)
+	return result
+}
+
+// CheckInstantAvailabilityErr is like CheckInstantAvailability, but also returns the error of a failed check,
+// together with the info hashes that are known to be available from the cache.
+func (c *Client) CheckInstantAvailabilityErr(ctx context.Context, apiKey string, infoHashes ...string) ([]string, error) {
+	result, err := c.checkInstantAvailability(ctx, apiKey, infoHashes...)
+	if err != nil {
+		c.logger.Error("Couldn't check instant availability", zap.Error(err), zap.String("debridSite", "AllDebrid"))
+	}
+	return result, err
+}
+
+func (c *Client) checkInstantAvailability(ctx context.Context, apiKey string, infoHashes ...string) ([]string, error) {
+	zapFieldDebridSite := zap.String("debridSite", "AllDebrid")
+
+	// Precondition check
+	if len(infoHashes) == 0 {
+		return nil, nil
+	}
+
+	// Only check the ones of which we don't know that they're valid (or which our knowledge that they're valid is older than the cache age).
+	// We don't cache unavailable ones, because that might change often!
+	var result []string
+	var unknownAvailabilityValues []string
+	for _, infoHash := range infoHashes {
+		created, found, err := c.availabilityCache.Get(infoHash)
+		if err != nil {
+			c.logger.Error("Couldn't decode availability cache item", zap.Error(err), zap.String("infoHash", infoHash), zapFieldDebridSite)
+			unknownAvailabilityValues = append(unknownAvailabilityValues, infoHash)
+		} else if !found || time.Since(created) > c.cacheAge {
+			unknownAvailabilityValues = append(unknownAvailabilityValues, infoHash)
+		} else {
+			result = append(result, infoHash)
+		}
+	}
+	c.logger.Debug("Checked availability cache", zap.Int("cached", len(result)), zap.Int("unknown", len(unknownAvailabilityValues)), zapFieldDebridSite)
+
+	// Only make HTTP request if we didn't find all hashes in the cache yet
+	if len(unknownAvailabilityValues) == 0 {
+		return result, nil
+	}
+	resBytes, err := c.do(ctx, "POST", "/v4/magnet/instant", apiKey, url.Values{"magnets[]": unknownAvailabilityValues})
+	if err != nil {
+		return result, fmt.Errorf("Couldn't check torrents' instant availability on AllDebrid: %v", err)
+	}
+	for _, magnet := range gjson.GetBytes(resBytes, "data.magnets").Array() {
+		if !magnet.Get("instant").Bool() {
+			continue
+		}
+		infoHash := strings.ToUpper(magnet.Get("hash").String())
+		result = append(result, infoHash)
+		// Create cache item
+		if err = c.availabilityCache.Set(infoHash); err != nil {
+			c.logger.Error("Couldn't cache availability", zap.Error(err), zapFieldDebridSite)
+		}
+	}
+	return result, nil
+}
+
+// GetStreamURL adds the magnet to AllDebrid and unlocks the link of its largest file.
+func (c *Client) GetStreamURL(ctx context.Context, magnetURL, apiKey string) (string, error) {
+	zapFieldDebridSite := zap.String("debridSite", "AllDebrid")
+	c.logger.Debug("Adding magnet to AllDebrid...", zapFieldDebridSite)
+	data := url.Values{}
+	data.Set("magnets[]", magnetURL)
+	resBytes, err := c.do(ctx, "POST", "/v4/magnet/upload", apiKey, data)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't add magnet to AllDebrid: %v", err)
+	}
+	// Note: "ready" in the response isn't the instant availability, because it's false even for torrents that are instantly available
+	adID := gjson.GetBytes(resBytes, "data.magnets.0.id").String()
+	if adID == "" {
+		return "", errors.New("Couldn't determine torrent ID in magnet upload response from AllDebrid")
+	}
+	c.logger.Debug("Finished adding magnet to AllDebrid", zap.String("torrentID", adID), zapFieldDebridSite)
+
+	query := url.Values{}
+	query.Set("id", adID)
+	resBytes, err = c.do(ctx, "GET", "/v4/magnet/status", apiKey, query)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't get magnet status from AllDebrid: %v", err)
+	}
+	link, err := selectLink(gjson.GetBytes(resBytes, "data.magnets.links").Array())
+	if err != nil {
+		return "", fmt.Errorf("Couldn't find proper link in magnet status: %v", err)
+	}
+
+	query = url.Values{}
+	query.Set("link", link)
+	resBytes, err = c.do(ctx, "GET", "/v4/link/unlock", apiKey, query)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't unlock link: %v", err)
+	}
+	streamURL := gjson.GetBytes(resBytes, "data.link").String()
+	if streamURL == "" {
+		return "", errors.New("AllDebrid responded with an empty unlocked link")
+	}
+	c.logger.Debug("Unlocked link", zap.String("unlockedLink", streamURL), zapFieldDebridSite)
+
+	return streamURL, nil
+}
+
+// do sends a request to the AllDebrid API and returns the response body if its status is "success".
+// For GET requests the data is sent as query, for POST requests as form.
+func (c *Client) do(ctx context.Context, method, path, apiKey string, data url.Values) ([]byte, error) {
+	query := url.Values{}
+	query.Set("agent", "deflix")
+	query.Set("apikey", apiKey)
+	var body io.Reader
+	if method == "GET" {
+		for key, values := range data {
+			query[key] = values
+		}
+	} else {
+		body = strings.NewReader(data.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create %v request: %v", method, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for headerKey, headerVal := range c.extraHeaders {
+		req.Header.Add(headerKey, headerVal)
+	}
+	// In case AllDebrid blocks requests based on the User-Agent
+	fakeVersion := strconv.Itoa(rand.Intn(10000))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0."+fakeVersion+".149 Safari/537.36")
+
+	// Not the URL, because it contains the API key
+	c.logger.Debug("Sending request to AllDebrid", zap.String("method", method), zap.String("path", path))
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send %v request: %v", method, err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read response body: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad HTTP response status: %v (%v request to '%v'; response body: '%s')", res.Status, method, path, resBody)
+	}
+	if gjson.GetBytes(resBody, "status").String() != "success" {
+		return nil, fmt.Errorf("Got error response from AllDebrid: %v", gjson.GetBytes(resBody, "error.message").String())
+	}
+	return resBody, nil
+}
+
+// selectLink returns the link of the biggest file.
+func selectLink(links []gjson.Result) (string, error) {
+	// Precondition check
+	if len(links) == 0 {
+		return "", errors.New("Empty slice of links")
+	}
+
+	var link string
+	var size int64
+	for _, res := range links {
+		if res.Get("size").Int() > size {
+			size = res.Get("size").Int()
+			link = res.Get("link").String()
+		}
+	}
+
+	if link == "" {
+		return "", errors.New("No link found")
+	}
+
+	return link, nil
+}
@@ -0,0 +1,96 @@
+package debrid
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	// Max number of info hashes per availability request.
+	// RealDebrid's instantAvailability endpoint takes one path segment per info hash and rejects too long URLs, and large requests are slow on all services.
+	AvailabilityBatchSize = 40
+	// Max number of concurrent availability requests for a single check
+	AvailabilityWorkers = 4
+)
+
+// AvailabilityBatches returns the max number of availability requests that a check of the given number of info hashes makes with AvailabilityBatchSize,
+// for counting them against rate limits.
+func AvailabilityBatches(infoHashes int) int {
+	return (infoHashes + AvailabilityBatchSize - 1) / AvailabilityBatchSize
+}
+
+// batchingResolver splits availability checks with many info hashes into batches, which are checked concurrently.
+type batchingResolver struct {
+	Resolver
+	batchSize int
+	workers   int
+}
+
+// WithBatching wraps the resolver so that availability checks with more than batchSize info hashes are split into batches,
+// of which up to the given number of workers are checked concurrently. The results are merged in the order of the batches.
+func WithBatching(resolver Resolver, batchSize, workers int) Resolver {
+	r := batchingResolver{
+		Resolver:  resolver,
+		batchSize: batchSize,
+		workers:   workers,
+	}
+	if _, ok := resolver.(FallibleChecker); ok {
+		return fallibleBatchingResolver{r}
+	}
+	return r
+}
+
+func (r batchingResolver) CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string {
+	// Errors can only occur if the wrapped resolver implements FallibleChecker, in which case they're handled by fallibleBatchingResolver's callers
+	result, _ := r.check(ctx, keyOrToken, infoHashes...)
+	return result
+}
+
+// check returns the merged results of all batches and the first error of a failed batch. The results of the other batches are kept.
+func (r batchingResolver) check(ctx context.Context, keyOrToken string, infoHashes ...string) ([]string, error) {
+	if len(infoHashes) <= r.batchSize {
+		return checkAvailability(ctx, r.Resolver, keyOrToken, infoHashes...)
+	}
+
+	var batches [][]string
+	for start := 0; start < len(infoHashes); start += r.batchSize {
+		end := start + r.batchSize
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+		batches = append(batches, infoHashes[start:end])
+	}
+	results := make([][]string, len(batches))
+	errs := make([]error, len(batches))
+	sem := make(chan struct{}, r.workers)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, batch []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = checkAvailability(ctx, r.Resolver, keyOrToken, batch...)
+		}(i, batch)
+	}
+	wg.Wait()
+
+	var result []string
+	var firstErr error
+	for i, batchResult := range results {
+		result = append(result, batchResult...)
+		if firstErr == nil {
+			firstErr = errs[i]
+		}
+	}
+	return result, firstErr
+}
+
+// fallibleBatchingResolver is a batchingResolver for a resolver that implements FallibleChecker.
+type fallibleBatchingResolver struct {
+	batchingResolver
+}
+
+func (r fallibleBatchingResolver) CheckInstantAvailabilityErr(ctx context.Context, keyOrToken string, infoHashes ...string) ([]string, error) {
+	return r.check(ctx, keyOrToken, infoHashes...)
+}
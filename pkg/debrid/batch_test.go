@@ -0,0 +1,77 @@
+package debrid
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingResolver reports every second info hash as available and records the batch sizes and the max number of concurrent checks.
+type countingResolver struct {
+	Resolver
+	lock          sync.Mutex
+	batchSizes    []int
+	running       int
+	maxConcurrent int
+}
+
+func (r *countingResolver) CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string {
+	r.lock.Lock()
+	r.batchSizes = append(r.batchSizes, len(infoHashes))
+	r.running++
+	if r.running > r.maxConcurrent {
+		r.maxConcurrent = r.running
+	}
+	r.lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	r.lock.Lock()
+	r.running--
+	r.lock.Unlock()
+
+	var result []string
+	for i := 0; i < len(infoHashes); i += 2 {
+		result = append(result, infoHashes[i])
+	}
+	return result
+}
+
+func TestWithBatching(t *testing.T) {
+	var infoHashes, expected []string
+	for i := 0; i < 100; i++ {
+		infoHashes = append(infoHashes, strconv.Itoa(i))
+		if i%2 == 0 {
+			expected = append(expected, strconv.Itoa(i))
+		}
+	}
+
+	// Not split up
+	counter := &countingResolver{}
+	result := WithBatching(counter, 100, 2).CheckInstantAvailability(context.Background(), "foo", infoHashes...)
+	require.Equal(t, expected, result)
+	require.Equal(t, []int{100}, counter.batchSizes)
+
+	// Batches of 10, checked by 3 workers, merged in order
+	counter = &countingResolver{}
+	result = WithBatching(counter, 10, 3).CheckInstantAvailability(context.Background(), "foo", infoHashes...)
+	require.Equal(t, expected, result)
+	require.Equal(t, []int{10, 10, 10, 10, 10, 10, 10, 10, 10, 10}, counter.batchSizes)
+	require.LessOrEqual(t, counter.maxConcurrent, 3)
+	require.Greater(t, counter.maxConcurrent, 1)
+
+	// Last batch is smaller
+	counter = &countingResolver{}
+	WithBatching(counter, 40, 4).CheckInstantAvailability(context.Background(), "foo", infoHashes...)
+	require.ElementsMatch(t, []int{40, 40, 20}, counter.batchSizes)
+}
+
+func TestAvailabilityBatches(t *testing.T) {
+	require.Equal(t, 0, AvailabilityBatches(0))
+	require.Equal(t, 1, AvailabilityBatches(1))
+	require.Equal(t, 1, AvailabilityBatches(AvailabilityBatchSize))
+	require.Equal(t, 2, AvailabilityBatches(AvailabilityBatchSize+1))
+	require.Equal(t, 3, AvailabilityBatches(100))
+}
@@ -0,0 +1,287 @@
+package debridlink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	debrid "github.com/deflix-tv/go-debrid"
+)
+
+type ClientOptions struct {
+	BaseURL      string
+	Timeout      time.Duration
+	CacheAge     time.Duration
+	ExtraHeaders []string
+}
+
+func NewClientOpts(baseURL string, timeout, cacheAge time.Duration, extraHeaders []string) ClientOptions {
+	return ClientOptions{
+		BaseURL:      baseURL,
+		Timeout:      timeout,
+		CacheAge:     cacheAge,
+		ExtraHeaders: extraHeaders,
+	}
+}
+
+var DefaultClientOpts = ClientOptions{
+	BaseURL:  "https://debrid-link.fr/api/v2",
+	Timeout:  5 * time.Second,
+	CacheAge: 24 * time.Hour,
+}
+
+// Client is a Debrid-Link client with the same methods as the RealDebrid, AllDebrid and Premiumize clients of go-debrid.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	// For API key validity
+	apiKeyCache debrid.Cache
+	// For info_hash instant availability
+	availabilityCache debrid.Cache
+	cacheAge          time.Duration
+	extraHeaders      map[string]string
+	logger            *zap.Logger
+}
+
+func NewClient(opts ClientOptions, apiKeyCache, availabilityCache debrid.Cache, logger *zap.Logger) (*Client, error) {
+	// Precondition check
+	if opts.BaseURL == "" {
+		return nil, errors.New("opts.BaseURL must not be empty")
+	}
+	extraHeaderMap := make(map[string]string, len(opts.ExtraHeaders))
+	for _, extraHeader := range opts.ExtraHeaders {
+		if extraHeader == "" {
+			continue
+		}
+		colonIndex := strings.Index(extraHeader, ":")
+		if colonIndex <= 0 || colonIndex == len(extraHeader)-1 {
+			return nil, errors.New("opts.ExtraHeaders elements must have a format like \"X-Foo: bar\"")
+		}
+		extraHeaderMap[extraHeader[:colonIndex]] = strings.TrimSpace(extraHeader[colonIndex+1:])
+	}
+
+	return &Client{
+		baseURL: opts.BaseURL,
+		httpClient: &http.Client{
+			Timeout: opts.Timeout,
+		},
+		apiKeyCache:       apiKeyCache,
+		availabilityCache: availabilityCache,
+		cacheAge:          opts.CacheAge,
+		extraHeaders:      extraHeaderMap,
+		logger:            logger,
+	}, nil
+}
+
+func (c *Client) TestAPIkey(ctx context.Context, apiKey string) error {
+	zapFieldDebridSite := zap.String("debridSite", "Debrid-Link")
+	zapFieldAPIkey := zap.String("apiKey", apiKey)
+	c.logger.Debug("Testing API key...", zapFieldDebridSite, zapFieldAPIkey)
+
+	// Check cache first.
+	// Note: Only when an API key is valid a cache item is created, because an invalid API key might become valid again soon when the user extends their premium status.
+	created, found, err := c.apiKeyCache.Get(apiKey)
+	if err != nil {
+		c.logger.Error("Couldn't decode API key cache item", zap.Error(err), zapFieldDebridSite, zapFieldAPIkey)
+	} else if !found {
+		c.logger.Debug("API key not found in cache", zapFieldDebridSite, zapFieldAPIkey)
+	} else if time.Since(created) > (24 * time.Hour) {
+		expiredSince := time.Since(created.Add(24 * time.Hour))
+		c.logger.Debug("API key cached as valid, but item is expired", zap.Duration("expiredSince", expiredSince), zapFieldDebridSite, zapFieldAPIkey)
+	} else {
+		c.logger.Debug("API key cached as valid", zapFieldDebridSite, zapFieldAPIkey)
+		return nil
+	}
+
+	resBytes, err := c.get(ctx, c.baseURL+"/account/infos", apiKey)
+	if err != nil {
+		return fmt.Errorf("Couldn't fetch account info from Debrid-Link with the provided API key: %v", err)
+	}
+	if !gjson.GetBytes(resBytes, "success").Bool() {
+		errMsg := gjson.GetBytes(resBytes, "error").String()
+		return fmt.Errorf("Got error response from Debrid-Link: %v", errMsg)
+	}
+	// 0 is a free account
+	if gjson.GetBytes(resBytes, "value.accountType").Int() == 0 {
+		return errors.New("Debrid-Link account isn't premium")
+	}
+
+	c.logger.Debug("API key OK", zapFieldDebridSite, zapFieldAPIkey)
+
+	// Create cache item
+	if err = c.apiKeyCache.Set(apiKey); err != nil {
+		c.logger.Error("Couldn't cache API key", zap.Error(err), zapFieldDebridSite, zapFieldAPIkey)
+	}
+
+	return nil
+}
+
+// CheckInstantAvailability returns the info hashes of the torrents that are instantly available. A failed check is only logged.
+func (c *Client) CheckInstantAvailability(ctx context.Context, apiKey string, infoHashes ...string) []string {
+	result, _ := c.CheckInstantAvailabilityErr(ctx, apiKey, infoHashes...)
+	return result
+}
+
+// CheckInstantAvailabilityErr is like CheckInstantAvailability, but also returns the error of a failed check,
+// together with the info hashes that are known to be available from the cache.
+func (c *Client) CheckInstantAvailabilityErr(ctx context.Context, apiKey string, infoHashes ...string) ([]string, error) {
+	result, err := c.checkInstantAvailability(ctx, apiKey, infoHashes...)
+	if err != nil {
+		c.logger.Error("Couldn't check instant availability", zap.Error(err), zap.String("debridSite", "Debrid-Link"), zap.String("apiKey", apiKey))
+	}
+	return result, err
+}
+
+func (c *Client) checkInstantAvailability(ctx context.Context, apiKey string, infoHashes ...string) ([]string, error) {
+	zapFieldDebridSite := zap.String("debridSite", "Debrid-Link")
+	zapFieldAPIkey := zap.String("apiKey", apiKey)
+
+	// Precondition check
+	if len(infoHashes) == 0 {
+		return nil, nil
+	}
+
+	// Only check the ones of which we don't know that they're valid (or which our knowledge that they're valid is older than the cache age).
+	// We don't cache unavailable ones, because that might change often!
+	var result []string
+	var unknownAvailabilityValues []string
+	for _, infoHash := range infoHashes {
+		created, found, err := c.availabilityCache.Get(infoHash)
+		if err != nil {
+			c.logger.Error("Couldn't decode availability cache item", zap.Error(err), zap.String("infoHash", infoHash), zapFieldDebridSite, zapFieldAPIkey)
+			unknownAvailabilityValues = append(unknownAvailabilityValues, infoHash)
+		} else if !found || time.Since(created) > c.cacheAge {
+			unknownAvailabilityValues = append(unknownAvailabilityValues, infoHash)
+		} else {
+			result = append(result, infoHash)
+		}
+	}
+	c.logger.Debug("Checked availability cache", zap.Int("cached", len(result)), zap.Int("unknown", len(unknownAvailabilityValues)), zapFieldDebridSite, zapFieldAPIkey)
+
+	// Only make HTTP request if we didn't find all hashes in the cache yet
+	if len(unknownAvailabilityValues) == 0 {
+		return result, nil
+	}
+	resBytes, err := c.get(ctx, c.baseURL+"/seedbox/cached?url="+url.QueryEscape(strings.Join(unknownAvailabilityValues, ",")), apiKey)
+	if err != nil {
+		return result, fmt.Errorf("Couldn't check torrents' instant availability on Debrid-Link: %v", err)
+	}
+	if !gjson.GetBytes(resBytes, "success").Bool() {
+		errMsg := gjson.GetBytes(resBytes, "error").String()
+		return result, fmt.Errorf("Got error response from Debrid-Link: %v", errMsg)
+	}
+	// The "value" object only contains the cached torrents, with the info_hash as key
+	cached := gjson.GetBytes(resBytes, "value").Map()
+	for _, infoHash := range unknownAvailabilityValues {
+		if _, ok := cached[strings.ToLower(infoHash)]; !ok {
+			if _, ok = cached[infoHash]; !ok {
+				continue
+			}
+		}
+		infoHash = strings.ToUpper(infoHash)
+		result = append(result, infoHash)
+		// Create cache item
+		if err = c.availabilityCache.Set(infoHash); err != nil {
+			c.logger.Error("Couldn't cache availability", zap.Error(err), zapFieldDebridSite, zapFieldAPIkey)
+		}
+	}
+	return result, nil
+}
+
+func (c *Client) GetStreamURL(ctx context.Context, magnetURL, apiKey string) (string, error) {
+	zapFieldDebridSite := zap.String("debridSite", "Debrid-Link")
+	zapFieldAPIkey := zap.String("apiKey", apiKey)
+	c.logger.Debug("Adding magnet to Debrid-Link...", zapFieldDebridSite, zapFieldAPIkey)
+	data := url.Values{}
+	data.Set("url", magnetURL)
+	data.Set("async", "true")
+	resBytes, err := c.post(ctx, c.baseURL+"/seedbox/add", apiKey, data)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't add magnet to Debrid-Link: %v", err)
+	}
+	if !gjson.GetBytes(resBytes, "success").Bool() {
+		errMsg := gjson.GetBytes(resBytes, "error").String()
+		return "", fmt.Errorf("Got error response from Debrid-Link: %v", errMsg)
+	}
+	c.logger.Debug("Finished adding magnet to Debrid-Link", zapFieldDebridSite, zapFieldAPIkey)
+	files := gjson.GetBytes(resBytes, "value.files").Array()
+	streamURL, err := selectLink(files)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't find proper link in torrent: %v", err)
+	}
+	c.logger.Debug("Created download link", zap.String("downloadLink", streamURL), zapFieldDebridSite, zapFieldAPIkey)
+
+	return streamURL, nil
+}
+
+func (c *Client) get(ctx context.Context, url, apiKey string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	return c.do(req, apiKey)
+}
+
+func (c *Client) post(ctx context.Context, url, apiKey string, data url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create POST request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req, apiKey)
+}
+
+func (c *Client) do(req *http.Request, apiKey string) ([]byte, error) {
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	for headerKey, headerVal := range c.extraHeaders {
+		req.Header.Add(headerKey, headerVal)
+	}
+
+	c.logger.Debug("Sending request to Debrid-Link", zap.String("method", req.Method), zap.String("url", req.URL.String()))
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send %v request: %v", req.Method, err)
+	}
+	defer res.Body.Close()
+
+	// Debrid-Link responds with a JSON body containing the error for most non-OK responses (like 401 for "badToken"), which the callers check.
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read response body: %v", err)
+	}
+	if res.StatusCode != http.StatusOK && !gjson.ValidBytes(resBody) {
+		return nil, fmt.Errorf("bad HTTP response status: %v (%v request to '%v')", res.Status, req.Method, req.URL)
+	}
+	return resBody, nil
+}
+
+// selectLink returns the download URL of the biggest file.
+func selectLink(files []gjson.Result) (string, error) {
+	// Precondition check
+	if len(files) == 0 {
+		return "", errors.New("Empty slice of files")
+	}
+
+	var link string
+	var size int64
+	for _, file := range files {
+		if file.Get("size").Int() > size {
+			size = file.Get("size").Int()
+			link = file.Get("downloadUrl").String()
+		}
+	}
+
+	if link == "" {
+		return "", errors.New("No link found")
+	}
+
+	return link, nil
+}
@@ -0,0 +1,66 @@
+package debrid
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	godebrid "github.com/deflix-tv/go-debrid"
+)
+
+// negativeCachingResolver caches which info hashes weren't instantly available, so that they're not checked again and again for obscure titles.
+type negativeCachingResolver struct {
+	Resolver
+	cache godebrid.Cache
+	ttl   time.Duration
+}
+
+// WithNegativeCache wraps the resolver so that info hashes that weren't instantly available aren't checked again for the TTL.
+// The availability of a torrent can change any time, for example when another user downloads it, so the TTL should be short.
+// The cache is shared by all users, so nothing is cached when the check failed, which requires the resolver to implement FallibleChecker.
+// For other resolvers nothing is cached when the result is empty, because that can also be a failed check.
+func WithNegativeCache(resolver Resolver, cache godebrid.Cache, ttl time.Duration) Resolver {
+	return negativeCachingResolver{
+		Resolver: resolver,
+		cache:    cache,
+		ttl:      ttl,
+	}
+}
+
+func (r negativeCachingResolver) CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string {
+	var unknownInfoHashes []string
+	for _, infoHash := range infoHashes {
+		// Errors are treated like cache misses
+		if created, found, err := r.cache.Get(strings.ToUpper(infoHash)); err == nil && found && time.Since(created) < r.ttl {
+			continue
+		}
+		unknownInfoHashes = append(unknownInfoHashes, infoHash)
+	}
+	if len(unknownInfoHashes) == 0 {
+		return nil
+	}
+
+	var result []string
+	var err error
+	if checker, ok := r.Resolver.(FallibleChecker); ok {
+		result, err = checker.CheckInstantAvailabilityErr(ctx, keyOrToken, unknownInfoHashes...)
+	} else if result = r.Resolver.CheckInstantAvailability(ctx, keyOrToken, unknownInfoHashes...); len(result) == 0 {
+		err = ErrUnconfirmed
+	}
+	// A failed or canceled check only contains the cached results, so the missing info hashes aren't necessarily unavailable
+	if err != nil || ctx.Err() != nil {
+		return result
+	}
+	available := make(map[string]struct{}, len(result))
+	for _, infoHash := range result {
+		available[strings.ToUpper(infoHash)] = struct{}{}
+	}
+	for _, infoHash := range unknownInfoHashes {
+		infoHash = strings.ToUpper(infoHash)
+		if _, ok := available[infoHash]; !ok {
+			// Only an optimization, so errors are ignored
+			_ = r.cache.Set(infoHash)
+		}
+	}
+	return result
+}
@@ -0,0 +1,96 @@
+package debrid
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	godebrid "github.com/deflix-tv/go-debrid"
+	"github.com/stretchr/testify/require"
+)
+
+// fixedResolver reports the given info hashes as available and records the checked ones.
+type fixedResolver struct {
+	Resolver
+	available []string
+	checked   [][]string
+}
+
+func (r *fixedResolver) CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string {
+	r.checked = append(r.checked, infoHashes)
+	var result []string
+	for _, infoHash := range infoHashes {
+		for _, available := range r.available {
+			if infoHash == available {
+				result = append(result, infoHash)
+			}
+		}
+	}
+	return result
+}
+
+func TestWithNegativeCache(t *testing.T) {
+	inner := &fixedResolver{available: []string{"aaa"}}
+	cache := godebrid.NewInMemoryCache()
+	resolver := WithNegativeCache(inner, cache, time.Hour)
+	ctx := context.Background()
+
+	require.Equal(t, []string{"aaa"}, resolver.CheckInstantAvailability(ctx, "foo", "aaa", "bbb", "ccc"))
+	// Unavailable ones aren't checked again, independent of the case
+	require.Equal(t, []string{"aaa"}, resolver.CheckInstantAvailability(ctx, "foo", "aaa", "BBB", "ddd"))
+	require.Equal(t, [][]string{{"aaa", "bbb", "ccc"}, {"aaa", "ddd"}}, inner.checked)
+	require.Empty(t, resolver.CheckInstantAvailability(ctx, "foo", "bbb", "ccc"))
+	require.Len(t, inner.checked, 2)
+
+	// Expired
+	resolver = WithNegativeCache(inner, cache, time.Nanosecond)
+	resolver.CheckInstantAvailability(ctx, "foo", "bbb")
+	require.Len(t, inner.checked, 3)
+
+	// Canceled checks aren't cached
+	inner = &fixedResolver{}
+	resolver = WithNegativeCache(inner, cache, time.Hour)
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	resolver.CheckInstantAvailability(canceledCtx, "foo", "eee")
+	resolver.CheckInstantAvailability(ctx, "foo", "eee")
+	require.Equal(t, [][]string{{"eee"}, {"eee"}}, inner.checked)
+}
+
+// failingResolver is a fixedResolver whose checks fail while err is set.
+type failingResolver struct {
+	fixedResolver
+	err error
+}
+
+func (r *failingResolver) CheckInstantAvailabilityErr(ctx context.Context, keyOrToken string, infoHashes ...string) ([]string, error) {
+	if r.err != nil {
+		r.checked = append(r.checked, infoHashes)
+		return nil, r.err
+	}
+	return r.fixedResolver.CheckInstantAvailability(ctx, keyOrToken, infoHashes...), nil
+}
+
+func TestWithNegativeCacheFailedCheck(t *testing.T) {
+	ctx := context.Background()
+
+	// Failed checks aren't cached, also when they're split into batches
+	inner := &failingResolver{err: errors.New("429 Too Many Requests")}
+	resolver := WithNegativeCache(WithBatching(inner, 2, 1), godebrid.NewInMemoryCache(), time.Hour)
+	require.Empty(t, resolver.CheckInstantAvailability(ctx, "foo", "aaa", "bbb", "ccc"))
+	inner.err = nil
+	inner.available = []string{"aaa"}
+	require.Equal(t, []string{"aaa"}, resolver.CheckInstantAvailability(ctx, "foo", "aaa", "bbb", "ccc"))
+	require.Equal(t, [][]string{{"aaa", "bbb"}, {"ccc"}, {"aaa", "bbb"}, {"ccc"}}, inner.checked)
+	// Successful checks are cached
+	resolver.CheckInstantAvailability(ctx, "foo", "bbb", "ccc")
+	require.Len(t, inner.checked, 4)
+
+	// Without FallibleChecker an empty result can be a failed check
+	empty := &fixedResolver{}
+	resolver = WithNegativeCache(empty, godebrid.NewInMemoryCache(), time.Hour)
+	resolver.CheckInstantAvailability(ctx, "foo", "aaa")
+	resolver.CheckInstantAvailability(ctx, "foo", "aaa")
+	require.Len(t, empty.checked, 2)
+}
@@ -0,0 +1,280 @@
+package premiumize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	debrid "github.com/deflix-tv/go-debrid"
+)
+
+type ClientOptions struct {
+	BaseURL      string
+	Timeout      time.Duration
+	CacheAge     time.Duration
+	ExtraHeaders []string
+	// When setting this to true, the user's original IP address is read from the context parameter with the key "debrid_originIP".
+	ForwardOriginIP bool
+}
+
+func NewClientOpts(baseURL string, timeout, cacheAge time.Duration, extraHeaders []string, forwardOriginIP bool) ClientOptions {
+	return ClientOptions{
+		BaseURL:         baseURL,
+		Timeout:         timeout,
+		CacheAge:        cacheAge,
+		ExtraHeaders:    extraHeaders,
+		ForwardOriginIP: forwardOriginIP,
+	}
+}
+
+var DefaultClientOpts = ClientOptions{
+	BaseURL:  "https://www.premiumize.me/api",
+	Timeout:  5 * time.Second,
+	CacheAge: 24 * time.Hour,
+}
+
+// Client is a Premiumize client with the same methods as the one of go-debrid.
+// Unlike that one it sends all requests with the context.
+// If the context has a value for the key "debrid_OAUTH2", the key or token is sent as OAuth2 access token instead of as API key.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	// For API key validity
+	apiKeyCache debrid.Cache
+	// For info_hash instant availability
+	availabilityCache debrid.Cache
+	cacheAge          time.Duration
+	extraHeaders      map[string]string
+	forwardOriginIP   bool
+	logger            *zap.Logger
+}
+
+func NewClient(opts ClientOptions, apiKeyCache, availabilityCache debrid.Cache, logger *zap.Logger) (*Client, error) {
+	// Precondition check
+	if opts.BaseURL == "" {
+		return nil, errors.New("opts.BaseURL must not be empty")
+	}
+	extraHeaderMap := make(map[string]string, len(opts.ExtraHeaders))
+	for _, extraHeader := range opts.ExtraHeaders {
+		if extraHeader == "" {
+			continue
+		}
+		colonIndex := strings.Index(extraHeader, ":")
+		if colonIndex <= 0 || colonIndex == len(extraHeader)-1 {
+			return nil, errors.New("opts.ExtraHeaders elements must have a format like \"X-Foo: bar\"")
+		}
+		extraHeaderMap[extraHeader[:colonIndex]] = strings.TrimSpace(extraHeader[colonIndex+1:])
+	}
+
+	return &Client{
+		baseURL: opts.BaseURL,
+		httpClient: &http.Client{
+			Timeout: opts.Timeout,
+		},
+		apiKeyCache:       apiKeyCache,
+		availabilityCache: availabilityCache,
+		cacheAge:          opts.CacheAge,
+		extraHeaders:      extraHeaderMap,
+		forwardOriginIP:   opts.ForwardOriginIP,
+		logger:            logger,
+	}, nil
+}
+
+func (c *Client) TestAPIkey(ctx context.Context, keyOrToken string) error {
+	zapFieldDebridSite := zap.String("debridSite", "Premiumize")
+	c.logger.Debug("Testing API key...", zapFieldDebridSite)
+
+	// Check cache first.
+	// Note: Only when an API key is valid a cache item is created, because an invalid API key might become valid again soon when the user extends their subscription.
+	created, found, err := c.apiKeyCache.Get(keyOrToken)
+	if err != nil {
+		c.logger.Error("Couldn't decode API key cache item", zap.Error(err), zapFieldDebridSite)
+	} else if !found {
+		c.logger.Debug("API key not found in cache", zapFieldDebridSite)
+	} else if time.Since(created) > (24 * time.Hour) {
+		expiredSince := time.Since(created.Add(24 * time.Hour))
+		c.logger.Debug("API key cached as valid, but item is expired", zap.Duration("expiredSince", expiredSince), zapFieldDebridSite)
+	} else {
+		c.logger.Debug("API key cached as valid", zapFieldDebridSite)
+		return nil
+	}
+
+	if _, err = c.do(ctx, "GET", "/account/info", keyOrToken, nil, nil); err != nil {
+		return fmt.Errorf("Couldn't fetch account info from Premiumize with the provided API key: %v", err)
+	}
+
+	c.logger.Debug("API key OK", zapFieldDebridSite)
+
+	// Create cache item
+	if err = c.apiKeyCache.Set(keyOrToken); err != nil {
+		c.logger.Error("Couldn't cache API key", zap.Error(err), zapFieldDebridSite)
+	}
+
+	return nil
+}
+
+// CheckInstantAvailability returns the info hashes of the torrents that are instantly available. A failed check is only logged.
+func (c *Client) CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string {
+	result, _ := c.CheckInstantAvailabilityErr(ctx, keyOrToken, infoHashes...)
+	return result
+}
+
+// CheckInstantAvailabilityErr is like CheckInstantAvailability, but also returns the error of a failed check,
+// together with the info hashes that are known to be available from the cache.
+func (c *Client) CheckInstantAvailabilityErr(ctx context.Context, keyOrToken string, infoHashes ...string) ([]string, error) {
+	result, err := c.checkInstantAvailability(ctx, keyOrToken, infoHashes...)
+	if err != nil {
+		c.logger.Error("Couldn't check instant availability", zap.Error(err), zap.String("debridSite", "Premiumize"))
+	}
+	return result, err
+}
+
+func (c *Client) checkInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) ([]string, error) {
+	zapFieldDebridSite := zap.String("debridSite", "Premiumize")
+
+	// Precondition check
+	if len(infoHashes) == 0 {
+		return nil, nil
+	}
+
+	// Only check the ones of which we don't know that they're valid (or which our knowledge that they're valid is older than the cache age).
+	// We don't cache unavailable ones, because that might change often!
+	var result []string
+	var unknownAvailabilityValues []string
+	for _, infoHash := range infoHashes {
+		created, found, err := c.availabilityCache.Get(infoHash)
+		if err != nil {
+			c.logger.Error("Couldn't decode availability cache item", zap.Error(err), zap.String("infoHash", infoHash), zapFieldDebridSite)
+			unknownAvailabilityValues = append(unknownAvailabilityValues, infoHash)
+		} else if !found || time.Since(created) > c.cacheAge {
+			unknownAvailabilityValues = append(unknownAvailabilityValues, infoHash)
+		} else {
+			result = append(result, infoHash)
+		}
+	}
+	c.logger.Debug("Checked availability cache", zap.Int("cached", len(result)), zap.Int("unknown", len(unknownAvailabilityValues)), zapFieldDebridSite)
+
+	// Only make HTTP request if we didn't find all hashes in the cache yet
+	if len(unknownAvailabilityValues) == 0 {
+		return result, nil
+	}
+	// Premiumize expects the items in the query, even for this POST request
+	resBytes, err := c.do(ctx, "POST", "/cache/check", keyOrToken, url.Values{"items[]": unknownAvailabilityValues}, nil)
+	if err != nil {
+		return result, fmt.Errorf("Couldn't check torrents' instant availability on Premiumize: %v", err)
+	}
+	// The response is a list of booleans in the order of the requested items
+	for i, available := range gjson.GetBytes(resBytes, "response").Array() {
+		if !available.Bool() || i >= len(unknownAvailabilityValues) {
+			continue
+		}
+		infoHash := strings.ToUpper(unknownAvailabilityValues[i])
+		result = append(result, infoHash)
+		// Create cache item
+		if err = c.availabilityCache.Set(infoHash); err != nil {
+			c.logger.Error("Couldn't cache availability", zap.Error(err), zapFieldDebridSite)
+		}
+	}
+	return result, nil
+}
+
+// GetStreamURL creates a direct download link for the largest file of the torrent.
+func (c *Client) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string) (string, error) {
+	zapFieldDebridSite := zap.String("debridSite", "Premiumize")
+	c.logger.Debug("Adding magnet to Premiumize...", zapFieldDebridSite)
+	data := url.Values{}
+	data.Set("src", magnetURL)
+	// Different from RealDebrid, Premiumize asks for the original IP only for directdl requests
+	if ip, ok := ctx.Value("debrid_originIP").(string); c.forwardOriginIP && ok {
+		data.Set("download_ip", ip)
+	}
+	resBytes, err := c.do(ctx, "POST", "/transfer/directdl", keyOrToken, nil, data)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't add magnet to Premiumize: %v", err)
+	}
+	ddlLink, err := selectLink(gjson.GetBytes(resBytes, "content").Array())
+	if err != nil {
+		return "", fmt.Errorf("Couldn't find proper link in Premiumize response: %v", err)
+	}
+	c.logger.Debug("Created direct download link", zap.String("ddlLink", ddlLink), zapFieldDebridSite)
+
+	return ddlLink, nil
+}
+
+// do sends a request to the Premiumize API and returns the response body if its status is "success".
+// The query is sent in the URL and the form as body.
+func (c *Client) do(ctx context.Context, method, path, keyOrToken string, query, form url.Values) ([]byte, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if ctx.Value("debrid_OAUTH2") != nil {
+		query.Set("access_token", keyOrToken)
+	} else {
+		query.Set("apikey", keyOrToken)
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create %v request: %v", method, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for headerKey, headerVal := range c.extraHeaders {
+		req.Header.Add(headerKey, headerVal)
+	}
+
+	// Not the URL, because it contains the API key or token
+	c.logger.Debug("Sending request to Premiumize", zap.String("method", method), zap.String("path", path))
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send %v request: %v", method, err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read response body: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad HTTP response status: %v (%v request to '%v'; response body: '%s')", res.Status, method, path, resBody)
+	}
+	if gjson.GetBytes(resBody, "status").String() != "success" {
+		return nil, fmt.Errorf("Got error response from Premiumize: %v", gjson.GetBytes(resBody, "message").String())
+	}
+	return resBody, nil
+}
+
+// selectLink returns the link of the biggest file.
+func selectLink(content []gjson.Result) (string, error) {
+	// Precondition check
+	if len(content) == 0 {
+		return "", errors.New("Empty slice of content")
+	}
+
+	var link string
+	var size int64
+	for _, res := range content {
+		if res.Get("size").Int() > size {
+			size = res.Get("size").Int()
+			link = res.Get("link").String()
+		}
+	}
+
+	if link == "" {
+		return "", errors.New("No link found")
+	}
+
+	return link, nil
+}
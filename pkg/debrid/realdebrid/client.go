@@ -0,0 +1,347 @@
+package realdebrid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	debrid "github.com/deflix-tv/go-debrid"
+)
+
+type ClientOptions struct {
+	BaseURL      string
+	Timeout      time.Duration
+	CacheAge     time.Duration
+	ExtraHeaders []string
+	// When setting this to true, the user's original IP address is read from the context parameter with the key "debrid_originIP".
+	ForwardOriginIP bool
+}
+
+func NewClientOpts(baseURL string, timeout, cacheAge time.Duration, extraHeaders []string, forwardOriginIP bool) ClientOptions {
+	return ClientOptions{
+		BaseURL:         baseURL,
+		Timeout:         timeout,
+		CacheAge:        cacheAge,
+		ExtraHeaders:    extraHeaders,
+		ForwardOriginIP: forwardOriginIP,
+	}
+}
+
+var DefaultClientOpts = ClientOptions{
+	BaseURL:  "https://api.real-debrid.com",
+	Timeout:  5 * time.Second,
+	CacheAge: 24 * time.Hour,
+}
+
+// Client is a RealDebrid client with the same methods as the one of go-debrid.
+// Unlike that one it sends all requests with the context and stops waiting for downloads when the context is canceled.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	// For API token validity
+	tokenCache debrid.Cache
+	// For info_hash instant availability
+	availabilityCache debrid.Cache
+	cacheAge          time.Duration
+	extraHeaders      map[string]string
+	forwardOriginIP   bool
+	logger            *zap.Logger
+}
+
+func NewClient(opts ClientOptions, tokenCache, availabilityCache debrid.Cache, logger *zap.Logger) (*Client, error) {
+	// Precondition check
+	if opts.BaseURL == "" {
+		return nil, errors.New("opts.BaseURL must not be empty")
+	}
+	extraHeaderMap := make(map[string]string, len(opts.ExtraHeaders))
+	for _, extraHeader := range opts.ExtraHeaders {
+		if extraHeader == "" {
+			continue
+		}
+		colonIndex := strings.Index(extraHeader, ":")
+		if colonIndex <= 0 || colonIndex == len(extraHeader)-1 {
+			return nil, errors.New("opts.ExtraHeaders elements must have a format like \"X-Foo: bar\"")
+		}
+		extraHeaderMap[extraHeader[:colonIndex]] = strings.TrimSpace(extraHeader[colonIndex+1:])
+	}
+
+	return &Client{
+		baseURL: opts.BaseURL,
+		httpClient: &http.Client{
+			Timeout: opts.Timeout,
+		},
+		tokenCache:        tokenCache,
+		availabilityCache: availabilityCache,
+		cacheAge:          opts.CacheAge,
+		extraHeaders:      extraHeaderMap,
+		forwardOriginIP:   opts.ForwardOriginIP,
+		logger:            logger,
+	}, nil
+}
+
+func (c *Client) TestToken(ctx context.Context, token string) error {
+	zapFieldDebridSite := zap.String("debridSite", "RealDebrid")
+	c.logger.Debug("Testing token...", zapFieldDebridSite)
+
+	// Check cache first.
+	// Note: Only when a token is valid a cache item is created, because an invalid token might become valid again soon when the user extends their premium status.
+	created, found, err := c.tokenCache.Get(token)
+	if err != nil {
+		c.logger.Error("Couldn't decode token cache item", zap.Error(err), zapFieldDebridSite)
+	} else if !found {
+		c.logger.Debug("Token not found in cache", zapFieldDebridSite)
+	} else if time.Since(created) > (24 * time.Hour) {
+		expiredSince := time.Since(created.Add(24 * time.Hour))
+		c.logger.Debug("Token cached as valid, but item is expired", zap.Duration("expiredSince", expiredSince), zapFieldDebridSite)
+	} else {
+		c.logger.Debug("Token cached as valid", zapFieldDebridSite)
+		return nil
+	}
+
+	resBytes, err := c.get(ctx, c.baseURL+"/rest/1.0/user", token)
+	if err != nil {
+		return fmt.Errorf("Couldn't fetch user info from RealDebrid with the provided token: %v", err)
+	}
+	if !gjson.GetBytes(resBytes, "id").Exists() {
+		return errors.New("Couldn't parse user info response from RealDebrid")
+	}
+
+	c.logger.Debug("Token OK", zapFieldDebridSite)
+
+	// Create cache item
+	if err = c.tokenCache.Set(token); err != nil {
+		c.logger.Error("Couldn't cache token", zap.Error(err), zapFieldDebridSite)
+	}
+
+	return nil
+}
+
+// CheckInstantAvailability returns the info hashes of the torrents that are instantly available. A failed check is only logged.
+func (c *Client) CheckInstantAvailability(ctx context.Context, token string, infoHashes ...string) []string {
+	result, _ := c.CheckInstantAvailabilityErr(ctx, token, infoHashes...)
+	return result
+}
+
+// CheckInstantAvailabilityErr is like CheckInstantAvailability, but also returns the error of a failed check,
+// together with the info hashes that are known to be available from the cache.
+func (c *Client) CheckInstantAvailabilityErr(ctx context.Context, token string, infoHashes ...string) ([]string, error) {
+	result, err := c.checkInstantAvailability(ctx, token, infoHashes...)
+	if err != nil {
+		c.logger.Error("Couldn't check instant availability", zap.Error(err), zap.String("debridSite", "RealDebrid"))
+	}
+	return result, err
+}
+
+func (c *Client) checkInstantAvailability(ctx context.Context, token string, infoHashes ...string) ([]string, error) {
+	zapFieldDebridSite := zap.String("debridSite", "RealDebrid")
+
+	// Precondition check
+	if len(infoHashes) == 0 {
+		return nil, nil
+	}
+
+	// Only check the ones of which we don't know that they're valid (or which our knowledge that they're valid is older than the cache age).
+	// We don't cache unavailable ones, because that might change often!
+	var result []string
+	var unknownAvailabilityValues []string
+	for _, infoHash := range infoHashes {
+		created, found, err := c.availabilityCache.Get(infoHash)
+		if err != nil {
+			c.logger.Error("Couldn't decode availability cache item", zap.Error(err), zap.String("infoHash", infoHash), zapFieldDebridSite)
+			unknownAvailabilityValues = append(unknownAvailabilityValues, infoHash)
+		} else if !found || time.Since(created) > c.cacheAge {
+			unknownAvailabilityValues = append(unknownAvailabilityValues, infoHash)
+		} else {
+			result = append(result, infoHash)
+		}
+	}
+	c.logger.Debug("Checked availability cache", zap.Int("cached", len(result)), zap.Int("unknown", len(unknownAvailabilityValues)), zapFieldDebridSite)
+
+	// Only make HTTP request if we didn't find all hashes in the cache yet
+	if len(unknownAvailabilityValues) == 0 {
+		return result, nil
+	}
+	resBytes, err := c.get(ctx, c.baseURL+"/rest/1.0/torrents/instantAvailability/"+strings.Join(unknownAvailabilityValues, "/"), token)
+	if err != nil {
+		return result, fmt.Errorf("Couldn't check torrents' instant availability on RealDebrid: %v", err)
+	}
+	// Note: This iterates through all elements with the key being the info_hash
+	gjson.ParseBytes(resBytes).ForEach(func(key gjson.Result, value gjson.Result) bool {
+		// If something was found we can assume the instantly available file of the torrent is the streamable video
+		if len(value.Get("rd").Array()) == 0 {
+			return true
+		}
+		infoHash := strings.ToUpper(key.String())
+		result = append(result, infoHash)
+		// Create cache item
+		if err = c.availabilityCache.Set(infoHash); err != nil {
+			c.logger.Error("Couldn't cache availability", zap.Error(err), zapFieldDebridSite)
+		}
+		return true
+	})
+	return result, nil
+}
+
+// GetStreamURL adds the torrent to RealDebrid, selects its largest file and unrestricts the download link.
+// It waits up to 5 seconds for RealDebrid to download the torrent, or until the context is canceled.
+// remote leads to a stream URL for the remote traffic of the account.
+func (c *Client) GetStreamURL(ctx context.Context, magnetURL, token string, remote bool) (string, error) {
+	zapFieldDebridSite := zap.String("debridSite", "RealDebrid")
+	c.logger.Debug("Adding torrent to RealDebrid...", zapFieldDebridSite)
+	data := url.Values{}
+	data.Set("magnet", magnetURL)
+	resBytes, err := c.post(ctx, c.baseURL+"/rest/1.0/torrents/addMagnet", token, data)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't add torrent to RealDebrid: %v", err)
+	}
+	torrentID := gjson.GetBytes(resBytes, "id").String()
+	if torrentID == "" {
+		return "", errors.New("Couldn't add torrent to RealDebrid: response body doesn't contain \"id\" key")
+	}
+	c.logger.Debug("Finished adding torrent to RealDebrid", zap.String("torrentID", torrentID), zapFieldDebridSite)
+
+	// The info URL is built with the configured base URL instead of using the "uri" of the response, because the base URL could be a proxy that we want to go through
+	infoURL := c.baseURL + "/rest/1.0/torrents/info/" + torrentID
+	resBytes, err = c.get(ctx, infoURL, token)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't get torrent info from RealDebrid: %v", err)
+	}
+	fileID, err := selectFileID(gjson.GetBytes(resBytes, "files").Array())
+	if err != nil {
+		return "", fmt.Errorf("Couldn't find proper file in torrent: %v", err)
+	}
+	data = url.Values{}
+	data.Set("files", strconv.FormatInt(fileID, 10))
+	if _, err = c.post(ctx, c.baseURL+"/rest/1.0/torrents/selectFiles/"+torrentID, token, data); err != nil {
+		return "", fmt.Errorf("Couldn't add torrent to RealDebrid downloads: %v", err)
+	}
+
+	// Possible status: magnet_error, magnet_conversion, waiting_files_selection, queued, downloading, downloaded, error, virus, compressing, uploading, dead
+	const maxPolls = 5
+	for polls := 0; ; polls++ {
+		resBytes, err = c.get(ctx, infoURL, token)
+		if err != nil {
+			return "", fmt.Errorf("Couldn't get torrent info from RealDebrid: %v", err)
+		}
+		torrentStatus := gjson.GetBytes(resBytes, "status").String()
+		if torrentStatus == "downloaded" {
+			break
+		}
+		switch torrentStatus {
+		case "magnet_error", "error", "virus", "dead":
+			return "", fmt.Errorf("Bad torrent status: %v", torrentStatus)
+		}
+		if polls == maxPolls {
+			return "", fmt.Errorf("Torrent still %v on RealDebrid after waiting for %v seconds", torrentStatus, maxPolls)
+		}
+		c.logger.Debug("Waiting for download...", zap.String("torrentStatus", torrentStatus), zapFieldDebridSite)
+		timer := time.NewTimer(time.Second)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		case <-timer.C:
+		}
+	}
+	links := gjson.GetBytes(resBytes, "links").Array()
+	if len(links) == 0 {
+		return "", errors.New("RealDebrid didn't return a link for the downloaded torrent")
+	}
+
+	data = url.Values{}
+	data.Set("link", links[0].String())
+	if remote {
+		data.Set("remote", "1")
+	}
+	resBytes, err = c.post(ctx, c.baseURL+"/rest/1.0/unrestrict/link", token, data)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't unrestrict link: %v", err)
+	}
+	streamURL := gjson.GetBytes(resBytes, "download").String()
+	if streamURL == "" {
+		return "", errors.New("RealDebrid responded with an empty download link")
+	}
+	c.logger.Debug("Unrestricted link", zap.String("unrestrictedLink", streamURL), zapFieldDebridSite)
+
+	return streamURL, nil
+}
+
+func (c *Client) get(ctx context.Context, url, token string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	return c.do(req, token)
+}
+
+func (c *Client) post(ctx context.Context, url, token string, data url.Values) ([]byte, error) {
+	// Different from Premiumize, RealDebrid asks for the original IP for all POST requests
+	if ip, ok := ctx.Value("debrid_originIP").(string); c.forwardOriginIP && ok {
+		data.Set("ip", ip)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create POST request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req, token)
+}
+
+func (c *Client) do(req *http.Request, token string) ([]byte, error) {
+	req.Header.Set("Authorization", "Bearer "+token)
+	for headerKey, headerVal := range c.extraHeaders {
+		req.Header.Add(headerKey, headerVal)
+	}
+
+	c.logger.Debug("Sending request to RealDebrid", zap.String("method", req.Method), zap.String("url", req.URL.String()))
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send %v request: %v", req.Method, err)
+	}
+	defer res.Body.Close()
+
+	// Different RealDebrid API endpoints respond with different success status codes
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusNoContent {
+		if res.StatusCode == http.StatusUnauthorized {
+			return nil, errors.New("Invalid token")
+		} else if res.StatusCode == http.StatusForbidden {
+			return nil, errors.New("Account locked")
+		}
+		resBody, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("bad HTTP response status: %v (%v request to '%v'; response body: '%s')", res.Status, req.Method, req.URL, resBody)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// selectFileID returns the ID of the biggest file.
+func selectFileID(files []gjson.Result) (int64, error) {
+	// Precondition check
+	if len(files) == 0 {
+		return 0, errors.New("Empty slice of files")
+	}
+
+	var fileID int64
+	var size int64
+	for _, file := range files {
+		if file.Get("bytes").Int() > size {
+			size = file.Get("bytes").Int()
+			fileID = file.Get("id").Int()
+		}
+	}
+
+	// IDs start with 1
+	if fileID == 0 {
+		return 0, errors.New("No file ID found")
+	}
+
+	return fileID, nil
+}
@@ -0,0 +1,122 @@
+// Package debrid contains the interface that the addon uses for all debrid services, so that the handlers don't depend on the concrete clients.
+package debrid
+
+import (
+	"context"
+	"errors"
+
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/alldebrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/debridlink"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/premiumize"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/realdebrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/torbox"
+)
+
+// Resolver is a debrid service that can check the instant availability of torrents and convert them into stream URLs.
+type Resolver interface {
+	// TestCreds returns an error if the API key or token is invalid.
+	TestCreds(ctx context.Context, keyOrToken string) error
+	// CheckInstantAvailability returns the info hashes of the torrents that are instantly available.
+	// Errors are only logged, so an empty result can also mean that the check failed. See FallibleChecker for telling them apart.
+	CheckInstantAvailability(ctx context.Context, keyOrToken string, infoHashes ...string) []string
+	// GetStreamURL converts the magnet URL into a stream URL.
+	// For TV show episodes season and episode are > 0, so that resolvers that support it can select the episode's file in season packs. The others stream the largest file.
+	// remote is only supported by RealDebrid, where it leads to a stream URL for the remote traffic of the account, and ignored by the other services.
+	GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, season, episode int, remote bool) (string, error)
+}
+
+// FallibleChecker is implemented by resolvers whose availability checks report failures.
+// The wrappers in this package implement it when the wrapped resolver does.
+type FallibleChecker interface {
+	// CheckInstantAvailabilityErr is like CheckInstantAvailability, but returns an error if the check failed.
+	// The result then only contains the info hashes that are known to be available, for example from a cache.
+	CheckInstantAvailabilityErr(ctx context.Context, keyOrToken string, infoHashes ...string) ([]string, error)
+}
+
+// ErrUnconfirmed is returned for an empty availability result of resolvers that don't implement FallibleChecker, because they only log failed checks.
+// So it can mean that none of the torrents are available or that the check failed.
+var ErrUnconfirmed = errors.New("Empty availability result, which can also be a failed check")
+
+// checkAvailability calls CheckInstantAvailabilityErr if the resolver implements FallibleChecker, and otherwise CheckInstantAvailability without ever returning an error.
+func checkAvailability(ctx context.Context, resolver Resolver, keyOrToken string, infoHashes ...string) ([]string, error) {
+	if checker, ok := resolver.(FallibleChecker); ok {
+		return checker.CheckInstantAvailabilityErr(ctx, keyOrToken, infoHashes...)
+	}
+	return resolver.CheckInstantAvailability(ctx, keyOrToken, infoHashes...), nil
+}
+
+// Registry maps the IDs of the debrid services ("rd", "ad", "pm", "dl" and "tb") to their resolvers.
+type Registry map[string]Resolver
+
+// NewRegistry creates a registry with all debrid services that the addon supports.
+// Their availability checks are batched with AvailabilityBatchSize and AvailabilityWorkers.
+// All clients send their requests with the context, so canceling it cancels the requests.
+func NewRegistry(rdClient *realdebrid.Client, adClient *alldebrid.Client, pmClient *premiumize.Client, dlClient *debridlink.Client, tbClient *torbox.Client) Registry {
+	return Registry{
+		"rd": WithBatching(realDebrid{rdClient}, AvailabilityBatchSize, AvailabilityWorkers),
+		"ad": WithBatching(allDebrid{adClient}, AvailabilityBatchSize, AvailabilityWorkers),
+		"pm": WithBatching(premiumizeResolver{pmClient}, AvailabilityBatchSize, AvailabilityWorkers),
+		"dl": WithBatching(debridLink{dlClient}, AvailabilityBatchSize, AvailabilityWorkers),
+		"tb": WithBatching(torboxResolver{tbClient}, AvailabilityBatchSize, AvailabilityWorkers),
+	}
+}
+
+type realDebrid struct {
+	*realdebrid.Client
+}
+
+func (r realDebrid) TestCreds(ctx context.Context, keyOrToken string) error {
+	return r.TestToken(ctx, keyOrToken)
+}
+
+func (r realDebrid) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, _, _ int, remote bool) (string, error) {
+	return r.Client.GetStreamURL(ctx, magnetURL, keyOrToken, remote)
+}
+
+type allDebrid struct {
+	*alldebrid.Client
+}
+
+func (r allDebrid) TestCreds(ctx context.Context, keyOrToken string) error {
+	return r.TestAPIkey(ctx, keyOrToken)
+}
+
+func (r allDebrid) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, _, _ int, _ bool) (string, error) {
+	return r.Client.GetStreamURL(ctx, magnetURL, keyOrToken)
+}
+
+type premiumizeResolver struct {
+	*premiumize.Client
+}
+
+func (r premiumizeResolver) TestCreds(ctx context.Context, keyOrToken string) error {
+	return r.TestAPIkey(ctx, keyOrToken)
+}
+
+func (r premiumizeResolver) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, _, _ int, _ bool) (string, error) {
+	return r.Client.GetStreamURL(ctx, magnetURL, keyOrToken)
+}
+
+type debridLink struct {
+	*debridlink.Client
+}
+
+func (r debridLink) TestCreds(ctx context.Context, keyOrToken string) error {
+	return r.TestAPIkey(ctx, keyOrToken)
+}
+
+func (r debridLink) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, _, _ int, _ bool) (string, error) {
+	return r.Client.GetStreamURL(ctx, magnetURL, keyOrToken)
+}
+
+type torboxResolver struct {
+	*torbox.Client
+}
+
+func (r torboxResolver) TestCreds(ctx context.Context, keyOrToken string) error {
+	return r.TestAPIkey(ctx, keyOrToken)
+}
+
+func (r torboxResolver) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, _, _ int, _ bool) (string, error) {
+	return r.Client.GetStreamURL(ctx, magnetURL, keyOrToken)
+}
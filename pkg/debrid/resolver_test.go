@@ -0,0 +1,85 @@
+package debrid
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	debrid "github.com/deflix-tv/go-debrid"
+
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/alldebrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/premiumize"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/realdebrid"
+)
+
+// TestResolversCancelRequests checks that canceling the context cancels the requests to the debrid service,
+// instead of only returning early while the requests keep running.
+func TestResolversCancelRequests(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices a closed connection after the body was read
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	logger := zap.NewNop()
+	rdOpts := realdebrid.DefaultClientOpts
+	rdOpts.BaseURL = server.URL
+	rdClient, err := realdebrid.NewClient(rdOpts, debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	require.NoError(t, err)
+	adOpts := alldebrid.DefaultClientOpts
+	adOpts.BaseURL = server.URL
+	adClient, err := alldebrid.NewClient(adOpts, debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	require.NoError(t, err)
+	pmOpts := premiumize.DefaultClientOpts
+	pmOpts.BaseURL = server.URL
+	pmClient, err := premiumize.NewClient(pmOpts, debrid.NewInMemoryCache(), debrid.NewInMemoryCache(), logger)
+	require.NoError(t, err)
+
+	resolvers := map[string]Resolver{
+		"rd": realDebrid{rdClient},
+		"ad": allDebrid{adClient},
+		"pm": premiumizeResolver{pmClient},
+	}
+	for name, resolver := range resolvers {
+		t.Run(name, func(t *testing.T) {
+			calls := map[string]func(ctx context.Context) error{
+				"TestCreds": func(ctx context.Context) error {
+					return resolver.TestCreds(ctx, "foo")
+				},
+				"CheckInstantAvailabilityErr": func(ctx context.Context) error {
+					_, err := resolver.(FallibleChecker).CheckInstantAvailabilityErr(ctx, "foo", "abc")
+					return err
+				},
+				"GetStreamURL": func(ctx context.Context) error {
+					_, err := resolver.GetStreamURL(ctx, "magnet:?xt=urn:btih:abc", "foo", 0, 0, false)
+					return err
+				},
+			}
+			for callName, call := range calls {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				start := time.Now()
+				err := call(ctx)
+				cancel()
+				require.Error(t, err, callName)
+				require.Less(t, time.Since(start), time.Second, callName)
+				select {
+				case <-canceled:
+				case <-time.After(time.Second):
+					t.Fatalf("%v: request to the debrid service wasn't canceled", callName)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package debrid
+
+import (
+	"context"
+)
+
+// StreamURLFunc converts the magnet URL into a stream URL, like Resolver.GetStreamURL.
+type StreamURLFunc func(ctx context.Context, magnetURL, keyOrToken string, season, episode int, remote bool) (string, error)
+
+// streamURLResolver makes the conversions of a resolver with another function, for example with a client that can select the episode's file in season packs.
+type streamURLResolver struct {
+	Resolver
+	getStreamURL StreamURLFunc
+}
+
+// WithStreamURLs wraps the resolver so that its conversions are made by the given function. Its credential and availability checks are unchanged.
+// The function should use the context for its requests, so that they are canceled with it.
+func WithStreamURLs(resolver Resolver, getStreamURL StreamURLFunc) Resolver {
+	r := streamURLResolver{
+		Resolver:     resolver,
+		getStreamURL: getStreamURL,
+	}
+	if _, ok := resolver.(FallibleChecker); ok {
+		return fallibleStreamURLResolver{r}
+	}
+	return r
+}
+
+func (r streamURLResolver) GetStreamURL(ctx context.Context, magnetURL, keyOrToken string, season, episode int, remote bool) (string, error) {
+	return r.getStreamURL(ctx, magnetURL, keyOrToken, season, episode, remote)
+}
+
+// fallibleStreamURLResolver is a streamURLResolver for a resolver that implements FallibleChecker.
+type fallibleStreamURLResolver struct {
+	streamURLResolver
+}
+
+func (r fallibleStreamURLResolver) CheckInstantAvailabilityErr(ctx context.Context, keyOrToken string, infoHashes ...string) ([]string, error) {
+	return r.Resolver.(FallibleChecker).CheckInstantAvailabilityErr(ctx, keyOrToken, infoHashes...)
+}
@@ -0,0 +1,28 @@
+package debrid
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithStreamURLs(t *testing.T) {
+	getStreamURL := func(ctx context.Context, magnetURL, keyOrToken string, season, episode int, remote bool) (string, error) {
+		return "https://example.com/" + strconv.Itoa(season) + "/" + strconv.Itoa(episode), nil
+	}
+
+	inner := &failingResolver{fixedResolver: fixedResolver{available: []string{"aaa"}}}
+	resolver := WithStreamURLs(inner, getStreamURL)
+	streamURL, err := resolver.GetStreamURL(context.Background(), "magnet:?xt=urn:btih:aaa", "foo", 1, 2, false)
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/1/2", streamURL)
+	// Availability checks are still made by the wrapped resolver, which still reports failures
+	require.Equal(t, []string{"aaa"}, resolver.CheckInstantAvailability(context.Background(), "foo", "aaa", "bbb"))
+	_, ok := resolver.(FallibleChecker)
+	require.True(t, ok)
+
+	_, ok = WithStreamURLs(&fixedResolver{}, getStreamURL).(FallibleChecker)
+	require.False(t, ok)
+}
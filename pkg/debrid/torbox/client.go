@@ -0,0 +1,323 @@
+package torbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	debrid "github.com/deflix-tv/go-debrid"
+)
+
+type ClientOptions struct {
+	BaseURL      string
+	Timeout      time.Duration
+	CacheAge     time.Duration
+	ExtraHeaders []string
+}
+
+func NewClientOpts(baseURL string, timeout, cacheAge time.Duration, extraHeaders []string) ClientOptions {
+	return ClientOptions{
+		BaseURL:      baseURL,
+		Timeout:      timeout,
+		CacheAge:     cacheAge,
+		ExtraHeaders: extraHeaders,
+	}
+}
+
+var DefaultClientOpts = ClientOptions{
+	BaseURL:  "https://api.torbox.app/v1/api",
+	Timeout:  5 * time.Second,
+	CacheAge: 24 * time.Hour,
+}
+
+// Client is a Torbox client with the same methods as the RealDebrid, AllDebrid and Premiumize clients of go-debrid.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	// For API key validity
+	apiKeyCache debrid.Cache
+	// For info_hash instant availability
+	availabilityCache debrid.Cache
+	cacheAge          time.Duration
+	extraHeaders      map[string]string
+	logger            *zap.Logger
+}
+
+func NewClient(opts ClientOptions, apiKeyCache, availabilityCache debrid.Cache, logger *zap.Logger) (*Client, error) {
+	// Precondition check
+	if opts.BaseURL == "" {
+		return nil, errors.New("opts.BaseURL must not be empty")
+	}
+	extraHeaderMap := make(map[string]string, len(opts.ExtraHeaders))
+	for _, extraHeader := range opts.ExtraHeaders {
+		if extraHeader == "" {
+			continue
+		}
+		colonIndex := strings.Index(extraHeader, ":")
+		if colonIndex <= 0 || colonIndex == len(extraHeader)-1 {
+			return nil, errors.New("opts.ExtraHeaders elements must have a format like \"X-Foo: bar\"")
+		}
+		extraHeaderMap[extraHeader[:colonIndex]] = strings.TrimSpace(extraHeader[colonIndex+1:])
+	}
+
+	return &Client{
+		baseURL: opts.BaseURL,
+		httpClient: &http.Client{
+			Timeout: opts.Timeout,
+		},
+		apiKeyCache:       apiKeyCache,
+		availabilityCache: availabilityCache,
+		cacheAge:          opts.CacheAge,
+		extraHeaders:      extraHeaderMap,
+		logger:            logger,
+	}, nil
+}
+
+func (c *Client) TestAPIkey(ctx context.Context, apiKey string) error {
+	zapFieldDebridSite := zap.String("debridSite", "Torbox")
+	zapFieldAPIkey := zap.String("apiKey", apiKey)
+	c.logger.Debug("Testing API key...", zapFieldDebridSite, zapFieldAPIkey)
+
+	// Check cache first.
+	// Note: Only when an API key is valid a cache item is created, because an invalid API key might become valid again soon when the user extends their subscription.
+	created, found, err := c.apiKeyCache.Get(apiKey)
+	if err != nil {
+		c.logger.Error("Couldn't decode API key cache item", zap.Error(err), zapFieldDebridSite, zapFieldAPIkey)
+	} else if !found {
+		c.logger.Debug("API key not found in cache", zapFieldDebridSite, zapFieldAPIkey)
+	} else if time.Since(created) > (24 * time.Hour) {
+		expiredSince := time.Since(created.Add(24 * time.Hour))
+		c.logger.Debug("API key cached as valid, but item is expired", zap.Duration("expiredSince", expiredSince), zapFieldDebridSite, zapFieldAPIkey)
+	} else {
+		c.logger.Debug("API key cached as valid", zapFieldDebridSite, zapFieldAPIkey)
+		return nil
+	}
+
+	resBytes, err := c.get(ctx, c.baseURL+"/user/me", apiKey)
+	if err != nil {
+		return fmt.Errorf("Couldn't fetch user info from Torbox with the provided API key: %v", err)
+	}
+	if !gjson.GetBytes(resBytes, "success").Bool() {
+		return fmt.Errorf("Got error response from Torbox: %v", errorMessage(resBytes))
+	}
+	// 0 is the free plan
+	if gjson.GetBytes(resBytes, "data.plan").Int() == 0 {
+		return errors.New("Torbox account doesn't have a paid plan")
+	}
+
+	c.logger.Debug("API key OK", zapFieldDebridSite, zapFieldAPIkey)
+
+	// Create cache item
+	if err = c.apiKeyCache.Set(apiKey); err != nil {
+		c.logger.Error("Couldn't cache API key", zap.Error(err), zapFieldDebridSite, zapFieldAPIkey)
+	}
+
+	return nil
+}
+
+// CheckInstantAvailability returns the info hashes of the torrents that are instantly available. A failed check is only logged.
+func (c *Client) CheckInstantAvailability(ctx context.Context, apiKey string, infoHashes ...string) []string {
+	result, _ := c.CheckInstantAvailabilityErr(ctx, apiKey, infoHashes...)
+	return result
+}
+
+// CheckInstantAvailabilityErr is like CheckInstantAvailability, but also returns the error of a failed check,
+// together with the info hashes that are known to be available from the cache.
+func (c *Client) CheckInstantAvailabilityErr(ctx context.Context, apiKey string, infoHashes ...string) ([]string, error) {
+	result, err := c.checkInstantAvailability(ctx, apiKey, infoHashes...)
+	if err != nil {
+		c.logger.Error("Couldn't check instant availability", zap.Error(err), zap.String("debridSite", "Torbox"), zap.String("apiKey", apiKey))
+	}
+	return result, err
+}
+
+func (c *Client) checkInstantAvailability(ctx context.Context, apiKey string, infoHashes ...string) ([]string, error) {
+	zapFieldDebridSite := zap.String("debridSite", "Torbox")
+	zapFieldAPIkey := zap.String("apiKey", apiKey)
+
+	// Precondition check
+	if len(infoHashes) == 0 {
+		return nil, nil
+	}
+
+	// Only check the ones of which we don't know that they're valid (or which our knowledge that they're valid is older than the cache age).
+	// We don't cache unavailable ones, because that might change often!
+	var result []string
+	var unknownAvailabilityValues []string
+	for _, infoHash := range infoHashes {
+		created, found, err := c.availabilityCache.Get(infoHash)
+		if err != nil {
+			c.logger.Error("Couldn't decode availability cache item", zap.Error(err), zap.String("infoHash", infoHash), zapFieldDebridSite, zapFieldAPIkey)
+			unknownAvailabilityValues = append(unknownAvailabilityValues, infoHash)
+		} else if !found || time.Since(created) > c.cacheAge {
+			unknownAvailabilityValues = append(unknownAvailabilityValues, infoHash)
+		} else {
+			result = append(result, infoHash)
+		}
+	}
+	c.logger.Debug("Checked availability cache", zap.Int("cached", len(result)), zap.Int("unknown", len(unknownAvailabilityValues)), zapFieldDebridSite, zapFieldAPIkey)
+
+	// Only make HTTP request if we didn't find all hashes in the cache yet
+	if len(unknownAvailabilityValues) == 0 {
+		return result, nil
+	}
+	query := url.Values{}
+	query.Set("hash", strings.Join(unknownAvailabilityValues, ","))
+	query.Set("format", "list")
+	resBytes, err := c.get(ctx, c.baseURL+"/torrents/checkcached?"+query.Encode(), apiKey)
+	if err != nil {
+		return result, fmt.Errorf("Couldn't check torrents' instant availability on Torbox: %v", err)
+	}
+	if !gjson.GetBytes(resBytes, "success").Bool() {
+		return result, fmt.Errorf("Got error response from Torbox: %v", errorMessage(resBytes))
+	}
+	// The list only contains the cached torrents
+	cached := map[string]struct{}{}
+	for _, item := range gjson.GetBytes(resBytes, "data").Array() {
+		cached[strings.ToUpper(item.Get("hash").String())] = struct{}{}
+	}
+	for _, infoHash := range unknownAvailabilityValues {
+		infoHash = strings.ToUpper(infoHash)
+		if _, ok := cached[infoHash]; !ok {
+			continue
+		}
+		result = append(result, infoHash)
+		// Create cache item
+		if err = c.availabilityCache.Set(infoHash); err != nil {
+			c.logger.Error("Couldn't cache availability", zap.Error(err), zapFieldDebridSite, zapFieldAPIkey)
+		}
+	}
+	return result, nil
+}
+
+func (c *Client) GetStreamURL(ctx context.Context, magnetURL, apiKey string) (string, error) {
+	zapFieldDebridSite := zap.String("debridSite", "Torbox")
+	zapFieldAPIkey := zap.String("apiKey", apiKey)
+	c.logger.Debug("Adding magnet to Torbox...", zapFieldDebridSite, zapFieldAPIkey)
+	data := url.Values{}
+	data.Set("magnet", magnetURL)
+	resBytes, err := c.post(ctx, c.baseURL+"/torrents/createtorrent", apiKey, data)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't add magnet to Torbox: %v", err)
+	}
+	if !gjson.GetBytes(resBytes, "success").Bool() {
+		return "", fmt.Errorf("Got error response from Torbox: %v", errorMessage(resBytes))
+	}
+	torrentID := gjson.GetBytes(resBytes, "data.torrent_id").String()
+	c.logger.Debug("Finished adding magnet to Torbox", zap.String("torrentID", torrentID), zapFieldDebridSite, zapFieldAPIkey)
+
+	// Get the torrent's files
+	resBytes, err = c.get(ctx, c.baseURL+"/torrents/mylist?id="+url.QueryEscape(torrentID), apiKey)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't get torrent info from Torbox: %v", err)
+	}
+	if !gjson.GetBytes(resBytes, "success").Bool() {
+		return "", fmt.Errorf("Got error response from Torbox: %v", errorMessage(resBytes))
+	}
+	fileID, err := selectFileID(gjson.GetBytes(resBytes, "data.files").Array())
+	if err != nil {
+		return "", fmt.Errorf("Couldn't find proper file in torrent: %v", err)
+	}
+
+	// Request the download link
+	query := url.Values{}
+	query.Set("token", apiKey)
+	query.Set("torrent_id", torrentID)
+	query.Set("file_id", strconv.FormatInt(fileID, 10))
+	resBytes, err = c.get(ctx, c.baseURL+"/torrents/requestdl?"+query.Encode(), apiKey)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't request download link from Torbox: %v", err)
+	}
+	if !gjson.GetBytes(resBytes, "success").Bool() {
+		return "", fmt.Errorf("Got error response from Torbox: %v", errorMessage(resBytes))
+	}
+	streamURL := gjson.GetBytes(resBytes, "data").String()
+	if streamURL == "" {
+		return "", errors.New("Torbox responded with an empty download link")
+	}
+	c.logger.Debug("Created download link", zap.String("downloadLink", streamURL), zapFieldDebridSite, zapFieldAPIkey)
+
+	return streamURL, nil
+}
+
+func (c *Client) get(ctx context.Context, url, apiKey string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	return c.do(req, apiKey)
+}
+
+func (c *Client) post(ctx context.Context, url, apiKey string, data url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create POST request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req, apiKey)
+}
+
+func (c *Client) do(req *http.Request, apiKey string) ([]byte, error) {
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	for headerKey, headerVal := range c.extraHeaders {
+		req.Header.Add(headerKey, headerVal)
+	}
+
+	c.logger.Debug("Sending request to Torbox", zap.String("method", req.Method), zap.String("url", req.URL.String()))
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send %v request: %v", req.Method, err)
+	}
+	defer res.Body.Close()
+
+	// Torbox responds with a JSON body containing the error for most non-OK responses, which the callers check.
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read response body: %v", err)
+	}
+	if res.StatusCode != http.StatusOK && !gjson.ValidBytes(resBody) {
+		return nil, fmt.Errorf("bad HTTP response status: %v (%v request to '%v')", res.Status, req.Method, req.URL)
+	}
+	return resBody, nil
+}
+
+// errorMessage returns the error message of a Torbox error response.
+func errorMessage(resBytes []byte) string {
+	errMsg := gjson.GetBytes(resBytes, "error").String()
+	if detail := gjson.GetBytes(resBytes, "detail").String(); detail != "" {
+		errMsg += ": " + detail
+	}
+	return errMsg
+}
+
+// selectFileID returns the ID of the biggest file.
+func selectFileID(files []gjson.Result) (int64, error) {
+	// Precondition check
+	if len(files) == 0 {
+		return 0, errors.New("Empty slice of files")
+	}
+
+	var fileID int64
+	var size int64
+	for _, file := range files {
+		if file.Get("size").Int() > size {
+			size = file.Get("size").Int()
+			fileID = file.Get("id").Int()
+		}
+	}
+
+	if size == 0 {
+		return 0, errors.New("No file found")
+	}
+
+	return fileID, nil
+}
@@ -2,7 +2,10 @@ package metafetcher
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
 	"strconv"
 	"time"
 
@@ -18,12 +21,18 @@ import (
 var _ stremio.MetaFetcher = (*Client)(nil)
 var _ imdb2torrent.MetaGetter = (*Client)(nil)
 
+// DefaultKitsuBaseURL is the base URL of the Kitsu API, which is used for getting the metadata of anime by their Kitsu ID.
+const DefaultKitsuBaseURL = "https://kitsu.io/api/edge"
+
 // Client is used to implement stremio.MetaFetcher.
 type Client struct {
 	imdb2metaClient pb.MetaFetcherClient
 	cinemetaClient  *cinemeta.Client
 	conn            *grpc.ClientConn
-	logger          *zap.Logger
+	// For anime with Kitsu IDs, which neither imdb2meta nor Cinemeta know
+	kitsuBaseURL string
+	httpClient   *http.Client
+	logger       *zap.Logger
 }
 
 // NewClient creates a new metafetcher client.
@@ -56,7 +65,11 @@ func NewClient(imdb2metaAddress string, cinemetaClient *cinemeta.Client, logger
 		imdb2metaClient: imdb2metaClient,
 		cinemetaClient:  cinemetaClient,
 		conn:            conn,
-		logger:          logger,
+		kitsuBaseURL:    DefaultKitsuBaseURL,
+		httpClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+		logger: logger,
 	}, nil
 }
 
@@ -151,6 +164,56 @@ func (c *Client) GetTVShowSimple(ctx context.Context, imdbID string, season, epi
 	}, nil
 }
 
+// GetKitsuSimple returns the title and year of the anime with the given Kitsu ID, like "11469".
+// The title is the canonical one, which is usually the romanized Japanese title that most anime releases use.
+func (c *Client) GetKitsuSimple(ctx context.Context, kitsuID string) (imdb2torrent.Meta, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.kitsuBaseURL+"/anime/"+kitsuID, nil)
+	if err != nil {
+		return imdb2torrent.Meta{}, fmt.Errorf("couldn't create GET request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.api+json")
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return imdb2torrent.Meta{}, fmt.Errorf("couldn't send GET request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return imdb2torrent.Meta{}, fmt.Errorf("bad GET response: %v", res.StatusCode)
+	}
+	var kitsuRes struct {
+		Data struct {
+			Attributes struct {
+				CanonicalTitle string `json:"canonicalTitle"`
+				Titles         struct {
+					EnJP string `json:"en_jp"`
+				} `json:"titles"`
+				// Like "2023-09-29"
+				StartDate string `json:"startDate"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&kitsuRes); err != nil {
+		return imdb2torrent.Meta{}, fmt.Errorf("couldn't decode response body: %w", err)
+	}
+	attributes := kitsuRes.Data.Attributes
+	title := attributes.CanonicalTitle
+	if title == "" {
+		title = attributes.Titles.EnJP
+	}
+	if title == "" {
+		return imdb2torrent.Meta{}, errors.New("Kitsu response doesn't contain a title")
+	}
+	// The year is only informational, so a missing start date (for example of announced anime) isn't an error
+	var year int
+	if len(attributes.StartDate) >= 4 {
+		year, _ = strconv.Atoi(attributes.StartDate[:4])
+	}
+	return imdb2torrent.Meta{
+		Title: title,
+		Year:  year,
+	}, nil
+}
+
 func (c *Client) Close() error {
 	return c.conn.Close()
 }
@@ -0,0 +1,264 @@
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Get when the object doesn't exist.
+var ErrNotFound = errors.New("object not found")
+
+type ClientOptions struct {
+	// For example "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000" for MinIO
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Timeout         time.Duration
+}
+
+func NewClientOpts(endpoint, region, bucket, accessKeyID, secretAccessKey string, timeout time.Duration) ClientOptions {
+	return ClientOptions{
+		Endpoint:        endpoint,
+		Region:          region,
+		Bucket:          bucket,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		Timeout:         timeout,
+	}
+}
+
+var DefaultClientOpts = ClientOptions{
+	Region:  "us-east-1",
+	Timeout: 5 * time.Minute,
+}
+
+// Client is a minimal client for S3-compatible object storage (like AWS S3, MinIO, Backblaze B2 or Wasabi).
+// It only supports the operations that are required for persisting files and uses path-style requests,
+// which are supported by all S3-compatible services.
+type Client struct {
+	endpoint        string
+	region          string
+	bucket          string
+	accessKeyID     string
+	secretAccessKey string
+	httpClient      *http.Client
+}
+
+func NewClient(opts ClientOptions) (*Client, error) {
+	// Precondition check
+	if opts.Endpoint == "" {
+		return nil, errors.New("opts.Endpoint must not be empty")
+	} else if opts.Bucket == "" {
+		return nil, errors.New("opts.Bucket must not be empty")
+	} else if opts.AccessKeyID == "" || opts.SecretAccessKey == "" {
+		return nil, errors.New("opts.AccessKeyID and opts.SecretAccessKey must not be empty")
+	}
+	if opts.Region == "" {
+		opts.Region = DefaultClientOpts.Region
+	}
+
+	return &Client{
+		endpoint:        strings.TrimSuffix(opts.Endpoint, "/"),
+		region:          opts.Region,
+		bucket:          opts.Bucket,
+		accessKeyID:     opts.AccessKeyID,
+		secretAccessKey: opts.SecretAccessKey,
+		httpClient: &http.Client{
+			Timeout: opts.Timeout,
+		},
+	}, nil
+}
+
+// Put uploads the content of the reader as object with the given key.
+// The size must be the exact number of bytes the reader returns.
+func (c *Client) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	req, err := c.newRequest(ctx, "PUT", key, nil, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Get downloads the object with the given key. The caller must close the returned reader.
+// ErrNotFound is returned if the object doesn't exist.
+func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// List returns the keys of all objects that start with the given prefix.
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	var result []string
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		req, err := c.newRequest(ctx, "GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var listRes struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&listRes)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't decode list response: %v", err)
+		}
+		for _, content := range listRes.Contents {
+			result = append(result, content.Key)
+		}
+		if !listRes.IsTruncated || listRes.NextContinuationToken == "" {
+			return result, nil
+		}
+		continuationToken = listRes.NextContinuationToken
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	path := "/" + uriEncode(c.bucket, true)
+	if key != "" {
+		path += "/" + uriEncode(key, false)
+	}
+	reqURL := c.endpoint + path
+	if len(query) > 0 {
+		reqURL += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create %v request: %v", method, err)
+	}
+	c.sign(req, path, query, time.Now().UTC())
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't send %v request: %v", req.Method, err)
+	}
+	if res.StatusCode == http.StatusNotFound && req.Method == "GET" && req.URL.RawQuery == "" {
+		res.Body.Close()
+		return nil, ErrNotFound
+	} else if res.StatusCode != http.StatusOK {
+		resBody, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("bad HTTP response status: %v (%v request to '%v'): %s", res.Status, req.Method, req.URL, resBody)
+	}
+	return res, nil
+}
+
+// sign adds the headers for AWS Signature Version 4.
+// The payload isn't signed, so that bodies can be streamed without reading them twice.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (c *Client) sign(req *http.Request, path string, query url.Values, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := "UNSIGNED-PAYLOAD"
+	if req.Body == nil {
+		// Hash of an empty string
+		payloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	}
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.secretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, c.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query parameters sorted by key and encoded as required by AWS Signature Version 4.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		for _, val := range query[key] {
+			params = append(params, uriEncode(key, true)+"="+uriEncode(val, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes all characters except the unreserved ones from RFC 3986.
+// Slashes are only encoded if encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,252 @@
+package torznab
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+var (
+	infoHashRegex = regexp.MustCompile(`(?i)btih:([0-9a-f]{40})`)
+	camRegex      = regexp.MustCompile(`(?i)\b(cam|camrip|hdcam|ts|hdts|telesync)\b`)
+	uhdRegex      = regexp.MustCompile(`(?i)\b(4k|uhd)\b`)
+)
+
+type ClientOptions struct {
+	// URL of the Torznab API endpoint, for example "http://localhost:9117/api/v2.0/indexers/all/results/torznab/api" for Jackett
+	BaseURL  string
+	APIkey   string
+	Timeout  time.Duration
+	CacheAge time.Duration
+}
+
+func NewClientOpts(baseURL, apiKey string, timeout, cacheAge time.Duration) ClientOptions {
+	return ClientOptions{
+		BaseURL:  baseURL,
+		APIkey:   apiKey,
+		Timeout:  timeout,
+		CacheAge: cacheAge,
+	}
+}
+
+var _ imdb2torrent.MagnetSearcher = (*Client)(nil)
+
+// Client is an imdb2torrent.MagnetSearcher for indexers with a Torznab API, like Jackett and Prowlarr.
+type Client struct {
+	// For logging and cache keys, because different Torznab endpoints return different results for the same IMDb ID
+	name             string
+	baseURL          string
+	apiKey           string
+	httpClient       *http.Client
+	cache            imdb2torrent.Cache
+	cacheAge         time.Duration
+	logger           *zap.Logger
+	logFoundTorrents bool
+}
+
+func NewClient(name string, opts ClientOptions, cache imdb2torrent.Cache, logger *zap.Logger, logFoundTorrents bool) (*Client, error) {
+	// Precondition check
+	if opts.BaseURL == "" {
+		return nil, errors.New("opts.BaseURL must not be empty")
+	}
+
+	return &Client{
+		name:    name,
+		baseURL: opts.BaseURL,
+		apiKey:  opts.APIkey,
+		httpClient: &http.Client{
+			Timeout: opts.Timeout,
+		},
+		cache:            cache,
+		cacheAge:         opts.CacheAge,
+		logger:           logger,
+		logFoundTorrents: logFoundTorrents,
+	}, nil
+}
+
+// FindMovie searches the Torznab endpoint for torrents for the given IMDb ID.
+// If no error occured, but there are just no torrents for the movie yet, an empty result and *no* error are returned.
+func (c *Client) FindMovie(ctx context.Context, imdbID string) ([]imdb2torrent.Result, error) {
+	query := url.Values{}
+	query.Set("t", "movie")
+	query.Set("imdbid", imdbID)
+	return c.find(ctx, imdbID, query)
+}
+
+// FindTVShow searches the Torznab endpoint for torrents for the given IMDb ID + season + episode.
+// If no error occured, but there are just no torrents for the TV show yet, an empty result and *no* error are returned.
+func (c *Client) FindTVShow(ctx context.Context, imdbID string, season, episode int) ([]imdb2torrent.Result, error) {
+	query := url.Values{}
+	query.Set("t", "tvsearch")
+	query.Set("imdbid", imdbID)
+	query.Set("season", strconv.Itoa(season))
+	query.Set("ep", strconv.Itoa(episode))
+	id := imdbID + ":" + strconv.Itoa(season) + ":" + strconv.Itoa(episode)
+	return c.find(ctx, id, query)
+}
+
+// IsSlow returns true, because Torznab endpoints usually aggregate several indexers, which takes a while.
+func (c *Client) IsSlow() bool {
+	return true
+}
+
+func (c *Client) find(ctx context.Context, id string, query url.Values) ([]imdb2torrent.Result, error) {
+	zapFieldID := zap.String("id", id)
+	zapFieldTorrentSite := zap.String("torrentSite", c.name)
+
+	// Check cache first
+	cacheKey := id + "-" + c.name
+	torrentList, created, found, err := c.cache.Get(cacheKey)
+	if err != nil {
+		c.logger.Error("Couldn't get torrent results from cache", zap.Error(err), zapFieldID, zapFieldTorrentSite)
+	} else if !found {
+		c.logger.Debug("Torrent results not found in cache", zapFieldID, zapFieldTorrentSite)
+	} else if time.Since(created) > (c.cacheAge) {
+		expiredSince := time.Since(created.Add(c.cacheAge))
+		c.logger.Debug("Hit cache for torrents, but item is expired", zap.Duration("expiredSince", expiredSince), zapFieldID, zapFieldTorrentSite)
+	} else {
+		c.logger.Debug("Hit cache for torrents, returning results", zap.Int("torrentCount", len(torrentList)), zapFieldID, zapFieldTorrentSite)
+		return torrentList, nil
+	}
+
+	if c.apiKey != "" {
+		query.Set("apikey", c.apiKey)
+	}
+	reqURL := c.baseURL + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create GET request: %v", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		// Don't include the URL, because it contains the API key
+		return nil, fmt.Errorf("Couldn't send GET request to %v: %v", c.name, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Bad GET response: %v", res.StatusCode)
+	}
+	var feed rss
+	if err = xml.NewDecoder(res.Body).Decode(&feed); err != nil {
+		return nil, fmt.Errorf("Couldn't decode response body: %v", err)
+	}
+
+	var results []imdb2torrent.Result
+	for _, item := range feed.Channel.Items {
+		result, ok := item.toResult()
+		if !ok {
+			continue
+		}
+		if c.logFoundTorrents {
+			c.logger.Debug("Found torrent", zap.String("title", result.Title), zap.String("quality", result.Quality), zap.String("infoHash", result.InfoHash), zap.String("magnet", result.MagnetURL), zapFieldID, zapFieldTorrentSite)
+		}
+		results = append(results, result)
+	}
+
+	// Fill cache, even if there are no results, because that's just the current state of the indexers.
+	// Any actual errors would have returned earlier.
+	if err := c.cache.Set(cacheKey, results); err != nil {
+		c.logger.Error("Couldn't cache torrents", zap.Error(err), zap.String("cache", "torrent"), zapFieldID, zapFieldTorrentSite)
+	}
+
+	return results, nil
+}
+
+type rss struct {
+	Channel struct {
+		Items []item `xml:"item"`
+	} `xml:"channel"`
+}
+
+type item struct {
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+	Size  int64  `xml:"size"`
+	// The "torznab:attr" elements. Without namespace in the tag, so that it also matches indexers that use a different namespace prefix.
+	Attrs []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:"attr"`
+}
+
+func (i item) attr(name string) string {
+	for _, attr := range i.Attrs {
+		if attr.Name == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// toResult converts the item into an imdb2torrent.Result.
+// It returns false if the item isn't a video in one of the supported qualities or doesn't contain a magnet URL or info hash.
+func (i item) toResult() (imdb2torrent.Result, bool) {
+	quality := parseQuality(i.Title)
+	if quality == "" {
+		return imdb2torrent.Result{}, false
+	}
+
+	magnet := i.attr("magneturl")
+	if magnet == "" && strings.HasPrefix(i.Link, "magnet:") {
+		magnet = i.Link
+	}
+	infoHash := strings.ToUpper(i.attr("infohash"))
+	if infoHash == "" {
+		if match := infoHashRegex.FindStringSubmatch(magnet); len(match) == 2 {
+			infoHash = strings.ToUpper(match[1])
+		}
+	}
+	if len(infoHash) != 40 {
+		return imdb2torrent.Result{}, false
+	}
+	if magnet == "" {
+		magnet = "magnet:?xt=urn:btih:" + infoHash + "&dn=" + url.QueryEscape(i.Title)
+	}
+	// Keep the size, so that it can be shown to the user
+	if i.Size > 0 && !strings.Contains(magnet, "&xl=") {
+		magnet += "&xl=" + strconv.FormatInt(i.Size, 10)
+	}
+
+	return imdb2torrent.Result{
+		Title:     i.Title,
+		Quality:   quality,
+		InfoHash:  infoHash,
+		MagnetURL: magnet,
+	}, true
+}
+
+// parseQuality returns the quality in the same format as the built-in imdb2torrent clients, like "1080p 10bit", or an empty string if it's none of the supported resolutions.
+func parseQuality(title string) string {
+	quality := ""
+	if strings.Contains(title, "720p") {
+		quality = "720p"
+	} else if strings.Contains(title, "1080p") {
+		quality = "1080p"
+	} else if strings.Contains(title, "2160p") || uhdRegex.MatchString(title) {
+		quality = "2160p"
+	} else {
+		return ""
+	}
+
+	if strings.Contains(strings.ToLower(title), "10bit") || strings.Contains(strings.ToLower(title), "10-bit") {
+		quality += " 10bit"
+	}
+
+	// https://en.wikipedia.org/wiki/Pirated_movie_release_types
+	if camRegex.MatchString(title) {
+		quality += (" (⚠️cam)")
+	}
+
+	return quality
+}
@@ -0,0 +1,80 @@
+package torznab
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/deflix-tv/imdb2torrent"
+)
+
+const feed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom" xmlns:torznab="http://torznab.com/schemas/2015/feed">
+  <channel>
+    <item>
+      <title>Big.Buck.Bunny.2008.1080p.BluRay.x264</title>
+      <link>http://localhost:9117/dl/foo</link>
+      <size>1000</size>
+      <torznab:attr name="seeders" value="10" />
+      <torznab:attr name="infohash" value="dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c" />
+    </item>
+    <item>
+      <title>Big.Buck.Bunny.2008.2160p.10bit.HDR</title>
+      <link>http://localhost:9117/dl/bar</link>
+      <torznab:attr name="magneturl" value="magnet:?xt=urn:btih:ABCDEFABCDEFABCDEFABCDEFABCDEFABCDEFABCD&amp;dn=foo" />
+    </item>
+    <item>
+      <title>Big.Buck.Bunny.2008.DVDRip</title>
+      <torznab:attr name="infohash" value="1234567890123456789012345678901234567890" />
+    </item>
+    <item>
+      <title>Big.Buck.Bunny.2008.720p.WEB</title>
+      <link>http://localhost:9117/dl/baz</link>
+    </item>
+  </channel>
+</rss>`
+
+func TestFindMovie(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Write([]byte(feed))
+	}))
+	defer server.Close()
+
+	opts := NewClientOpts(server.URL, "secret", time.Second, time.Hour)
+	client, err := NewClient("test", opts, imdb2torrent.NewInMemoryCache(), zap.NewNop(), false)
+	require.NoError(t, err)
+
+	results, err := client.FindMovie(context.Background(), "tt1254207")
+	require.NoError(t, err)
+	require.Equal(t, "apikey=secret&imdbid=tt1254207&t=movie", query)
+	expected := []imdb2torrent.Result{
+		{
+			Title:     "Big.Buck.Bunny.2008.1080p.BluRay.x264",
+			Quality:   "1080p",
+			InfoHash:  "DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C",
+			MagnetURL: "magnet:?xt=urn:btih:DD8255ECDC7CA55FB0BBF81323D87062DB1F6D1C&dn=Big.Buck.Bunny.2008.1080p.BluRay.x264&xl=1000",
+		},
+		{
+			Title:     "Big.Buck.Bunny.2008.2160p.10bit.HDR",
+			Quality:   "2160p 10bit",
+			InfoHash:  "ABCDEFABCDEFABCDEFABCDEFABCDEFABCDEFABCD",
+			MagnetURL: "magnet:?xt=urn:btih:ABCDEFABCDEFABCDEFABCDEFABCDEFABCDEFABCD&dn=foo",
+		},
+	}
+	require.Equal(t, expected, results)
+}
+
+func TestParseQuality(t *testing.T) {
+	require.Equal(t, "720p", parseQuality("Foo.2020.720p.WEB"))
+	require.Equal(t, "2160p", parseQuality("Foo 2020 UHD BluRay"))
+	require.Equal(t, "1080p 10bit", parseQuality("Foo.2020.1080p.10-bit.x265"))
+	require.Equal(t, "1080p (⚠️cam)", parseQuality("Foo.2020.1080p.HDCAM"))
+	require.Empty(t, parseQuality("Foo.2020.DVDRip"))
+}
@@ -9,15 +9,14 @@ DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" >/dev/null 2>&1 && pwd )"
 
 if [ "$#" -eq 0 ]; then
     echo "You have to pass a target operating system as argument, like windows, darwin or linux"
+    echo "Optionally pass a target architecture as second argument, like amd64 or arm64. Default is the architecture of the host."
     exit 1
 fi
+GOARCH="${2:-$(go env GOARCH)}"
 
-# Create pkger files
 cd "${DIR}/.."
-go run github.com/markbates/pkger/cmd/pkger
-sed -i "s/package .*/package main/" pkged.go
-mv pkged.go cmd/deflix-stremio/
 
 # Compile
+# The web files for the "/configure" endpoint are embedded via go:embed, so the binary doesn't depend on any files at runtime.
 # Without disabling CGO the binary doesn't run in distroless/static
-CGO_ENABLED=0 GOOS="$1" go build -v -ldflags="-s -w" ./cmd/deflix-stremio/
+CGO_ENABLED=0 GOOS="$1" GOARCH="${GOARCH}" go build -v -ldflags="-s -w" ./cmd/deflix-stremio/
@@ -0,0 +1,9 @@
+// Package web contains the web files of the addon, which get embedded into the binary.
+package web
+
+import "embed"
+
+// Configure contains the files for the "/configure" endpoint in the "configure" directory.
+//
+//go:embed configure
+var Configure embed.FS